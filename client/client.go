@@ -106,6 +106,40 @@ type ClientConfig struct {
 	RetryDelay time.Duration
 	// NRetry in MQTT-SN specification
 	RetryCount uint
+	// MaxInflight limits the number of PUBLISH messages waiting for
+	// acknowledgement. Publishers exceeding the limit are blocked and served
+	// in priority order (see PublishWithPriority). Zero means no limit.
+	MaxInflight int
+	// WireHook, if set, receives all the raw packets sent and received.
+	WireHook WireHook
+	// HandlerPanicPolicy decides what happens when a message handler
+	// callback panics. The panic is logged and the client continues by
+	// default.
+	HandlerPanicPolicy PanicPolicy
+	// OnHandlerPanic, if set, is called with a *HandlerPanicError when
+	// a message handler callback panics, before HandlerPanicPolicy is
+	// applied.
+	OnHandlerPanic func(err error)
+	// HandlerWorkers limits the number of goroutines running message
+	// handler callbacks. Zero means each received message is handled in
+	// a new goroutine.
+	HandlerWorkers int
+	// HandlerQueueSize limits the number of received messages waiting for
+	// a free handler worker (see HandlerWorkers). When the queue is full,
+	// a QoS 0 message is dropped. QoS 1 and 2 messages have already been
+	// acknowledged to the gateway, hence they are never dropped: receiving
+	// is blocked until there is free space in the queue instead. Handlers
+	// must not wait for the gateway's responses (e.g. by Publish with QoS 1
+	// or 2) then, otherwise the client could deadlock.
+	HandlerQueueSize int
+	// QOSDowngradePolicy decides what happens when the gateway grants
+	// a lower QoS than requested by Subscribe. The granted QoS is accepted
+	// by default (see also Client.SubscriptionQOS).
+	QOSDowngradePolicy QOSDowngradePolicy
+	// OnQOSDowngrade, if set, is called with a *QOSDowngradeError when
+	// the gateway grants a lower QoS than requested, before
+	// QOSDowngradePolicy is applied.
+	OnQOSDowngrade func(err error)
 }
 
 type Client struct {
@@ -114,7 +148,11 @@ type Client struct {
 	registeredTopicsLock sync.RWMutex
 	messageHandlers      *messageHandlers
 	transactions         *transactions.TransactionStore
+	publishQueue         *publishQueue
+	handlerPool          *util.WorkerPool
+	registerFlight       util.SingleFlight
 	msgID                *util.IDSequence
+	dialLock             sync.Mutex // guards the fields set by Dial
 	conn                 net.Conn
 	state                *util.ClientState
 	stateChangeCh        chan util.ClientState
@@ -122,6 +160,11 @@ type Client struct {
 	groupCtx             context.Context
 	cancel               func()
 	log                  util.Logger
+	gatewayInfo          *GatewayInfo
+	gatewayInfoLock      sync.Mutex
+	chanSubscriptions    chanSubscriptions
+	subscriptionQOS      sync.Map // topic filter => granted QoS
+	pingLock             sync.Mutex
 	// for testing
 	mockupDialFunc func() (net.Conn, error)
 }
@@ -129,7 +172,7 @@ type Client struct {
 // NewClient sets up a new client according to the provided configuration.
 func NewClient(log util.Logger, cfg *ClientConfig) *Client {
 	state := util.StateDisconnected
-	return &Client{
+	c := &Client{
 		cfg:              cfg,
 		registeredTopics: make(map[string]uint16),
 		messageHandlers:  &messageHandlers{},
@@ -139,6 +182,10 @@ func NewClient(log util.Logger, cfg *ClientConfig) *Client {
 		log:              log,
 		msgID:            util.NewIDSequence(msgs.MinMessageID, msgs.MaxMessageID),
 	}
+	if cfg.MaxInflight > 0 {
+		c.publishQueue = newPublishQueue(cfg.MaxInflight)
+	}
+	return c
 }
 
 func (c *Client) connectDTLS(ctx context.Context, address string) (net.Conn, error) {
@@ -208,36 +255,30 @@ func findTopic(topicID uint16, m map[string]uint16) (string, bool) {
 }
 
 // Dial connects to a MQTT-SN broker. The address must be in the "host:port" form.
+// The client can be dialed again once its previous connection terminated,
+// the old connection is closed then.
 func (c *Client) Dial(address string) error {
 	ctx, cancel := context.WithCancel(context.Background())
+	conn, err := c.dial(ctx, address)
+	if err != nil {
+		cancel()
+		return err
+	}
 	group, groupCtx := errgroup.WithContext(ctx)
 
+	c.dialLock.Lock()
+	if c.conn != nil && c.groupCtx.Err() != nil {
+		c.conn.Close()
+	}
+	c.conn = conn
 	c.cancel = cancel
 	c.group = group
 	c.groupCtx = groupCtx
-
-	var err error
-	if c.mockupDialFunc == nil {
-		if c.cfg.UseDTLS {
-			c.conn, err = c.connectDTLS(ctx, address)
-		} else {
-			c.conn, err = net.Dial("udp", address)
-		}
-		if err != nil {
-			return err
-		}
-
-		if c.cfg.UseDTLS {
-			c.log.Debug("DTLS connected")
-		} else {
-			c.log.Debug("UDP connected")
-		}
-	} else {
-		c.conn, err = c.mockupDialFunc()
-		if err != nil {
-			return err
-		}
+	if c.cfg.HandlerWorkers > 0 {
+		c.handlerPool = util.NewWorkerPool(groupCtx, c.cfg.HandlerWorkers,
+			c.cfg.HandlerQueueSize, util.Block)
 	}
+	c.dialLock.Unlock()
 
 	group.Go(func() error {
 		return c.receiveLoop(groupCtx)
@@ -253,19 +294,64 @@ func (c *Client) Dial(address string) error {
 	return nil
 }
 
+func (c *Client) dial(ctx context.Context, address string) (net.Conn, error) {
+	if c.mockupDialFunc != nil {
+		return c.mockupDialFunc()
+	}
+	if c.cfg.UseDTLS {
+		conn, err := c.connectDTLS(ctx, address)
+		if err != nil {
+			return nil, err
+		}
+		c.log.Debug("DTLS connected")
+		return conn, nil
+	}
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	c.log.Debug("UDP connected")
+	return conn, nil
+}
+
+// Dialed returns true if the client is dialed to the MQTT-SN gateway and the
+// connection has not terminated yet. Unlike IsConnected, it does not matter
+// whether CONNECT has been sent.
+func (c *Client) Dialed() bool {
+	c.dialLock.Lock()
+	defer c.dialLock.Unlock()
+	return c.groupCtx != nil && c.groupCtx.Err() == nil
+}
+
+// IsConnected returns true if the client is connected to the MQTT-SN
+// gateway.
+func (c *Client) IsConnected() bool {
+	return c.connected() == nil
+}
+
+// Config returns a copy of the client's configuration.
+func (c *Client) Config() ClientConfig {
+	return *c.cfg
+}
+
 // Wait blocks until the client is terminated.
 func (c *Client) Wait() error {
 	return c.group.Wait()
 }
 
 // Close closes the connection with the MQTT-SN gateway. The client sends
-// a DISCONNECT message before closing the connection.
+// a DISCONNECT message before closing the connection. The connection is
+// closed even if the DISCONNECT fails.
 func (c *Client) Close() error {
-	if err := c.Disconnect(); err != nil {
-		return err
-	}
-	c.cancel()
-	return c.conn.Close()
+	err := c.Disconnect()
+	c.dialLock.Lock()
+	cancel, conn := c.cancel, c.conn
+	c.dialLock.Unlock()
+	cancel()
+	if closeErr := conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
 func (c *Client) error() error {
@@ -302,6 +388,9 @@ func (c *Client) notifyStateChange(s util.ClientState) {
 // MQTT-SN specification, this must be the first message the client sends
 // unless it's a PUBLISH message with QoS = -1.
 func (c *Client) Connect() error {
+	if c.groupCtx == nil || c.groupCtx.Err() != nil {
+		return ErrNotConnected
+	}
 	connect := msgs.NewConnectMessage(
 		[]byte(c.cfg.ClientID),
 		c.cfg.CleanSession,
@@ -326,27 +415,36 @@ func (c *Client) Connect() error {
 			}
 		}
 
-		select {
-		case <-transaction.Done():
-			err := transaction.Err()
-			switch err {
-			case nil:
-				return nil
-			case transactions.ErrTimeout:
-				continue
-			default:
-				return err
-			}
-		case <-c.groupCtx.Done():
-			return context.Canceled
+		err := c.await(transaction)
+		switch err {
+		case nil:
+			return nil
+		case ErrTimeout:
+			continue
+		default:
+			return err
 		}
 	}
 
-	return errors.New("connect timeout")
+	return ErrTimeout
 }
 
 // Register sends a REGISTER message to the MQTT-SN gateway.
 func (c *Client) Register(topic string) error {
+	if err := checkTopicLength(topic); err != nil {
+		return err
+	}
+	if err := c.connected(); err != nil {
+		return err
+	}
+	// Concurrent registrations of the same topic share a single REGISTER.
+	_, err := c.registerFlight.Do(topic, func() (interface{}, error) {
+		return nil, c.register(topic)
+	})
+	return err
+}
+
+func (c *Client) register(topic string) error {
 	msgID, _ := c.msgID.Next()
 	transaction := newRegisterTransaction(c, msgID, topic)
 	register := msgs.NewRegisterMessage(0, topic)
@@ -356,17 +454,54 @@ func (c *Client) Register(topic string) error {
 	if err := c.send(register); err != nil {
 		transaction.Fail(err)
 	}
-	select {
-	case <-transaction.Done():
-		return transaction.Err()
-	case <-c.groupCtx.Done():
-		return context.Canceled
+	return c.await(transaction)
+}
+
+// topicFilter returns the topic filter of a subscription.
+func (c *Client) topicFilter(topicName string, topicIDType msgs.TopicIDType, topicID uint16) (string, error) {
+	switch topicIDType {
+	case msgs.TIT_PREDEFINED:
+		filter, ok := c.cfg.PredefinedTopics.GetTopicName(c.cfg.ClientID, topicID)
+		if !ok {
+			return "", fmt.Errorf("Invalid predefined topic ID: %d", topicID)
+		}
+		return filter, nil
+	case msgs.TIT_SHORT:
+		return msgs.DecodeShortTopic(topicID), nil
 	}
+	return topicName, nil
 }
 
-func (c *Client) subscribe(topicName string, topicIDType uint8, topicID uint16, qos uint8, callback MessageHandlerFunc) error {
+func (c *Client) subscribe(topicName string, topicIDType msgs.TopicIDType, topicID uint16, qos uint8, callback MessageHandlerFunc) (err error) {
+	if err := checkTopicLength(topicName); err != nil {
+		return err
+	}
+	if err := c.connected(); err != nil {
+		return err
+	}
+	filter, err := c.topicFilter(topicName, topicIDType, topicID)
+	if err != nil {
+		return err
+	}
+
+	// The gateway is permitted to send matching PUBLISH messages before
+	// SUBACK => the callback must be ready before SUBSCRIBE is sent.
+	if callback != nil {
+		previous, hasPrevious := c.messageHandlers.load(filter)
+		c.messageHandlers.store(filter, callback)
+		defer func() {
+			if err != nil {
+				if hasPrevious {
+					c.messageHandlers.store(filter, previous)
+				} else {
+					c.messageHandlers.delete(filter)
+				}
+			}
+		}()
+	}
+
 	msgID, _ := c.msgID.Next()
-	transaction := newSubscribeTransaction(c, msgID, callback)
+	transaction := newSubscribeTransaction(c, msgID)
 	subscribe := msgs.NewSubscribeMessage(topicID, topicIDType, []byte(topicName), qos, false)
 	subscribe.SetMessageID(msgID)
 	c.transactions.Store(msgID, transaction)
@@ -374,17 +509,16 @@ func (c *Client) subscribe(topicName string, topicIDType uint8, topicID uint16,
 	if err := c.send(subscribe); err != nil {
 		transaction.Fail(err)
 	}
-	select {
-	case <-transaction.Done():
-		return transaction.Err()
-	case <-c.groupCtx.Done():
-		return context.Canceled
+	if err := c.await(transaction); err != nil {
+		return err
 	}
+	return c.grantedQOS(filter, topicName, topicIDType, topicID, qos, transaction.qos)
 }
 
 // Subscribe subscribes to a topic with the provided QoS. If the topic is 2 characters
 // long, it's treated as a short topic. The received messages are passed to the
-// provided callback.
+// provided callback. The callback may be nil if the messages are handled by
+// a handler registered using AddHandler.
 func (c *Client) Subscribe(topic string, qos uint8, callback MessageHandlerFunc) error {
 	if msgs.IsShortTopic(topic) {
 		return c.subscribe("", msgs.TIT_SHORT, msgs.EncodeShortTopic(topic), qos, callback)
@@ -394,12 +528,19 @@ func (c *Client) Subscribe(topic string, qos uint8, callback MessageHandlerFunc)
 }
 
 // SubscribePredefined subscribes to a predefined topic with the provided QoS.
-// The received messages are passed to the provided callback.
+// The received messages are passed to the provided callback. The callback may
+// be nil if the messages are handled by a handler registered using AddHandler.
 func (c *Client) SubscribePredefined(topicID uint16, qos uint8, callback MessageHandlerFunc) error {
 	return c.subscribe("", msgs.TIT_PREDEFINED, topicID, qos, callback)
 }
 
-func (c *Client) unsubscribe(topicName string, topicIDType uint8, topicID uint16) error {
+func (c *Client) unsubscribe(topicName string, topicIDType msgs.TopicIDType, topicID uint16) error {
+	if err := checkTopicLength(topicName); err != nil {
+		return err
+	}
+	if err := c.connected(); err != nil {
+		return err
+	}
 	msgID, _ := c.msgID.Next()
 	transaction := newUnsubscribeTransaction(c, msgID)
 	unsubscribe := msgs.NewUnsubscribeMessage(topicID, topicIDType, []byte(topicName))
@@ -409,12 +550,13 @@ func (c *Client) unsubscribe(topicName string, topicIDType uint8, topicID uint16
 	if err := c.send(unsubscribe); err != nil {
 		transaction.Fail(err)
 	}
-	select {
-	case <-transaction.Done():
-		return transaction.Err()
-	case <-c.groupCtx.Done():
-		return context.Canceled
+	if err := c.await(transaction); err != nil {
+		return err
 	}
+	if filter, err := c.topicFilter(topicName, topicIDType, topicID); err == nil {
+		c.subscriptionQOS.Delete(filter)
+	}
+	return nil
 }
 
 // Unsubscribe unsubscribes from a topic. If the topic is 2 characters long,
@@ -432,7 +574,36 @@ func (c *Client) UnsubscribePredefined(topicID uint16) error {
 	return c.unsubscribe("", msgs.TIT_PREDEFINED, topicID)
 }
 
-func (c *Client) publish(topicIDType uint8, topicID uint16, qos uint8, retain bool, payload []byte) error {
+// AddHandler registers a callback for received messages matching the given
+// topic filter (may contain wildcards). Unlike callbacks passed to Subscribe,
+// the handler can be registered before Dial or Connect, it's not removed by
+// Unsubscribe and it survives reconnections. The handler is used only when no
+// subscription callback matches the message topic.
+func (c *Client) AddHandler(filter string, callback MessageHandlerFunc) {
+	c.messageHandlers.storePersistent(filter, callback)
+}
+
+// RemoveHandler removes a handler registered using AddHandler.
+func (c *Client) RemoveHandler(filter string) {
+	c.messageHandlers.deletePersistent(filter)
+}
+
+func (c *Client) publish(topicIDType msgs.TopicIDType, topicID uint16, qos uint8, retain bool, payload []byte, priority Priority) error {
+	// QoS -1 PUBLISH can be sent without a connection.
+	if qos == 3 {
+		if c.groupCtx == nil || c.groupCtx.Err() != nil {
+			return ErrNotConnected
+		}
+	} else if err := c.connected(); err != nil {
+		return err
+	}
+	if c.publishQueue != nil {
+		if err := c.publishQueue.acquire(c.groupCtx, priority); err != nil {
+			return ErrNotConnected
+		}
+		defer c.publishQueue.release()
+	}
+
 	publish := msgs.NewPublishMessage(topicID, topicIDType, payload, qos, retain, false)
 	msgID, _ := c.msgID.Next()
 	publish.SetMessageID(msgID)
@@ -458,69 +629,97 @@ func (c *Client) publish(topicIDType uint8, topicID uint16, qos uint8, retain bo
 	if err := c.send(publish); err != nil {
 		transaction.Fail(err)
 	}
-	select {
-	case <-transaction.Done():
-		return transaction.Err()
-	case <-c.groupCtx.Done():
-		return context.Canceled
-	}
+	return c.await(transaction)
 }
 
 // Publish publishes a message to the provided topic.
 func (c *Client) Publish(topic string, qos uint8, retain bool, payload []byte) error {
-	var topicIDType uint8
+	return c.PublishWithPriority(topic, qos, retain, payload, PriorityNormal)
+}
+
+// PublishWithPriority publishes a message to the provided topic. The priority
+// is only relevant if ClientConfig.MaxInflight is set.
+func (c *Client) PublishWithPriority(topic string, qos uint8, retain bool, payload []byte, priority Priority) error {
+	var topicIDType msgs.TopicIDType
 	var topicID uint16
 	if msgs.IsShortTopic(topic) {
 		topicIDType = msgs.TIT_SHORT
 		topicID = msgs.EncodeShortTopic(topic)
 	} else {
+		if err := checkTopicLength(topic); err != nil {
+			return err
+		}
 		topicIDType = msgs.TIT_REGISTERED
 		var ok bool
 		c.registeredTopicsLock.RLock()
 		topicID, ok = c.registeredTopics[topic]
 		c.registeredTopicsLock.RUnlock()
 		if !ok {
-			return fmt.Errorf("topic %#v not registered!", topic)
+			return ErrTopicNotRegistered
 		}
 	}
-	return c.publish(topicIDType, topicID, qos, retain, payload)
+	return c.publish(topicIDType, topicID, qos, retain, payload, priority)
 }
 
 // PublishPredefined publishes a message to the provided topic.
 func (c *Client) PublishPredefined(topicID uint16, qos uint8, retain bool, payload []byte) error {
-	return c.publish(msgs.TIT_PREDEFINED, topicID, qos, retain, payload)
+	return c.PublishPredefinedWithPriority(topicID, qos, retain, payload, PriorityNormal)
 }
 
-// Ping sends a PING message to the MQTT-SN gateway.
-func (c *Client) Ping() error {
-	transaction := newPingTransaction(c)
-	ping := msgs.NewPingreqMessage(nil)
-	c.transactions.StoreByType(msgs.PINGREQ, transaction)
-	transaction.Proceed(nil, ping)
-	if err := c.send(ping); err != nil {
-		transaction.Fail(err)
+// PublishPredefinedWithPriority publishes a message to the provided topic. The
+// priority is only relevant if ClientConfig.MaxInflight is set.
+func (c *Client) PublishPredefinedWithPriority(topicID uint16, qos uint8, retain bool, payload []byte, priority Priority) error {
+	return c.publish(msgs.TIT_PREDEFINED, topicID, qos, retain, payload, priority)
+}
+
+// Ping sends a PINGREQ message to the MQTT-SN gateway and returns the round
+// trip time, i.e. the time between the last PINGREQ (re)transmission and the
+// PINGRESP reception. It can be used for connectivity checks and link
+// quality reporting independently of the keepalive. If a ping is already in
+// progress, Ping waits for its result instead of sending another PINGREQ.
+func (c *Client) Ping(ctx context.Context) (time.Duration, error) {
+	if err := c.connected(); err != nil {
+		return 0, err
+	}
+	c.pingLock.Lock()
+	transactionx, _ := c.transactions.GetByType(msgs.PINGREQ)
+	transaction, ok := transactionx.(*pingTransaction)
+	if !ok {
+		transaction = newPingTransaction(c)
+		ping := msgs.NewPingreqMessage(nil)
+		c.transactions.StoreByType(msgs.PINGREQ, transaction)
+		transaction.Proceed(nil, ping)
+		transaction.markSent()
+		if err := c.send(ping); err != nil {
+			transaction.Fail(err)
+		}
 	}
+	c.pingLock.Unlock()
+
 	select {
 	case <-transaction.Done():
-		return transaction.Err()
+		if err := transaction.Err(); err != nil {
+			return 0, clientError(err)
+		}
+		return transaction.roundTrip(), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
 	case <-c.groupCtx.Done():
-		return context.Canceled
+		return 0, ErrNotConnected
 	}
 }
 
 // Sleep informs the MQTT-SN gateway that the client is going to sleep.
 func (c *Client) Sleep(duration time.Duration) error {
+	if err := c.connected(); err != nil {
+		return err
+	}
 	transaction := newSleepTransaction(c, duration)
 	c.transactions.StoreByType(msgs.DISCONNECT, transaction)
 	if err := transaction.Sleep(); err != nil {
 		return err
 	}
-	select {
-	case <-transaction.Done():
-		return transaction.Err()
-	case <-c.groupCtx.Done():
-		return context.Canceled
-	}
+	return c.await(transaction)
 }
 
 // Disconnect sends a DISCONNECT message to the MQTT-SN gateway.
@@ -543,20 +742,15 @@ func (c *Client) Disconnect() error {
 		return err
 	}
 	c.setState(util.StateDisconnected)
-	select {
-	case <-transaction.Done():
-		err := transaction.Err()
-		switch err {
-		case nil:
-			c.log.Debug("DISCONNECT ACKed, quitting.")
-		case transactions.ErrNoMoreRetries:
-			c.log.Info("No reply for DISCONNECT message from broker, quitting anyway.")
-		default:
-			return err
-		}
-		c.cancel()
-		return nil
-	case <-c.groupCtx.Done():
-		return context.Canceled
+	err := c.await(transaction)
+	switch err {
+	case nil:
+		c.log.Debug("DISCONNECT ACKed, quitting.")
+	case ErrTimeout:
+		c.log.Info("No reply for DISCONNECT message from broker, quitting anyway.")
+	default:
+		return err
 	}
+	c.cancel()
+	return nil
 }
@@ -3,19 +3,20 @@ package client
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"math/rand"
 	"net"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	msgs "github.com/energomonitor/bisquitt/messages"
 	"github.com/energomonitor/bisquitt/topics"
-	"github.com/energomonitor/bisquitt/transactions"
 	"github.com/energomonitor/bisquitt/util"
 
 	"github.com/stretchr/testify/assert"
@@ -58,6 +59,63 @@ func TestConnect(t *testing.T) {
 	wg.Wait()
 }
 
+func TestWireHook(t *testing.T) {
+	assert := assert.New(t)
+
+	clientID := "test-client"
+
+	type packet struct {
+		dir  WireDirection
+		data []byte
+	}
+	var packetsLock sync.Mutex
+	var packets []packet
+	stp := newTestSetupWithConfig(t, &ClientConfig{
+		CleanSession:   true,
+		ClientID:       clientID,
+		RetryDelay:     time.Second,
+		RetryCount:     2,
+		ConnectTimeout: time.Second,
+		WireHook: func(dir WireDirection, data []byte) {
+			packetsLock.Lock()
+			defer packetsLock.Unlock()
+			packets = append(packets, packet{dir, append([]byte(nil), data...)})
+		},
+	})
+	defer stp.cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		stp.connect(clientID)
+		stp.disconnect()
+	}()
+
+	if err := stp.client.Connect(); err != nil {
+		stp.t.Fatal(err)
+	}
+	if err := stp.client.Disconnect(); err != nil {
+		stp.t.Fatal(err)
+	}
+	stp.assertClientDone()
+	wg.Wait()
+
+	connect := &bytes.Buffer{}
+	msgs.NewConnectMessage([]byte(clientID), true, false, 0).Write(connect)
+	connack := &bytes.Buffer{}
+	msgs.NewConnackMessage(msgs.RC_ACCEPTED).Write(connack)
+
+	packetsLock.Lock()
+	defer packetsLock.Unlock()
+	if assert.Len(packets, 4) {
+		assert.Equal(WireSent, packets[0].dir)
+		assert.Equal(connect.Bytes(), packets[0].data)
+		assert.Equal(WireReceived, packets[1].dir)
+		assert.Equal(connack.Bytes(), packets[1].data)
+	}
+}
+
 func TestConnectRejected(t *testing.T) {
 	assert := assert.New(t)
 
@@ -84,7 +142,8 @@ func TestConnectRejected(t *testing.T) {
 	}()
 
 	err := stp.client.Connect()
-	assert.Equal("connection rejected: congestion", err.Error())
+	assert.Equal(ErrRejected{Type: msgs.CONNECT, Code: msgs.RC_CONGESTION}, err)
+	assert.Equal("CONNECT rejected: congestion", err.Error())
 	assert.Equal(util.StateDisconnected, stp.client.state.Get())
 
 	wg.Wait()
@@ -261,6 +320,61 @@ func TestRegister(t *testing.T) {
 	wg.Wait()
 }
 
+func TestRegisterConcurrent(t *testing.T) {
+	assert := assert.New(t)
+
+	clientID := "test-client"
+	topic := "test/a"
+	topicID := uint16(123)
+
+	stp := newTestSetup(t, clientID)
+	defer stp.cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		stp.connect(clientID)
+
+		// client --REGISTER--> GW
+		register := stp.recv().(*msgs.RegisterMessage)
+		assert.Equal(topic, register.TopicName)
+
+		// Let the other registrations join.
+		time.Sleep(100 * time.Millisecond)
+
+		// client <--REGACK-- GW
+		regack := msgs.NewRegackMessage(topicID, msgs.RC_ACCEPTED)
+		regack.CopyMessageID(register)
+		stp.send(regack)
+
+		// No other REGISTER is sent.
+		stp.disconnect()
+	}()
+
+	if err := stp.client.Connect(); err != nil {
+		stp.t.Fatal(err)
+	}
+
+	var registered sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		registered.Add(1)
+		go func() {
+			defer registered.Done()
+			assert.NoError(stp.client.Register(topic))
+		}()
+	}
+	registered.Wait()
+	assert.Equal(topicID, stp.client.registeredTopics[topic])
+
+	if err := stp.client.Disconnect(); err != nil {
+		stp.t.Fatal(err)
+	}
+	stp.assertClientDone()
+	wg.Wait()
+}
+
 func TestPublishQOS0(t *testing.T) {
 	assert := assert.New(t)
 
@@ -1566,6 +1680,7 @@ func TestPing(t *testing.T) {
 		assert.True(ok)
 
 		// client <--PINGRESP-- GW
+		time.Sleep(50 * time.Millisecond)
 		pingresp := msgs.NewPingrespMessage()
 		stp.send(pingresp)
 
@@ -1577,9 +1692,12 @@ func TestPing(t *testing.T) {
 	}
 	assert.Equal(util.StateActive, stp.client.state.Get())
 
-	if err := stp.client.Ping(); err != nil {
+	rtt, err := stp.client.Ping(context.Background())
+	if err != nil {
 		stp.t.Fatal(err)
 	}
+	assert.GreaterOrEqual(rtt, 50*time.Millisecond)
+	assert.Less(rtt, time.Second)
 
 	if err := stp.client.Disconnect(); err != nil {
 		stp.t.Fatal(err)
@@ -1707,7 +1825,7 @@ func TestSleepTimeout(t *testing.T) {
 	if err == nil {
 		t.Error("Timeout did not occur")
 	}
-	assert.Equal(transactions.ErrNoMoreRetries, err)
+	assert.Equal(ErrTimeout, err)
 
 	if err := stp.client.Disconnect(); err != nil {
 		stp.t.Fatal(err)
@@ -1791,50 +1909,1049 @@ func TestDisconnectTimeout(t *testing.T) {
 	wg.Wait()
 }
 
-//
-// testSetup
-//
+func TestCloseDisconnectError(t *testing.T) {
+	assert := assert.New(t)
 
-type testSetup struct {
-	ID         string
-	t          *testing.T
-	conn       net.Conn
-	ctx        context.Context
-	cancel     context.CancelFunc
-	client     *Client
-	clientDone chan struct{}
+	clientID := "test-client"
+
+	stp := newTestSetup(t, clientID)
+	defer stp.cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		stp.connect(clientID)
+	}()
+
+	if err := stp.client.Connect(); err != nil {
+		stp.t.Fatal(err)
+	}
+	wg.Wait()
+
+	// The gateway is gone, the DISCONNECT can't be sent.
+	stp.conn.Close()
+	assert.Error(stp.client.Close())
+
+	// The client quits and its connection is closed anyway.
+	<-stp.client.groupCtx.Done()
+	_, err := stp.client.conn.Write([]byte{2, byte(msgs.PINGREQ)})
+	assert.True(errors.Is(err, net.ErrClosed), "%v", err)
 }
 
-func newTestSetup(t *testing.T, clientID string) *testSetup {
-	ctx, cancel := context.WithCancel(context.Background())
-	clientDone := make(chan struct{})
-	// Test name without "Test" prefix.
-	id := reflect.ValueOf(*t).FieldByName("name").String()[4:]
-	stp := &testSetup{
-		ID:         id,
-		t:          t,
-		ctx:        ctx,
-		cancel:     cancel,
-		clientDone: clientDone,
+func TestErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	clientID := "test-client"
+	topic := "ab"
+
+	stp := newTestSetup(t, clientID)
+	defer stp.cancel()
+
+	err := stp.client.Publish(topic, 1, false, []byte("test-msg"))
+	assert.Equal(ErrNotConnected, err)
+	err = stp.client.Register(strings.Repeat("a", MaxTopicLength+1))
+	assert.Equal(ErrTopicTooLong, err)
+	_, err = stp.client.Ping(context.Background())
+	assert.Equal(ErrNotConnected, err)
+	err = stp.client.Sleep(time.Second)
+	assert.Equal(ErrNotConnected, err)
+	_, err = stp.client.GatewayInfo(context.Background())
+	assert.Equal(ErrNotConnected, err)
+	// Not even dialed.
+	_, err = NewClient(util.NoOpLogger{}, &ClientConfig{}).GatewayInfo(context.Background())
+	assert.Equal(ErrNotConnected, err)
+	_, err = stp.client.SubscribeChan(topic, 0, -1)
+	assert.EqualError(err, "invalid channel buffer size: -1")
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		stp.connect(clientID)
+
+		// client --SUBSCRIBE--> GW
+		subscribe := stp.recv().(*msgs.SubscribeMessage)
+
+		// client <--SUBACK-- GW
+		suback := msgs.NewSubackMessage(0, 0, msgs.RC_INVALID_TOPIC_ID)
+		suback.CopyMessageID(subscribe)
+		stp.send(suback)
+
+		// client --PUBLISH--> GW
+		publish := stp.recv().(*msgs.PublishMessage)
+		assert.Equal(uint8(2), publish.QOS)
+
+		// client <--PUBACK-- GW
+		puback := msgs.NewPubackMessage(publish.TopicID, msgs.RC_CONGESTION)
+		puback.CopyMessageID(publish)
+		stp.send(puback)
+
+		for i := uint(0); i < stp.client.cfg.RetryCount+1; i++ {
+			// client --PUBLISH--> GW
+			publish := stp.recv().(*msgs.PublishMessage)
+			assert.Equal(uint8(1), publish.QOS)
+		}
+
+		stp.disconnect()
+	}()
+
+	if err := stp.client.Connect(); err != nil {
+		stp.t.Fatal(err)
 	}
 
-	// Create new randomness source and log its seed.
-	seed := time.Now().UTC().UnixNano()
-	t.Logf("seed = %d\n", seed)
-	rand := rand.New(rand.NewSource(seed))
+	err = stp.client.Subscribe("test/topic", 0, nil)
+	var rejected ErrRejected
+	if assert.True(errors.As(err, &rejected)) {
+		assert.Equal(msgs.SUBSCRIBE, rejected.Type)
+		assert.Equal(msgs.RC_INVALID_TOPIC_ID, rejected.Code)
+	}
 
-	log := util.NewDebugLogger(stp.ID)
-	var listener *net.UnixListener
-	listener, stp.conn = stp.createSocketPair("unixpacket", rand)
+	err = stp.client.Publish(topic, 2, false, []byte("test-msg"))
+	assert.Equal(ErrRejected{Type: msgs.PUBLISH, Code: msgs.RC_CONGESTION}, err)
 
-	cfg := &ClientConfig{
-		PredefinedTopics: make(topics.PredefinedTopics),
-		CleanSession:     true,
-		ClientID:         clientID,
-		RetryDelay:       time.Second,
-		RetryCount:       2,
-		ConnectTimeout:   time.Second,
+	err = stp.client.Publish(topic, 1, false, []byte("test-msg"))
+	assert.Equal(ErrTimeout, err)
+
+	err = stp.client.Publish("test/unregistered", 0, false, []byte("test-msg"))
+	assert.Equal(ErrTopicNotRegistered, err)
+
+	if err := stp.client.Disconnect(); err != nil {
+		stp.t.Fatal(err)
+	}
+	stp.assertClientDone()
+
+	err = stp.client.Publish(topic, 0, false, []byte("test-msg"))
+	assert.Equal(ErrNotConnected, err)
+
+	wg.Wait()
+}
+
+func TestSimpleClient(t *testing.T) {
+	assert := assert.New(t)
+
+	clientID := "test-client"
+	// Must be two characters long.
+	subTopic := "ab"
+	pubTopic := "test/topic"
+	topicID := uint16(12)
+	payload := []byte("test-payload")
+
+	stp := newTestSetup(t, clientID)
+	defer stp.cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		stp.connect(clientID)
+
+		// client --SUBSCRIBE--> GW
+		subscribe := stp.recv().(*msgs.SubscribeMessage)
+		assert.Equal(msgs.TIT_SHORT, subscribe.TopicIDType)
+		assert.Equal(msgs.EncodeShortTopic(subTopic), subscribe.TopicID)
+		assert.Equal(uint8(1), subscribe.QOS)
+
+		// client <--SUBACK-- GW
+		suback := msgs.NewSubackMessage(0, 1, msgs.RC_ACCEPTED)
+		suback.CopyMessageID(subscribe)
+		stp.send(suback)
+
+		// client <--PUBLISH-- GW
+		publish := msgs.NewPublishMessage(subscribe.TopicID, msgs.TIT_SHORT, payload, 0, false, false)
+		stp.send(publish)
+
+		// client --REGISTER--> GW
+		register := stp.recv().(*msgs.RegisterMessage)
+		assert.Equal(pubTopic, register.TopicName)
+
+		// client <--REGACK-- GW
+		regack := msgs.NewRegackMessage(topicID, msgs.RC_ACCEPTED)
+		regack.CopyMessageID(register)
+		stp.send(regack)
+
+		// client --PUBLISH--> GW
+		publish = stp.recv().(*msgs.PublishMessage)
+		assert.Equal(msgs.TIT_REGISTERED, publish.TopicIDType)
+		assert.Equal(topicID, publish.TopicID)
+		assert.Equal(payload, publish.Data)
+
+		stp.disconnect()
+	}()
+
+	if err := stp.client.Connect(); err != nil {
+		stp.t.Fatal(err)
+	}
+	simple := newSimpleClient(stp.client)
+
+	ch, err := simple.SubscribeChan(subTopic)
+	if err != nil {
+		stp.t.Fatal(err)
+	}
+
+	select {
+	case msg := <-ch:
+		assert.Equal(subTopic, msg.Topic)
+		assert.Equal(payload, msg.Payload)
+		assert.Equal(uint8(0), msg.QOS)
+	case <-time.After(time.Second):
+		stp.t.Fatal("message not delivered")
+	}
+
+	if err := simple.Publish(pubTopic, 0, false, payload); err != nil {
+		stp.t.Fatal(err)
+	}
+
+	if err := simple.Close(); err != nil {
+		stp.t.Fatal(err)
 	}
+	_, ok := <-ch
+	assert.False(ok, "channel should be closed")
+
+	wg.Wait()
+}
+
+func TestSubscribeChan(t *testing.T) {
+	assert := assert.New(t)
+
+	clientID := "test-client"
+	topic := "test/a"
+	qos := uint8(0)
+	payload := []byte("test-payload")
+
+	stp := newTestSetup(t, clientID)
+	defer stp.cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		stp.connect(clientID)
+
+		// client --SUBSCRIBE--> GW
+		subscribe := stp.recv().(*msgs.SubscribeMessage)
+		assert.Equal([]byte(topic), subscribe.TopicName)
+		assert.Equal(qos, subscribe.QOS)
+
+		// client <--SUBACK-- GW
+		suback := msgs.NewSubackMessage(1, qos, msgs.RC_ACCEPTED)
+		suback.CopyMessageID(subscribe)
+		stp.send(suback)
+
+		// client <--PUBLISH-- GW
+		publish := msgs.NewPublishMessage(1, msgs.TIT_REGISTERED, payload, qos, false, false)
+		stp.send(publish)
+
+		// client --UNSUBSCRIBE--> GW
+		unsubscribe := stp.recv().(*msgs.UnsubscribeMessage)
+		assert.Equal([]byte(topic), unsubscribe.TopicName)
+
+		// client <--UNSUBACK-- GW
+		unsuback := msgs.NewUnsubackMessage()
+		unsuback.CopyMessageID(unsubscribe)
+		stp.send(unsuback)
+
+		stp.disconnect()
+	}()
+
+	if err := stp.client.Connect(); err != nil {
+		stp.t.Fatal(err)
+	}
+
+	ch, err := stp.client.SubscribeChan(topic, qos, 1)
+	if err != nil {
+		stp.t.Fatal(err)
+	}
+	assert.Equal(1, cap(ch))
+
+	select {
+	case msg := <-ch:
+		assert.Equal(topic, msg.Topic)
+		assert.Equal(payload, msg.Payload)
+	case <-time.After(time.Second):
+		stp.t.Fatal("message not delivered")
+	}
+
+	if err := stp.client.UnsubscribeChan(topic); err != nil {
+		stp.t.Fatal(err)
+	}
+	_, ok := <-ch
+	assert.False(ok, "channel should be closed")
+
+	if err := stp.client.Disconnect(); err != nil {
+		stp.t.Fatal(err)
+	}
+	stp.assertClientDone()
+
+	wg.Wait()
+}
+
+func TestMultiMessageDatagram(t *testing.T) {
+	assert := assert.New(t)
+
+	clientID := "test-client"
+	topic := "test/a"
+	payload := []byte("test-payload")
+
+	stp := newTestSetup(t, clientID)
+	defer stp.cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		stp.connect(clientID)
+
+		// client --SUBSCRIBE--> GW
+		subscribe := stp.recv().(*msgs.SubscribeMessage)
+
+		// client <--SUBACK, PUBLISH-- GW
+		datagram := &bytes.Buffer{}
+		suback := msgs.NewSubackMessage(1, 0, msgs.RC_ACCEPTED)
+		suback.CopyMessageID(subscribe)
+		suback.Write(datagram)
+		msgs.NewPublishMessage(1, msgs.TIT_REGISTERED, payload, 0, false, false).Write(datagram)
+		if _, err := stp.conn.Write(datagram.Bytes()); err != nil {
+			stp.t.Error(err)
+		}
+
+		stp.disconnect()
+	}()
+
+	if err := stp.client.Connect(); err != nil {
+		stp.t.Fatal(err)
+	}
+
+	ch, err := stp.client.SubscribeChan(topic, 0, 1)
+	if err != nil {
+		stp.t.Fatal(err)
+	}
+	select {
+	case msg := <-ch:
+		assert.Equal(topic, msg.Topic)
+		assert.Equal(payload, msg.Payload)
+	case <-time.After(time.Second):
+		stp.t.Fatal("message not delivered")
+	}
+
+	if err := stp.client.Disconnect(); err != nil {
+		stp.t.Fatal(err)
+	}
+	stp.assertClientDone()
+
+	wg.Wait()
+}
+
+func TestHandlerPanic(t *testing.T) {
+	assert := assert.New(t)
+
+	clientID := "test-client"
+	topic := "test/a"
+
+	panicking := make(chan struct{})
+	panics := make(chan error, 1)
+	stp := newTestSetupWithConfig(t, &ClientConfig{
+		CleanSession:   true,
+		ClientID:       clientID,
+		RetryDelay:     time.Second,
+		RetryCount:     2,
+		ConnectTimeout: time.Second,
+		OnHandlerPanic: func(err error) {
+			panics <- err
+		},
+	})
+	defer stp.cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		stp.connect(clientID)
+
+		// client --SUBSCRIBE--> GW
+		subscribe := stp.recv().(*msgs.SubscribeMessage)
+
+		// client <--SUBACK-- GW
+		suback := msgs.NewSubackMessage(1, 0, msgs.RC_ACCEPTED)
+		suback.CopyMessageID(subscribe)
+		stp.send(suback)
+
+		// client <--PUBLISH-- GW
+		stp.send(msgs.NewPublishMessage(1, msgs.TIT_REGISTERED, []byte("panic"), 0, false, false))
+		<-panicking
+		// client <--PUBLISH-- GW
+		stp.send(msgs.NewPublishMessage(1, msgs.TIT_REGISTERED, []byte("ok"), 0, false, false))
+
+		stp.disconnect()
+	}()
+
+	if err := stp.client.Connect(); err != nil {
+		stp.t.Fatal(err)
+	}
+
+	received := make(chan string, 1)
+	err := stp.client.Subscribe(topic, 0, func(_ *Client, _ string, msg *msgs.PublishMessage) {
+		if string(msg.Data) == "panic" {
+			close(panicking)
+			panic("test panic")
+		}
+		received <- string(msg.Data)
+	})
+	if err != nil {
+		stp.t.Fatal(err)
+	}
+
+	select {
+	case payload := <-received:
+		assert.Equal("ok", payload)
+	case <-time.After(time.Second):
+		stp.t.Fatal("message not delivered")
+	}
+	err = <-panics
+	if panicErr, ok := err.(*HandlerPanicError); assert.True(ok) {
+		assert.Equal(topic, panicErr.Topic)
+		assert.Equal("test panic", panicErr.Value)
+	}
+
+	if err := stp.client.Disconnect(); err != nil {
+		stp.t.Fatal(err)
+	}
+	stp.assertClientDone()
+
+	wg.Wait()
+}
+
+func TestHandlerWorkers(t *testing.T) {
+	assert := assert.New(t)
+
+	clientID := "test-client"
+	topic := "test/a"
+
+	stp := newTestSetupWithConfig(t, &ClientConfig{
+		CleanSession:     true,
+		ClientID:         clientID,
+		RetryDelay:       time.Second,
+		RetryCount:       2,
+		ConnectTimeout:   time.Second,
+		HandlerWorkers:   1,
+		HandlerQueueSize: 1,
+	})
+	defer stp.cancel()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	received := make(chan string, 10)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		stp.connect(clientID)
+
+		// client --SUBSCRIBE--> GW
+		subscribe := stp.recv().(*msgs.SubscribeMessage)
+
+		// client <--SUBACK-- GW
+		suback := msgs.NewSubackMessage(1, 1, msgs.RC_ACCEPTED)
+		suback.CopyMessageID(subscribe)
+		stp.send(suback)
+
+		// client <--PUBLISH-- GW (occupies the only worker)
+		stp.send(msgs.NewPublishMessage(1, msgs.TIT_REGISTERED, []byte("a"), 0, false, false))
+		<-started
+		// client <--PUBLISH-- GW (queued)
+		stp.send(msgs.NewPublishMessage(1, msgs.TIT_REGISTERED, []byte("b"), 0, false, false))
+		// client <--PUBLISH-- GW (QoS 0, dropped)
+		stp.send(msgs.NewPublishMessage(1, msgs.TIT_REGISTERED, []byte("c"), 0, false, false))
+		// client <--PUBLISH-- GW (QoS 1, acknowledged and waiting)
+		publish := msgs.NewPublishMessage(1, msgs.TIT_REGISTERED, []byte("d"), 1, false, false)
+		publish.SetMessageID(2)
+		stp.send(publish)
+
+		// client --PUBACK--> GW
+		puback := stp.recv().(*msgs.PubackMessage)
+		assert.Equal(uint16(2), puback.MessageID())
+		close(release)
+
+		stp.disconnect()
+	}()
+
+	if err := stp.client.Connect(); err != nil {
+		stp.t.Fatal(err)
+	}
+
+	err := stp.client.Subscribe(topic, 1, func(_ *Client, _ string, msg *msgs.PublishMessage) {
+		if string(msg.Data) == "a" {
+			close(started)
+			<-release
+		}
+		received <- string(msg.Data)
+	})
+	if err != nil {
+		stp.t.Fatal(err)
+	}
+
+	for _, expected := range []string{"a", "b", "d"} {
+		select {
+		case payload := <-received:
+			assert.Equal(expected, payload)
+		case <-time.After(time.Second):
+			stp.t.Fatalf("message %q not delivered", expected)
+		}
+	}
+
+	if err := stp.client.Disconnect(); err != nil {
+		stp.t.Fatal(err)
+	}
+	stp.assertClientDone()
+	assert.Empty(received)
+
+	wg.Wait()
+}
+
+func TestSubscribeQOSDowngradeRetry(t *testing.T) {
+	assert := assert.New(t)
+
+	clientID := "test-client"
+	topic := "test/a"
+
+	downgrades := make(chan error, 1)
+	stp := newTestSetupWithConfig(t, &ClientConfig{
+		CleanSession:       true,
+		ClientID:           clientID,
+		RetryDelay:         time.Second,
+		RetryCount:         2,
+		ConnectTimeout:     time.Second,
+		QOSDowngradePolicy: QOSDowngradeRetry,
+		OnQOSDowngrade: func(err error) {
+			downgrades <- err
+		},
+	})
+	defer stp.cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		stp.connect(clientID)
+
+		for _, qos := range []uint8{2, 1} {
+			// client --SUBSCRIBE--> GW
+			subscribe := stp.recv().(*msgs.SubscribeMessage)
+			assert.Equal(qos, subscribe.QOS)
+
+			// client <--SUBACK-- GW
+			suback := msgs.NewSubackMessage(1, 1, msgs.RC_ACCEPTED)
+			suback.CopyMessageID(subscribe)
+			stp.send(suback)
+		}
+
+		stp.disconnect()
+	}()
+
+	if err := stp.client.Connect(); err != nil {
+		stp.t.Fatal(err)
+	}
+
+	if err := stp.client.Subscribe(topic, 2, nil); err != nil {
+		stp.t.Fatal(err)
+	}
+	err := <-downgrades
+	if downgradeErr, ok := err.(*QOSDowngradeError); assert.True(ok) {
+		assert.Equal(topic, downgradeErr.Topic)
+		assert.Equal(uint8(2), downgradeErr.Requested)
+		assert.Equal(uint8(1), downgradeErr.Granted)
+	}
+	qos, ok := stp.client.SubscriptionQOS(topic)
+	assert.True(ok)
+	assert.Equal(uint8(1), qos)
+
+	if err := stp.client.Disconnect(); err != nil {
+		stp.t.Fatal(err)
+	}
+	stp.assertClientDone()
+
+	wg.Wait()
+}
+
+func TestSubscribeQOSDowngradeFail(t *testing.T) {
+	assert := assert.New(t)
+
+	clientID := "test-client"
+	topic := "test/a"
+
+	stp := newTestSetupWithConfig(t, &ClientConfig{
+		CleanSession:       true,
+		ClientID:           clientID,
+		RetryDelay:         time.Second,
+		RetryCount:         2,
+		ConnectTimeout:     time.Second,
+		QOSDowngradePolicy: QOSDowngradeFail,
+	})
+	defer stp.cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		stp.connect(clientID)
+
+		// client --SUBSCRIBE--> GW
+		subscribe := stp.recv().(*msgs.SubscribeMessage)
+
+		// client <--SUBACK-- GW
+		suback := msgs.NewSubackMessage(1, 0, msgs.RC_ACCEPTED)
+		suback.CopyMessageID(subscribe)
+		stp.send(suback)
+
+		// client --UNSUBSCRIBE--> GW
+		unsubscribe := stp.recv().(*msgs.UnsubscribeMessage)
+		assert.Equal([]byte(topic), unsubscribe.TopicName)
+
+		// client <--UNSUBACK-- GW
+		unsuback := msgs.NewUnsubackMessage()
+		unsuback.CopyMessageID(unsubscribe)
+		stp.send(unsuback)
+
+		stp.disconnect()
+	}()
+
+	if err := stp.client.Connect(); err != nil {
+		stp.t.Fatal(err)
+	}
+
+	err := stp.client.Subscribe(topic, 1, func(*Client, string, *msgs.PublishMessage) {})
+	_, ok := err.(*QOSDowngradeError)
+	assert.True(ok)
+	_, ok = stp.client.SubscriptionQOS(topic)
+	assert.False(ok)
+	_, ok = stp.client.messageHandlers.load(topic)
+	assert.False(ok)
+
+	if err := stp.client.Disconnect(); err != nil {
+		stp.t.Fatal(err)
+	}
+	stp.assertClientDone()
+
+	wg.Wait()
+}
+
+func TestPublishQueuePriority(t *testing.T) {
+	assert := assert.New(t)
+
+	priorities := []Priority{PriorityLow, PriorityNormal, PriorityHigh}
+	order := runPublishQueue(t, priorities)
+	assert.Equal([]Priority{PriorityHigh, PriorityNormal, PriorityLow}, order)
+}
+
+func TestPublishQueueStarvation(t *testing.T) {
+	assert := assert.New(t)
+
+	priorities := []Priority{PriorityLow}
+	for i := 0; i < starvationLimit+2; i++ {
+		priorities = append(priorities, PriorityHigh)
+	}
+	order := runPublishQueue(t, priorities)
+	assert.Len(order, len(priorities))
+	for i, priority := range order {
+		if i == starvationLimit {
+			assert.Equal(PriorityLow, priority)
+		} else {
+			assert.Equal(PriorityHigh, priority)
+		}
+	}
+}
+
+// runPublishQueue enqueues publishers with the given priorities to
+// a publishQueue with a single in-flight slot and returns the order they were
+// served in.
+func runPublishQueue(t *testing.T, priorities []Priority) []Priority {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	q := newPublishQueue(1)
+	if err := q.acquire(ctx, PriorityNormal); err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	var order []Priority
+	var wg sync.WaitGroup
+	for i, priority := range priorities {
+		wg.Add(1)
+		go func(priority Priority) {
+			defer wg.Done()
+			if err := q.acquire(ctx, priority); err != nil {
+				t.Error(err)
+				return
+			}
+			lock.Lock()
+			order = append(order, priority)
+			lock.Unlock()
+			q.release()
+		}(priority)
+
+		// Wait until the publisher is enqueued to ensure deterministic order.
+		for {
+			q.lock.Lock()
+			n := q.waitingCount()
+			q.lock.Unlock()
+			if n == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	q.release()
+	wg.Wait()
+	return order
+}
+
+func TestAddHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	clientID := "test-client"
+	topic := "test/a"
+	wildcard := "test/+"
+	qos := uint8(1)
+
+	stp := newTestSetup(t, clientID)
+	defer stp.cancel()
+
+	callbackFired := make(chan string, 1)
+	stp.client.AddHandler(wildcard, func(client *Client, topic string, msg *msgs.PublishMessage) {
+		callbackFired <- topic
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		stp.connect(clientID)
+
+		// client --SUBSCRIBE--> GW
+		subscribe := stp.recv().(*msgs.SubscribeMessage)
+		assert.Equal([]byte(wildcard), subscribe.TopicName)
+
+		// PUBLISH before SUBACK is permitted.
+		// client <--PUBLISH-- GW
+		publish := msgs.NewPublishMessage(msgs.EncodeShortTopic("ab"),
+			msgs.TIT_SHORT, []byte("ignored"), 0, false, false)
+		stp.send(publish)
+
+		// client <--REGISTER-- GW
+		msgID := uint16(2)
+		register := msgs.NewRegisterMessage(1, topic)
+		register.SetMessageID(msgID)
+		stp.send(register)
+
+		// client --REGACK--> GW
+		regack := stp.recv().(*msgs.RegackMessage)
+		assert.Equal(msgs.RC_ACCEPTED, regack.ReturnCode)
+
+		// client <--PUBLISH-- GW
+		publish = msgs.NewPublishMessage(register.TopicID,
+			msgs.TIT_REGISTERED, []byte(""), 0, false, false)
+		stp.send(publish)
+
+		// client <--SUBACK-- GW
+		suback := msgs.NewSubackMessage(0, 0, msgs.RC_ACCEPTED)
+		suback.CopyMessageID(subscribe)
+		stp.send(suback)
+
+		stp.disconnect()
+	}()
+
+	if err := stp.client.Connect(); err != nil {
+		stp.t.Fatal(err)
+	}
+	if err := stp.client.Subscribe(wildcard, qos, nil); err != nil {
+		stp.t.Fatal(err)
+	}
+
+	select {
+	case received := <-callbackFired:
+		assert.Equal(topic, received)
+	case <-time.After(time.Second):
+		stp.t.Fatal("handler not fired")
+	}
+
+	if err := stp.client.Disconnect(); err != nil {
+		stp.t.Fatal(err)
+	}
+	stp.assertClientDone()
+
+	wg.Wait()
+}
+
+func TestProfileApply(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := &ClientConfig{
+		ClientID:   "test-client",
+		RetryCount: 10,
+	}
+	ProfileLowPower().Apply(cfg)
+	assert.Equal("test-client", cfg.ClientID)
+	assert.Equal(ProfileLowPower().KeepAlive, cfg.KeepAlive)
+	assert.Equal(ProfileLowPower().RetryCount, cfg.RetryCount)
+	assert.Equal(1, cfg.MaxInflight)
+
+	ProfileRealtime().Apply(cfg)
+	assert.Equal(ProfileRealtime().RetryDelay, cfg.RetryDelay)
+	assert.Equal(ProfileRealtime().MaxInflight, cfg.MaxInflight)
+
+	// The presets cannot be modified.
+	profile := ProfileBalanced()
+	profile.MaxInflight = 100
+	assert.Equal(8, ProfileBalanced().MaxInflight)
+}
+
+func TestConfigFromFile(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg, gateways, err := ConfigFromFile("testdata/client.yaml")
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal([]string{"gw1.example.com:1883", "gw2.example.com:1883"}, gateways)
+	assert.Equal("sensor-1", cfg.ClientID)
+	assert.Equal(ProfileLowPower().KeepAlive, cfg.KeepAlive)
+	assert.Equal(ProfileLowPower().RetryDelay, cfg.RetryDelay)
+	assert.Equal(uint(3), cfg.RetryCount)
+	assert.True(cfg.CleanSession)
+	assert.Equal("sensors/sensor-1/status", cfg.WillTopic)
+	assert.Equal([]byte("offline"), cfg.WillPayload)
+	assert.Equal(uint8(1), cfg.WillQOS)
+	assert.True(cfg.WillRetained)
+	assert.False(cfg.UseDTLS)
+	assert.Equal(topics.PredefinedTopics{"*": {1: "sensors/sensor-1/data"}}, cfg.PredefinedTopics)
+
+	cfg, gateways, err = ConfigFromFile("testdata/client.json")
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal([]string{"gw1.example.com:1883"}, gateways)
+	assert.Equal("sensor-2", cfg.ClientID)
+	assert.Equal("sensor", cfg.User)
+	assert.Equal([]byte("secret"), cfg.Password)
+	assert.Equal(30*time.Second, cfg.KeepAlive)
+	assert.Equal(5*time.Second, cfg.RetryDelay)
+	assert.Equal(uint(2), cfg.RetryCount)
+	assert.False(cfg.CleanSession)
+	assert.True(cfg.UseDTLS)
+	assert.True(cfg.SelfSigned)
+	assert.True(cfg.Insecure)
+
+	_, _, err = ConfigFromFile("testdata/missing.yaml")
+	assert.Error(err)
+}
+
+func TestGatewayInfo(t *testing.T) {
+	assert := assert.New(t)
+
+	clientID := "test-client"
+
+	stp := newTestSetup(t, clientID)
+	defer stp.cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		stp.connect(clientID)
+
+		// client --SUBSCRIBE--> GW
+		subscribe := stp.recv().(*msgs.SubscribeMessage)
+		assert.Equal([]byte(gatewayInfoTopic), subscribe.TopicName)
+
+		// client <--SUBACK-- GW
+		suback := msgs.NewSubackMessage(1, 0, msgs.RC_ACCEPTED)
+		suback.CopyMessageID(subscribe)
+		stp.send(suback)
+
+		// client <--PUBLISH-- GW
+		payload := []byte(`{"version":"1.0.0","max_payload":7168,"auth_methods":["PLAIN"],"sleep":true,"compression":[]}`)
+		stp.send(msgs.NewPublishMessage(1, msgs.TIT_REGISTERED, payload, 0, true, false))
+
+		// client --UNSUBSCRIBE--> GW
+		unsubscribe := stp.recv().(*msgs.UnsubscribeMessage)
+		assert.Equal([]byte(gatewayInfoTopic), unsubscribe.TopicName)
+
+		// client <--UNSUBACK-- GW
+		unsuback := msgs.NewUnsubackMessage()
+		unsuback.CopyMessageID(unsubscribe)
+		stp.send(unsuback)
+
+		stp.disconnect()
+	}()
+
+	if err := stp.client.Connect(); err != nil {
+		stp.t.Fatal(err)
+	}
+
+	info, err := stp.client.GatewayInfo(context.Background())
+	if err != nil {
+		stp.t.Fatal(err)
+	}
+	assert.Equal(&GatewayInfo{
+		Version:     "1.0.0",
+		MaxPayload:  7168,
+		AuthMethods: []string{"PLAIN"},
+		Sleep:       true,
+		Compression: []string{},
+	}, info)
+
+	// The result is cached => no other SUBSCRIBE.
+	info2, err := stp.client.GatewayInfo(context.Background())
+	assert.NoError(err)
+	assert.Same(info, info2)
+
+	if err := stp.client.Disconnect(); err != nil {
+		stp.t.Fatal(err)
+	}
+	stp.assertClientDone()
+
+	wg.Wait()
+}
+
+func TestGatewayInfoUnavailable(t *testing.T) {
+	assert := assert.New(t)
+
+	clientID := "test-client"
+
+	stp := newTestSetupWithConfig(t, &ClientConfig{
+		PredefinedTopics: make(topics.PredefinedTopics),
+		CleanSession:     true,
+		ClientID:         clientID,
+		RetryDelay:       100 * time.Millisecond,
+		RetryCount:       2,
+		ConnectTimeout:   time.Second,
+	})
+	defer stp.cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		stp.connect(clientID)
+
+		// The user subscription and two GatewayInfo queries.
+		for i := 0; i < 3; i++ {
+			// client --SUBSCRIBE--> GW
+			subscribe := stp.recv().(*msgs.SubscribeMessage)
+			assert.Equal([]byte(gatewayInfoTopic), subscribe.TopicName)
+
+			// client <--SUBACK-- GW
+			suback := msgs.NewSubackMessage(1, 0, msgs.RC_ACCEPTED)
+			suback.CopyMessageID(subscribe)
+			stp.send(suback)
+
+			// client --UNSUBSCRIBE--> GW
+			unsubscribe := stp.recv().(*msgs.UnsubscribeMessage)
+			assert.Equal([]byte(gatewayInfoTopic), unsubscribe.TopicName)
+
+			// client <--UNSUBACK-- GW
+			unsuback := msgs.NewUnsubackMessage()
+			unsuback.CopyMessageID(unsubscribe)
+			stp.send(unsuback)
+		}
+
+		stp.disconnect()
+	}()
+
+	if err := stp.client.Connect(); err != nil {
+		stp.t.Fatal(err)
+	}
+
+	// The user's handler is not replaced.
+	err := stp.client.Subscribe(gatewayInfoTopic, 0, func(*Client, string, *msgs.PublishMessage) {})
+	assert.NoError(err)
+	_, err = stp.client.GatewayInfo(context.Background())
+	assert.Equal(ErrGatewayInfoTopicInUse, err)
+	_, ok := stp.client.messageHandlers.load(gatewayInfoTopic)
+	assert.True(ok)
+	assert.NoError(stp.client.Unsubscribe(gatewayInfoTopic))
+
+	// The gateway is given as long as for the other requests.
+	start := time.Now()
+	_, err = stp.client.GatewayInfo(context.Background())
+	assert.Equal(ErrGatewayInfoUnavailable, err)
+	assert.GreaterOrEqual(int64(time.Since(start)), int64(300*time.Millisecond))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = stp.client.GatewayInfo(ctx)
+	assert.Equal(context.DeadlineExceeded, err)
+
+	if err := stp.client.Disconnect(); err != nil {
+		stp.t.Fatal(err)
+	}
+	stp.assertClientDone()
+
+	wg.Wait()
+}
+
+//
+// testSetup
+//
+
+type testSetup struct {
+	ID         string
+	t          *testing.T
+	conn       net.Conn
+	ctx        context.Context
+	cancel     context.CancelFunc
+	client     *Client
+	clientDone chan struct{}
+}
+
+func newTestSetup(t *testing.T, clientID string) *testSetup {
+	return newTestSetupWithConfig(t, &ClientConfig{
+		PredefinedTopics: make(topics.PredefinedTopics),
+		CleanSession:     true,
+		ClientID:         clientID,
+		RetryDelay:       time.Second,
+		RetryCount:       2,
+		ConnectTimeout:   time.Second,
+	})
+}
+
+func newTestSetupWithConfig(t *testing.T, cfg *ClientConfig) *testSetup {
+	ctx, cancel := context.WithCancel(context.Background())
+	clientDone := make(chan struct{})
+	// Test name without "Test" prefix.
+	id := reflect.ValueOf(t).Elem().FieldByName("name").String()[4:]
+	stp := &testSetup{
+		ID:         id,
+		t:          t,
+		ctx:        ctx,
+		cancel:     cancel,
+		clientDone: clientDone,
+	}
+
+	// Create new randomness source and log its seed.
+	seed := time.Now().UTC().UnixNano()
+	t.Logf("seed = %d\n", seed)
+	rand := rand.New(rand.NewSource(seed))
+
+	log := util.NewDebugLogger(stp.ID)
+	var listener *net.UnixListener
+	listener, stp.conn = stp.createSocketPair("unixpacket", rand)
+
 	stp.client = NewClient(log, cfg)
 	stp.client.mockupDialFunc = func() (net.Conn, error) {
 		conn, err := listener.AcceptUnix()
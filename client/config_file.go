@@ -0,0 +1,206 @@
+package client
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/energomonitor/bisquitt/topics"
+	cryptoutils "github.com/energomonitor/bisquitt/util/crypto"
+	"gopkg.in/yaml.v3"
+)
+
+// Client configuration file format. JSON is a subset of YAML, hence JSON
+// files are decoded by the YAML decoder as well.
+type configFile struct {
+	Gateways     []string `yaml:"gateways"`
+	ClientID     string   `yaml:"client_id"`
+	User         string   `yaml:"user"`
+	Password     string   `yaml:"password"`
+	CleanSession *bool    `yaml:"clean_session"`
+	// Name of a Profile applied before the other settings.
+	Profile        string         `yaml:"profile"`
+	KeepAlive      *time.Duration `yaml:"keepalive"`
+	ConnectTimeout *time.Duration `yaml:"connect_timeout"`
+	RetryDelay     *time.Duration `yaml:"retry_delay"`
+	RetryCount     *uint          `yaml:"retry_count"`
+	MaxInflight    *int           `yaml:"max_inflight"`
+	DTLS           struct {
+		Enabled    bool     `yaml:"enabled"`
+		SelfSigned bool     `yaml:"self_signed"`
+		Insecure   bool     `yaml:"insecure"`
+		Cert       string   `yaml:"cert"`
+		Key        string   `yaml:"key"`
+		CAFiles    []string `yaml:"ca_files"`
+		CAPath     string   `yaml:"ca_path"`
+	} `yaml:"dtls"`
+	Will *struct {
+		Topic    string `yaml:"topic"`
+		Payload  string `yaml:"payload"`
+		QOS      uint8  `yaml:"qos"`
+		Retained bool   `yaml:"retained"`
+	} `yaml:"will"`
+	PredefinedTopics topics.PredefinedTopics `yaml:"predefined_topics"`
+}
+
+var profiles = map[string]func() Profile{
+	"lowpower": ProfileLowPower,
+	"balanced": ProfileBalanced,
+	"realtime": ProfileRealtime,
+}
+
+// ConfigFromFile reads a client configuration file in YAML or JSON format.
+// It returns the client configuration and the list of MQTT-SN gateway
+// addresses ("host:port") to be passed to Client.Dial.
+//
+// Relative paths of certificate and key files are relative to the
+// configuration file's directory. Options which are not set keep ClientConfig
+// zero values unless set by the selected profile ("lowpower", "balanced" or
+// "realtime", see Profile). Example:
+//
+//	gateways:
+//	  - gw1.example.com:8883
+//	  - gw2.example.com:8883
+//	client_id: sensor-1
+//	profile: lowpower
+//	retry_count: 3
+//	clean_session: true
+//	dtls:
+//	  enabled: true
+//	  cert: sensor-1.crt
+//	  key: sensor-1.key
+//	  ca_files: [ca.crt]
+//	will:
+//	  topic: sensors/sensor-1/status
+//	  payload: offline
+//	  qos: 1
+//	  retained: true
+//	predefined_topics:
+//	  "*":
+//	    1: sensors/sensor-1/data
+func ConfigFromFile(path string) (*ClientConfig, []string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var file configFile
+	if err := yaml.NewDecoder(f).Decode(&file); err != nil {
+		return nil, nil, fmt.Errorf("cannot parse client configuration file '%s': %s", path, err)
+	}
+
+	cfg, err := file.clientConfig(filepath.Dir(path))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid client configuration file '%s': %s", path, err)
+	}
+	return cfg, file.Gateways, nil
+}
+
+func (file *configFile) clientConfig(dir string) (*ClientConfig, error) {
+	cfg := &ClientConfig{
+		ClientID:         file.ClientID,
+		User:             file.User,
+		PredefinedTopics: file.PredefinedTopics,
+	}
+	if file.Password != "" {
+		cfg.Password = []byte(file.Password)
+	}
+
+	if file.Profile != "" {
+		profile, ok := profiles[strings.ToLower(file.Profile)]
+		if !ok {
+			return nil, fmt.Errorf("unknown profile %q", file.Profile)
+		}
+		profile().Apply(cfg)
+	}
+	if file.CleanSession != nil {
+		cfg.CleanSession = *file.CleanSession
+	}
+	if file.KeepAlive != nil {
+		cfg.KeepAlive = *file.KeepAlive
+	}
+	if file.ConnectTimeout != nil {
+		cfg.ConnectTimeout = *file.ConnectTimeout
+	}
+	if file.RetryDelay != nil {
+		cfg.RetryDelay = *file.RetryDelay
+	}
+	if file.RetryCount != nil {
+		cfg.RetryCount = *file.RetryCount
+	}
+	if file.MaxInflight != nil {
+		cfg.MaxInflight = *file.MaxInflight
+	}
+
+	if will := file.Will; will != nil {
+		if will.QOS > 1 {
+			return nil, fmt.Errorf("will QOS must be 0-1, got %d", will.QOS)
+		}
+		cfg.WillTopic = will.Topic
+		cfg.WillPayload = []byte(will.Payload)
+		cfg.WillQOS = will.QOS
+		cfg.WillRetained = will.Retained
+	}
+
+	if err := file.loadDTLS(cfg, dir); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (file *configFile) loadDTLS(cfg *ClientConfig, dir string) error {
+	dtls := &file.DTLS
+	cfg.UseDTLS = dtls.Enabled
+	cfg.SelfSigned = dtls.SelfSigned
+	cfg.Insecure = dtls.Insecure
+
+	resolve := func(path string) string {
+		if path == "" || filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+
+	if dtls.Enabled && (dtls.Cert == "" || dtls.Key == "") && !dtls.SelfSigned {
+		return fmt.Errorf("dtls cert and key are mandatory unless self_signed is set")
+	}
+	if dtls.Cert != "" && dtls.Key != "" {
+		certFile, keyFile := resolve(dtls.Cert), resolve(dtls.Key)
+		cert, err := cryptoutils.LoadCertificate(certFile)
+		if err != nil {
+			return fmt.Errorf("cannot load a certificate from file '%s': %s", certFile, err)
+		}
+		cfg.Certificate = cert
+		key, err := cryptoutils.LoadKey(keyFile)
+		if err != nil {
+			return fmt.Errorf("cannot load a private key from file '%s': %s", keyFile, err)
+		}
+		cfg.PrivateKey = key
+	}
+
+	var caFiles []string
+	for _, file := range dtls.CAFiles {
+		caFiles = append(caFiles, resolve(file))
+	}
+	if dtls.CAPath != "" {
+		files, err := filepath.Glob(filepath.Join(resolve(dtls.CAPath), "*.crt"))
+		if err != nil {
+			return fmt.Errorf("loading CA certificates failed: glob error: %s", err)
+		}
+		caFiles = append(caFiles, files...)
+	}
+	var caCertificates []*x509.Certificate
+	for _, file := range caFiles {
+		certs, err := cryptoutils.LoadX509Certificate(file)
+		if err != nil {
+			return fmt.Errorf("parsing a CA certificate '%s' failed: %s", file, err)
+		}
+		caCertificates = append(caCertificates, certs...)
+	}
+	cfg.CACertificates = caCertificates
+	return nil
+}
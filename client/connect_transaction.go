@@ -2,7 +2,6 @@ package client
 
 import (
 	"context"
-	"fmt"
 
 	msgs "github.com/energomonitor/bisquitt/messages"
 	"github.com/energomonitor/bisquitt/transactions"
@@ -31,7 +30,7 @@ func newConnectTransaction(ctx context.Context, client *Client) *connectTransact
 
 func (t *connectTransaction) Connack(connack *msgs.ConnackMessage) {
 	if connack.ReturnCode != msgs.RC_ACCEPTED {
-		t.Fail(fmt.Errorf("connection rejected: %s", connack.ReturnCode))
+		t.Fail(ErrRejected{Type: msgs.CONNECT, Code: connack.ReturnCode})
 		return
 	}
 	t.client.setState(util.StateActive)
@@ -0,0 +1,85 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	msgs "github.com/energomonitor/bisquitt/messages"
+	"github.com/energomonitor/bisquitt/transactions"
+	"github.com/energomonitor/bisquitt/util"
+)
+
+// MaxTopicLength is the maximal length of a topic name in bytes. A longer
+// topic name would not fit into a REGISTER or SUBSCRIBE message.
+const MaxTopicLength = msgs.MaxPayloadLength
+
+// Errors returned by Connect, Register, Subscribe, Unsubscribe, Publish, Ping,
+// Sleep and Disconnect methods. Besides them, the methods can return network
+// errors.
+var (
+	// ErrNotConnected is returned if the client is not connected to the
+	// MQTT-SN gateway, i.e. Dial or Connect has not been called or the
+	// connection has been closed.
+	ErrNotConnected = errors.New("not connected")
+	// ErrTimeout is returned if the MQTT-SN gateway has not answered even
+	// after ClientConfig.RetryCount retries (ClientConfig.ConnectTimeout in
+	// case of CONNECT).
+	ErrTimeout = errors.New("no reply from gateway")
+	// ErrTopicTooLong is returned if the topic name is longer than
+	// MaxTopicLength.
+	ErrTopicTooLong = errors.New("topic too long")
+	// ErrTopicNotRegistered is returned by Publish if the topic has not been
+	// registered using Register.
+	ErrTopicNotRegistered = errors.New("topic not registered")
+)
+
+// ErrRejected is returned if the MQTT-SN gateway rejected a request.
+type ErrRejected struct {
+	// Type of the rejected message, e.g. msgs.CONNECT.
+	Type msgs.MessageType
+	Code msgs.ReturnCode
+}
+
+func (e ErrRejected) Error() string {
+	return fmt.Sprintf("%s rejected: %s", e.Type, e.Code)
+}
+
+// connected returns ErrNotConnected if the client is not connected to the
+// MQTT-SN gateway.
+func (c *Client) connected() error {
+	c.dialLock.Lock()
+	groupCtx := c.groupCtx
+	c.dialLock.Unlock()
+	if groupCtx == nil || groupCtx.Err() != nil {
+		return ErrNotConnected
+	}
+	if c.state.Get() == util.StateDisconnected {
+		return ErrNotConnected
+	}
+	return nil
+}
+
+// await waits until the transaction finishes and translates the transaction
+// errors to the client errors.
+func (c *Client) await(transaction transactions.Transaction) error {
+	return clientError(transactions.Await(c.groupCtx, transaction))
+}
+
+// clientError translates the transaction errors to the client errors.
+func clientError(err error) error {
+	switch err {
+	case transactions.ErrTimeout, transactions.ErrNoMoreRetries:
+		return ErrTimeout
+	case context.Canceled:
+		return ErrNotConnected
+	}
+	return err
+}
+
+func checkTopicLength(topic string) error {
+	if len(topic) > MaxTopicLength {
+		return ErrTopicTooLong
+	}
+	return nil
+}
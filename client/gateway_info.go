@@ -0,0 +1,102 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	msgs "github.com/energomonitor/bisquitt/messages"
+)
+
+// Topic the bisquitt gateway publishes its capabilities on when its $SYS
+// topics are enabled.
+const gatewayInfoTopic = "$SYS/bisquitt/capabilities"
+
+// ErrGatewayInfoUnavailable is returned by GatewayInfo if the gateway does not
+// publish its capabilities, e.g. because it's not a bisquitt gateway or its
+// $SYS topics are disabled.
+var ErrGatewayInfoUnavailable = errors.New("gateway capabilities not available")
+
+// ErrGatewayInfoTopicInUse is returned by GatewayInfo if a subscription
+// handler is registered for the reserved topic the capabilities are published
+// on. GatewayInfo would replace it.
+var ErrGatewayInfoTopicInUse = errors.New("gateway capabilities topic already subscribed")
+
+// GatewayInfo describes the features supported by the MQTT-SN gateway.
+type GatewayInfo struct {
+	Version string `json:"version"`
+	// Maximal PUBLISH payload length in bytes.
+	MaxPayload int `json:"max_payload"`
+	// Supported AUTH methods; empty if authentication is disabled.
+	AuthMethods []string `json:"auth_methods"`
+	// Sleeping clients support.
+	Sleep bool `json:"sleep"`
+	// Supported payload compression algorithms.
+	Compression []string `json:"compression"`
+}
+
+// GatewayInfo queries the gateway capabilities. The client must be connected.
+// The result of the first successful query is cached for the client's
+// lifetime.
+//
+// The capabilities are received using a temporary subscription to a reserved
+// topic. If the gateway does not answer within the time the other requests
+// are retried for (ClientConfig.RetryDelay * (ClientConfig.RetryCount + 1)),
+// ErrGatewayInfoUnavailable is returned. If RetryDelay is zero, only ctx
+// limits the wait.
+func (c *Client) GatewayInfo(ctx context.Context) (*GatewayInfo, error) {
+	if err := c.connected(); err != nil {
+		return nil, err
+	}
+	c.gatewayInfoLock.Lock()
+	defer c.gatewayInfoLock.Unlock()
+	if c.gatewayInfo != nil {
+		return c.gatewayInfo, nil
+	}
+
+	if _, ok := c.messageHandlers.load(gatewayInfoTopic); ok {
+		return nil, ErrGatewayInfoTopicInUse
+	}
+
+	payloadCh := make(chan []byte, 1)
+	callback := func(_ *Client, _ string, msg *msgs.PublishMessage) {
+		select {
+		case payloadCh <- msg.Data:
+		default:
+		}
+	}
+	if err := c.Subscribe(gatewayInfoTopic, 0, callback); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := c.Unsubscribe(gatewayInfoTopic); err != nil {
+			c.log.Error("Cannot unsubscribe from %q: %s", gatewayInfoTopic, err)
+			c.messageHandlers.delete(gatewayInfoTopic)
+		}
+	}()
+
+	var timeout <-chan time.Time
+	if c.cfg.RetryDelay > 0 {
+		timer := time.NewTimer(c.cfg.RetryDelay * time.Duration(c.cfg.RetryCount+1))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	var payload []byte
+	select {
+	case payload = <-payloadCh:
+	case <-timeout:
+		return nil, ErrGatewayInfoUnavailable
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.groupCtx.Done():
+		return nil, ErrNotConnected
+	}
+
+	info := &GatewayInfo{}
+	if err := json.Unmarshal(payload, info); err != nil {
+		return nil, err
+	}
+	c.gatewayInfo = info
+	return info, nil
+}
@@ -2,90 +2,163 @@ package client
 
 import (
 	"fmt"
-	"strings"
+	"runtime/debug"
 	"sync"
 
 	msgs "github.com/energomonitor/bisquitt/messages"
+	"github.com/energomonitor/bisquitt/topics"
+	"github.com/energomonitor/bisquitt/util"
 )
 
 // Subscribed message handler callback type.
 type MessageHandlerFunc func(client *Client, topic string, msg *msgs.PublishMessage)
 
 type messageHandler struct {
-	route    []string
+	filter   string
 	callback MessageHandlerFunc
 }
 
+// messageHandlers routes received messages to callbacks. Subscription
+// handlers are bound to subscriptions and removed on unsubscribe. Persistent
+// handlers are registered using Client.AddHandler, independently of the
+// connection state and subscriptions. Subscription handlers take precedence.
 type messageHandlers struct {
-	handlers sync.Map
+	handlers   sync.Map
+	persistent sync.Map
 }
 
-func (mhs *messageHandlers) store(route []string, callback MessageHandlerFunc) {
-	mhs.handlers.Store(join(route), &messageHandler{
-		route:    route,
+func (mhs *messageHandlers) store(filter string, callback MessageHandlerFunc) {
+	mhs.handlers.Store(filter, &messageHandler{
+		filter:   filter,
 		callback: callback,
 	})
 }
 
-func (mhs *messageHandlers) delete(route []string) {
-	mhs.handlers.Delete(join(route))
+func (mhs *messageHandlers) load(filter string) (MessageHandlerFunc, bool) {
+	value, ok := mhs.handlers.Load(filter)
+	if !ok {
+		return nil, false
+	}
+	return value.(*messageHandler).callback, true
+}
+
+func (mhs *messageHandlers) delete(filter string) {
+	mhs.handlers.Delete(filter)
+}
+
+func (mhs *messageHandlers) storePersistent(filter string, callback MessageHandlerFunc) {
+	mhs.persistent.Store(filter, &messageHandler{
+		filter:   filter,
+		callback: callback,
+	})
+}
+
+func (mhs *messageHandlers) deletePersistent(filter string) {
+	mhs.persistent.Delete(filter)
 }
 
 func (mhs *messageHandlers) handle(client *Client, topic string, msg *msgs.PublishMessage) {
+	callback := find(&mhs.handlers, topic)
+	if callback == nil {
+		callback = find(&mhs.persistent, topic)
+	}
+
+	if callback == nil {
+		return
+	}
+	if client.handlerPool == nil {
+		go client.runHandler(callback, topic, msg)
+		return
+	}
+	task := func() {
+		client.runHandler(callback, topic, msg)
+	}
+	var err error
+	if msg.QOS == 0 || msg.QOS == 3 {
+		// QoS 0 or -1, not acknowledged.
+		err = client.handlerPool.TrySubmit(task)
+	} else {
+		// Already acknowledged, it must not be lost.
+		err = client.handlerPool.Submit(client.groupCtx, task)
+	}
+	switch err {
+	case nil:
+	case util.ErrQueueFull:
+		client.log.Error("Message handler queue full, message on %q dropped", topic)
+	default:
+		client.log.Debug("Message on %q not handled: %s", topic, err)
+	}
+}
+
+func find(handlers *sync.Map, topic string) MessageHandlerFunc {
 	var callback MessageHandlerFunc
-	route := split(topic)
-	mhs.handlers.Range(func(key, value interface{}) bool {
+	handlers.Range(func(key, value interface{}) bool {
 		mh, ok := value.(*messageHandler)
 		if !ok {
 			panic(fmt.Errorf("unexpected type '%T'", value))
 		}
 
-		if match(mh.route, route) {
+		if topics.Match(mh.filter, topic) {
 			callback = mh.callback
 			return false
 		}
 
 		return true
 	})
-
-	if callback != nil {
-		go callback(client, topic, msg)
-		return
-	}
+	return callback
 }
 
-func join(route []string) string {
-	return strings.Join(route, "/")
-}
+// PanicPolicy decides what happens when a message handler callback panics.
+type PanicPolicy uint8
+
+const (
+	// PanicLog logs the panic and the client continues.
+	PanicLog PanicPolicy = iota
+	// PanicDisconnect logs the panic and closes the client.
+	PanicDisconnect
+	// PanicRethrow panics again, i.e. the program crashes as if the panic
+	// was not recovered at all.
+	PanicRethrow
+)
 
-func split(topic string) []string {
-	return strings.Split(topic, "/")
+// HandlerPanicError describes a panic of a message handler callback. It's
+// passed to ClientConfig.OnHandlerPanic.
+type HandlerPanicError struct {
+	Topic string
+	// Value passed to panic.
+	Value interface{}
+	Stack []byte
 }
 
-// Taken from Paho mqtt client:
-// https://github.com/eclipse/paho.mqtt.golang/blob/a140ed81404c0a4aa0e97c91e7b99d1577c45418/router.go#L33
-//
-// match takes a slice of strings which represent the route being tested having been split on '/'
-// separators, and a slice of strings representing the topic string in the published message, similarly
-// split.
-// The function determines if the topic string matches the route according to the MQTT topic rules
-// and returns a boolean of the outcome
-func match(route []string, topic []string) bool {
-	if len(route) == 0 {
-		return len(topic) == 0
-	}
-
-	if len(topic) == 0 {
-		return route[0] == "#"
-	}
-
-	if route[0] == "#" {
-		return true
-	}
-
-	if (route[0] == "+") || (route[0] == topic[0]) {
-		return match(route[1:], topic[1:])
-	}
+func (e *HandlerPanicError) Error() string {
+	return fmt.Sprintf("message handler for topic %q panicked: %v", e.Topic, e.Value)
+}
 
-	return false
+// runHandler runs a message handler callback recovering from its panic
+// according to ClientConfig.HandlerPanicPolicy.
+func (c *Client) runHandler(callback MessageHandlerFunc, topic string, msg *msgs.PublishMessage) {
+	defer func() {
+		value := recover()
+		if value == nil {
+			return
+		}
+		err := &HandlerPanicError{
+			Topic: topic,
+			Value: value,
+			Stack: debug.Stack(),
+		}
+		c.log.Error("%s\n%s", err, err.Stack)
+		if c.cfg.OnHandlerPanic != nil {
+			c.cfg.OnHandlerPanic(err)
+		}
+		switch c.cfg.HandlerPanicPolicy {
+		case PanicDisconnect:
+			if err := c.Close(); err != nil {
+				c.log.Error("Cannot close client: %s", err)
+			}
+		case PanicRethrow:
+			panic(value)
+		}
+	}()
+	callback(c, topic, msg)
 }
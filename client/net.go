@@ -1,6 +1,7 @@
 package client
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"net"
@@ -12,9 +13,44 @@ import (
 	dtlsProtocol "github.com/pion/dtls/v2/pkg/protocol"
 )
 
+// WireDirection is a direction of a packet passed to WireHook.
+type WireDirection uint8
+
+const (
+	WireSent WireDirection = iota
+	WireReceived
+)
+
+func (d WireDirection) String() string {
+	switch d {
+	case WireSent:
+		return "sent"
+	case WireReceived:
+		return "received"
+	default:
+		return fmt.Sprintf("unknown (%d)", d)
+	}
+}
+
+// WireHook receives raw MQTT-SN packets exactly as sent to (after encoding)
+// or received from (before decoding) the gateway. Packets sent over DTLS are
+// passed unencrypted. The hook is called synchronously from the client's
+// goroutines, hence it must not block. The data must not be modified or
+// retained after the hook returns.
+type WireHook func(dir WireDirection, data []byte)
+
 func (c *Client) send(msg msgs.Message) error {
 	c.log.Debug("<- %v", msg)
-	return msg.Write(c.conn)
+	if c.cfg.WireHook == nil {
+		return msg.Write(c.conn)
+	}
+	buf := &bytes.Buffer{}
+	if err := msg.Write(buf); err != nil {
+		return err
+	}
+	c.cfg.WireHook(WireSent, buf.Bytes())
+	_, err := c.conn.Write(buf.Bytes())
+	return err
 }
 
 func (c *Client) keepaliveLoop(ctx context.Context) error {
@@ -32,7 +68,7 @@ func (c *Client) keepaliveLoop(ctx context.Context) error {
 	for {
 		select {
 		case <-ticker.C:
-			if err := c.Ping(); err != nil {
+			if _, err := c.Ping(c.groupCtx); err != nil {
 				return err
 			}
 
@@ -59,6 +95,7 @@ func (c *Client) receiveLoop(ctx context.Context) error {
 	c.log.Debug("Receive loop starts")
 	defer c.log.Debug("Receive loop quits")
 
+	packet := make([]byte, msgs.MaxPacketLen)
 	for {
 	AGAIN:
 		select {
@@ -72,7 +109,7 @@ func (c *Client) receiveLoop(ctx context.Context) error {
 		if err != nil {
 			return err
 		}
-		msg, err := msgs.ReadPacket(c.conn)
+		n, err := c.conn.Read(packet)
 		if err != nil {
 			switch e := err.(type) {
 			case net.Error:
@@ -84,9 +121,20 @@ func (c *Client) receiveLoop(ctx context.Context) error {
 			}
 			return err
 		}
-		c.log.Debug("-> %v", msg)
-		if err := c.handlePacket(msg); err != nil {
-			return err
+		if c.cfg.WireHook != nil {
+			c.cfg.WireHook(WireReceived, packet[:n])
+		}
+		// A datagram can contain multiple messages, e.g. coalesced by the
+		// gateway.
+		received, errs := msgs.ParseDatagram(packet[:n])
+		for _, msg := range received {
+			c.log.Debug("-> %v", msg)
+			if err := c.handlePacket(msg); err != nil {
+				return err
+			}
+		}
+		if len(errs) > 0 {
+			return errs[0]
 		}
 	}
 }
@@ -227,15 +275,17 @@ func (c *Client) handlePacket(msgx msgs.Message) error {
 		transaction.Pubrel(msg)
 		return nil
 
-	// Client PUBLISH QoS 1 transaction.
+	// Client PUBLISH QoS 1 transaction or a rejected QoS 2 PUBLISH.
 	case *msgs.PubackMessage:
 		transactionx, _ := c.transactions.Get(msg.MessageID())
-		transaction, ok := transactionx.(*publishQOS1Transaction)
-		if !ok {
+		switch transaction := transactionx.(type) {
+		case *publishQOS1Transaction:
+			transaction.Puback(msg)
+		case *publishQOS2Transaction:
+			transaction.Puback(msg)
+		default:
 			c.log.Error("Unexpected transaction type %T for message: %v", transactionx, msg)
-			return nil
 		}
-		transaction.Puback(msg)
 		return nil
 
 	// Client PUBLISH QoS 2 transaction.
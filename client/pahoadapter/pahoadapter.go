@@ -0,0 +1,276 @@
+// Package pahoadapter adapts client.Client to the mqtt.Client interface of
+// the paho.mqtt.golang library so that applications written against paho can
+// use the MQTT-SN transport with minimal changes:
+//
+//	var c mqtt.Client = pahoadapter.NewClient(log,
+//		client.NewClient(log, cfg), "gateway:1883")
+//	if token := c.Connect(); token.Wait() && token.Error() != nil {
+//		panic(token.Error())
+//	}
+//
+// Topics are registered automatically before publishing, predefined topics are
+// recognized using ClientConfig.PredefinedTopics. A nil callback passed to
+// Subscribe means the messages are handled by callbacks registered using
+// AddRoute. Messages are acknowledged automatically, Message.Ack does
+// nothing.
+//
+// The adapter lives in its own package so that the client package does not
+// depend on the paho client library.
+package pahoadapter
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/energomonitor/bisquitt/client"
+	msgs "github.com/energomonitor/bisquitt/messages"
+	"github.com/energomonitor/bisquitt/util"
+)
+
+// Client implements mqtt.Client using client.Client.
+type Client struct {
+	client  *client.Client
+	address string
+	log     util.Logger
+	// Serializes Connect and Disconnect.
+	lock sync.Mutex
+}
+
+var _ mqtt.Client = (*Client)(nil)
+
+// NewClient creates an adapter of the given client. The client is dialed to
+// the MQTT-SN gateway on the given address by Connect unless it's already
+// dialed.
+func NewClient(log util.Logger, c *client.Client, address string) *Client {
+	return &Client{
+		client:  c,
+		address: address,
+		log:     log,
+	}
+}
+
+// Client returns the underlying client.Client.
+func (p *Client) Client() *client.Client {
+	return p.client
+}
+
+// IsConnected returns true if the client is connected to the MQTT-SN
+// gateway.
+func (p *Client) IsConnected() bool {
+	return p.client.IsConnected()
+}
+
+// IsConnectionOpen returns true if the client is connected to the MQTT-SN
+// gateway. Unlike paho, the client does not reconnect automatically, hence
+// it's the same as IsConnected.
+func (p *Client) IsConnectionOpen() bool {
+	return p.IsConnected()
+}
+
+// Connect dials the MQTT-SN gateway if necessary and sends a CONNECT message.
+func (p *Client) Connect() mqtt.Token {
+	return newPahoToken(func() error {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		if !p.client.Dialed() {
+			if err := p.client.Dial(p.address); err != nil {
+				return err
+			}
+		}
+		return p.client.Connect()
+	})
+}
+
+// Disconnect sends a DISCONNECT message to the MQTT-SN gateway and closes the
+// connection. The quiesce argument is ignored: the DISCONNECT is sent
+// immediately.
+func (p *Client) Disconnect(quiesce uint) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if !p.client.Dialed() {
+		return
+	}
+	if err := p.client.Close(); err != nil {
+		p.log.Error("Disconnect failed: %s", err)
+	}
+}
+
+// Publish publishes a message to the given topic. The payload must be
+// a string, []byte, bytes.Buffer or *bytes.Buffer.
+func (p *Client) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	return newPahoToken(func() error {
+		var data []byte
+		switch v := payload.(type) {
+		case string:
+			data = []byte(v)
+		case []byte:
+			data = v
+		case bytes.Buffer:
+			data = v.Bytes()
+		case *bytes.Buffer:
+			data = v.Bytes()
+		default:
+			return fmt.Errorf("unknown payload type %T", payload)
+		}
+		return p.client.PublishByName(topic, qos, retained, data)
+	})
+}
+
+// Subscribe subscribes to the given topic.
+func (p *Client) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return newPahoToken(func() error {
+		return p.client.SubscribeByName(topic, qos, p.messageHandler(callback))
+	})
+}
+
+// SubscribeMultiple subscribes to the given topics. The MQTT-SN SUBSCRIBE
+// message contains a single topic, hence the topics are subscribed one by
+// one.
+func (p *Client) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	return newPahoToken(func() error {
+		for topic, qos := range filters {
+			if err := p.client.SubscribeByName(topic, qos, p.messageHandler(callback)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Unsubscribe unsubscribes from the given topics.
+func (p *Client) Unsubscribe(topics ...string) mqtt.Token {
+	return newPahoToken(func() error {
+		for _, topic := range topics {
+			if err := p.client.UnsubscribeByName(topic); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AddRoute registers a callback for received messages matching the given
+// topic filter (see client.Client.AddHandler).
+func (p *Client) AddRoute(topic string, callback mqtt.MessageHandler) {
+	p.client.AddHandler(topic, p.messageHandler(callback))
+}
+
+// OptionsReader returns the client configuration translated to paho client
+// options.
+func (p *Client) OptionsReader() mqtt.ClientOptionsReader {
+	cfg := p.client.Config()
+	scheme := "udp"
+	if cfg.UseDTLS {
+		scheme = "dtls"
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(fmt.Sprintf("%s://%s", scheme, p.address)).
+		SetClientID(cfg.ClientID).
+		SetCleanSession(cfg.CleanSession).
+		SetKeepAlive(cfg.KeepAlive).
+		SetConnectTimeout(cfg.ConnectTimeout).
+		SetUsername(cfg.User).
+		SetPassword(string(cfg.Password)).
+		SetAutoReconnect(false)
+	if cfg.WillTopic != "" {
+		opts.SetBinaryWill(cfg.WillTopic, cfg.WillPayload, cfg.WillQOS, cfg.WillRetained)
+	}
+	// ClientOptionsReader can only be created by a paho client.
+	return mqtt.NewClient(opts).OptionsReader()
+}
+
+func (p *Client) messageHandler(callback mqtt.MessageHandler) client.MessageHandlerFunc {
+	if callback == nil {
+		return nil
+	}
+	return func(_ *client.Client, topic string, msg *msgs.PublishMessage) {
+		callback(p, &pahoMessage{topic: topic, msg: msg})
+	}
+}
+
+// pahoMessage implements mqtt.Message.
+type pahoMessage struct {
+	topic string
+	msg   *msgs.PublishMessage
+}
+
+func (m *pahoMessage) Duplicate() bool {
+	return m.msg.DUP()
+}
+
+func (m *pahoMessage) Qos() byte {
+	// QoS -1 is not known to MQTT.
+	if m.msg.QOS == 3 {
+		return 0
+	}
+	return m.msg.QOS
+}
+
+func (m *pahoMessage) Retained() bool {
+	return m.msg.Retain
+}
+
+func (m *pahoMessage) Topic() string {
+	return m.topic
+}
+
+func (m *pahoMessage) MessageID() uint16 {
+	return m.msg.MessageID()
+}
+
+func (m *pahoMessage) Payload() []byte {
+	return m.msg.Data
+}
+
+// Ack does nothing, received messages are acknowledged automatically.
+func (m *pahoMessage) Ack() {}
+
+// pahoToken implements mqtt.Token for an operation running in its own
+// goroutine.
+type pahoToken struct {
+	done chan struct{}
+	err  error
+}
+
+func newPahoToken(operation func() error) *pahoToken {
+	t := &pahoToken{
+		done: make(chan struct{}),
+	}
+	go func() {
+		t.err = operation()
+		close(t.done)
+	}()
+	return t
+}
+
+func (t *pahoToken) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *pahoToken) WaitTimeout(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-t.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (t *pahoToken) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *pahoToken) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,190 @@
+package pahoadapter
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/energomonitor/bisquitt/client"
+	msgs "github.com/energomonitor/bisquitt/messages"
+	"github.com/energomonitor/bisquitt/topics"
+	"github.com/energomonitor/bisquitt/util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const maxTestPktLength = 512
+
+func TestClient(t *testing.T) {
+	assert := assert.New(t)
+
+	clientID := "test-client"
+	subTopic := "test/sub"
+	pubTopic := "test/pub"
+	subTopicID := uint16(11)
+	pubTopicID := uint16(12)
+	payload := []byte("test-payload")
+
+	gw := newTestGateway(t)
+	defer gw.conn.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		// client --CONNECT--> GW
+		connect := gw.recv().(*msgs.ConnectMessage)
+		assert.Equal([]byte(clientID), connect.ClientID)
+
+		// client <--CONNACK-- GW
+		gw.send(msgs.NewConnackMessage(msgs.RC_ACCEPTED))
+
+		// client --SUBSCRIBE--> GW
+		subscribe := gw.recv().(*msgs.SubscribeMessage)
+		assert.Equal(subTopic, string(subscribe.TopicName))
+		assert.Equal(uint8(1), subscribe.QOS)
+
+		// client <--SUBACK-- GW
+		suback := msgs.NewSubackMessage(subTopicID, 1, msgs.RC_ACCEPTED)
+		suback.CopyMessageID(subscribe)
+		gw.send(suback)
+
+		// client <--PUBLISH-- GW
+		publish := msgs.NewPublishMessage(subTopicID, msgs.TIT_REGISTERED, payload, 1, true, false)
+		publish.SetMessageID(100)
+		gw.send(publish)
+
+		// client --PUBACK--> GW
+		puback := gw.recv().(*msgs.PubackMessage)
+		assert.Equal(uint16(100), puback.MessageID())
+
+		// client --REGISTER--> GW
+		register := gw.recv().(*msgs.RegisterMessage)
+		assert.Equal(pubTopic, register.TopicName)
+
+		// client <--REGACK-- GW
+		regack := msgs.NewRegackMessage(pubTopicID, msgs.RC_ACCEPTED)
+		regack.CopyMessageID(register)
+		gw.send(regack)
+
+		// client --PUBLISH--> GW
+		publish = gw.recv().(*msgs.PublishMessage)
+		assert.Equal(pubTopicID, publish.TopicID)
+		assert.Equal(payload, publish.Data)
+
+		// client <--PUBACK-- GW
+		puback = msgs.NewPubackMessage(pubTopicID, msgs.RC_ACCEPTED)
+		puback.CopyMessageID(publish)
+		gw.send(puback)
+
+		// client --DISCONNECT--> GW
+		disconnect := gw.recv().(*msgs.DisconnectMessage)
+		assert.Equal(uint16(0), disconnect.Duration)
+
+		// client <--DISCONNECT-- GW
+		gw.send(msgs.NewDisconnectMessage(0))
+	}()
+
+	log := util.NewDebugLogger("Client")
+	snClient := client.NewClient(log, &client.ClientConfig{
+		PredefinedTopics: make(topics.PredefinedTopics),
+		CleanSession:     true,
+		ClientID:         clientID,
+		RetryDelay:       time.Second,
+		RetryCount:       2,
+		ConnectTimeout:   time.Second,
+	})
+	var c mqtt.Client = NewClient(log, snClient, gw.conn.LocalAddr().String())
+	assert.False(c.IsConnected())
+	token := c.Connect()
+	if assert.True(token.WaitTimeout(time.Second)) {
+		assert.NoError(token.Error())
+	}
+	assert.True(c.IsConnected())
+	opts := c.OptionsReader()
+	assert.Equal(clientID, opts.ClientID())
+
+	received := make(chan mqtt.Message, 1)
+	token = c.Subscribe(subTopic, 1, func(_ mqtt.Client, msg mqtt.Message) {
+		received <- msg
+	})
+	token.Wait()
+	assert.NoError(token.Error())
+
+	select {
+	case msg := <-received:
+		assert.Equal(subTopic, msg.Topic())
+		assert.Equal(payload, msg.Payload())
+		assert.Equal(byte(1), msg.Qos())
+		assert.True(msg.Retained())
+		assert.Equal(uint16(100), msg.MessageID())
+	case <-time.After(time.Second):
+		t.Fatal("message not delivered")
+	}
+
+	token = c.Publish(pubTopic, 1, false, string(payload))
+	token.Wait()
+	assert.NoError(token.Error())
+
+	token = c.Publish(pubTopic, 1, false, 42)
+	token.Wait()
+	assert.Error(token.Error())
+
+	c.Disconnect(0)
+	assert.False(c.IsConnected())
+
+	wg.Wait()
+}
+
+// testGateway is a MQTT-SN gateway mockup communicating with a single client
+// over UDP.
+type testGateway struct {
+	t      *testing.T
+	conn   *net.UDPConn
+	client net.Addr
+}
+
+func newTestGateway(t *testing.T) *testGateway {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testGateway{
+		t:    t,
+		conn: conn,
+	}
+}
+
+func (gw *testGateway) send(msg msgs.Message) {
+	var buf bytes.Buffer
+	if err := msg.Write(&buf); err != nil {
+		gw.t.Fatal(err)
+	}
+	if _, err := gw.conn.WriteTo(buf.Bytes(), gw.client); err != nil {
+		gw.t.Fatal(err)
+	}
+}
+
+func (gw *testGateway) recv() msgs.Message {
+	buff := make([]byte, maxTestPktLength)
+	if err := gw.conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		gw.t.Fatal(err)
+	}
+	n, addr, err := gw.conn.ReadFrom(buff)
+	if err != nil {
+		gw.t.Fatal(err)
+	}
+	gw.client = addr
+
+	pktReader := bytes.NewReader(buff[:n])
+	header := &msgs.Header{}
+	header.Unpack(pktReader)
+	msg := msgs.NewMessageWithHeader(*header)
+	msg.Unpack(pktReader)
+
+	return msg
+}
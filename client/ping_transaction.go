@@ -1,36 +1,61 @@
 package client
 
 import (
+	"sync"
+	"time"
+
 	msgs "github.com/energomonitor/bisquitt/messages"
 	"github.com/energomonitor/bisquitt/transactions"
 )
 
 type pingTransaction struct {
 	*transaction
+	lock sync.Mutex
+	// Time of the last PINGREQ (re)transmission.
+	sent time.Time
+	rtt  time.Duration
 }
 
 func newPingTransaction(client *Client) *pingTransaction {
 	tLog := client.log.WithTag("PING")
 	tLog.Debug("Created.")
-	return &pingTransaction{
-		transaction: &transaction{
-			RetryTransaction: transactions.NewRetryTransaction(
-				client.groupCtx, client.cfg.RetryDelay, client.cfg.RetryCount,
-				func(lastMsg interface{}) error {
-					tLog.Debug("Resend.")
-					return client.send(lastMsg.(msgs.Message))
-				},
-				func() {
-					client.transactions.DeleteByType(msgs.PINGREQ)
-					tLog.Debug("Deleted.")
-				},
-			),
-			client: client,
-			log:    tLog,
-		},
+	t := &pingTransaction{}
+	t.transaction = &transaction{
+		RetryTransaction: transactions.NewRetryTransaction(
+			client.groupCtx, client.cfg.RetryDelay, client.cfg.RetryCount,
+			func(lastMsg interface{}) error {
+				tLog.Debug("Resend.")
+				t.markSent()
+				return client.send(lastMsg.(msgs.Message))
+			},
+			func() {
+				client.transactions.DeleteByType(msgs.PINGREQ)
+				tLog.Debug("Deleted.")
+			},
+		),
+		client: client,
+		log:    tLog,
 	}
+	return t
+}
+
+func (t *pingTransaction) markSent() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.sent = time.Now()
 }
 
 func (t *pingTransaction) Pingresp(pingresp *msgs.PingrespMessage) {
+	t.lock.Lock()
+	t.rtt = time.Since(t.sent)
+	t.lock.Unlock()
 	t.Success()
 }
+
+// roundTrip returns the time between the last PINGREQ transmission and the
+// PINGRESP reception.
+func (t *pingTransaction) roundTrip() time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.rtt
+}
@@ -0,0 +1,73 @@
+package client
+
+import "time"
+
+// Profile bundles ClientConfig settings tuned for a typical use case so
+// that they need not be hand-tuned one by one. Use Apply to copy the
+// settings to a ClientConfig:
+//
+//	cfg := &client.ClientConfig{ClientID: "sensor-1"}
+//	client.ProfileLowPower().Apply(cfg)
+type Profile struct {
+	KeepAlive      time.Duration
+	ConnectTimeout time.Duration
+	// TRetry in MQTT-SN specification
+	RetryDelay time.Duration
+	// NRetry in MQTT-SN specification
+	RetryCount uint
+	// See ClientConfig.MaxInflight.
+	MaxInflight int
+	// SleepDuration is the recommended duration to be passed to Client.Sleep
+	// between bursts of activity. Zero means the client is not expected to
+	// sleep at all. It's advisory only: Apply does not copy it anywhere and
+	// the client never sleeps on its own.
+	SleepDuration time.Duration
+}
+
+// ProfileLowPower suits battery-powered devices which spend most of the
+// time asleep. Retries are rare and patient to spare the radio and only one
+// message is in flight at a time.
+func ProfileLowPower() Profile {
+	return Profile{
+		KeepAlive:      15 * time.Minute,
+		ConnectTimeout: time.Minute,
+		RetryDelay:     30 * time.Second,
+		RetryCount:     2,
+		MaxInflight:    1,
+		SleepDuration:  10 * time.Minute,
+	}
+}
+
+// ProfileBalanced suits mains-powered devices on a reasonably reliable
+// network.
+func ProfileBalanced() Profile {
+	return Profile{
+		KeepAlive:      time.Minute,
+		ConnectTimeout: 20 * time.Second,
+		RetryDelay:     10 * time.Second,
+		RetryCount:     4,
+		MaxInflight:    8,
+	}
+}
+
+// ProfileRealtime suits devices requiring low latency. Lost clients and
+// messages are detected quickly at the cost of more traffic.
+func ProfileRealtime() Profile {
+	return Profile{
+		KeepAlive:      10 * time.Second,
+		ConnectTimeout: 5 * time.Second,
+		RetryDelay:     time.Second,
+		RetryCount:     5,
+		MaxInflight:    32,
+	}
+}
+
+// Apply copies the profile's settings except SleepDuration to cfg. Other
+// ClientConfig fields are left untouched.
+func (p Profile) Apply(cfg *ClientConfig) {
+	cfg.KeepAlive = p.KeepAlive
+	cfg.ConnectTimeout = p.ConnectTimeout
+	cfg.RetryDelay = p.RetryDelay
+	cfg.RetryCount = p.RetryCount
+	cfg.MaxInflight = p.MaxInflight
+}
@@ -38,5 +38,9 @@ func (t *publishQOS1Transaction) Puback(puback *msgs.PubackMessage) {
 		t.log.Debug("Unexpected message in %d: %v", t.State, puback)
 		return
 	}
+	if puback.ReturnCode != msgs.RC_ACCEPTED {
+		t.Fail(ErrRejected{Type: msgs.PUBLISH, Code: puback.ReturnCode})
+		return
+	}
 	t.Success()
 }
@@ -33,6 +33,15 @@ func newPublishQOS2Transaction(client *Client, msgID uint16) *publishQOS2Transac
 	}
 }
 
+// Puback handles the rejection of the PUBLISH by the gateway.
+func (t *publishQOS2Transaction) Puback(puback *msgs.PubackMessage) {
+	if t.State != awaitingPubrec || puback.ReturnCode == msgs.RC_ACCEPTED {
+		t.log.Debug("Unexpected message in %d: %v", t.State, puback)
+		return
+	}
+	t.Fail(ErrRejected{Type: msgs.PUBLISH, Code: puback.ReturnCode})
+}
+
 func (t *publishQOS2Transaction) Pubrec(pubrec *msgs.PubrecMessage) error {
 	if t.State != awaitingPubrec {
 		t.log.Debug("Unexpected message in %d: %v", t.State, pubrec)
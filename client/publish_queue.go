@@ -0,0 +1,154 @@
+package client
+
+import (
+	"context"
+	"sync"
+)
+
+// Priority of an outgoing PUBLISH message. Higher priority messages are
+// sent first when the number of in-flight messages is limited (see
+// ClientConfig.MaxInflight).
+type Priority uint8
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+
+	priorityCount = int(PriorityHigh) + 1
+)
+
+// A priority level waiting longer than starvationLimit grants to higher
+// priorities is served next regardless of its priority.
+const starvationLimit = 8
+
+// publishQueue limits the number of in-flight PUBLISH messages. Waiting
+// publishers are served in priority order. Lower priorities are protected
+// from starvation by serving them after at most starvationLimit grants to
+// higher priorities.
+type publishQueue struct {
+	lock     sync.Mutex
+	max      int
+	inflight int
+	waiting  [priorityCount][]chan struct{}
+	skipped  [priorityCount]int
+}
+
+func newPublishQueue(max int) *publishQueue {
+	return &publishQueue{
+		max: max,
+	}
+}
+
+// acquire blocks until the caller is allowed to send a PUBLISH message or
+// the context is canceled. The caller must call release when the message is
+// no longer in flight.
+func (q *publishQueue) acquire(ctx context.Context, priority Priority) error {
+	if priority > PriorityHigh {
+		priority = PriorityHigh
+	}
+
+	q.lock.Lock()
+	if q.inflight < q.max && q.waitingCount() == 0 {
+		q.inflight++
+		q.lock.Unlock()
+		return nil
+	}
+	ch := make(chan struct{})
+	q.waiting[priority] = append(q.waiting[priority], ch)
+	q.lock.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		select {
+		case <-ch:
+			// Granted concurrently => give the slot to someone else.
+			q.inflight--
+			q.grant()
+		default:
+			q.remove(priority, ch)
+		}
+		return ctx.Err()
+	}
+}
+
+// release frees the in-flight slot acquired by acquire.
+func (q *publishQueue) release() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.inflight--
+	q.grant()
+}
+
+// grant passes free in-flight slots to the waiting publishers.
+// Must be called with the lock held.
+func (q *publishQueue) grant() {
+	for q.inflight < q.max {
+		priority, ok := q.next()
+		if !ok {
+			return
+		}
+		ch := q.waiting[priority][0]
+		q.waiting[priority] = q.waiting[priority][1:]
+		q.inflight++
+		close(ch)
+	}
+}
+
+// next chooses the priority level to be served next.
+// Must be called with the lock held.
+func (q *publishQueue) next() (Priority, bool) {
+	highest := -1
+	for p := priorityCount - 1; p >= 0; p-- {
+		if len(q.waiting[p]) > 0 {
+			highest = p
+			break
+		}
+	}
+	if highest < 0 {
+		return 0, false
+	}
+
+	chosen := highest
+	for p := 0; p < highest; p++ {
+		if len(q.waiting[p]) > 0 && q.skipped[p] >= starvationLimit {
+			chosen = p
+			break
+		}
+	}
+
+	q.skipped[chosen] = 0
+	for p := 0; p < chosen; p++ {
+		if len(q.waiting[p]) > 0 {
+			q.skipped[p]++
+		}
+	}
+	return Priority(chosen), true
+}
+
+// Must be called with the lock held.
+func (q *publishQueue) remove(priority Priority, ch chan struct{}) {
+	waiting := q.waiting[priority]
+	for i := range waiting {
+		if waiting[i] == ch {
+			q.waiting[priority] = append(waiting[:i], waiting[i+1:]...)
+			break
+		}
+	}
+	if len(q.waiting[priority]) == 0 {
+		q.skipped[priority] = 0
+	}
+}
+
+// Must be called with the lock held.
+func (q *publishQueue) waitingCount() int {
+	n := 0
+	for p := range q.waiting {
+		n += len(q.waiting[p])
+	}
+	return n
+}
@@ -35,7 +35,7 @@ func newRegisterTransaction(client *Client, msgID uint16, topic string) *registe
 
 func (t *registerTransaction) Regack(regack *msgs.RegackMessage) {
 	if regack.ReturnCode != msgs.RC_ACCEPTED {
-		t.Fail(fmt.Errorf("registration rejected with code %d", regack.ReturnCode))
+		t.Fail(ErrRejected{Type: msgs.REGISTER, Code: regack.ReturnCode})
 		return
 	}
 
@@ -43,5 +43,6 @@ func (t *registerTransaction) Regack(regack *msgs.RegackMessage) {
 	t.client.registeredTopicsLock.Lock()
 	t.client.registeredTopics[register.TopicName] = regack.TopicID
 	t.client.registeredTopicsLock.Unlock()
+	t.SetResult(regack.TopicID)
 	t.Success()
 }
@@ -0,0 +1,209 @@
+package client
+
+import (
+	"sync"
+
+	msgs "github.com/energomonitor/bisquitt/messages"
+	"github.com/energomonitor/bisquitt/util"
+)
+
+// QoS used by SimpleClient.SubscribeChan.
+const simpleSubscribeQOS = 1
+
+// Capacity of channels returned by SimpleClient.SubscribeChan.
+const simpleChanBuffer = 16
+
+// Message is a message received on a subscribed topic.
+type Message struct {
+	Topic   string
+	Payload []byte
+	QOS     uint8
+	Retain  bool
+}
+
+// SimpleClient is a minimal blocking facade over Client intended for scripting
+// and quick tools. All its methods block until the respective operation is
+// finished and received messages are delivered using channels instead of
+// callbacks.
+//
+// Example:
+//
+//	c, err := client.Connect(util.NoOpLogger{}, "localhost:1883", cfg)
+//	if err != nil {
+//		panic(err)
+//	}
+//	defer c.Close()
+//
+//	ch, err := c.SubscribeChan("dev/commands")
+//	if err != nil {
+//		panic(err)
+//	}
+//	for msg := range ch {
+//		fmt.Printf("%s: %s\n", msg.Topic, msg.Payload)
+//	}
+type SimpleClient struct {
+	client            *Client
+	subscriptionsLock sync.Mutex
+	subscriptions     []*chanSubscription
+}
+
+// Connect creates a new client, connects it to the MQTT-SN gateway on the
+// given address and sends a CONNECT message.
+func Connect(log util.Logger, address string, cfg *ClientConfig) (*SimpleClient, error) {
+	c := NewClient(log, cfg)
+	if err := c.Dial(address); err != nil {
+		return nil, err
+	}
+	s := newSimpleClient(c)
+	if err := c.Connect(); err != nil {
+		c.cancel()
+		c.conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func newSimpleClient(c *Client) *SimpleClient {
+	s := &SimpleClient{
+		client: c,
+	}
+	go func() {
+		<-c.groupCtx.Done()
+		s.closeSubscriptions()
+	}()
+	return s
+}
+
+// Client returns the underlying Client.
+func (s *SimpleClient) Client() *Client {
+	return s.client
+}
+
+// Publish publishes a message to the given topic. Unlike Client.Publish, the
+// topic is registered automatically if necessary. Predefined topics are
+// recognized using ClientConfig.PredefinedTopics.
+func (s *SimpleClient) Publish(topic string, qos uint8, retain bool, payload []byte) error {
+	return s.client.PublishByName(topic, qos, retain, payload)
+}
+
+// PublishByName publishes a message to the given topic. Unlike Publish, the
+// topic is registered automatically if necessary. Predefined topics are
+// recognized using ClientConfig.PredefinedTopics.
+func (c *Client) PublishByName(topic string, qos uint8, retain bool, payload []byte) error {
+	if topicID, ok := c.cfg.PredefinedTopics.GetTopicID(c.cfg.ClientID, topic); ok {
+		return c.PublishPredefined(topicID, qos, retain, payload)
+	}
+	if !msgs.IsShortTopic(topic) {
+		c.registeredTopicsLock.RLock()
+		_, registered := c.registeredTopics[topic]
+		c.registeredTopicsLock.RUnlock()
+		if !registered {
+			if err := c.Register(topic); err != nil {
+				return err
+			}
+		}
+	}
+	return c.Publish(topic, qos, retain, payload)
+}
+
+// SubscribeChan subscribes to the given topic (QoS 1) and returns a channel
+// the received messages are delivered to. The channel is closed when the
+// SimpleClient is closed or the connection to the gateway terminates.
+func (s *SimpleClient) SubscribeChan(topic string) (<-chan *Message, error) {
+	sub := newChanSubscription(simpleChanBuffer)
+	if err := s.client.SubscribeByName(topic, simpleSubscribeQOS, sub.handle); err != nil {
+		sub.close()
+		return nil, err
+	}
+
+	s.subscriptionsLock.Lock()
+	s.subscriptions = append(s.subscriptions, sub)
+	s.subscriptionsLock.Unlock()
+	return sub.ch, nil
+}
+
+// SubscribeByName subscribes to the given topic. Predefined topics are
+// recognized using ClientConfig.PredefinedTopics.
+func (c *Client) SubscribeByName(topic string, qos uint8, callback MessageHandlerFunc) error {
+	if topicID, ok := c.cfg.PredefinedTopics.GetTopicID(c.cfg.ClientID, topic); ok {
+		return c.SubscribePredefined(topicID, qos, callback)
+	}
+	return c.Subscribe(topic, qos, callback)
+}
+
+// UnsubscribeByName unsubscribes from the given topic. Predefined topics are
+// recognized using ClientConfig.PredefinedTopics.
+func (c *Client) UnsubscribeByName(topic string) error {
+	if topicID, ok := c.cfg.PredefinedTopics.GetTopicID(c.cfg.ClientID, topic); ok {
+		return c.UnsubscribePredefined(topicID)
+	}
+	return c.Unsubscribe(topic)
+}
+
+// Close disconnects the client from the MQTT-SN gateway and closes all the
+// channels returned by SubscribeChan.
+func (s *SimpleClient) Close() error {
+	err := s.client.Close()
+	s.closeSubscriptions()
+	return err
+}
+
+func (s *SimpleClient) closeSubscriptions() {
+	s.subscriptionsLock.Lock()
+	defer s.subscriptionsLock.Unlock()
+	for _, sub := range s.subscriptions {
+		sub.close()
+	}
+	s.subscriptions = nil
+}
+
+// chanSubscription delivers messages from a MessageHandlerFunc callback to
+// a channel.
+type chanSubscription struct {
+	// Read-locked by message deliveries, write-locked when closing.
+	lock      sync.RWMutex
+	closed    bool
+	closeOnce sync.Once
+	done      chan struct{}
+	ch        chan *Message
+}
+
+func newChanSubscription(buffer int) *chanSubscription {
+	return &chanSubscription{
+		done: make(chan struct{}),
+		ch:   make(chan *Message, buffer),
+	}
+}
+
+// handle implements MessageHandlerFunc.
+func (s *chanSubscription) handle(_ *Client, topic string, msg *msgs.PublishMessage) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if s.closed {
+		return
+	}
+	m := &Message{
+		Topic:   topic,
+		Payload: msg.Data,
+		QOS:     msg.QOS,
+		Retain:  msg.Retain,
+	}
+	select {
+	case s.ch <- m:
+	case <-s.done:
+	}
+}
+
+// close unblocks pending deliveries and closes the channel. It's safe to call
+// close multiple times.
+func (s *chanSubscription) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.closed = true
+		close(s.ch)
+	})
+}
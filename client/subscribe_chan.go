@@ -0,0 +1,70 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+)
+
+// chanSubscriptions holds subscriptions created by Client.SubscribeChan.
+type chanSubscriptions struct {
+	lock sync.Mutex
+	subs map[string]*chanSubscription // topic => subscription
+}
+
+// swap stores the subscription for the topic and returns the previous one.
+func (cs *chanSubscriptions) swap(topic string, sub *chanSubscription) *chanSubscription {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	if cs.subs == nil {
+		cs.subs = make(map[string]*chanSubscription)
+	}
+	previous := cs.subs[topic]
+	if sub == nil {
+		delete(cs.subs, topic)
+	} else {
+		cs.subs[topic] = sub
+	}
+	return previous
+}
+
+// SubscribeChan subscribes to a topic with the provided QoS like Subscribe
+// but the received messages are delivered to the returned channel with the
+// given buffer capacity (zero means unbuffered) instead of a callback. The
+// channel is closed by UnsubscribeChan, by another SubscribeChan call with
+// the same topic or when the client terminates.
+//
+// Messages are not dropped when the channel is full, hence the channel must
+// be drained continuously.
+func (c *Client) SubscribeChan(topic string, qos uint8, buffer int) (<-chan *Message, error) {
+	if buffer < 0 {
+		return nil, fmt.Errorf("invalid channel buffer size: %d", buffer)
+	}
+	sub := newChanSubscription(buffer)
+	if err := c.Subscribe(topic, qos, sub.handle); err != nil {
+		sub.close()
+		return nil, err
+	}
+	if previous := c.chanSubscriptions.swap(topic, sub); previous != nil {
+		previous.close()
+	}
+	go func() {
+		select {
+		case <-c.groupCtx.Done():
+			sub.close()
+		case <-sub.done:
+		}
+	}()
+	return sub.ch, nil
+}
+
+// UnsubscribeChan unsubscribes from a topic subscribed using SubscribeChan
+// and closes the channel the messages were delivered to.
+func (c *Client) UnsubscribeChan(topic string) error {
+	if err := c.Unsubscribe(topic); err != nil {
+		return err
+	}
+	if sub := c.chanSubscriptions.swap(topic, nil); sub != nil {
+		sub.close()
+	}
+	return nil
+}
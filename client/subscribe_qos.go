@@ -0,0 +1,78 @@
+package client
+
+import (
+	"fmt"
+
+	msgs "github.com/energomonitor/bisquitt/messages"
+)
+
+// QOSDowngradePolicy decides what happens when the gateway grants a lower QoS
+// than requested in SUBSCRIBE.
+type QOSDowngradePolicy uint8
+
+const (
+	// QOSDowngradeAccept accepts the granted QoS, the subscription succeeds.
+	QOSDowngradeAccept QOSDowngradePolicy = iota
+	// QOSDowngradeRetry subscribes again requesting the granted QoS. The
+	// subscription succeeds if the gateway grants it.
+	QOSDowngradeRetry
+	// QOSDowngradeFail unsubscribes and the subscription fails with
+	// a *QOSDowngradeError.
+	QOSDowngradeFail
+)
+
+// QOSDowngradeError describes a subscription granted a lower QoS than
+// requested. It's passed to ClientConfig.OnQOSDowngrade and returned by
+// Subscribe if ClientConfig.QOSDowngradePolicy is QOSDowngradeFail.
+type QOSDowngradeError struct {
+	// Subscribed topic filter.
+	Topic     string
+	Requested uint8
+	Granted   uint8
+}
+
+func (e *QOSDowngradeError) Error() string {
+	return fmt.Sprintf("subscription to %q granted QoS %d, requested %d",
+		e.Topic, e.Granted, e.Requested)
+}
+
+// SubscriptionQOS returns the QoS granted by the gateway to the subscription
+// of the given topic filter. Returns false if the topic is not subscribed.
+func (c *Client) SubscriptionQOS(topic string) (uint8, bool) {
+	qos, ok := c.subscriptionQOS.Load(topic)
+	if !ok {
+		return 0, false
+	}
+	return qos.(uint8), true
+}
+
+// grantedQOS records the QoS granted to the subscription of the given topic
+// filter and applies ClientConfig.QOSDowngradePolicy if it's lower than
+// requested.
+func (c *Client) grantedQOS(filter, topicName string, topicIDType msgs.TopicIDType, topicID uint16, requested, granted uint8) error {
+	c.subscriptionQOS.Store(filter, granted)
+	if granted >= requested {
+		return nil
+	}
+
+	err := &QOSDowngradeError{
+		Topic:     filter,
+		Requested: requested,
+		Granted:   granted,
+	}
+	c.log.Info("%s", err)
+	if c.cfg.OnQOSDowngrade != nil {
+		c.cfg.OnQOSDowngrade(err)
+	}
+
+	switch c.cfg.QOSDowngradePolicy {
+	case QOSDowngradeRetry:
+		return c.subscribe(topicName, topicIDType, topicID, granted, nil)
+	case QOSDowngradeFail:
+		if err := c.unsubscribe(topicName, topicIDType, topicID); err != nil {
+			c.log.Error("Cannot unsubscribe from %q: %s", filter, err)
+		}
+		return err
+	}
+	return nil
+}
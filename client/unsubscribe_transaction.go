@@ -2,7 +2,6 @@ package client
 
 import (
 	"fmt"
-	"strings"
 
 	msgs "github.com/energomonitor/bisquitt/messages"
 	"github.com/energomonitor/bisquitt/transactions"
@@ -62,9 +61,7 @@ func (t *unsubscribeTransaction) Unsuback(_ *msgs.UnsubackMessage) {
 		topicName,
 	)
 
-	t.client.messageHandlers.delete(
-		strings.Split(topicName, "/"),
-	)
+	t.client.messageHandlers.delete(topicName)
 
 	t.Success()
 }
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -72,6 +73,75 @@ func handleAction() cli.ActionFunc {
 			predefinedTopics.Merge(v)
 		}
 
+		var filter *gateway.Filter
+		if c.IsSet(FilterFileFlag) {
+			v, err := gateway.ReadFilterFile(c.Path(FilterFileFlag))
+			if err != nil {
+				return fmt.Errorf("cannot read filter file: %s", err)
+			}
+			filter = v
+		}
+
+		var sourceTagger gateway.SourceTagger
+		if c.IsSet(SourceTagsFileFlag) {
+			v, err := gateway.ReadCIDRTagsFile(c.Path(SourceTagsFileFlag))
+			if err != nil {
+				return fmt.Errorf("cannot read source tags file: %s", err)
+			}
+			sourceTagger = v
+		}
+
+		var downlinkPriorities gateway.TopicPriorities
+		if c.IsSet(DownlinkPriorityFlag) {
+			v, err := gateway.ParseTopicPriorityOptions(c.StringSlice(DownlinkPriorityFlag)...)
+			if err != nil {
+				return fmt.Errorf(`parsing "--%s" failed: %s`, DownlinkPriorityFlag, err)
+			}
+			downlinkPriorities = v
+		}
+
+		var retainRules gateway.RetainRules
+		if c.IsSet(RetainRuleFlag) {
+			v, err := gateway.ParseRetainRuleOptions(c.StringSlice(RetainRuleFlag)...)
+			if err != nil {
+				return fmt.Errorf(`parsing "--%s" failed: %s`, RetainRuleFlag, err)
+			}
+			retainRules = v
+		}
+
+		var routes gateway.Routes
+		if c.IsSet(RouteFlag) {
+			v, err := gateway.ParseRouteOptions(c.StringSlice(RouteFlag)...)
+			if err != nil {
+				return fmt.Errorf(`parsing "--%s" failed: %s`, RouteFlag, err)
+			}
+			routes = v
+		}
+
+		var latencySLOs gateway.LatencySLOs
+		if c.IsSet(LatencySLOFlag) {
+			v, err := gateway.ParseLatencySLOOptions(c.StringSlice(LatencySLOFlag)...)
+			if err != nil {
+				return fmt.Errorf(`parsing "--%s" failed: %s`, LatencySLOFlag, err)
+			}
+			latencySLOs = v
+		}
+
+		gatewayID := c.Int(GatewayIDFlag)
+		if gatewayID < 0 || gatewayID > 255 {
+			return fmt.Errorf(`"--%s" out of range: %d`, GatewayIDFlag, gatewayID)
+		}
+
+		mqttKeepAlive := c.Duration(MqttKeepAliveFlag)
+		if mqttKeepAlive < 0 || mqttKeepAlive > gateway.MaxMqttKeepAlive {
+			return fmt.Errorf(`"--%s" out of range: %s`, MqttKeepAliveFlag, mqttKeepAlive)
+		}
+
+		mqttTopicAliases := c.Int(MqttTopicAliasesFlag)
+		if mqttTopicAliases < 0 || mqttTopicAliases > 65535 {
+			return fmt.Errorf(`"--%s" out of range: %d`, MqttTopicAliasesFlag, mqttTopicAliases)
+		}
+
 		host := c.String(HostFlag)
 		port := c.Int(PortFlag)
 		if useDTLS && !c.IsSet(PortFlag) {
@@ -114,9 +184,69 @@ func handleAction() cli.ActionFunc {
 
 		performanceLogTime := c.Duration(PerformanceLogTimeFlag)
 
+		var billingSinks []gateway.BillingSink
+		if c.IsSet(BillingFileFlag) {
+			billingSinks = append(billingSinks, &gateway.FileBillingSink{
+				File: c.Path(BillingFileFlag),
+			})
+		}
+		if c.IsSet(BillingURLFlag) {
+			billingSinks = append(billingSinks, &gateway.HTTPBillingSink{
+				URL: c.String(BillingURLFlag),
+			})
+		}
+		if c.IsSet(BillingTopicFlag) {
+			billingSinks = append(billingSinks, &gateway.MQTTBillingSink{
+				Address:  mqttBrokerAddress,
+				User:     mqttUser,
+				Password: mqttPassword,
+				ClientID: "bisquitt-billing",
+				Topic:    c.String(BillingTopicFlag),
+			})
+		}
+		if len(billingSinks) > 1 {
+			return fmt.Errorf(`options "--%s", "--%s" and "--%s" are mutually exclusive`,
+				BillingFileFlag, BillingURLFlag, BillingTopicFlag)
+		}
+		var billingSink gateway.BillingSink
+		if len(billingSinks) == 1 {
+			billingSink = billingSinks[0]
+		}
+
+		var replicationSink gateway.ReplicationSink
+		if c.IsSet(ReplicationURLFlag) {
+			replicationSink = &gateway.HTTPReplicationSink{
+				URL:    c.String(ReplicationURLFlag),
+				Secret: c.String(ReplicationSecretFlag),
+			}
+		}
+		var standbySessions *gateway.SessionStore
+		if c.IsSet(StandbyListenFlag) {
+			// Replicated sessions are resumed without authentication of
+			// the clients, hence a snapshot must not be accepted from
+			// anyone.
+			if !c.IsSet(ReplicationSecretFlag) && !isLoopbackAddress(c.String(StandbyListenFlag)) {
+				return fmt.Errorf(`option "--%s" is mandatory when "--%s" is not a loopback address`,
+					ReplicationSecretFlag, StandbyListenFlag)
+			}
+			standbySessions = gateway.NewSessionStore()
+			standbySessions.Secret = c.String(ReplicationSecretFlag)
+		}
+
+		var canary *gateway.CanaryConfig
+		if c.Duration(CanaryIntervalFlag) > 0 {
+			canary = &gateway.CanaryConfig{
+				Interval: c.Duration(CanaryIntervalFlag),
+				Topic:    c.String(CanaryTopicFlag),
+			}
+		}
+
 		gwConfig := &gateway.GatewayConfig{
 			MqttBrokerAddress:     mqttBrokerAddress,
 			MqttConnectionTimeout: mqttConnectionTimeout,
+			MqttKeepAlive:         mqttKeepAlive,
+			Mqtt5:                 c.Bool(Mqtt5Flag),
+			MqttTopicAliasMaximum: uint16(mqttTopicAliases),
 			MqttUser:              mqttUser,
 			MqttPassword:          mqttPassword,
 			UseDTLS:               useDTLS,
@@ -128,6 +258,34 @@ func handleAction() cli.ActionFunc {
 			AuthEnabled:           authEnabled,
 			RetryDelay:            10 * time.Second,
 			RetryCount:            4,
+			ShutdownReportFile:    c.Path(ShutdownReportFileFlag),
+			Filter:                filter,
+			DownlinkPriorities:    downlinkPriorities,
+			RetainRules:           retainRules,
+			Routes:                routes,
+			LatencySLOs:           latencySLOs,
+			DownlinkMessageRate:   c.Float64(DownlinkMsgRateFlag),
+			DownlinkByteRate:      c.Int(DownlinkByteRateFlag),
+			BillingSink:           billingSink,
+			BillingInterval:       c.Duration(BillingIntervalFlag),
+			SourceTagger:          sourceTagger,
+			ReplicationSink:       replicationSink,
+			ReplicationInterval:   c.Duration(ReplicationIntervalFlag),
+			StandbySessions:       standbySessions,
+			SysTopics:             c.Bool(SysTopicsFlag),
+			ClientMetadata:        c.Bool(ClientMetadataFlag),
+			StrictSpec:            c.Bool(StrictSpecFlag),
+			StrictConfig:          c.Bool(StrictConfigFlag),
+			SessionTTL:            c.Duration(SessionTTLFlag),
+			DedupWindow:           c.Duration(DedupWindowFlag),
+			Canary:                canary,
+			UnorderedDelivery:     c.Bool(UnorderedDeliveryFlag),
+			CoalesceSize:          c.Int(CoalesceSizeFlag),
+			PushTopics:            c.StringSlice(PushTopicFlag),
+			QuarantineThreshold:   c.Int(QuarantineThresholdFlag),
+			QuarantineWindow:      c.Duration(QuarantineWindowFlag),
+			QuarantineDuration:    c.Duration(QuarantineDurationFlag),
+			GatewayID:             uint8(gatewayID),
 		}
 
 		logTag := "gw"
@@ -193,8 +351,38 @@ func handleAction() cli.ActionFunc {
 			logger.Info("switched to %s:%s", currentUser.Username, currentGroup.Name)
 		}
 
+		if standbySessions != nil {
+			server := &http.Server{
+				Addr:    c.String(StandbyListenFlag),
+				Handler: standbySessions,
+			}
+			go func() {
+				<-ctx.Done()
+				server.Close()
+			}()
+			go func() {
+				if err := server.ListenAndServe(); err != http.ErrServerClosed {
+					logger.Error("Standby sessions server error: %s", err)
+				}
+			}()
+		}
+
 		gw := gateway.NewGateway(logger, gwConfig)
 
 		return gw.ListenAndServe(ctx, fmt.Sprintf("%s:%d", host, port))
 	}
 }
+
+// isLoopbackAddress returns true if the "host:port" address is bound to
+// a loopback interface.
+func isLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
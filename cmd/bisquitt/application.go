@@ -16,6 +16,9 @@ const (
 	MqttPasswordFlag         = "mqtt-password"
 	MqttPasswordFileFlag     = "mqtt-password-file"
 	MqttTimeoutFlag          = "mqtt-timeout"
+	MqttKeepAliveFlag        = "mqtt-keepalive"
+	Mqtt5Flag                = "mqtt5"
+	MqttTopicAliasesFlag     = "mqtt-topic-aliases"
 	HostFlag                 = "host"
 	PortFlag                 = "port"
 	DtlsFlag                 = "dtls"
@@ -31,6 +34,38 @@ const (
 	AuthFlag                 = "auth"
 	UserFlag                 = "user"
 	GroupFlag                = "group"
+	ShutdownReportFileFlag   = "shutdown-report-file"
+	FilterFileFlag           = "filter-file"
+	DownlinkPriorityFlag     = "downlink-priority"
+	RetainRuleFlag           = "retain-rule"
+	RouteFlag                = "route"
+	LatencySLOFlag           = "latency-slo"
+	DownlinkMsgRateFlag      = "downlink-msg-rate"
+	DownlinkByteRateFlag     = "downlink-byte-rate"
+	BillingFileFlag          = "billing-file"
+	BillingURLFlag           = "billing-url"
+	BillingTopicFlag         = "billing-topic"
+	BillingIntervalFlag      = "billing-interval"
+	SourceTagsFileFlag       = "source-tags-file"
+	ReplicationURLFlag       = "replication-url"
+	ReplicationIntervalFlag  = "replication-interval"
+	StandbyListenFlag        = "standby-listen"
+	ReplicationSecretFlag    = "replication-secret"
+	SysTopicsFlag            = "sys-topics"
+	ClientMetadataFlag       = "client-metadata"
+	StrictSpecFlag           = "strict-spec"
+	StrictConfigFlag         = "strict-config"
+	SessionTTLFlag           = "session-ttl"
+	DedupWindowFlag          = "dedup-window"
+	CanaryIntervalFlag       = "canary-interval"
+	CanaryTopicFlag          = "canary-topic"
+	UnorderedDeliveryFlag    = "unordered-delivery"
+	CoalesceSizeFlag         = "coalesce-size"
+	PushTopicFlag            = "push-topic"
+	QuarantineThresholdFlag  = "quarantine-threshold"
+	QuarantineWindowFlag     = "quarantine-window"
+	QuarantineDurationFlag   = "quarantine-duration"
+	GatewayIDFlag            = "gateway-id"
 )
 
 var Application = cli.App{
@@ -85,6 +120,29 @@ var Application = cli.App{
 				"MQTT_TIMEOUT",
 			},
 		},
+		&cli.DurationFlag{
+			Name:  MqttKeepAliveFlag,
+			Usage: "MQTT keepalive overriding the one requested by clients, at most 65535s (0 = use the client's keepalive)",
+			Value: 0,
+			EnvVars: []string{
+				"MQTT_KEEPALIVE",
+			},
+		},
+		&cli.BoolFlag{
+			Name:  Mqtt5Flag,
+			Usage: "connect to the MQTT broker using MQTT 5 and use topic aliases",
+			EnvVars: []string{
+				"MQTT5",
+			},
+		},
+		&cli.IntFlag{
+			Name:  MqttTopicAliasesFlag,
+			Usage: "number of topic aliases the MQTT broker may use when sending to the gateway (MQTT 5 only, 0-65535)",
+			Value: 0,
+			EnvVars: []string{
+				"MQTT_TOPIC_ALIASES",
+			},
+		},
 		&cli.StringFlag{
 			Name:  HostFlag,
 			Usage: "host to listen on",
@@ -198,6 +256,243 @@ var Application = cli.App{
 			},
 			Hidden: !platform.HasSetGroup(),
 		},
+		&cli.PathFlag{
+			Name:  ShutdownReportFileFlag,
+			Usage: "file to write a JSON activity report to on shutdown",
+			EnvVars: []string{
+				"SHUTDOWN_REPORT_FILE",
+			},
+		},
+		&cli.PathFlag{
+			Name:  FilterFileFlag,
+			Usage: "file with rules filtering messages published by clients",
+			EnvVars: []string{
+				"FILTER_FILE",
+			},
+		},
+		&cli.StringSliceFlag{
+			Name:  DownlinkPriorityFlag,
+			Usage: "priority of messages delivered to waking clients, higher first (format: topic;priority)",
+			EnvVars: []string{
+				"DOWNLINK_PRIORITY",
+			},
+		},
+		&cli.StringSliceFlag{
+			Name:  RetainRuleFlag,
+			Usage: "strip or force the retain flag of messages published by clients (format: topic;strip or topic;force)",
+			EnvVars: []string{
+				"RETAIN_RULE",
+			},
+		},
+		&cli.StringSliceFlag{
+			Name:  RouteFlag,
+			Usage: "send clients' messages and subscriptions on a topic to another MQTT broker (format: topic;host:port[;maxqos[;user[;password]]]; the default broker's credentials are not sent to the route's broker)",
+			EnvVars: []string{
+				"ROUTE",
+			},
+		},
+		&cli.StringSliceFlag{
+			Name:  LatencySLOFlag,
+			Usage: "alert when the percentile of broker acknowledgement latencies of clients' QoS 1 messages on a topic exceeds the objective (format: topic;percentile;latency, e.g. sensors/#;99;500ms)",
+			EnvVars: []string{
+				"LATENCY_SLO",
+			},
+		},
+		&cli.Float64Flag{
+			Name:  DownlinkMsgRateFlag,
+			Usage: "maximum messages per second sent to a client, excess QoS 0 messages are dropped (0 = unlimited)",
+			Value: 0,
+			EnvVars: []string{
+				"DOWNLINK_MSG_RATE",
+			},
+		},
+		&cli.IntFlag{
+			Name:  DownlinkByteRateFlag,
+			Usage: "maximum bytes per second of messages sent to a client, excess QoS 0 messages are dropped (0 = unlimited)",
+			Value: 0,
+			EnvVars: []string{
+				"DOWNLINK_BYTE_RATE",
+			},
+		},
+		&cli.PathFlag{
+			Name:  BillingFileFlag,
+			Usage: "file to append per-client byte counts to (JSON lines)",
+			EnvVars: []string{
+				"BILLING_FILE",
+			},
+		},
+		&cli.StringFlag{
+			Name:  BillingURLFlag,
+			Usage: "URL to POST per-client byte counts to",
+			EnvVars: []string{
+				"BILLING_URL",
+			},
+		},
+		&cli.StringFlag{
+			Name:  BillingTopicFlag,
+			Usage: "MQTT topic to publish per-client byte counts to",
+			EnvVars: []string{
+				"BILLING_TOPIC",
+			},
+		},
+		&cli.DurationFlag{
+			Name:  BillingIntervalFlag,
+			Usage: "per-client byte counts flush interval",
+			Value: time.Minute,
+			EnvVars: []string{
+				"BILLING_INTERVAL",
+			},
+		},
+		&cli.PathFlag{
+			Name:  SourceTagsFileFlag,
+			Usage: "file with rules tagging clients by their source address (CIDR)",
+			EnvVars: []string{
+				"SOURCE_TAGS_FILE",
+			},
+		},
+		&cli.StringFlag{
+			Name:  ReplicationURLFlag,
+			Usage: "URL of a standby gateway to replicate client sessions to",
+			EnvVars: []string{
+				"REPLICATION_URL",
+			},
+		},
+		&cli.DurationFlag{
+			Name:  ReplicationIntervalFlag,
+			Usage: "client sessions replication interval",
+			Value: time.Second,
+			EnvVars: []string{
+				"REPLICATION_INTERVAL",
+			},
+		},
+		&cli.StringFlag{
+			Name:  StandbyListenFlag,
+			Usage: "HTTP address to receive client sessions replicated from an active gateway on (host:port)",
+			EnvVars: []string{
+				"STANDBY_LISTEN",
+			},
+		},
+		&cli.StringFlag{
+			Name:  ReplicationSecretFlag,
+			Usage: "shared secret authenticating client sessions replication (mandatory if the standby address is not a loopback one)",
+			EnvVars: []string{
+				"REPLICATION_SECRET",
+			},
+		},
+		&cli.BoolFlag{
+			Name:  SysTopicsFlag,
+			Usage: `serve gateway statistics on "$SYS/bisquitt/#" topics to clients`,
+			EnvVars: []string{
+				"SYS_TOPICS",
+			},
+		},
+		&cli.BoolFlag{
+			Name:  ClientMetadataFlag,
+			Usage: `accept client metadata (JSON object) published to "$SYS/bisquitt/metadata"`,
+			EnvVars: []string{
+				"CLIENT_METADATA",
+			},
+		},
+		&cli.BoolFlag{
+			Name:  StrictSpecFlag,
+			Usage: "refuse client messages deviating from the MQTT-SN specification instead of tolerating them",
+			EnvVars: []string{
+				"STRICT_SPEC",
+			},
+		},
+		&cli.BoolFlag{
+			Name:  StrictConfigFlag,
+			Usage: "refuse to start if the configuration self-check finds any problem instead of logging warnings",
+			EnvVars: []string{
+				"STRICT_CONFIG",
+			},
+		},
+		&cli.DurationFlag{
+			Name:  SessionTTLFlag,
+			Usage: "purge sessions of clients inactive for this long (0 = never)",
+			Value: 0,
+			EnvVars: []string{
+				"SESSION_TTL",
+			},
+		},
+		&cli.DurationFlag{
+			Name:  DedupWindowFlag,
+			Usage: "do not forward retransmissions of QoS 1 messages acknowledged within this window (0 = disabled)",
+			Value: 0,
+			EnvVars: []string{
+				"DEDUP_WINDOW",
+			},
+		},
+		&cli.DurationFlag{
+			Name:  CanaryIntervalFlag,
+			Usage: "interval of synthetic client end-to-end checks (0 = disabled)",
+			Value: 0,
+			EnvVars: []string{
+				"CANARY_INTERVAL",
+			},
+		},
+		&cli.StringFlag{
+			Name:  CanaryTopicFlag,
+			Usage: "MQTT topic used by the synthetic client",
+			Value: "bisquitt/canary",
+			EnvVars: []string{
+				"CANARY_TOPIC",
+			},
+		},
+		&cli.BoolFlag{
+			Name:  UnorderedDeliveryFlag,
+			Usage: "do not keep the order of messages on a topic delivered to a client (higher throughput)",
+			EnvVars: []string{
+				"UNORDERED_DELIVERY",
+			},
+		},
+		&cli.IntFlag{
+			Name:  CoalesceSizeFlag,
+			Usage: "pack messages buffered for a sleeping client into datagrams of at most this size (0 = disabled)",
+			Value: 0,
+			EnvVars: []string{
+				"COALESCE_SIZE",
+			},
+		},
+		&cli.StringSliceFlag{
+			Name:  PushTopicFlag,
+			Usage: "topic registered to every client right after it connects (can be repeated)",
+			EnvVars: []string{
+				"PUSH_TOPIC",
+			},
+		},
+		&cli.IntFlag{
+			Name:  QuarantineThresholdFlag,
+			Usage: "refuse clients whose handlers panicked this many times within quarantine-window (0 = disabled)",
+			Value: 0,
+			EnvVars: []string{
+				"QUARANTINE_THRESHOLD",
+			},
+		},
+		&cli.DurationFlag{
+			Name:  QuarantineWindowFlag,
+			Usage: "time window in which client handler panics are counted",
+			Value: time.Hour,
+			EnvVars: []string{
+				"QUARANTINE_WINDOW",
+			},
+		},
+		&cli.DurationFlag{
+			Name:  QuarantineDurationFlag,
+			Usage: "how long a client is refused after reaching quarantine-threshold",
+			Value: time.Hour,
+			EnvVars: []string{
+				"QUARANTINE_DURATION",
+			},
+		},
+		&cli.IntFlag{
+			Name:  GatewayIDFlag,
+			Usage: "gateway ID sent to clients searching for a gateway (0-255)",
+			Value: 0,
+			EnvVars: []string{
+				"GATEWAY_ID",
+			},
+		},
 	},
 	HideHelpCommand: true,
 	Action:          handleAction(),
@@ -0,0 +1,259 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	mqttPackets "github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Default interval of billing records flushing (see
+// GatewayConfig.BillingInterval).
+const defaultBillingInterval = time.Minute
+
+// Maximum time a BillingSink is given to flush a record.
+const billingFlushTimeout = 30 * time.Second
+
+// ByteCount is the number of bytes transferred over the MQTT-SN connection
+// of a single client. Only the MQTT-SN messages are counted, i.e. without
+// UDP, IP and DTLS overhead.
+type ByteCount struct {
+	ClientID string `json:"client_id"`
+	// Bytes received from the client.
+	BytesIn uint64 `json:"bytes_in"`
+	// Bytes sent to the client.
+	BytesOut uint64 `json:"bytes_out"`
+}
+
+// BillingRecord contains bytes transferred per ClientID since the previous
+// record.
+type BillingRecord struct {
+	From   time.Time   `json:"from"`
+	To     time.Time   `json:"to"`
+	Counts []ByteCount `json:"counts"`
+}
+
+// BillingSink stores billing records.
+type BillingSink interface {
+	Flush(ctx context.Context, record *BillingRecord) error
+}
+
+// FileBillingSink appends billing records to a file, one JSON document per
+// line.
+type FileBillingSink struct {
+	File string
+}
+
+func (s *FileBillingSink) Flush(ctx context.Context, record *BillingRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// HTTPBillingSink POSTs billing records in JSON format to the given URL.
+type HTTPBillingSink struct {
+	URL string
+	// http.DefaultClient is used if nil.
+	Client *http.Client
+}
+
+func (s *HTTPBillingSink) Flush(ctx context.Context, record *BillingRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("billing sink %s: unexpected status %s", s.URL, resp.Status)
+	}
+	return nil
+}
+
+// MQTTBillingSink publishes billing records in JSON format to the given
+// topic of an MQTT broker. A new MQTT connection is established for
+// every record.
+type MQTTBillingSink struct {
+	Address  *net.TCPAddr
+	User     *string
+	Password []byte
+	ClientID string
+	Topic    string
+}
+
+func (s *MQTTBillingSink) Flush(ctx context.Context, record *BillingRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", s.Address.String())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	connect := mqttPackets.NewControlPacket(mqttPackets.Connect).(*mqttPackets.ConnectPacket)
+	connect.ProtocolName = "MQTT"
+	connect.ProtocolVersion = 4
+	connect.ClientIdentifier = s.ClientID
+	connect.CleanSession = true
+	connect.Keepalive = uint16(billingFlushTimeout / time.Second)
+	if s.User != nil {
+		connect.UsernameFlag = true
+		connect.Username = *s.User
+	}
+	if s.Password != nil {
+		connect.PasswordFlag = true
+		connect.Password = s.Password
+	}
+	if err := connect.Write(conn); err != nil {
+		return err
+	}
+	reply, err := mqttPackets.ReadPacket(conn)
+	if err != nil {
+		return err
+	}
+	connack, ok := reply.(*mqttPackets.ConnackPacket)
+	if !ok {
+		return fmt.Errorf("billing sink: unexpected MQTT packet %v", reply)
+	}
+	if connack.ReturnCode != mqttPackets.Accepted {
+		return fmt.Errorf("billing sink: MQTT connection refused: %s",
+			mqttPackets.ConnackReturnCodes[connack.ReturnCode])
+	}
+
+	publish := mqttPackets.NewControlPacket(mqttPackets.Publish).(*mqttPackets.PublishPacket)
+	publish.TopicName = s.Topic
+	publish.Payload = data
+	if err := publish.Write(conn); err != nil {
+		return err
+	}
+	return mqttPackets.NewControlPacket(mqttPackets.Disconnect).Write(conn)
+}
+
+// byteMeter accumulates bytes transferred per ClientID between flushes.
+// It's safe for concurrent use.
+type byteMeter struct {
+	lock   sync.Mutex
+	since  time.Time
+	counts map[string]*ByteCount
+}
+
+func newByteMeter() *byteMeter {
+	return &byteMeter{
+		since:  time.Now(),
+		counts: make(map[string]*ByteCount),
+	}
+}
+
+func (m *byteMeter) add(clientID string, in, out uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	c, ok := m.counts[clientID]
+	if !ok {
+		c = &ByteCount{ClientID: clientID}
+		m.counts[clientID] = c
+	}
+	c.BytesIn += in
+	c.BytesOut += out
+}
+
+// take returns a record of the bytes accumulated since the previous call
+// and resets the counters.
+func (m *byteMeter) take() *BillingRecord {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	now := time.Now()
+	r := &BillingRecord{
+		From:   m.since,
+		To:     now,
+		Counts: make([]ByteCount, 0, len(m.counts)),
+	}
+	for _, c := range m.counts {
+		r.Counts = append(r.Counts, *c)
+	}
+	sort.Slice(r.Counts, func(i, j int) bool {
+		return r.Counts[i].ClientID < r.Counts[j].ClientID
+	})
+	m.since = now
+	m.counts = make(map[string]*ByteCount)
+	return r
+}
+
+// restore returns counts of a record which could not be flushed to the
+// meter so that they are not lost.
+func (m *byteMeter) restore(r *BillingRecord) {
+	for _, c := range r.Counts {
+		m.add(c.ClientID, c.BytesIn, c.BytesOut)
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if r.From.Before(m.since) {
+		m.since = r.From
+	}
+}
+
+// flushBilling passes the accumulated byte counts to the billing sink.
+func (gw *Gateway) flushBilling() {
+	record := gw.meter.take()
+	if len(record.Counts) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), billingFlushTimeout)
+	defer cancel()
+	if err := gw.cfg.BillingSink.Flush(ctx, record); err != nil {
+		gw.log.Error("Cannot flush billing record: %s", err)
+		gw.meter.restore(record)
+	}
+}
+
+func (gw *Gateway) billingLoop(ctx context.Context) {
+	interval := gw.cfg.BillingInterval
+	if interval <= 0 {
+		interval = defaultBillingInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			gw.flushBilling()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -23,11 +23,11 @@ func newBrokerPublishQOS1Transaction(ctx context.Context, h *handler, msgID uint
 		},
 	}
 	t.RetryTransaction = transactions.NewRetryTransaction(
-		ctx, h.cfg.RetryDelay, h.cfg.RetryCount, t.resend,
-		func() {
+		ctx, h.cfg.RetryDelay, h.cfg.RetryCount, h.guardRetry(t.resend),
+		h.guardFinally(func() {
 			h.transactions.Delete(msgID)
 			tLog.Debug("Deleted.")
-		},
+		}),
 	)
 	return t
 }
@@ -0,0 +1,207 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/energomonitor/bisquitt/client"
+	snMsgs "github.com/energomonitor/bisquitt/messages"
+	"github.com/energomonitor/bisquitt/util"
+)
+
+// Default canary settings (see CanaryConfig).
+const (
+	defaultCanaryInterval = time.Minute
+	defaultCanaryTimeout  = 10 * time.Second
+	defaultCanaryClientID = "bisquitt-canary"
+	defaultCanaryTopic    = "bisquitt/canary"
+)
+
+var ErrCanaryTimeout = errors.New("canary message not received")
+
+// CanaryConfig configures a synthetic MQTT-SN client run periodically by the
+// gateway against its own listener. Every run connects, subscribes to Topic,
+// publishes a message to it with QoS 1 and waits until the message is
+// delivered back by the MQTT broker. Hence, the whole path client -> gateway
+// -> broker -> gateway -> client is checked.
+//
+// The canary is counted as a regular client in the Report.
+type CanaryConfig struct {
+	// Interval between runs (one minute if zero).
+	Interval time.Duration
+	// Maximum duration of a single run step (ten seconds if zero).
+	Timeout  time.Duration
+	ClientID string
+	Topic    string
+	// Credentials used if authentication is enabled.
+	User     string
+	Password []byte
+}
+
+// CanaryStatus summarizes the canary runs.
+type CanaryStatus struct {
+	Runs     uint64 `json:"runs"`
+	Failures uint64 `json:"failures"`
+	// Time of the last run.
+	LastRun time.Time `json:"last_run"`
+	// Round-trip time of the last successful run's message.
+	LastLatency time.Duration `json:"last_latency_ns"`
+	// Error of the last run, empty if successful.
+	LastError string `json:"last_error,omitempty"`
+}
+
+type canary struct {
+	cfg     CanaryConfig
+	gwCfg   *GatewayConfig
+	address string
+	log     util.Logger
+
+	lock   sync.Mutex
+	status CanaryStatus
+}
+
+func newCanary(cfg CanaryConfig, gwCfg *GatewayConfig, listenAddr net.Addr, log util.Logger) *canary {
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultCanaryInterval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultCanaryTimeout
+	}
+	if cfg.ClientID == "" {
+		cfg.ClientID = defaultCanaryClientID
+	}
+	if cfg.Topic == "" {
+		cfg.Topic = defaultCanaryTopic
+	}
+	address := listenAddr.String()
+	if udpAddr, ok := listenAddr.(*net.UDPAddr); ok && udpAddr.IP.IsUnspecified() {
+		address = net.JoinHostPort("127.0.0.1", strconv.Itoa(udpAddr.Port))
+	}
+	return &canary{
+		cfg:     cfg,
+		gwCfg:   gwCfg,
+		address: address,
+		log:     log,
+	}
+}
+
+func (c *canary) loop(ctx context.Context) {
+	ticker := time.NewTicker(c.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			latency, err := c.run(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			c.record(latency, err)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *canary) record(latency time.Duration, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.status.Runs++
+	c.status.LastRun = time.Now()
+	if err != nil {
+		c.log.Error("Canary run failed: %s", err)
+		c.status.Failures++
+		c.status.LastError = err.Error()
+		return
+	}
+	c.log.Debug("Canary run succeeded in %s", latency)
+	c.status.LastLatency = latency
+	c.status.LastError = ""
+}
+
+func (c *canary) get() CanaryStatus {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.status
+}
+
+// run performs a single canary run and returns the message round-trip time.
+func (c *canary) run(ctx context.Context) (time.Duration, error) {
+	keepAlive := c.cfg.Timeout * 2
+	if keepAlive < time.Second {
+		keepAlive = time.Second
+	}
+	clientCfg := &client.ClientConfig{
+		UseDTLS:        c.gwCfg.UseDTLS,
+		SelfSigned:     true,
+		Insecure:       true,
+		ClientID:       c.cfg.ClientID,
+		CleanSession:   true,
+		KeepAlive:      keepAlive,
+		ConnectTimeout: c.cfg.Timeout,
+		RetryDelay:     c.cfg.Timeout,
+		RetryCount:     0,
+	}
+	if c.gwCfg.AuthEnabled {
+		clientCfg.User = c.cfg.User
+		clientCfg.Password = c.cfg.Password
+	}
+	cl := client.NewClient(c.log.WithTag("client"), clientCfg)
+	if err := cl.Dial(c.address); err != nil {
+		return 0, fmt.Errorf("dial: %s", err)
+	}
+	defer cl.Close()
+
+	if err := cl.Connect(); err != nil {
+		return 0, fmt.Errorf("connect: %s", err)
+	}
+	received := make(chan struct{}, 1)
+	payload := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+	callback := func(_ *client.Client, _ string, msg *snMsgs.PublishMessage) {
+		if string(msg.Data) != string(payload) {
+			return
+		}
+		select {
+		case received <- struct{}{}:
+		default:
+		}
+	}
+	if err := cl.Subscribe(c.cfg.Topic, 1, callback); err != nil {
+		return 0, fmt.Errorf("subscribe: %s", err)
+	}
+	if err := cl.Register(c.cfg.Topic); err != nil {
+		return 0, fmt.Errorf("register: %s", err)
+	}
+	start := time.Now()
+	if err := cl.Publish(c.cfg.Topic, 1, false, payload); err != nil {
+		return 0, fmt.Errorf("publish: %s", err)
+	}
+	select {
+	case <-received:
+	case <-time.After(c.cfg.Timeout):
+		return 0, ErrCanaryTimeout
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	latency := time.Since(start)
+	if err := cl.Unsubscribe(c.cfg.Topic); err != nil {
+		return 0, fmt.Errorf("unsubscribe: %s", err)
+	}
+	return latency, nil
+}
+
+// Canary returns the status of the canary client. Returns false if the canary
+// is not enabled or the gateway is not listening yet.
+func (gw *Gateway) Canary() (CanaryStatus, bool) {
+	gw.canaryLock.Lock()
+	c := gw.canary
+	gw.canaryLock.Unlock()
+	if c == nil {
+		return CanaryStatus{}, false
+	}
+	return c.get(), true
+}
@@ -20,6 +20,8 @@ package gateway
 import (
 	"context"
 	"fmt"
+	"sync/atomic"
+	"time"
 
 	mqttPackets "github.com/eclipse/paho.mqtt.golang/packets"
 	snMsgs "github.com/energomonitor/bisquitt/messages"
@@ -32,23 +34,44 @@ type clientPublishQOS1Transaction struct {
 	handler *handler
 	log     util.Logger
 	topicID uint16
+	// See dedup.go.
+	dedupKey dedupKey
+	// See slo.go.
+	topic   string
+	started time.Time
+	// Set to 1 when the MQTT broker's PUBACK is received.
+	acknowledged int32
 }
 
-func newClientPublishQOS1Transaction(ctx context.Context, h *handler, msgID uint16, topicID uint16) *clientPublishQOS1Transaction {
+func newClientPublishQOS1Transaction(ctx context.Context, h *handler, snPublish *snMsgs.PublishMessage, topic string) *clientPublishQOS1Transaction {
+	msgID := snPublish.MessageID()
 	tLog := h.log.WithTag(fmt.Sprintf("PUBLISH1c(%d)", msgID))
 	tLog.Debug("Created.")
-	return &clientPublishQOS1Transaction{
-		TimedTransaction: transactions.NewTimedTransaction(
-			ctx, h.cfg.RetryDelay,
-			func() {
-				h.transactions.Delete(msgID)
-				tLog.Debug("Deleted.")
-			},
-		),
-		handler: h,
-		log:     tLog,
-		topicID: topicID,
+	t := &clientPublishQOS1Transaction{
+		handler:  h,
+		log:      tLog,
+		topicID:  snPublish.TopicID,
+		dedupKey: h.dedupKey(snPublish, topic),
+		topic:    topic,
+		started:  time.Now(),
 	}
+	t.TimedTransaction = transactions.NewTimedTransaction(
+		ctx, h.cfg.RetryDelay,
+		h.guardFinally(func() {
+			h.transactions.Delete(msgID)
+			if atomic.LoadInt32(&t.acknowledged) == 0 {
+				// Not acknowledged by the MQTT broker in time, the
+				// latency is at least RetryDelay.
+				latency := time.Since(t.started)
+				if latency < h.cfg.RetryDelay {
+					latency = h.cfg.RetryDelay
+				}
+				h.cfg.SLO.observe(topic, latency)
+			}
+			tLog.Debug("Deleted.")
+		}),
+	)
+	return t
 }
 
 func (t *clientPublishQOS1Transaction) Puback(mqPuback *mqttPackets.PubackPacket) error {
@@ -57,6 +80,9 @@ func (t *clientPublishQOS1Transaction) Puback(mqPuback *mqttPackets.PubackPacket
 	// See MQTT-SN specification v. 1.2, chapter 5.4.13.
 	snPuback := snMsgs.NewPubackMessage(t.topicID, snMsgs.RC_ACCEPTED)
 	snPuback.SetMessageID(mqPuback.MessageID)
+	atomic.StoreInt32(&t.acknowledged, 1)
 	t.Success()
+	t.handler.cfg.Dedup.acknowledged(t.dedupKey)
+	t.handler.cfg.SLO.observe(t.topic, time.Since(t.started))
 	return t.handler.snSend(snPuback)
 }
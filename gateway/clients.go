@@ -0,0 +1,235 @@
+package gateway
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/energomonitor/bisquitt/util"
+)
+
+// EventType identifies a client-related event passed to EventHook.
+type EventType uint8
+
+const (
+	// The client's state has changed (see ClientInfo.State).
+	EventStateChanged EventType = iota
+	// The client's handler has quit and the client is no longer served.
+	EventClosed
+	// The client's session has been taken over from the active gateway
+	// (see SessionStore).
+	EventSessionRestored
+	// The client has published its metadata (see ClientInfo.Metadata).
+	EventMetadataChanged
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventStateChanged:
+		return "state changed"
+	case EventClosed:
+		return "closed"
+	case EventSessionRestored:
+		return "session restored"
+	case EventMetadataChanged:
+		return "metadata changed"
+	default:
+		return fmt.Sprintf("unknown (%d)", t)
+	}
+}
+
+// Event is a client-related event passed to EventHook.
+type Event struct {
+	Type   EventType
+	Time   time.Time
+	Client ClientInfo
+}
+
+// EventHook is called synchronously from the client's handler, hence it must
+// not block.
+type EventHook func(Event)
+
+// ClientInfo is a point-in-time snapshot of a client served by the gateway.
+// It can be used by external systems to implement custom liveness policies.
+type ClientInfo struct {
+	// Handler ID, i.e. the client's remote address.
+	ID       string
+	ClientID string
+	State    util.ClientState
+	// Time the handler was started.
+	ConnectedAt time.Time
+	// Time the last message was received from the client.
+	LastActivity     time.Time
+	MessagesReceived uint64
+	MessagesSent     uint64
+	BytesReceived    uint64
+	BytesSent        uint64
+	// Tags derived from the client's source address (see SourceTagger).
+	Tags map[string]string
+	// Metadata published by the client (see MetadataTopic).
+	Metadata map[string]string
+}
+
+// clientActivity tracks the client's activity. It's safe for concurrent use.
+type clientActivity struct {
+	lock         sync.Mutex
+	clientID     string
+	connectedAt  time.Time
+	lastActivity time.Time
+	msgsReceived uint64
+	msgsSent     uint64
+	// Set before the handler starts, read-only then.
+	tags     map[string]string
+	metadata map[string]string
+	bytesIn  uint64
+	bytesOut uint64
+	// If set, transferred bytes are billed to the ClientID. Bytes
+	// transferred before the ClientID is known are billed once it's set.
+	meter       *byteMeter
+	unbilledIn  uint64
+	unbilledOut uint64
+}
+
+func newClientActivity() *clientActivity {
+	now := time.Now()
+	return &clientActivity{
+		connectedAt:  now,
+		lastActivity: now,
+	}
+}
+
+func (a *clientActivity) setClientID(clientID string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.clientID = clientID
+	if a.meter != nil && (a.unbilledIn > 0 || a.unbilledOut > 0) {
+		a.meter.add(clientID, a.unbilledIn, a.unbilledOut)
+		a.unbilledIn, a.unbilledOut = 0, 0
+	}
+}
+
+func (a *clientActivity) client() string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.clientID
+}
+
+func (a *clientActivity) setMetadata(metadata map[string]string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.metadata = metadata
+}
+
+func (a *clientActivity) messageReceived(size int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.lastActivity = time.Now()
+	a.msgsReceived++
+	a.bytesIn += uint64(size)
+	a.bill(uint64(size), 0)
+}
+
+func (a *clientActivity) last() time.Time {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.lastActivity
+}
+
+func (a *clientActivity) messageSent(size int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.msgsSent++
+	a.bytesOut += uint64(size)
+	a.bill(0, uint64(size))
+}
+
+// Must be called with the lock held.
+func (a *clientActivity) bill(in, out uint64) {
+	if a.meter == nil {
+		return
+	}
+	if a.clientID == "" {
+		a.unbilledIn += in
+		a.unbilledOut += out
+		return
+	}
+	a.meter.add(a.clientID, in, out)
+}
+
+func (h *handler) clientInfo() ClientInfo {
+	a := h.activity
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	var tags map[string]string
+	if a.tags != nil {
+		tags = make(map[string]string, len(a.tags))
+		for k, v := range a.tags {
+			tags[k] = v
+		}
+	}
+	return ClientInfo{
+		ID:               h.id,
+		ClientID:         a.clientID,
+		State:            h.state.Get(),
+		ConnectedAt:      a.connectedAt,
+		LastActivity:     a.lastActivity,
+		MessagesReceived: a.msgsReceived,
+		MessagesSent:     a.msgsSent,
+		BytesReceived:    a.bytesIn,
+		BytesSent:        a.bytesOut,
+		Tags:             tags,
+		Metadata:         copyMetadata(a.metadata),
+	}
+}
+
+func (h *handler) emit(eventType EventType) {
+	if h.cfg.EventHook == nil {
+		return
+	}
+	h.cfg.EventHook(Event{
+		Type:   eventType,
+		Time:   time.Now(),
+		Client: h.clientInfo(),
+	})
+}
+
+// Clients returns snapshots of all the clients currently served by the
+// gateway, sorted by ID.
+func (gw *Gateway) Clients() []ClientInfo {
+	var clients []ClientInfo
+	gw.clients.Range(func(_, value interface{}) bool {
+		clients = append(clients, value.(*handler).clientInfo())
+		return true
+	})
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].ID < clients[j].ID
+	})
+	return clients
+}
+
+// Client returns a snapshot of the client with the given ID (see
+// ClientInfo.ID).
+func (gw *Gateway) Client(id string) (ClientInfo, bool) {
+	value, ok := gw.clients.Load(id)
+	if !ok {
+		return ClientInfo{}, false
+	}
+	return value.(*handler).clientInfo(), true
+}
+
+// ClientLog returns recent log lines of the client with the given ID (see
+// ClientInfo.ID), including the debug ones, the oldest first. Returns false
+// if the client is not served or the log capture is disabled (see
+// GatewayConfig.ClientLogSize).
+func (gw *Gateway) ClientLog(id string) ([]util.LogLine, bool) {
+	value, ok := gw.clients.Load(id)
+	if !ok {
+		return nil, false
+	}
+	ring := value.(*handler).logRing
+	if ring == nil {
+		return nil, false
+	}
+	return ring.Lines(), true
+}
@@ -0,0 +1,53 @@
+package gateway
+
+import (
+	"bytes"
+
+	snMsgs "github.com/energomonitor/bisquitt/messages"
+)
+
+// snSendCoalesced sends the messages packed into as few datagrams as
+// possible, none of them longer than handlerConfig.CoalesceSize (a message
+// longer than that is sent in a datagram of its own). Every MQTT-SN message
+// starts with its length, hence the receiver can split the datagrams again.
+//
+// Must not be called in the asleep state, the messages would not be queued.
+func (h *handler) snSendCoalesced(msgs []snMsgs.Message) error {
+	var datagram bytes.Buffer
+	var sizes []int
+	var types []snMsgs.MessageType
+
+	flush := func() error {
+		if datagram.Len() == 0 {
+			return nil
+		}
+		if _, err := h.snConn.Write(datagram.Bytes()); err != nil {
+			return err
+		}
+		for i, size := range sizes {
+			h.stats.messageSent(types[i])
+			h.activity.messageSent(size)
+		}
+		datagram.Reset()
+		sizes = sizes[:0]
+		types = types[:0]
+		return nil
+	}
+
+	for _, msg := range msgs {
+		h.log.Debug("<- %v", msg)
+		buff := &bytes.Buffer{}
+		if err := msg.Write(buff); err != nil {
+			return err
+		}
+		if datagram.Len()+buff.Len() > h.cfg.CoalesceSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		datagram.Write(buff.Bytes())
+		sizes = append(sizes, buff.Len())
+		types = append(types, msg.MessageType())
+	}
+	return flush()
+}
@@ -35,10 +35,10 @@ func newConnectTransaction(ctx context.Context, h *handler, authEnabled bool, mq
 	return &connectTransaction{
 		TimedTransaction: transactions.NewTimedTransaction(
 			ctx, connectTransactionTimeout,
-			func() {
+			h.guardFinally(func() {
 				h.transactions.DeleteByType(snMsgs.CONNECT)
 				tLog.Debug("Deleted.")
-			},
+			}),
 		),
 		handler:     h,
 		log:         tLog,
@@ -142,6 +142,9 @@ func (t *connectTransaction) Connack(mqConnack *mqttPackets.ConnackPacket) error
 		return err
 	}
 
+	if !t.mqConnect.CleanSession {
+		t.handler.stats.count(&t.handler.stats.persistSessions)
+	}
 	// Must be set before snSend to avoid race condition in tests.
 	t.handler.setState(util.StateActive)
 	if err := t.SendConnack(snMsgs.RC_ACCEPTED); err != nil {
@@ -0,0 +1,119 @@
+// QoS 1 replay protection.
+//
+// If the PUBACK sent by the gateway to a client is lost, the client
+// retransmits the QoS 1 PUBLISH and the gateway forwards it to the MQTT broker
+// again. QoS 1 allows that, but some downstream consumers are sensitive to
+// duplicates.
+//
+// If GatewayConfig.DedupWindow is set, the gateway remembers the QoS 1
+// PUBLISHes acknowledged to clients for that long, identified by the
+// ClientID, the topic, the MsgID and a hash of the payload. A PUBLISH
+// matching a remembered one is acknowledged again, but it's not forwarded to
+// the MQTT broker (counted as MessagesDropped["duplicate"]).
+//
+// A client connecting with CleanSession=true (e.g. after a reboot) starts
+// numbering its messages anew, hence its remembered PUBLISHes are forgotten.
+
+package gateway
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	snMsgs "github.com/energomonitor/bisquitt/messages"
+)
+
+type dedupKey struct {
+	clientID    string
+	topic       string
+	msgID       uint16
+	payloadHash uint64
+}
+
+type dedupEntry struct {
+	key     dedupKey
+	expires time.Time
+}
+
+// dedupWindow remembers the QoS 1 PUBLISHes acknowledged to the clients,
+// shared by all the handlers. It's safe for concurrent use.
+type dedupWindow struct {
+	window time.Duration
+	lock   sync.Mutex
+	seen   map[dedupKey]time.Time // key => expiry
+	// Entries in the order of expiry.
+	queue []dedupEntry
+}
+
+func newDedupWindow(window time.Duration) *dedupWindow {
+	return &dedupWindow{
+		window: window,
+		seen:   make(map[dedupKey]time.Time),
+	}
+}
+
+// expire must be called with the lock held.
+func (w *dedupWindow) expire(now time.Time) {
+	i := 0
+	for ; i < len(w.queue) && !w.queue[i].expires.After(now); i++ {
+		entry := w.queue[i]
+		// The key might have been acknowledged again later.
+		if w.seen[entry.key] == entry.expires {
+			delete(w.seen, entry.key)
+		}
+	}
+	w.queue = w.queue[i:]
+}
+
+// acknowledged remembers the acknowledged PUBLISH.
+func (w *dedupWindow) acknowledged(key dedupKey) {
+	if w == nil {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	now := time.Now()
+	w.expire(now)
+	expires := now.Add(w.window)
+	w.seen[key] = expires
+	w.queue = append(w.queue, dedupEntry{key: key, expires: expires})
+}
+
+// forget forgets all the PUBLISHes of the client.
+func (w *dedupWindow) forget(clientID string) {
+	if w == nil {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for key := range w.seen {
+		if key.clientID == clientID {
+			// The queue entry expires without effect.
+			delete(w.seen, key)
+		}
+	}
+}
+
+// duplicate reports whether the PUBLISH has already been acknowledged.
+func (w *dedupWindow) duplicate(key dedupKey) bool {
+	if w == nil {
+		return false
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.expire(time.Now())
+	_, ok := w.seen[key]
+	return ok
+}
+
+func (h *handler) dedupKey(snPublish *snMsgs.PublishMessage, topic string) dedupKey {
+	hash := fnv.New64a()
+	hash.Write(snPublish.Data)
+	return dedupKey{
+		clientID:    h.clientID,
+		topic:       topic,
+		msgID:       snPublish.MessageID(),
+		payloadHash: hash.Sum64(),
+	}
+}
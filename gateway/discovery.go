@@ -0,0 +1,122 @@
+// Gateway discovery.
+//
+// The gateway answers SEARCHGW messages with GWINFO carrying
+// GatewayConfig.GatewayID. It listens on a unicast address, hence it does not
+// broadcast ADVERTISE messages itself.
+//
+// Forwarders relay broadcasts received from their wireless networks to the
+// gateway encapsulated (see snMsgs.EncapsulatedMessage) and broadcast the
+// encapsulated messages sent back by the gateway with the radius given in the
+// encapsulation:
+//
+//  - A SEARCHGW relayed by a forwarder is answered with GWINFO broadcast with
+//    the SEARCHGW's radius.
+//    [MQTT-SN specification v. 1.2, chapter 6.1 Gateway Advertisement and
+//    Discovery]
+//  - ADVERTISE and GWINFO messages of other gateways relayed by a forwarder
+//    are re-broadcast through all the other forwarders known to the gateway.
+//    The relaying forwarder has already used up one hop of the message's
+//    radius, hence the radius is decremented and the message is dropped once
+//    its radius is exhausted.
+//
+// The re-broadcasting is disabled if authentication is enabled because
+// forwarders are not authenticated. Messages of clients connected through
+// a forwarder are not supported.
+
+package gateway
+
+import (
+	"sync"
+
+	snMsgs "github.com/energomonitor/bisquitt/messages"
+)
+
+// forwarders are the handlers whose peers relayed encapsulated messages,
+// shared by all the handlers.
+type forwarders struct {
+	lock     sync.Mutex
+	handlers map[*handler]struct{}
+}
+
+func newForwarders() *forwarders {
+	return &forwarders{
+		handlers: make(map[*handler]struct{}),
+	}
+}
+
+func (f *forwarders) add(h *handler) {
+	if f == nil {
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.handlers[h] = struct{}{}
+}
+
+func (f *forwarders) remove(h *handler) {
+	if f == nil {
+		return
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.handlers, h)
+}
+
+// others returns all the forwarders' handlers except the given one.
+func (f *forwarders) others(h *handler) []*handler {
+	if f == nil {
+		return nil
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var others []*handler
+	for other := range f.handlers {
+		if other != h {
+			others = append(others, other)
+		}
+	}
+	return others
+}
+
+func (h *handler) handleSearchGw(snSearchGw *snMsgs.SearchGwMessage) error {
+	return h.snSend(snMsgs.NewGwInfoMessage(h.cfg.GatewayID, nil))
+}
+
+func (h *handler) handleEncapsulated(snEncapsulated *snMsgs.EncapsulatedMessage) error {
+	h.cfg.Forwarders.add(h)
+	switch snMsg := snEncapsulated.Message.(type) {
+	case *snMsgs.SearchGwMessage:
+		radius := snMsg.Radius
+		if radius > snMsgs.MaxRadius {
+			radius = snMsgs.MaxRadius
+		}
+		snGwInfo := snMsgs.NewGwInfoMessage(h.cfg.GatewayID, nil)
+		return h.snSend(snMsgs.NewEncapsulatedMessage(radius, snEncapsulated.WirelessNodeID, snGwInfo))
+	case *snMsgs.AdvertiseMessage, *snMsgs.GwInfoMessage:
+		h.rebroadcast(snEncapsulated)
+		return nil
+	default:
+		h.log.Info("Unsupported encapsulated message ignored: %v", snMsg)
+		return nil
+	}
+}
+
+// rebroadcast sends the message relayed by the handler's forwarder to all
+// the other forwarders.
+func (h *handler) rebroadcast(snEncapsulated *snMsgs.EncapsulatedMessage) {
+	if h.cfg.Forwarders == nil {
+		return
+	}
+	if !snEncapsulated.DecrementRadius() {
+		h.log.Debug("Broadcast radius exhausted: %v", snEncapsulated.Message)
+		return
+	}
+	// The wireless node ID identifies the sender in the relaying forwarder's
+	// network, it's meaningless in the other ones.
+	snMsg := snMsgs.NewEncapsulatedMessage(snEncapsulated.Radius, nil, snEncapsulated.Message)
+	for _, forwarder := range h.cfg.Forwarders.others(h) {
+		if err := forwarder.snSend(snMsg); err != nil {
+			h.log.Error("Cannot re-broadcast to forwarder %s: %s", forwarder.id, err)
+		}
+	}
+}
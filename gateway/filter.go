@@ -0,0 +1,117 @@
+package gateway
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/energomonitor/bisquitt/topics"
+	"gopkg.in/yaml.v3"
+)
+
+// FilterAction is an action taken when a FilterRule matches a message.
+type FilterAction string
+
+const (
+	FilterAllow FilterAction = "allow"
+	FilterDeny  FilterAction = "deny"
+)
+
+// FilterRule matches messages published by clients. All the non-empty
+// conditions must be met for the rule to match.
+type FilterRule struct {
+	Action FilterAction `yaml:"action"`
+	// MQTT topic filter, may contain wildcards. Matches all topics if empty.
+	Topic string `yaml:"topic"`
+	// If non-zero, only payloads longer than PayloadOver bytes are matched.
+	PayloadOver int `yaml:"payload_over"`
+	// Regular expression the payload must match.
+	Payload string `yaml:"payload"`
+
+	payloadRegexp *regexp.Regexp
+}
+
+func (r *FilterRule) match(topic string, payload []byte) bool {
+	if r.Topic != "" && !topics.Match(r.Topic, topic) {
+		return false
+	}
+	if r.PayloadOver > 0 && len(payload) <= r.PayloadOver {
+		return false
+	}
+	if r.payloadRegexp != nil && !r.payloadRegexp.Match(payload) {
+		return false
+	}
+	return true
+}
+
+// Filter decides which messages published by clients are forwarded to the
+// MQTT broker. The rules are evaluated in order and the first matching rule
+// wins. Messages not matched by any rule are allowed.
+//
+// A nil *Filter allows all messages.
+type Filter struct {
+	rules []FilterRule
+}
+
+// NewFilter validates the given rules and creates a new Filter.
+func NewFilter(rules []FilterRule) (*Filter, error) {
+	f := &Filter{
+		rules: make([]FilterRule, len(rules)),
+	}
+	for i, rule := range rules {
+		switch rule.Action {
+		case FilterAllow, FilterDeny:
+		default:
+			return nil, fmt.Errorf("filter rule %d: invalid action %q", i+1, rule.Action)
+		}
+		if rule.Payload != "" {
+			re, err := regexp.Compile(rule.Payload)
+			if err != nil {
+				return nil, fmt.Errorf("filter rule %d: %s", i+1, err)
+			}
+			rule.payloadRegexp = re
+		}
+		f.rules[i] = rule
+	}
+	return f, nil
+}
+
+// ReadFilterFile reads filter rules from a file in YAML format:
+//
+//	# Drop debug messages.
+//	- action: deny
+//	  topic: debug/#
+//	# Drop large payloads.
+//	- action: deny
+//	  payload_over: 1024
+//	# Drop empty raw readings.
+//	- action: deny
+//	  topic: sensors/+/raw
+//	  payload: "^\\s*$"
+func ReadFilterFile(file string) (*Filter, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []FilterRule
+	if err := yaml.NewDecoder(f).Decode(&rules); err != nil {
+		return nil, err
+	}
+	return NewFilter(rules)
+}
+
+// Allow reports whether a message with the given topic and payload should be
+// forwarded to the MQTT broker.
+func (f *Filter) Allow(topic string, payload []byte) bool {
+	if f == nil {
+		return true
+	}
+	for i := range f.rules {
+		if f.rules[i].match(topic, payload) {
+			return f.rules[i].Action == FilterAllow
+		}
+	}
+	return true
+}
@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/energomonitor/bisquitt/topics"
@@ -30,24 +31,189 @@ type GatewayConfig struct {
 	PerformanceLogTime    time.Duration
 	PredefinedTopics      topics.PredefinedTopics
 	AuthEnabled           bool
+	// MqttKeepAlive, if non-zero, is used as the MQTT keepalive instead of
+	// the one requested by the MQTT-SN client. The gateway then answers the
+	// client's PINGREQs itself and pings the MQTT broker on client's behalf.
+	// Values over MaxMqttKeepAlive are clamped.
+	MqttKeepAlive time.Duration
+	// Mqtt5, if set, makes the gateway connect to the MQTT broker using
+	// MQTT 5 and use topic aliases to reduce the upstream bandwidth (see
+	// mqtt5.go). Routed brokers are connected to using MQTT 3.1.1.
+	Mqtt5 bool
+	// MqttTopicAliasMaximum is the number of topic aliases the MQTT broker
+	// may use in PUBLISHes sent to the gateway if Mqtt5 is set.
+	MqttTopicAliasMaximum uint16
 	// TRetry in MQTT-SN specification
 	RetryDelay time.Duration
 	// NRetry in MQTT-SN specification
 	RetryCount uint
+	// ShutdownReportFile is a path to a file the shutdown report is written
+	// to in JSON format. The report is only logged if empty.
+	ShutdownReportFile string
+	// EventHook, if set, is notified about client state changes.
+	EventHook EventHook
+	// Filter, if set, decides which messages published by clients are
+	// forwarded to the MQTT broker.
+	Filter *Filter
+	// DownlinkPriorities decide the order in which messages buffered for
+	// a sleeping client are delivered when the client wakes up.
+	DownlinkPriorities TopicPriorities
+	// BillingSink, if set, receives bytes transferred per ClientID every
+	// BillingInterval (one minute if zero) and on shutdown.
+	BillingSink     BillingSink
+	BillingInterval time.Duration
+	// SourceTagger, if set, tags clients with metadata derived from their
+	// source addresses. The tags are informative only (see SourceTagger).
+	SourceTagger SourceTagger
+	// ReplicationSink, if set, receives snapshots of all the client
+	// sessions every ReplicationInterval (one second if zero). It is used
+	// to keep a warm standby gateway.
+	ReplicationSink     ReplicationSink
+	ReplicationInterval time.Duration
+	// StandbySessions, if set, holds sessions replicated from the active
+	// gateway. A client connecting from an address with a replicated
+	// session continues the session without a new CONNECT.
+	StandbySessions *SessionStore
+	// SysTopics enables the gateway statistics topics served to clients
+	// by the gateway itself (see SysTopicPrefix).
+	SysTopics bool
+	// TransactionMaxLifetime is the age after which a transaction is
+	// considered leaked and removed (one hour if zero).
+	TransactionMaxLifetime time.Duration
+	// Canary, if set, configures a synthetic client periodically checking
+	// the gateway end-to-end.
+	Canary *CanaryConfig
+	// By default, messages on a topic are delivered to a client one at a
+	// time to keep their order. UnorderedDelivery disables the ordering in
+	// favor of throughput.
+	UnorderedDelivery bool
+	// ClientLogSize is the number of recent log lines, including the debug
+	// ones, kept in memory for every client (see Gateway.ClientLog). Zero
+	// disables the capture.
+	ClientLogSize int
+	// CoalesceSize, if non-zero, enables packing multiple messages buffered
+	// for a sleeping client into datagrams of at most CoalesceSize bytes when
+	// the client wakes up. Clients must be able to parse multiple messages
+	// in a datagram.
+	CoalesceSize int
+	// PushTopics are registered by the gateway (REGISTER sent to the client)
+	// right after a client connects so that the client knows their TopicIDs
+	// before it uses them. Topics with wildcards, short topics and topics
+	// predefined for the client are skipped.
+	PushTopics []string
+	// DownlinkMessageRate and DownlinkByteRate, if non-zero, limit
+	// messages sent by the MQTT broker to a client (per second). QoS 0
+	// messages exceeding the limit are dropped, QoS 1 and 2 messages are
+	// delayed.
+	DownlinkMessageRate float64
+	DownlinkByteRate    int
+	// RetainRules, if set, strip or force the Retain flag of messages
+	// published by clients.
+	RetainRules RetainRules
+	// StrictSpec refuses client messages deviating from the MQTT-SN
+	// specification. Otherwise, common deviations are tolerated. The
+	// deviations are counted in Report.Deviations either way.
+	StrictSpec bool
+	// StrictConfig refuses to start the gateway if the configuration
+	// self-check finds any problem. Otherwise, the problems are just logged
+	// (see Gateway.SelfCheck).
+	StrictConfig bool
+	// SessionTTL, if non-zero, purges sessions of clients which have not
+	// sent any message for this long, including the sessions replicated to
+	// StandbySessions (see also Gateway.PurgeSessions). The TTL of
+	// a sleeping client counts from the end of its sleep duration.
+	SessionTTL time.Duration
+	// ClientMetadata enables clients to publish their metadata to
+	// MetadataTopic (see Gateway.Inventory).
+	ClientMetadata bool
+	// Routes, if set, send the traffic of clients on the routes' topics to
+	// other MQTT brokers instead of MqttBrokerAddress. A failure of
+	// a route's connection does not affect the clients' sessions.
+	Routes Routes
+	// DedupWindow, if non-zero, is how long QoS 1 PUBLISHes acknowledged
+	// to clients are remembered so that their retransmissions are not
+	// forwarded to the MQTT broker again.
+	DedupWindow time.Duration
+	// LatencySLOs, if set, are latency objectives of QoS 1 messages
+	// published by clients. SLOAlertHook, if set, is called when an SLO
+	// becomes breached or is met again (see Report.LatencySLOs).
+	LatencySLOs  LatencySLOs
+	SLOAlertHook SLOAlertHook
+	// A panic in a client's handler fails just the client's session. A
+	// client whose handlers panicked QuarantineThreshold times within
+	// QuarantineWindow (one hour if zero) is refused for QuarantineDuration
+	// (one hour if zero). Zero QuarantineThreshold disables the quarantine.
+	QuarantineThreshold int
+	QuarantineWindow    time.Duration
+	QuarantineDuration  time.Duration
+	// GatewayID identifies the gateway in GWINFO messages answering
+	// clients' SEARCHGW (see discovery.go).
+	GatewayID uint8
 }
 
 type Gateway struct {
-	cfg *GatewayConfig
-	log util.Logger
+	cfg      *GatewayConfig
+	log      util.Logger
+	stats    *stats
+	handlers sync.WaitGroup
+	clients  sync.Map // handler ID => *handler
+	meter    *byteMeter
+	// Set when the gateway starts listening if the canary is enabled.
+	canary     *canary
+	canaryLock sync.Mutex
+	// Nil if GatewayConfig.ClientMetadata is not set.
+	inventory *inventory
+	// Nil if no GatewayConfig.LatencySLOs are set.
+	slo *sloTracker
 }
 
 // Timeout for DTLS connection establishment.
 const dtlsConnectTimeout = 30 * time.Second
 
 func NewGateway(log util.Logger, cfg *GatewayConfig) *Gateway {
-	return &Gateway{
-		cfg: cfg,
-		log: log,
+	gw := &Gateway{
+		cfg:   cfg,
+		log:   log,
+		stats: newStats(),
+	}
+	if cfg.BillingSink != nil {
+		gw.meter = newByteMeter()
+	}
+	if cfg.ClientMetadata {
+		gw.inventory = newInventory()
+	}
+	if len(cfg.LatencySLOs) > 0 {
+		gw.slo = newSLOTracker(cfg.LatencySLOs, cfg.SLOAlertHook, log.WithTag("slo"))
+	}
+	return gw
+}
+
+// Report returns a summary of the gateway activity since its creation.
+func (gw *Gateway) Report() *Report {
+	r := gw.stats.report()
+	if status, ok := gw.Canary(); ok {
+		r.Canary = &status
+	}
+	r.LatencySLOs = gw.slo.statuses()
+	return r
+}
+
+// shutdownReport waits for all the handlers to quit and emits the final
+// gateway activity report and billing record.
+func (gw *Gateway) shutdownReport() {
+	gw.handlers.Wait()
+
+	if gw.meter != nil {
+		gw.flushBilling()
+	}
+
+	report := gw.Report()
+	gw.log.Info("Shutdown report:")
+	report.Log(gw.log)
+	if gw.cfg.ShutdownReportFile != "" {
+		if err := report.WriteFile(gw.cfg.ShutdownReportFile); err != nil {
+			gw.log.Error("Cannot write shutdown report: %s", err)
+		}
 	}
 }
 
@@ -92,6 +258,10 @@ func newUDPListener(ctx context.Context, address *net.UDPAddr) (net.Listener, er
 // ListenAndServe starts a gateway listening on the given address. It returns
 // only on fatal internal errors or when the given context is canceled.
 func (gw *Gateway) ListenAndServe(ctx context.Context, address string) error {
+	if err := gw.selfCheck(ctx); err != nil {
+		return err
+	}
+
 	udpAddr, err := net.ResolveUDPAddr("udp", address)
 	if err != nil {
 		return err
@@ -112,15 +282,63 @@ func (gw *Gateway) ListenAndServe(ctx context.Context, address string) error {
 	}()
 
 	gw.log.Info("Listening on %s", snListener.Addr().String())
+	defer gw.shutdownReport()
+	if gw.meter != nil {
+		go gw.billingLoop(ctx)
+	}
+	if gw.cfg.ReplicationSink != nil {
+		go gw.replicationLoop(ctx)
+	}
+	if gw.slo != nil {
+		go gw.slo.loop(ctx)
+	}
+	if gw.cfg.Canary != nil {
+		c := newCanary(*gw.cfg.Canary, gw.cfg, snListener.Addr(), gw.log.WithTag("canary"))
+		gw.canaryLock.Lock()
+		gw.canary = c
+		gw.canaryLock.Unlock()
+		go c.loop(ctx)
+	}
 
 	handlerCfg := &handlerConfig{
-		MqttBrokerAddress:     gw.cfg.MqttBrokerAddress,
-		MqttUser:              gw.cfg.MqttUser,
-		MqttPassword:          gw.cfg.MqttPassword,
-		MqttConnectionTimeout: gw.cfg.MqttConnectionTimeout,
-		AuthEnabled:           gw.cfg.AuthEnabled,
-		RetryDelay:            gw.cfg.RetryDelay,
-		RetryCount:            gw.cfg.RetryCount,
+		MqttBrokerAddress:      gw.cfg.MqttBrokerAddress,
+		MqttUser:               gw.cfg.MqttUser,
+		MqttPassword:           gw.cfg.MqttPassword,
+		MqttConnectionTimeout:  gw.cfg.MqttConnectionTimeout,
+		MqttKeepAlive:          gw.cfg.MqttKeepAlive,
+		Mqtt5:                  gw.cfg.Mqtt5,
+		MqttTopicAliasMaximum:  gw.cfg.MqttTopicAliasMaximum,
+		AuthEnabled:            gw.cfg.AuthEnabled,
+		RetryDelay:             gw.cfg.RetryDelay,
+		RetryCount:             gw.cfg.RetryCount,
+		EventHook:              gw.cfg.EventHook,
+		Filter:                 gw.cfg.Filter,
+		DownlinkPriorities:     gw.cfg.DownlinkPriorities,
+		SysTopics:              gw.cfg.SysTopics,
+		TransactionMaxLifetime: gw.cfg.TransactionMaxLifetime,
+		UnorderedDelivery:      gw.cfg.UnorderedDelivery,
+		ClientLogSize:          gw.cfg.ClientLogSize,
+		CoalesceSize:           gw.cfg.CoalesceSize,
+		PushTopics:             gw.cfg.PushTopics,
+		RetainRules:            gw.cfg.RetainRules,
+		Routes:                 gw.cfg.Routes,
+		Inventory:              gw.inventory,
+		SLO:                    gw.slo,
+		StrictSpec:             gw.cfg.StrictSpec,
+		SessionTTL:             gw.cfg.SessionTTL,
+		DownlinkMessageRate:    gw.cfg.DownlinkMessageRate,
+		DownlinkByteRate:       gw.cfg.DownlinkByteRate,
+		GatewayID:              gw.cfg.GatewayID,
+	}
+	if !gw.cfg.AuthEnabled {
+		handlerCfg.Forwarders = newForwarders()
+	}
+	if gw.cfg.DedupWindow > 0 {
+		handlerCfg.Dedup = newDedupWindow(gw.cfg.DedupWindow)
+	}
+	if gw.cfg.QuarantineThreshold > 0 {
+		handlerCfg.Quarantine = newQuarantine(gw.cfg.QuarantineThreshold,
+			gw.cfg.QuarantineWindow, gw.cfg.QuarantineDuration)
 	}
 
 	for {
@@ -128,19 +346,39 @@ func (gw *Gateway) ListenAndServe(ctx context.Context, address string) error {
 		if err != nil {
 			if _, ok := err.(*dtls.HandshakeError); ok {
 				gw.log.Debug("Client TLS handshake error")
+				gw.stats.count(&gw.stats.handshakeErrors)
 				continue
 			}
 			if err == udp.ErrClosedListener {
 				return nil
 			}
 			gw.log.Error("MQTT-SN Accept error: %v", err)
+			gw.stats.count(&gw.stats.acceptErrors)
 			return err
 		}
 		gw.log.Debug("Client connected: %s", clientConn.RemoteAddr().String())
 		handlerID := clientConn.RemoteAddr().String()
 		handlerLogger := gw.log.WithTag(fmt.Sprintf("h:%s", handlerID))
 		handler := newHandler(handlerCfg, gw.cfg.PredefinedTopics, handlerLogger)
+		handler.id = handlerID
+		handler.stats = gw.stats
+		handler.activity.meter = gw.meter
+		if gw.cfg.SourceTagger != nil {
+			tags := gw.cfg.SourceTagger.Tags(clientConn.RemoteAddr())
+			handler.activity.tags = tags
+			gw.stats.clientTagged(tags)
+		}
+		if gw.cfg.StandbySessions != nil {
+			if session, ok := gw.takeSession(handlerID); ok {
+				handlerLogger.Info("Taking over session of client %q", session.ClientID)
+				handler.restore(session)
+			}
+		}
+		gw.clients.Store(handlerID, handler)
+		gw.handlers.Add(1)
 		go func() {
+			defer gw.handlers.Done()
+			defer gw.clients.Delete(handlerID)
 			defer func() {
 				handlerLogger.Debug("Closing MQTT-SN connection")
 				err := clientConn.Close()
@@ -150,8 +388,10 @@ func (gw *Gateway) ListenAndServe(ctx context.Context, address string) error {
 			}()
 
 			// NOTE: Potentional error was already logged inside handler,
-			//       no need to take any further action here.
-			handler.run(ctx, clientConn)
+			//       it's only counted here.
+			if err := handler.run(ctx, clientConn); err != nil {
+				gw.stats.count(&gw.stats.handlerErrors)
+			}
 		}()
 	}
 }
@@ -3,18 +3,30 @@ package gateway
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	mqttPackets "github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/energomonitor/bisquitt"
 	snMsgs "github.com/energomonitor/bisquitt/messages"
 	"github.com/energomonitor/bisquitt/topics"
+	"github.com/energomonitor/bisquitt/transactions"
 	"github.com/energomonitor/bisquitt/util"
 	"github.com/stretchr/testify/assert"
 )
@@ -419,6 +431,72 @@ func TestClientPublishQOS0(t *testing.T) {
 	stp.disconnect()
 }
 
+func TestClientMultiMessageDatagram(t *testing.T) {
+	assert := assert.New(t)
+
+	stp := newTestSetup(t, false, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	topic := "test-topic-0"
+
+	stp.connect()
+	topicID := stp.register(topic)
+
+	// client --PUBLISH,PUBLISH--> GW (in one datagram)
+	buff := &bytes.Buffer{}
+	payloads := [][]byte{[]byte("test-msg-0"), []byte("test-msg-1")}
+	for _, payload := range payloads {
+		snPublish := snMsgs.NewPublishMessage(topicID, snMsgs.TIT_REGISTERED, payload, 0, false, false)
+		if err := snPublish.Write(buff); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := stp.snConn.Write(buff.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	// GW --PUBLISH--> MQTT broker
+	for _, payload := range payloads {
+		mqttPublish := stp.mqttRecv().(*mqttPackets.PublishPacket)
+		assert.Equal(topic, mqttPublish.TopicName)
+		assert.Equal(payload, mqttPublish.Payload)
+	}
+
+	// DISCONNECT
+	stp.disconnect()
+}
+
+func TestClientPublishShortWildcard(t *testing.T) {
+	assert := assert.New(t)
+
+	stp := newTestSetup(t, false, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	stp.connect()
+
+	for _, topic := range []string{"a+", "#"} {
+		// client --PUBLISH--> GW
+		topicID := snMsgs.EncodeShortTopic(topic)
+		snPublish := snMsgs.NewPublishMessage(topicID, snMsgs.TIT_SHORT, []byte("test-msg"), 1, false, false)
+		stp.snSend(snPublish, true)
+
+		// client <--PUBACK-- GW
+		snPuback := stp.snRecv().(*snMsgs.PubackMessage)
+		assert.Equal(snMsgs.RC_NOT_SUPPORTED, snPuback.ReturnCode)
+		assert.Equal(topicID, snPuback.TopicID)
+		assert.Equal(snPublish.MessageID(), snPuback.MessageID())
+	}
+
+	// QoS 0 PUBLISH is dropped.
+	snPublish := snMsgs.NewPublishMessage(snMsgs.EncodeShortTopic("+/"), snMsgs.TIT_SHORT, []byte("test-msg"), 0, false, false)
+	stp.snSend(snPublish, true)
+
+	// The MQTT broker receives nothing but DISCONNECT.
+	stp.disconnect()
+
+	assert.Equal(uint64(3), stp.handler.stats.report().MessagesDropped["invalid_topic"])
+}
+
 func TestClientPublishQOS1(t *testing.T) {
 	assert := assert.New(t)
 
@@ -1212,198 +1290,2676 @@ func TestAuthFail(t *testing.T) {
 	assert.Equal(util.StateDisconnected, stp.handler.state.Get())
 }
 
-//
-// testSetup
-//
+func TestReport(t *testing.T) {
+	assert := assert.New(t)
 
-type testSetup struct {
-	ID            string
-	t             *testing.T
-	mqttConn      net.Conn
-	snConn        net.Conn
-	snNextMsgID   uint16
-	mqttNextMsgID uint16
-	ctx           context.Context
-	cancel        context.CancelFunc
-	handler       *handler
-	handlerDone   chan struct{}
-}
+	stp := newTestSetup(t, false, topics.PredefinedTopics{})
+	defer stp.cancel()
 
-func newTestSetup(t *testing.T, auth bool, predefinedTopics topics.PredefinedTopics) *testSetup {
-	ctx, cancel := context.WithCancel(context.Background())
-	handlerDone := make(chan struct{})
-	// Test name without "Test" prefix.
-	id := reflect.ValueOf(*t).FieldByName("name").String()[4:]
-	stp := &testSetup{
-		ID:            id,
-		t:             t,
-		ctx:           ctx,
-		cancel:        cancel,
-		handlerDone:   handlerDone,
-		snNextMsgID:   1,
-		mqttNextMsgID: 1,
-	}
-	stp.newHandler(auth, predefinedTopics)
-	return stp
-}
+	stp.connect()
+	topicID := stp.register("test-topic-0")
 
-func (stp *testSetup) newHandler(auth bool, predefinedTopics topics.PredefinedTopics) {
-	log := util.NewDebugLogger("h-" + stp.ID)
+	// client --PUBLISH--> GW
+	snPublish := snMsgs.NewPublishMessage(topicID, snMsgs.TIT_REGISTERED, []byte("test-msg-0"), 0, false, false)
+	stp.snSend(snPublish, true)
 
-	var snListener *net.UnixListener
-	var mqttListener *net.UnixListener
-	snListener, stp.snConn = stp.createSocketPair("unixpacket")
-	mqttListener, stp.mqttConn = stp.createSocketPair("unix")
+	// GW --PUBLISH--> MQTT broker
+	stp.mqttRecv()
 
-	handlerChan := make(chan *handler)
-	go func() {
-		defer close(stp.handlerDone)
+	// DISCONNECT
+	stp.disconnect()
 
-		snConnGateway, err := snListener.AcceptUnix()
-		if err != nil {
-			stp.t.Fatal(err)
-		}
-		mqttConnGateway, err := mqttListener.AcceptUnix()
-		if err != nil {
-			stp.t.Fatal(err)
-		}
+	report := stp.handler.stats.report()
+	assert.Equal(uint64(1), report.ClientsServed)
+	assert.Equal(int64(0), report.ClientsConnected)
+	assert.Equal(map[string]uint64{
+		"CONNECT":    1,
+		"REGISTER":   1,
+		"PUBLISH":    1,
+		"DISCONNECT": 1,
+	}, report.MessagesReceived)
+	assert.Equal(map[string]uint64{
+		"CONNACK":    1,
+		"REGACK":     1,
+		"DISCONNECT": 1,
+	}, report.MessagesSent)
+	assert.Equal(uint64(0), report.Errors["handler"])
+}
 
-		cfg := &handlerConfig{
-			AuthEnabled: auth,
-			RetryDelay:  time.Second,
-			RetryCount:  2,
-		}
-		handler := newHandler(cfg, predefinedTopics, log)
-		handler.mockupDialFunc = func() net.Conn {
-			return mqttConnGateway
-		}
-		select {
-		case <-stp.ctx.Done():
+func TestReportMqttDialError(t *testing.T) {
+	assert := assert.New(t)
+
+	// Nothing listens on the address.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	brokerAddress := listener.Addr().(*net.TCPAddr)
+	listener.Close()
+
+	stp := &testSetup{t: t}
+	snListener, snConn := stp.createSocketPair("unixpacket")
+	defer snListener.Close()
+	defer snConn.Close()
+	stp.snConn = snConn
+
+	h := newHandler(&handlerConfig{
+		MqttBrokerAddress: brokerAddress,
+		RetryDelay:        time.Second,
+		RetryCount:        2,
+	}, topics.PredefinedTopics{}, util.NoOpLogger{})
+	done := make(chan error)
+	go func() {
+		conn, err := snListener.AcceptUnix()
+		if err != nil {
+			done <- err
 			return
-		case handlerChan <- handler:
-			// continue
 		}
-		handler.run(stp.ctx, snConnGateway)
+		defer conn.Close()
+		done <- h.run(context.Background(), conn)
 	}()
 
-	select {
-	case <-stp.ctx.Done():
-		return
-	case stp.handler = <-handlerChan:
-		// continue
-	}
+	// client <--CONNACK(congestion)-- GW
+	snConnack := stp.snRecv().(*snMsgs.ConnackMessage)
+	assert.Equal(snMsgs.RC_CONGESTION, snConnack.ReturnCode)
+	assert.Error(<-done)
+
+	assert.Equal(uint64(1), h.stats.report().Errors["mqtt_dial"])
 }
 
-func (stp *testSetup) createSocketPair(sockType string) (*net.UnixListener, *net.UnixConn) {
-	// NOTE: "@" means "unnamed socket"
-	socket := fmt.Sprintf("@%d", rand.Uint64())
-	addr := &net.UnixAddr{Name: socket, Net: sockType}
+func TestClientInfo(t *testing.T) {
+	assert := assert.New(t)
 
-	listener, err := net.ListenUnix(sockType, addr)
-	if err != nil {
-		stp.t.Fatal(err)
-	}
+	stp := newTestSetup(t, false, topics.PredefinedTopics{})
+	defer stp.cancel()
 
-	conn, err := net.DialUnix(sockType, nil, addr)
-	if err != nil {
-		stp.t.Fatal(err)
-	}
+	before := stp.handler.clientInfo()
+	assert.Equal(util.StateDisconnected, before.State)
+	assert.Equal("", before.ClientID)
 
-	return listener, conn
+	stp.connect()
+	stp.register("test-topic-0")
+
+	info := stp.handler.clientInfo()
+	assert.Equal("test-client", info.ClientID)
+	assert.Equal(util.StateActive, info.State)
+	assert.Equal(uint64(2), info.MessagesReceived)
+	assert.Equal(uint64(2), info.MessagesSent)
+	assert.True(info.LastActivity.After(before.LastActivity))
+	assert.Equal(before.ConnectedAt, info.ConnectedAt)
+
+	stp.disconnect()
 }
 
-func (stp *testSetup) snSend(msg snMsgs.Message, setMsgID bool) {
-	if setMsgID {
-		if msg2, ok := msg.(snMsgs.MessageWithID); ok {
-			msg2.SetMessageID(stp.snNextMsgID)
-			stp.snNextMsgID++
-		}
-	}
+func TestClientLog(t *testing.T) {
+	assert := assert.New(t)
 
-	err := msg.Write(stp.snConn)
-	if err != nil {
-		stp.t.Fatal(err)
+	cfg := &handlerConfig{
+		RetryDelay:    time.Second,
+		RetryCount:    2,
+		ClientLogSize: 3,
 	}
-}
+	stp := newTestSetupWithConfig(t, cfg, topics.PredefinedTopics{})
+	defer stp.cancel()
 
-func (stp *testSetup) snRecv() snMsgs.Message {
-	buff := make([]byte, maxTestPktLength)
-	n, err := stp.snConn.Read(buff)
-	if err != nil {
-		if err != io.EOF {
-			stp.t.Fatal(err)
-		}
+	stp.connect()
+	stp.register("test-topic-0")
+
+	gw := NewGateway(util.NoOpLogger{}, &GatewayConfig{})
+	gw.clients.Store(stp.handler.id, stp.handler)
+
+	lines, ok := gw.ClientLog(stp.handler.id)
+	assert.True(ok)
+	if assert.Len(lines, 3) {
+		assert.Equal("DEBUG", lines[2].Level)
+		assert.Contains(lines[2].Message, "REGACK")
 	}
 
-	pktReader := bytes.NewReader(buff[:n])
-	header := &snMsgs.Header{}
-	header.Unpack(pktReader)
-	msg := snMsgs.NewMessageWithHeader(*header)
-	msg.Unpack(pktReader)
+	_, ok = gw.ClientLog("unknown")
+	assert.False(ok)
 
-	return msg
+	stp.disconnect()
 }
 
-func (stp *testSetup) mqttSend(msg mqttPackets.ControlPacket, setMsgID bool) {
-	if setMsgID {
-		switch msg2 := msg.(type) {
-		case *mqttPackets.PublishPacket:
-			msg2.MessageID = stp.mqttNextMsgID
-		default:
-			stp.t.Fatalf("Cannot set MsgID for %v", msg)
-		}
-		stp.mqttNextMsgID++
-	}
+func TestHandlerPanic(t *testing.T) {
+	assert := assert.New(t)
 
-	err := msg.Write(stp.mqttConn)
-	if err != nil {
-		stp.t.Fatal(err)
+	cfg := &handlerConfig{
+		RetryDelay: time.Second,
+		RetryCount: 2,
+		EventHook: func(event Event) {
+			if event.Type == EventStateChanged && event.Client.State == util.StateActive {
+				panic("test panic")
+			}
+		},
+		Quarantine: newQuarantine(1, time.Minute, time.Minute),
 	}
+	stp := newTestSetupWithConfig(t, cfg, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	// client --CONNECT--> GW
+	snConnect := snMsgs.NewConnectMessage([]byte("test-client"), true, false, 1)
+	stp.snSend(snConnect, false)
+
+	// GW --CONNECT--> MQTT broker
+	stp.mqttRecv()
+
+	// GW <--CONNACK-- MQTT broker
+	mqttConnack := mqttPackets.NewControlPacket(mqttPackets.Connack).(*mqttPackets.ConnackPacket)
+	mqttConnack.ReturnCode = mqttPackets.Accepted
+	stp.mqttSend(mqttConnack, false)
+
+	// The handler panics on the state change and quits.
+	// client <--DISCONNECT-- GW
+	_, ok := stp.snRecv().(*snMsgs.DisconnectMessage)
+	assert.True(ok)
+	stp.assertHandlerDone()
+	assert.Equal(uint64(1), stp.handler.stats.report().Errors["handler_panic"])
+
+	// The client is quarantined.
+	stp = newTestSetupWithConfig(t, cfg, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	// client --CONNECT--> GW
+	stp.snSend(snConnect, false)
+
+	// client <--CONNACK-- GW
+	snConnack := stp.snRecv().(*snMsgs.ConnackMessage)
+	assert.Equal(snMsgs.RC_CONGESTION, snConnack.ReturnCode)
+	stp.assertHandlerDone()
+	assert.Equal(uint64(1), stp.handler.stats.report().Errors["quarantined"])
 }
 
-func (stp *testSetup) mqttRecv() mqttPackets.ControlPacket {
-	msg, err := mqttPackets.ReadPacket(stp.mqttConn)
-	if err != nil {
-		stp.t.Fatal(err)
-	}
+func TestHandlerTimerPanic(t *testing.T) {
+	assert := assert.New(t)
 
-	return msg
+	stp := newTestSetup(t, false, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	stp.connect()
+
+	// A retry callback panics in the transaction's timer goroutine.
+	h := stp.handler
+	transaction := transactions.NewRetryTransaction(
+		stp.ctx, 10*time.Millisecond, 1,
+		h.guardRetry(func(interface{}) error {
+			panic("test panic")
+		}),
+		h.guardFinally(func() {}),
+	)
+	transaction.Proceed(nil, nil)
+
+	// The handler fails instead of the whole process.
+	// client <--DISCONNECT-- GW
+	_, ok := stp.snRecv().(*snMsgs.DisconnectMessage)
+	assert.True(ok)
+	stp.assertHandlerDone()
+	assert.Equal(uint64(1), h.stats.report().Errors["handler_panic"])
+	<-transaction.Done()
+	assert.Error(transaction.Err())
 }
 
-func testRead(connID string, conn net.Conn, timeout time.Duration) ([]byte, error) {
-	buff := make([]byte, maxTestPktLength)
-	err := conn.SetReadDeadline(time.Now().Add(timeout))
-	if err != nil {
-		return nil, fmt.Errorf("Can't set read deadline on %s connection: %s", connID, err)
-	}
+func TestQuarantinePrune(t *testing.T) {
+	assert := assert.New(t)
 
-	n, err := conn.Read(buff)
-	if err != nil {
-		return nil, err
-	}
-	return buff[:n], nil
+	q := newQuarantine(2, 50*time.Millisecond, 50*time.Millisecond)
+	q.offend("gone-1")
+	q.offend("gone-2")
+	q.offend("gone-2")
+	assert.True(q.holds("gone-2"))
+
+	// Panics out of the window and ended quarantines are forgotten.
+	time.Sleep(100 * time.Millisecond)
+	q.offend("client")
+	assert.Len(q.panics, 1)
+	assert.Contains(q.panics, "client")
+	assert.Empty(q.until)
 }
 
-func (stp *testSetup) assertConnEmpty(connID string, conn net.Conn, timeout time.Duration) {
-	data, err := testRead(connID, conn, timeout)
-	assert.Len(stp.t, data, 0, "No data expected on %s connection, got: %v", connID, data)
-	if err != nil {
-		switch e := err.(type) {
-		case net.Error:
-			if e.Temporary() && e.Timeout() {
-				return
+func TestClientMetadata(t *testing.T) {
+	assert := assert.New(t)
+
+	gw := NewGateway(util.NoOpLogger{}, &GatewayConfig{ClientMetadata: true})
+	events := make(chan Event, 1)
+	cfg := &handlerConfig{
+		RetryDelay: time.Second,
+		RetryCount: 2,
+		Inventory:  gw.inventory,
+		EventHook: func(event Event) {
+			if event.Type == EventMetadataChanged {
+				events <- event
 			}
-		}
-		stp.t.Errorf("Unexpected error on %s connection: %s", connID, err)
+		},
 	}
-}
+	stp := newTestSetupWithConfig(t, cfg, topics.PredefinedTopics{})
+	defer stp.cancel()
 
-func (stp *testSetup) assertConnClosed(connID string, conn net.Conn, timeout time.Duration) {
-	assert := assert.New(stp.t)
+	stp.connect()
+	topicID := stp.register(MetadataTopic)
 
-	data, err := testRead(connID, conn, timeout)
-	assert.Len(data, 0, "%s connection: no data expected, got: %v", connID, data)
-	if err != nil {
+	// client --PUBLISH--> GW
+	snPublish := snMsgs.NewPublishMessage(topicID, snMsgs.TIT_REGISTERED, []byte(`{"fw":"1.4.2","hw":"rev-b"}`), 1, false, false)
+	stp.snSend(snPublish, true)
+
+	// client <--PUBACK-- GW
+	snPuback := stp.snRecv().(*snMsgs.PubackMessage)
+	assert.Equal(snMsgs.RC_ACCEPTED, snPuback.ReturnCode)
+	// Not forwarded to the MQTT broker.
+	stp.assertConnEmpty("MQTT", stp.mqttConn, connEmptyTimeout)
+
+	expected := map[string]string{"fw": "1.4.2", "hw": "rev-b"}
+	event := <-events
+	assert.Equal(expected, event.Client.Metadata)
+	assert.Equal(expected, stp.handler.clientInfo().Metadata)
+	session, ok := stp.handler.session()
+	if assert.True(ok) {
+		assert.Equal(expected, session.Metadata)
+	}
+
+	// Invalid metadata is refused.
+	snPublish = snMsgs.NewPublishMessage(topicID, snMsgs.TIT_REGISTERED, []byte(`{"fw":1}`), 1, false, false)
+	stp.snSend(snPublish, true)
+
+	// client <--PUBACK-- GW
+	snPuback = stp.snRecv().(*snMsgs.PubackMessage)
+	assert.Equal(snMsgs.RC_NOT_SUPPORTED, snPuback.ReturnCode)
+
+	stp.disconnect()
+
+	// The inventory keeps the metadata of disconnected clients.
+	inventory := gw.Inventory()
+	if assert.Len(inventory, 1) {
+		assert.Equal("test-client", inventory[0].ClientID)
+		assert.Equal(expected, inventory[0].Metadata)
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := &handlerConfig{
+		RetryDelay: time.Second,
+		RetryCount: 2,
+		Dedup:      newDedupWindow(time.Minute),
+	}
+	stp := newTestSetupWithConfig(t, cfg, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	stp.connect()
+	topicID := stp.register("test-topic")
+
+	otherTopicID := stp.register("other-topic")
+
+	publish := func(topicID uint16, payload string, forwarded bool) {
+		// client --PUBLISH--> GW
+		snPublish := snMsgs.NewPublishMessage(topicID, snMsgs.TIT_REGISTERED, []byte(payload), 1, false, false)
+		snPublish.SetMessageID(100)
+		stp.snSend(snPublish, false)
+
+		if forwarded {
+			// GW --PUBLISH--> MQTT broker
+			mqttPublish := stp.mqttRecv().(*mqttPackets.PublishPacket)
+			assert.Equal(payload, string(mqttPublish.Payload))
+
+			// GW <--PUBACK-- MQTT broker
+			mqttPuback := mqttPackets.NewControlPacket(mqttPackets.Puback).(*mqttPackets.PubackPacket)
+			mqttPuback.MessageID = mqttPublish.MessageID
+			stp.mqttSend(mqttPuback, false)
+		}
+
+		// client <--PUBACK-- GW
+		snPuback := stp.snRecv().(*snMsgs.PubackMessage)
+		assert.Equal(uint16(100), snPuback.MessageID())
+		assert.Equal(snMsgs.RC_ACCEPTED, snPuback.ReturnCode)
+	}
+
+	publish(topicID, "test-msg-0", true)
+	// The client has not received the PUBACK and retransmits the message.
+	publish(topicID, "test-msg-0", false)
+	stp.assertConnEmpty("MQTT", stp.mqttConn, connEmptyTimeout)
+	// Another message using the same MsgID.
+	publish(topicID, "test-msg-1", true)
+	// The same message on another topic.
+	publish(otherTopicID, "test-msg-1", true)
+
+	// The rebooted client connects with CleanSession and reuses the MsgID.
+	stp.connect()
+	topicID = stp.register("test-topic")
+	publish(topicID, "test-msg-1", true)
+
+	assert.Equal(uint64(1), stp.handler.stats.report().MessagesDropped["duplicate"])
+
+	stp.disconnect()
+}
+
+func TestLatencySLO(t *testing.T) {
+	assert := assert.New(t)
+
+	alerts := make(chan SLOStatus, 1)
+	slos := LatencySLOs{
+		{Topic: "sensors/#", Percentile: 99, Latency: 50 * time.Millisecond},
+		{Topic: "#", Percentile: 50, Latency: time.Second},
+	}
+	tracker := newSLOTracker(slos, func(status SLOStatus) {
+		alerts <- status
+	}, util.NoOpLogger{})
+	cfg := &handlerConfig{
+		RetryDelay: 300 * time.Millisecond,
+		RetryCount: 2,
+		SLO:        tracker,
+	}
+	stp := newTestSetupWithConfig(t, cfg, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	stp.connect()
+	topicID := stp.register("sensors/temperature")
+
+	// client --PUBLISH--> GW
+	snPublish := snMsgs.NewPublishMessage(topicID, snMsgs.TIT_REGISTERED, []byte("21.5"), 1, false, false)
+	stp.snSend(snPublish, true)
+
+	// GW --PUBLISH--> MQTT broker
+	mqttPublish := stp.mqttRecv().(*mqttPackets.PublishPacket)
+
+	// A slow MQTT broker.
+	time.Sleep(100 * time.Millisecond)
+
+	// GW <--PUBACK-- MQTT broker
+	mqttPuback := mqttPackets.NewControlPacket(mqttPackets.Puback).(*mqttPackets.PubackPacket)
+	mqttPuback.MessageID = mqttPublish.MessageID
+	stp.mqttSend(mqttPuback, false)
+
+	// client <--PUBACK-- GW
+	stp.snRecv()
+
+	// client --PUBLISH--> GW
+	snPublish = snMsgs.NewPublishMessage(topicID, snMsgs.TIT_REGISTERED, []byte("21.6"), 1, false, false)
+	stp.snSend(snPublish, true)
+
+	// GW --PUBLISH--> MQTT broker
+	stp.mqttRecv()
+
+	// The MQTT broker does not acknowledge the message.
+	time.Sleep(2 * cfg.RetryDelay)
+
+	stp.disconnect()
+
+	tracker.alert(tracker.check(time.Now()))
+	select {
+	case status := <-alerts:
+		assert.Equal("sensors/#", status.Topic)
+		assert.True(status.Breached)
+		assert.GreaterOrEqual(status.Observed, 100*time.Millisecond)
+	default:
+		t.Fatal("SLO breach not alerted")
+	}
+
+	statuses := tracker.statuses()
+	if assert.Len(statuses, 2) {
+		// The unacknowledged message counts with at least RetryDelay.
+		assert.Equal(2, statuses[0].Samples)
+		assert.GreaterOrEqual(statuses[0].Observed, cfg.RetryDelay)
+		assert.Equal(uint64(1), statuses[0].Breaches)
+		// The message is counted in the first matching SLO only.
+		assert.Equal(0, statuses[1].Samples)
+		assert.False(statuses[1].Breached)
+	}
+
+	// Old latencies are forgotten; the last state is kept.
+	assert.Empty(tracker.check(time.Now().Add(sloWindow + time.Second)))
+	assert.True(tracker.statuses()[0].Breached)
+}
+
+func TestParseLatencySLOOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	slos, err := ParseLatencySLOOptions("sensors/#;99.9;500ms", "#;50;2s")
+	assert.NoError(err)
+	assert.Equal(LatencySLOs{
+		{Topic: "sensors/#", Percentile: 99.9, Latency: 500 * time.Millisecond},
+		{Topic: "#", Percentile: 50, Latency: 2 * time.Second},
+	}, slos)
+
+	for _, option := range []string{"sensors/#;99", "sensors/#;101;1s", "sensors/#;99;1"} {
+		_, err := ParseLatencySLOOptions(option)
+		assert.Error(err, option)
+	}
+}
+
+func TestStrictSpec(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict=%t", strict), func(t *testing.T) {
+			assert := assert.New(t)
+
+			cfg := &handlerConfig{
+				RetryDelay: time.Second,
+				RetryCount: 2,
+				StrictSpec: strict,
+			}
+			stp := newTestSetupWithConfig(t, cfg, topics.PredefinedTopics{})
+			defer stp.cancel()
+
+			stp.connect()
+			topicID := stp.register("test/topic")
+
+			// client --PUBLISH(QoS 1, CleanSession flag)--> GW
+			snPublish := snMsgs.NewPublishMessage(topicID, snMsgs.TIT_REGISTERED, []byte("test-msg"), 1, false, false)
+			snPublish.SetMessageID(1)
+			buff := &bytes.Buffer{}
+			if err := snPublish.Write(buff); err != nil {
+				t.Fatal(err)
+			}
+			pkt := buff.Bytes()
+			pkt[2] |= 0x04
+			if _, err := stp.snConn.Write(pkt); err != nil {
+				t.Fatal(err)
+			}
+			if strict {
+				// client <--PUBACK(not supported)-- GW
+				snPuback := stp.snRecv().(*snMsgs.PubackMessage)
+				assert.Equal(snMsgs.RC_NOT_SUPPORTED, snPuback.ReturnCode)
+			} else {
+				// GW --PUBLISH--> MQTT broker
+				mqttPublish := stp.mqttRecv().(*mqttPackets.PublishPacket)
+				assert.Equal("test/topic", mqttPublish.TopicName)
+
+				// GW <--PUBACK-- MQTT broker
+				mqttPuback := mqttPackets.NewControlPacket(mqttPackets.Puback).(*mqttPackets.PubackPacket)
+				mqttPuback.MessageID = mqttPublish.MessageID
+				stp.mqttSend(mqttPuback, false)
+
+				// client <--PUBACK-- GW
+				snPuback := stp.snRecv().(*snMsgs.PubackMessage)
+				assert.Equal(snMsgs.RC_ACCEPTED, snPuback.ReturnCode)
+			}
+
+			// client --PUBLISH(QoS 0, DUP)--> GW
+			snPublish = snMsgs.NewPublishMessage(topicID, snMsgs.TIT_REGISTERED, []byte("test-msg"), 0, false, true)
+			stp.snSend(snPublish, false)
+
+			// client --PUBLISH(QoS -1, registered TopicID)--> GW
+			snPublish = snMsgs.NewPublishMessage(topicID, snMsgs.TIT_REGISTERED, []byte("test-msg"), 3, false, false)
+			stp.snSend(snPublish, false)
+
+			if strict {
+				stp.assertConnEmpty("MQTT", stp.mqttConn, connEmptyTimeout)
+			} else {
+				// GW --PUBLISH--> MQTT broker
+				mqttPublish := stp.mqttRecv().(*mqttPackets.PublishPacket)
+				assert.False(mqttPublish.Dup)
+
+				// GW --PUBLISH--> MQTT broker
+				mqttPublish = stp.mqttRecv().(*mqttPackets.PublishPacket)
+				assert.Equal(uint8(0), mqttPublish.Qos)
+			}
+
+			stp.disconnect()
+
+			deviations := stp.handler.stats.report().Deviations
+			assert.Equal(uint64(1), deviations["reserved_flags"])
+			assert.Equal(uint64(1), deviations["dup_qos0"])
+			assert.Equal(uint64(1), deviations["qos_m1_topic_id"])
+		})
+	}
+}
+
+func TestStrictSpecTimers(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict=%t", strict), func(t *testing.T) {
+			assert := assert.New(t)
+
+			cfg := &handlerConfig{
+				RetryDelay: time.Second,
+				RetryCount: 2,
+				StrictSpec: strict,
+			}
+			stp := newTestSetupWithConfig(t, cfg, topics.PredefinedTopics{})
+			defer stp.cancel()
+
+			// client --CONNECT(KeepAlive 0)--> GW
+			snConnect := snMsgs.NewConnectMessage([]byte("test-client"), true, false, 0)
+			stp.snSend(snConnect, false)
+
+			// client <--CONNACK(not supported)-- GW (even if lenient)
+			snConnack := stp.snRecv().(*snMsgs.ConnackMessage)
+			assert.Equal(snMsgs.RC_NOT_SUPPORTED, snConnack.ReturnCode)
+
+			stp.connect()
+
+			// client --DISCONNECT(Duration 0)--> GW
+			if _, err := stp.snConn.Write([]byte{4, byte(snMsgs.DISCONNECT), 0, 0}); err != nil {
+				t.Fatal(err)
+			}
+			var deviations map[string]uint64
+			if strict {
+				stp.assertConnEmpty("MQTT", stp.mqttConn, connEmptyTimeout)
+				assert.Equal(util.StateActive, stp.handler.state.Get())
+				deviations = stp.handler.stats.report().Deviations
+				stp.disconnect()
+			} else {
+				// GW --DISCONNECT--> MQTT broker
+				_, ok := stp.mqttRecv().(*mqttPackets.DisconnectPacket)
+				assert.True(ok)
+
+				// client <--DISCONNECT-- GW
+				_, ok = stp.snRecv().(*snMsgs.DisconnectMessage)
+				assert.True(ok)
+				deviations = stp.handler.stats.report().Deviations
+				stp.assertHandlerDone()
+			}
+
+			assert.Equal(uint64(1), deviations["keepalive_zero"])
+			assert.Equal(uint64(1), deviations["sleep_zero"])
+		})
+	}
+}
+
+func TestFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	filter, err := NewFilter([]FilterRule{
+		{Action: FilterDeny, PayloadOver: 8},
+		{Action: FilterAllow, Topic: "debug/important"},
+		{Action: FilterDeny, Topic: "debug/#"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &handlerConfig{
+		RetryDelay: time.Second,
+		RetryCount: 2,
+		Filter:     filter,
+	}
+	stp := newTestSetupWithConfig(t, cfg, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	stp.connect()
+	deniedTopicID := stp.register("debug/verbose")
+	allowedTopicID := stp.register("debug/important")
+
+	// client --PUBLISH--> GW
+	snPublish := snMsgs.NewPublishMessage(deniedTopicID, snMsgs.TIT_REGISTERED, []byte("msg-0"), 1, false, false)
+	stp.snSend(snPublish, true)
+
+	// client <--PUBACK-- GW
+	snPuback := stp.snRecv().(*snMsgs.PubackMessage)
+	assert.Equal(snPublish.MessageID(), snPuback.MessageID())
+	assert.Equal(snMsgs.RC_ACCEPTED, snPuback.ReturnCode)
+
+	// Payload too long.
+	// client --PUBLISH--> GW
+	snPublish = snMsgs.NewPublishMessage(allowedTopicID, snMsgs.TIT_REGISTERED, []byte("too-long-msg"), 0, false, false)
+	stp.snSend(snPublish, true)
+
+	// client --PUBLISH--> GW
+	snPublish = snMsgs.NewPublishMessage(allowedTopicID, snMsgs.TIT_REGISTERED, []byte("msg-1"), 0, false, false)
+	stp.snSend(snPublish, true)
+
+	// GW --PUBLISH--> MQTT broker
+	mqttPublish := stp.mqttRecv().(*mqttPackets.PublishPacket)
+	assert.Equal("debug/important", mqttPublish.TopicName)
+	assert.Equal([]byte("msg-1"), mqttPublish.Payload)
+
+	stp.disconnect()
+
+	assert.Equal(uint64(2), stp.handler.stats.report().MessagesDropped["filter"])
+}
+
+func TestFilterInvalidRule(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewFilter([]FilterRule{{Action: "drop"}})
+	assert.Error(err)
+
+	_, err = NewFilter([]FilterRule{{Action: FilterDeny, Payload: "("}})
+	assert.Error(err)
+}
+
+func TestRetainRules(t *testing.T) {
+	assert := assert.New(t)
+
+	rules, err := ParseRetainRuleOptions("telemetry/#;strip", "status/+;force")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &handlerConfig{
+		RetryDelay:  time.Second,
+		RetryCount:  2,
+		RetainRules: rules,
+	}
+	stp := newTestSetupWithConfig(t, cfg, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	stp.connect()
+
+	for _, tc := range []struct {
+		topic          string
+		retain         bool
+		expectedRetain bool
+	}{
+		{"telemetry/temp", true, false},
+		{"status/dev-1", false, true},
+		{"other", true, true},
+		{"other", false, false},
+	} {
+		topicID := stp.register(tc.topic)
+
+		// client --PUBLISH--> GW
+		snPublish := snMsgs.NewPublishMessage(topicID, snMsgs.TIT_REGISTERED, []byte("test-msg"), 0, tc.retain, false)
+		stp.snSend(snPublish, true)
+
+		// GW --PUBLISH--> MQTT broker
+		mqttPublish := stp.mqttRecv().(*mqttPackets.PublishPacket)
+		assert.Equal(tc.topic, mqttPublish.TopicName)
+		assert.Equal(tc.expectedRetain, mqttPublish.Retain, tc.topic)
+	}
+
+	stp.disconnect()
+
+	report := stp.handler.stats.report()
+	assert.Equal(uint64(1), report.MessagesModified["retain_stripped"])
+	assert.Equal(uint64(1), report.MessagesModified["retain_forced"])
+}
+
+func TestParseRetainRuleOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := ParseRetainRuleOptions("telemetry/#")
+	assert.Error(err)
+
+	_, err = ParseRetainRuleOptions("telemetry/#;drop")
+	assert.Error(err)
+}
+
+func TestRoutes(t *testing.T) {
+	assert := assert.New(t)
+
+	// Route's MQTT broker.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	routes, err := ParseRouteOptions("telemetry/#;" + listener.Addr().String() + ";1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := "gw-user"
+	cfg := &handlerConfig{
+		RetryDelay:   time.Second,
+		RetryCount:   2,
+		Routes:       routes,
+		MqttUser:     &user,
+		MqttPassword: []byte("gw-password"),
+	}
+	stp := newTestSetupWithConfig(t, cfg, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	stp.connect()
+
+	routeConn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer routeConn.Close()
+	routeSend := func(msg mqttPackets.ControlPacket) {
+		if err := msg.Write(routeConn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	routeRecv := func() mqttPackets.ControlPacket {
+		for {
+			if err := routeConn.SetReadDeadline(time.Now().Add(3 * time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			msg, err := mqttPackets.ReadPacket(routeConn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Sent by the route's keepalive.
+			if _, ok := msg.(*mqttPackets.PingreqPacket); !ok {
+				return msg
+			}
+		}
+	}
+	upstream := stp.handler.upstreams[0]
+
+	// GW --CONNECT--> route's MQTT broker
+	mqttConnect := routeRecv().(*mqttPackets.ConnectPacket)
+	assert.Equal("test-client", mqttConnect.ClientIdentifier)
+	// The default MQTT broker's credentials are not sent to the route.
+	assert.False(mqttConnect.UsernameFlag)
+	assert.False(mqttConnect.PasswordFlag)
+	assert.Empty(mqttConnect.Password)
+
+	// GW <--CONNACK-- route's MQTT broker
+	routeSend(mqttPackets.NewControlPacket(mqttPackets.Connack))
+	assert.Eventually(upstream.connected, time.Second, 10*time.Millisecond)
+
+	telemetryTopicID := stp.register("telemetry/temp")
+
+	// client --PUBLISH(QoS 1)--> GW
+	snPublish := snMsgs.NewPublishMessage(telemetryTopicID, snMsgs.TIT_REGISTERED, []byte("21.5"), 1, false, false)
+	stp.snSend(snPublish, true)
+
+	// GW --PUBLISH--> route's MQTT broker
+	mqttPublish := routeRecv().(*mqttPackets.PublishPacket)
+	assert.Equal("telemetry/temp", mqttPublish.TopicName)
+	assert.Equal(uint8(1), mqttPublish.Qos)
+
+	// GW <--PUBACK-- route's MQTT broker
+	mqttPuback := mqttPackets.NewControlPacket(mqttPackets.Puback).(*mqttPackets.PubackPacket)
+	mqttPuback.MessageID = mqttPublish.MessageID
+	routeSend(mqttPuback)
+
+	// client <--PUBACK-- GW
+	snPuback := stp.snRecv().(*snMsgs.PubackMessage)
+	assert.Equal(snPublish.MessageID(), snPuback.MessageID())
+	assert.Equal(snMsgs.RC_ACCEPTED, snPuback.ReturnCode)
+
+	// client --PUBLISH(QoS 2)--> GW
+	snPublish = snMsgs.NewPublishMessage(telemetryTopicID, snMsgs.TIT_REGISTERED, []byte("21.6"), 2, false, false)
+	stp.snSend(snPublish, true)
+
+	// GW --PUBLISH(QoS 1)--> route's MQTT broker
+	mqttPublish = routeRecv().(*mqttPackets.PublishPacket)
+	assert.Equal(uint8(1), mqttPublish.Qos)
+
+	// client <--PUBREC-- GW
+	snPubrec := stp.snRecv().(*snMsgs.PubrecMessage)
+	assert.Equal(snPublish.MessageID(), snPubrec.MessageID())
+
+	// GW <--PUBACK-- route's MQTT broker (not passed to the client)
+	mqttPuback = mqttPackets.NewControlPacket(mqttPackets.Puback).(*mqttPackets.PubackPacket)
+	mqttPuback.MessageID = mqttPublish.MessageID
+	routeSend(mqttPuback)
+
+	// client --PUBREL--> GW
+	snPubrel := snMsgs.NewPubrelMessage()
+	snPubrel.SetMessageID(snPublish.MessageID())
+	stp.snSend(snPubrel, false)
+
+	// client <--PUBCOMP-- GW
+	snPubcomp := stp.snRecv().(*snMsgs.PubcompMessage)
+	assert.Equal(snPublish.MessageID(), snPubcomp.MessageID())
+
+	// client --SUBSCRIBE(QoS 2)--> GW
+	snSubscribe := snMsgs.NewSubscribeMessage(0, snMsgs.TIT_STRING, []byte("telemetry/cmd"), 2, false)
+	stp.snSend(snSubscribe, true)
+
+	// GW --SUBSCRIBE(QoS 1)--> route's MQTT broker
+	mqttSubscribe := routeRecv().(*mqttPackets.SubscribePacket)
+	assert.Equal([]string{"telemetry/cmd"}, mqttSubscribe.Topics)
+	assert.Equal([]byte{1}, mqttSubscribe.Qoss)
+
+	// GW <--SUBACK-- route's MQTT broker
+	mqttSuback := mqttPackets.NewControlPacket(mqttPackets.Suback).(*mqttPackets.SubackPacket)
+	mqttSuback.MessageID = mqttSubscribe.MessageID
+	mqttSuback.ReturnCodes = []byte{1}
+	routeSend(mqttSuback)
+
+	// client <--SUBACK-- GW
+	snSuback := stp.snRecv().(*snMsgs.SubackMessage)
+	assert.Equal(snMsgs.RC_ACCEPTED, snSuback.ReturnCode)
+	assert.Equal(uint8(1), snSuback.QOS)
+	cmdTopicID := snSuback.TopicID
+
+	// GW <--PUBLISH-- route's MQTT broker
+	mqttPublish = mqttPackets.NewControlPacket(mqttPackets.Publish).(*mqttPackets.PublishPacket)
+	mqttPublish.MessageID = 1
+	mqttPublish.Qos = 1
+	mqttPublish.TopicName = "telemetry/cmd"
+	mqttPublish.Payload = []byte("reboot")
+	routeSend(mqttPublish)
+
+	// client <--PUBLISH-- GW
+	snPublish = stp.snRecv().(*snMsgs.PublishMessage)
+	assert.Equal(cmdTopicID, snPublish.TopicID)
+	assert.Equal([]byte("reboot"), snPublish.Data)
+
+	// client --PUBACK--> GW
+	snPuback = snMsgs.NewPubackMessage(cmdTopicID, snMsgs.RC_ACCEPTED)
+	snPuback.SetMessageID(snPublish.MessageID())
+	stp.snSend(snPuback, false)
+
+	// GW --PUBACK--> route's MQTT broker
+	mqttPuback = routeRecv().(*mqttPackets.PubackPacket)
+	assert.Equal(uint16(1), mqttPuback.MessageID)
+
+	// The route's MQTT broker fails.
+	routeConn.Close()
+	assert.Eventually(func() bool {
+		return !upstream.connected()
+	}, time.Second, 10*time.Millisecond)
+
+	// client --PUBLISH(QoS 1)--> GW
+	snPublish = snMsgs.NewPublishMessage(telemetryTopicID, snMsgs.TIT_REGISTERED, []byte("21.7"), 1, false, false)
+	stp.snSend(snPublish, true)
+
+	// client <--PUBACK(congestion)-- GW
+	snPuback = stp.snRecv().(*snMsgs.PubackMessage)
+	assert.Equal(snMsgs.RC_CONGESTION, snPuback.ReturnCode)
+
+	// Other topics are not affected.
+	otherTopicID := stp.register("other")
+
+	// client --PUBLISH(QoS 1)--> GW
+	snPublish = snMsgs.NewPublishMessage(otherTopicID, snMsgs.TIT_REGISTERED, []byte("test-msg"), 1, false, false)
+	stp.snSend(snPublish, true)
+
+	// GW --PUBLISH--> MQTT broker
+	mqttPublish = stp.mqttRecv().(*mqttPackets.PublishPacket)
+	assert.Equal("other", mqttPublish.TopicName)
+
+	// GW <--PUBACK-- MQTT broker
+	mqttPuback = mqttPackets.NewControlPacket(mqttPackets.Puback).(*mqttPackets.PubackPacket)
+	mqttPuback.MessageID = mqttPublish.MessageID
+	stp.mqttSend(mqttPuback, false)
+
+	// client <--PUBACK-- GW
+	snPuback = stp.snRecv().(*snMsgs.PubackMessage)
+	assert.Equal(snMsgs.RC_ACCEPTED, snPuback.ReturnCode)
+
+	stp.disconnect()
+
+	assert.Equal(uint64(1), stp.handler.stats.report().Errors["route"])
+}
+
+func TestSelfCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	broker := newEchoBroker(t)
+	defer broker.Close()
+	// A closed port.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unreachable := listener.Addr().(*net.TCPAddr)
+	listener.Close()
+
+	predefined := topics.PredefinedTopics{}
+	predefined.Add("*", "topic/a", 1)
+	predefined.Add("*", "topic/b", 2)
+	predefined.Add("client", "topic/c", 1)
+	predefined.Add("client", "topic/c", 3)
+	predefined.Add("client", "topic/b", 2)
+
+	cfg := &GatewayConfig{
+		MqttBrokerAddress:     broker.Addr().(*net.TCPAddr),
+		MqttConnectionTimeout: time.Second,
+		PredefinedTopics:      predefined,
+		Routes: Routes{
+			{Topic: "sensors/#/raw", Broker: broker.Addr().(*net.TCPAddr)},
+			{Topic: "meters/+", Broker: unreachable},
+		},
+		PushTopics:    []string{"config/+"},
+		MqttKeepAlive: 24 * time.Hour,
+		UseDTLS:       true,
+		Certificate: &tls.Certificate{
+			Certificate: [][]byte{{0}},
+			Leaf: &x509.Certificate{
+				Subject:   pkix.Name{CommonName: "gw"},
+				NotBefore: time.Now().Add(-2 * time.Hour),
+				NotAfter:  time.Now().Add(-time.Hour),
+			},
+		},
+	}
+	gw := NewGateway(util.NoOpLogger{}, cfg)
+	problems := gw.SelfCheck(context.Background())
+	checks := make(map[string]int)
+	for _, p := range problems {
+		checks[p.Check]++
+	}
+	assert.Equal(map[string]int{
+		// topic/c predefined twice, TopicID 1 shadows topic/a
+		"predefined_topics": 2,
+		// sensors/#/raw, config/+
+		"topics":      2,
+		"broker":      1,
+		"certificate": 1,
+		"keepalive":   1,
+	}, checks, problems)
+
+	// Strict mode refuses to start.
+	cfg.StrictConfig = true
+	err = gw.ListenAndServe(context.Background(), "127.0.0.1:0")
+	assert.Error(err)
+
+	// A valid configuration.
+	gw = NewGateway(util.NoOpLogger{}, &GatewayConfig{
+		MqttBrokerAddress: broker.Addr().(*net.TCPAddr),
+		PredefinedTopics:  topics.PredefinedTopics{},
+		Routes: Routes{
+			{Topic: "meters/+/#", Broker: broker.Addr().(*net.TCPAddr)},
+		},
+	})
+	assert.Empty(gw.SelfCheck(context.Background()))
+}
+
+func TestParseRouteOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	routes, err := ParseRouteOptions("telemetry/#;127.0.0.1:1883", "cmd/#;127.0.0.1:1884;0")
+	if assert.NoError(err) && assert.Len(routes, 2) {
+		assert.Equal(uint8(2), routes[0].MaxQOS)
+		assert.Equal(1884, routes[1].Broker.Port)
+		assert.Equal(uint8(0), routes[1].MaxQOS)
+	}
+
+	routes, err = ParseRouteOptions("telemetry/#;127.0.0.1:1883;;cloud;secret")
+	if assert.NoError(err) && assert.Len(routes, 1) {
+		assert.Equal(uint8(2), routes[0].MaxQOS)
+		if assert.NotNil(routes[0].User) {
+			assert.Equal("cloud", *routes[0].User)
+		}
+		assert.Equal([]byte("secret"), routes[0].Password)
+	}
+
+	_, err = ParseRouteOptions("telemetry/#")
+	assert.Error(err)
+
+	_, err = ParseRouteOptions("telemetry/#;127.0.0.1:1883;3")
+	assert.Error(err)
+}
+
+func TestSleepDownlinkPriority(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := &handlerConfig{
+		RetryDelay: time.Second,
+		RetryCount: 2,
+		DownlinkPriorities: TopicPriorities{
+			{Topic: "alarm/#", Priority: 10},
+		},
+	}
+	stp := newTestSetupWithConfig(t, cfg, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	stp.connect()
+	telemetryTopicID := stp.subscribe("telemetry", 0)
+	alarmTopicID := stp.subscribe("alarm/fire", 0)
+
+	// client --DISCONNECT(duration)--> GW
+	snDisconnect := snMsgs.NewDisconnectMessage(1)
+	stp.snSend(snDisconnect, false)
+
+	// client <--DISCONNECT-- GW
+	stp.snRecv()
+
+	// GW <--PUBLISH-- MQTT broker
+	for _, topic := range []string{"telemetry", "alarm/fire"} {
+		mqttPublish := mqttPackets.NewControlPacket(mqttPackets.Publish).(*mqttPackets.PublishPacket)
+		mqttPublish.TopicName = topic
+		mqttPublish.Payload = []byte(topic)
+		stp.mqttSend(mqttPublish, false)
+	}
+	for {
+		stp.handler.msgBufferLock.Lock()
+		n := len(stp.handler.msgBuffer)
+		stp.handler.msgBufferLock.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// client --PINGREQ--> GW
+	stp.snSend(snMsgs.NewPingreqMessage(nil), false)
+
+	// client <--PUBLISH-- GW
+	snPublish := stp.snRecv().(*snMsgs.PublishMessage)
+	assert.Equal(alarmTopicID, snPublish.TopicID)
+
+	// client <--PUBLISH-- GW
+	snPublish = stp.snRecv().(*snMsgs.PublishMessage)
+	assert.Equal(telemetryTopicID, snPublish.TopicID)
+
+	// client <--PINGRESP-- GW
+	_, ok := stp.snRecv().(*snMsgs.PingrespMessage)
+	assert.True(ok)
+
+	stp.disconnect()
+}
+
+func TestSleepCoalesce(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := &handlerConfig{
+		RetryDelay:   time.Second,
+		RetryCount:   2,
+		CoalesceSize: 64,
+	}
+	stp := newTestSetupWithConfig(t, cfg, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	stp.connect()
+	topicID := stp.subscribe("telemetry", 0)
+
+	// client --DISCONNECT(duration)--> GW
+	stp.snSend(snMsgs.NewDisconnectMessage(1), false)
+
+	// client <--DISCONNECT-- GW
+	stp.snRecv()
+
+	// GW <--PUBLISH-- MQTT broker
+	payloads := []string{"1", "2", strings.Repeat("3", 50)}
+	for _, payload := range payloads {
+		mqttPublish := mqttPackets.NewControlPacket(mqttPackets.Publish).(*mqttPackets.PublishPacket)
+		mqttPublish.TopicName = "telemetry"
+		mqttPublish.Payload = []byte(payload)
+		stp.mqttSend(mqttPublish, false)
+	}
+	for {
+		stp.handler.msgBufferLock.Lock()
+		n := len(stp.handler.msgBuffer)
+		stp.handler.msgBufferLock.Unlock()
+		if n == len(payloads) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// client --PINGREQ--> GW
+	stp.snSend(snMsgs.NewPingreqMessage(nil), false)
+
+	// client <--PUBLISH, PUBLISH-- GW
+	// client <--PUBLISH, PINGRESP-- GW
+	for _, expected := range [][]string{payloads[:2], {payloads[2], ""}} {
+		data, err := testRead("MQTT-SN", stp.snConn, time.Second)
+		if !assert.NoError(err) {
+			return
+		}
+		r := bytes.NewReader(data)
+		for _, payload := range expected {
+			header := &snMsgs.Header{}
+			header.Unpack(r)
+			msg := snMsgs.NewMessageWithHeader(*header)
+			msg.Unpack(r)
+			if payload == "" {
+				assert.IsType(&snMsgs.PingrespMessage{}, msg)
+				continue
+			}
+			if snPublish, ok := msg.(*snMsgs.PublishMessage); assert.True(ok) {
+				assert.Equal(topicID, snPublish.TopicID)
+				assert.Equal([]byte(payload), snPublish.Data)
+			}
+		}
+		assert.Equal(0, r.Len())
+	}
+
+	stp.disconnect()
+}
+
+func TestSleepWakeEventHook(t *testing.T) {
+	assert := assert.New(t)
+
+	var stp *testSetup
+	woken := make(chan struct{}, 1)
+	cfg := &handlerConfig{
+		RetryDelay: time.Second,
+		RetryCount: 2,
+		EventHook: func(event Event) {
+			if event.Type == EventStateChanged && event.Client.State == util.StateAwake {
+				// The hook must not be called with msgBufferLock held.
+				stp.handler.msgBufferLock.Lock()
+				stp.handler.msgBufferLock.Unlock()
+				woken <- struct{}{}
+			}
+		},
+	}
+	stp = newTestSetupWithConfig(t, cfg, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	stp.connect()
+
+	// client --DISCONNECT(duration)--> GW
+	stp.snSend(snMsgs.NewDisconnectMessage(1), false)
+
+	// client <--DISCONNECT-- GW
+	stp.snRecv()
+
+	// client --PINGREQ--> GW
+	stp.snSend(snMsgs.NewPingreqMessage(nil), false)
+
+	// client <--PINGRESP-- GW
+	_, ok := stp.snRecv().(*snMsgs.PingrespMessage)
+	assert.True(ok)
+	select {
+	case <-woken:
+	case <-time.After(time.Second):
+		t.Error("EventStateChanged not emitted")
+	}
+
+	stp.disconnect()
+}
+
+func TestPushTopics(t *testing.T) {
+	assert := assert.New(t)
+
+	topic := "test/pushed"
+	cfg := &handlerConfig{
+		RetryDelay: time.Second,
+		RetryCount: 2,
+		// Only the first topic can be registered.
+		PushTopics: []string{topic, "test/+", "ab"},
+	}
+	stp := newTestSetupWithConfig(t, cfg, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	stp.connect()
+
+	// client <--REGISTER-- GW
+	snRegister := stp.snRecv().(*snMsgs.RegisterMessage)
+	assert.Equal(topic, snRegister.TopicName)
+	topicID := snRegister.TopicID
+
+	// client --REGACK--> GW
+	snRegack := snMsgs.NewRegackMessage(topicID, snMsgs.RC_ACCEPTED)
+	snRegack.CopyMessageID(snRegister)
+	stp.snSend(snRegack, false)
+
+	for {
+		if _, ok := stp.handler.findRegisteredTopicID(topic); ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// GW <--PUBLISH-- MQTT broker
+	mqttPublish := mqttPackets.NewControlPacket(mqttPackets.Publish).(*mqttPackets.PublishPacket)
+	mqttPublish.TopicName = topic
+	mqttPublish.Payload = []byte("test-msg")
+	stp.mqttSend(mqttPublish, false)
+
+	// client <--PUBLISH-- GW (no REGISTER needed)
+	snPublish := stp.snRecv().(*snMsgs.PublishMessage)
+	assert.Equal(topicID, snPublish.TopicID)
+	assert.Equal(snMsgs.TIT_REGISTERED, snPublish.TopicIDType)
+
+	stp.disconnect()
+}
+
+func TestBrokerPublishOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	topic := "test/topic"
+	qos := uint8(1)
+
+	stp := newTestSetup(t, false, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	stp.connect()
+	stp.subscribe("test/+", qos)
+
+	// GW <--PUBLISH-- MQTT broker (2x)
+	for _, payload := range []string{"msg-1", "msg-2"} {
+		mqttPublish := mqttPackets.NewControlPacket(mqttPackets.Publish).(*mqttPackets.PublishPacket)
+		mqttPublish.Qos = qos
+		mqttPublish.TopicName = topic
+		mqttPublish.Payload = []byte(payload)
+		stp.mqttSend(mqttPublish, true)
+	}
+
+	// client <--REGISTER-- GW
+	snRegister := stp.snRecv().(*snMsgs.RegisterMessage)
+	assert.Equal(topic, snRegister.TopicName)
+	topicID := snRegister.TopicID
+
+	// The second message waits for the first one.
+	stp.assertConnEmpty("MQTT-SN", stp.snConn, connEmptyTimeout)
+
+	// client --REGACK--> GW
+	snRegack := snMsgs.NewRegackMessage(topicID, snMsgs.RC_ACCEPTED)
+	snRegack.SetMessageID(snRegister.MessageID())
+	stp.snSend(snRegack, false)
+
+	for _, payload := range []string{"msg-1", "msg-2"} {
+		// client <--PUBLISH-- GW
+		snPublish := stp.snRecv().(*snMsgs.PublishMessage)
+		assert.Equal(topicID, snPublish.TopicID)
+		assert.Equal([]byte(payload), snPublish.Data)
+
+		// client --PUBACK--> GW
+		snPuback := snMsgs.NewPubackMessage(topicID, snMsgs.RC_ACCEPTED)
+		snPuback.SetMessageID(snPublish.MessageID())
+		stp.snSend(snPuback, false)
+
+		// GW --PUBACK--> MQTT broker
+		mqttPuback := stp.mqttRecv().(*mqttPackets.PubackPacket)
+		assert.Equal(snPuback.MessageID(), mqttPuback.MessageID)
+	}
+
+	stp.disconnect()
+}
+
+func TestBrokerPublishOrderRegisterMsgIDs(t *testing.T) {
+	assert := assert.New(t)
+
+	topicA := "test/a"
+	topicB := "test/b"
+
+	stp := newTestSetup(t, false, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	stp.connect()
+	stp.subscribe("test/+", 1)
+
+	newPublish := func(topic string, qos uint8, payload string) *mqttPackets.PublishPacket {
+		mqttPublish := mqttPackets.NewControlPacket(mqttPackets.Publish).(*mqttPackets.PublishPacket)
+		mqttPublish.Qos = qos
+		mqttPublish.TopicName = topic
+		mqttPublish.Payload = []byte(payload)
+		return mqttPublish
+	}
+
+	// GW <--PUBLISH(QoS 1)-- MQTT broker
+	stp.mqttSend(newPublish(topicA, 1, "a-1"), true)
+
+	// client <--REGISTER-- GW
+	snRegister := stp.snRecv().(*snMsgs.RegisterMessage)
+	assert.Equal(topicA, snRegister.TopicName)
+
+	// GW <--PUBLISH(QoS 0)-- MQTT broker
+	// Waits for the QoS 1 message.
+	stp.mqttSend(newPublish(topicA, 0, "a-2"), false)
+	stp.assertConnEmpty("MQTT-SN", stp.snConn, connEmptyTimeout)
+
+	// The queued QoS 0 message and a QoS 0 message on another topic must be
+	// registered at the same time. Their deliveries must be serialized by
+	// the upstream lock, otherwise the REGISTERs could get the same MsgID.
+	stp.handler.upstreamLock.Lock()
+
+	// client --REGACK(rejected)--> GW
+	// The QoS 1 delivery fails, the queued QoS 0 message is dequeued.
+	snRegack := snMsgs.NewRegackMessage(0, snMsgs.RC_INVALID_TOPIC_ID)
+	snRegack.SetMessageID(snRegister.MessageID())
+	stp.snSend(snRegack, false)
+	// GW <--PUBLISH(QoS 0)-- MQTT broker
+	stp.mqttSend(newPublish(topicB, 0, "b-1"), false)
+
+	// Nothing is delivered while the lock is held.
+	stp.assertConnEmpty("MQTT-SN", stp.snConn, connEmptyTimeout)
+	stp.handler.upstreamLock.Unlock()
+
+	// client <--REGISTER-- GW (2x)
+	msgIDs := make(map[uint16]bool)
+	registered := make(map[string]uint16)
+	for i := 0; i < 2; i++ {
+		snRegister := stp.snRecv().(*snMsgs.RegisterMessage)
+		msgIDs[snRegister.MessageID()] = true
+		registered[snRegister.TopicName] = snRegister.TopicID
+	}
+	assert.Len(msgIDs, 2, "REGISTER MsgIDs must differ")
+	assert.Contains(registered, topicA)
+	assert.Contains(registered, topicB)
+
+	// client --REGACK--> GW (2x)
+	for msgID := range msgIDs {
+		snRegack := snMsgs.NewRegackMessage(0, snMsgs.RC_ACCEPTED)
+		snRegack.SetMessageID(msgID)
+		stp.snSend(snRegack, false)
+	}
+
+	// client <--PUBLISH-- GW (2x)
+	payloads := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		snPublish := stp.snRecv().(*snMsgs.PublishMessage)
+		payloads[string(snPublish.Data)] = true
+	}
+	assert.Equal(map[string]bool{"a-2": true, "b-1": true}, payloads)
+
+	stp.disconnect()
+}
+
+func TestBrokerPublishQOS0FastPath(t *testing.T) {
+	assert := assert.New(t)
+
+	topic := "test/topic"
+
+	stp := newTestSetup(t, false, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	stp.connect()
+	topicID := stp.register(topic)
+	stp.subscribe(topic, 0)
+
+	// GW <--PUBLISH-- MQTT broker
+	mqttPublish := mqttPackets.NewControlPacket(mqttPackets.Publish).(*mqttPackets.PublishPacket)
+	mqttPublish.TopicName = topic
+	mqttPublish.Payload = []byte("test-payload")
+	stp.mqttSend(mqttPublish, false)
+
+	// client <--PUBLISH-- GW
+	snPublish := stp.snRecv().(*snMsgs.PublishMessage)
+	assert.Equal(topicID, snPublish.TopicID)
+	assert.Equal(mqttPublish.Payload, snPublish.Data)
+
+	// Neither a transaction nor delivery bookkeeping was needed.
+	assert.Nil(stp.handler.deliveries.waiting)
+	assert.Empty(stp.handler.transactions.StoredBefore(time.Now()))
+
+	stp.disconnect()
+}
+
+func BenchmarkBrokerPublishQOS0(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h := newHandler(&handlerConfig{}, topics.PredefinedTopics{}, util.NewProductionLogger("bench"))
+	h.state.Set(util.StateActive)
+	snConn, client := net.Pipe()
+	defer client.Close()
+	go io.Copy(ioutil.Discard, client)
+	h.snConn = util.NewConnWithContext(ctx, snConn, connTimeout)
+
+	mqttPublish := mqttPackets.NewControlPacket(mqttPackets.Publish).(*mqttPackets.PublishPacket)
+	mqttPublish.TopicName = "test/topic"
+	mqttPublish.Payload = []byte("test-payload")
+	if _, err := h.registerTopic(mqttPublish.TopicName); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sent, err := h.sendBrokerPublishQOS0(mqttPublish)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if !sent {
+			b.Fatal("PUBLISH not sent")
+		}
+	}
+}
+
+func TestSubscribeRegisteredTopic(t *testing.T) {
+	topic := "test/topic"
+
+	stp := newTestSetup(t, false, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	stp.connect()
+	topicID := stp.register(topic)
+	// The topic keeps its TopicID.
+	assert.Equal(t, topicID, stp.subscribe(topic, 0))
+
+	stp.disconnect()
+}
+
+func TestDownlinkShaping(t *testing.T) {
+	assert := assert.New(t)
+
+	topic := "test/topic"
+	cfg := &handlerConfig{
+		RetryDelay:          time.Second,
+		RetryCount:          2,
+		DownlinkMessageRate: 2,
+	}
+	stp := newTestSetupWithConfig(t, cfg, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	stp.connect()
+	topicID := stp.subscribe(topic, 1)
+
+	// GW <--PUBLISH-- MQTT broker (3x QoS 0, 1x QoS 1)
+	for i, qos := range []uint8{0, 0, 0, 1} {
+		mqttPublish := mqttPackets.NewControlPacket(mqttPackets.Publish).(*mqttPackets.PublishPacket)
+		mqttPublish.Qos = qos
+		mqttPublish.TopicName = topic
+		mqttPublish.Payload = []byte(fmt.Sprintf("msg-%d", i))
+		stp.mqttSend(mqttPublish, qos > 0)
+	}
+	start := time.Now()
+
+	// The burst allows two messages, the third one is dropped.
+	for _, payload := range []string{"msg-0", "msg-1"} {
+		// client <--PUBLISH-- GW
+		snPublish := stp.snRecv().(*snMsgs.PublishMessage)
+		assert.Equal(topicID, snPublish.TopicID)
+		assert.Equal([]byte(payload), snPublish.Data)
+	}
+
+	// The QoS 1 message is delayed, the other brokers' messages are
+	// handled meanwhile.
+	unlocked := make(chan struct{})
+	go func() {
+		stp.handler.upstreamLock.Lock()
+		stp.handler.upstreamLock.Unlock()
+		close(unlocked)
+	}()
+	select {
+	case <-unlocked:
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("upstream lock held while the message is delayed")
+	}
+
+	// client <--PUBLISH-- GW
+	snPublish := stp.snRecv().(*snMsgs.PublishMessage)
+	assert.Equal([]byte("msg-3"), snPublish.Data)
+	assert.GreaterOrEqual(time.Since(start), 400*time.Millisecond)
+
+	// client --PUBACK--> GW
+	snPuback := snMsgs.NewPubackMessage(topicID, snMsgs.RC_ACCEPTED)
+	snPuback.SetMessageID(snPublish.MessageID())
+	stp.snSend(snPuback, false)
+
+	// GW --PUBACK--> MQTT broker
+	stp.mqttRecv()
+
+	stp.disconnect()
+
+	assert.Equal(uint64(1), stp.handler.stats.report().MessagesDropped["downlink_rate"])
+}
+
+func TestSleepPinger(t *testing.T) {
+	assert := assert.New(t)
+
+	stp := newTestSetup(t, false, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	stp.connect()
+
+	// The broker must be pinged even if the sleep duration does not exceed
+	// the keepalive: the client's PINGREQs are not passed to the broker
+	// when asleep.
+	// client --DISCONNECT(duration)--> GW
+	snDisconnect := snMsgs.NewDisconnectMessage(1)
+	stp.snSend(snDisconnect, false)
+
+	// client <--DISCONNECT-- GW
+	_, ok := stp.snRecv().(*snMsgs.DisconnectMessage)
+	assert.True(ok)
+
+	// GW --PINGREQ--> MQTT broker
+	_, ok = stp.mqttRecv().(*mqttPackets.PingreqPacket)
+	assert.True(ok)
+
+	// GW <--PINGRESP-- MQTT broker (not passed to the client)
+	stp.mqttSend(mqttPackets.NewControlPacket(mqttPackets.Pingresp), false)
+
+	// client --PINGREQ--> GW (awake)
+	stp.snSend(snMsgs.NewPingreqMessage(nil), false)
+
+	// client <--PINGRESP-- GW
+	_, ok = stp.snRecv().(*snMsgs.PingrespMessage)
+	assert.True(ok)
+
+	// GW --PINGREQ--> MQTT broker
+	_, ok = stp.mqttRecv().(*mqttPackets.PingreqPacket)
+	assert.True(ok)
+
+	stp.disconnect()
+}
+
+func TestBrokerLatency(t *testing.T) {
+	assert := assert.New(t)
+
+	stp := newTestSetup(t, false, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	latency := 300 * time.Millisecond
+	stp.mqttFaults.setLatency(latency)
+
+	stp.connect()
+	topicID := stp.register("test-topic")
+
+	// client --PUBLISH--> GW
+	snPublish := snMsgs.NewPublishMessage(topicID, snMsgs.TIT_REGISTERED, []byte("test-msg"), 1, false, false)
+	stp.snSend(snPublish, true)
+
+	// GW --PUBLISH--> MQTT broker
+	mqttPublish := stp.mqttRecv().(*mqttPackets.PublishPacket)
+	assert.Equal("test-topic", mqttPublish.TopicName)
+
+	// GW <--PUBACK-- MQTT broker
+	mqttPuback := mqttPackets.NewControlPacket(mqttPackets.Puback).(*mqttPackets.PubackPacket)
+	mqttPuback.MessageID = mqttPublish.MessageID
+	sent := time.Now()
+	stp.mqttSend(mqttPuback, false)
+
+	// client <--PUBACK-- GW
+	snPuback := stp.snRecv().(*snMsgs.PubackMessage)
+	assert.GreaterOrEqual(int64(time.Since(sent)), int64(latency))
+	assert.Equal(snPublish.MessageID(), snPuback.MessageID())
+	assert.Equal(snMsgs.RC_ACCEPTED, snPuback.ReturnCode)
+
+	stp.disconnect()
+}
+
+func TestBrokerDrop(t *testing.T) {
+	stp := newTestSetup(t, false, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	stp.connect()
+
+	stp.mqttFaults.drop()
+
+	// client <--DISCONNECT-- GW
+	_, ok := stp.snRecv().(*snMsgs.DisconnectMessage)
+	assert.True(t, ok)
+
+	stp.assertHandlerDone()
+}
+
+func TestBrokerMalformedPacket(t *testing.T) {
+	stp := newTestSetup(t, false, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	stp.connect()
+
+	// Reserved MQTT packet type.
+	stp.mqttFaults.injectGarbage([]byte{0xF0, 0x00})
+
+	// client <--DISCONNECT-- GW
+	_, ok := stp.snRecv().(*snMsgs.DisconnectMessage)
+	assert.True(t, ok)
+
+	stp.assertHandlerDone()
+}
+
+func TestMqttKeepAliveOverride(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := &handlerConfig{
+		RetryDelay:    time.Second,
+		RetryCount:    2,
+		MqttKeepAlive: time.Minute,
+	}
+	stp := newTestSetupWithConfig(t, cfg, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	// client --CONNECT--> GW
+	snConnect := snMsgs.NewConnectMessage([]byte("test-client"), true, false, 1)
+	stp.snSend(snConnect, false)
+
+	// GW --CONNECT--> MQTT broker
+	mqttConnect := stp.mqttRecv().(*mqttPackets.ConnectPacket)
+	assert.Equal(uint16(60), mqttConnect.Keepalive)
+
+	// GW <--CONNACK-- MQTT broker
+	mqttConnack := mqttPackets.NewControlPacket(mqttPackets.Connack).(*mqttPackets.ConnackPacket)
+	mqttConnack.ReturnCode = mqttPackets.Accepted
+	stp.mqttSend(mqttConnack, false)
+
+	// client <--CONNACK-- GW
+	snConnack := stp.snRecv().(*snMsgs.ConnackMessage)
+	assert.Equal(snMsgs.RC_ACCEPTED, snConnack.ReturnCode)
+
+	// client --PINGREQ--> GW
+	stp.snSend(snMsgs.NewPingreqMessage(nil), false)
+
+	// client <--PINGRESP-- GW (answered locally)
+	_, ok := stp.snRecv().(*snMsgs.PingrespMessage)
+	assert.True(ok)
+
+	// The client stops sending messages => the gateway must notice it
+	// itself because the broker expects pings much later.
+	// client <--DISCONNECT-- GW
+	_, ok = stp.snRecv().(*snMsgs.DisconnectMessage)
+	assert.True(ok)
+
+	stp.assertHandlerDone()
+}
+
+func TestMqttKeepAliveClamp(t *testing.T) {
+	assert := assert.New(t)
+
+	// 24h does not fit in the MQTT CONNECT Keep Alive field.
+	h := &handler{cfg: &handlerConfig{MqttKeepAlive: 24 * time.Hour}}
+	h.setKeepAlive(1)
+	keepAlive, mqttKeepAlive := h.keepAlives()
+	assert.Equal(uint16(1), keepAlive)
+	assert.Equal(uint16(math.MaxUint16), mqttKeepAlive)
+}
+
+func TestMqttKeepAliveAfterConnack(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := &handlerConfig{
+		RetryDelay:    time.Second,
+		RetryCount:    2,
+		MqttKeepAlive: time.Second,
+	}
+	stp := newTestSetupWithConfig(t, cfg, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	// client --CONNECT--> GW
+	snConnect := snMsgs.NewConnectMessage([]byte("test-client"), true, false, 1)
+	stp.snSend(snConnect, false)
+
+	// GW --CONNECT--> MQTT broker
+	_, ok := stp.mqttRecv().(*mqttPackets.ConnectPacket)
+	assert.True(ok)
+
+	// The broker is slow to accept the connection. Neither the broker
+	// pinger nor the client watchdog may run meanwhile.
+	stp.assertConnEmpty("MQTT", stp.mqttConn, 2*time.Second)
+	stp.assertConnEmpty("MQTT-SN", stp.snConn, 0)
+
+	// GW <--CONNACK-- MQTT broker
+	mqttConnack := mqttPackets.NewControlPacket(mqttPackets.Connack).(*mqttPackets.ConnackPacket)
+	mqttConnack.ReturnCode = mqttPackets.Accepted
+	stp.mqttSend(mqttConnack, false)
+
+	// client <--CONNACK-- GW
+	snConnack := stp.snRecv().(*snMsgs.ConnackMessage)
+	assert.Equal(snMsgs.RC_ACCEPTED, snConnack.ReturnCode)
+
+	// client --PINGREQ--> GW
+	stp.snSend(snMsgs.NewPingreqMessage(nil), false)
+
+	// client <--PINGRESP-- GW (answered locally)
+	_, ok = stp.snRecv().(*snMsgs.PingrespMessage)
+	assert.True(ok)
+
+	// GW --PINGREQ--> MQTT broker
+	_, ok = stp.mqttRecv().(*mqttPackets.PingreqPacket)
+	assert.True(ok)
+
+	stp.disconnect()
+	stp.assertHandlerDone()
+}
+
+func TestMqtt5Conn(t *testing.T) {
+	assert := assert.New(t)
+
+	gwConn, brokerConn := net.Pipe()
+	defer gwConn.Close()
+	defer brokerConn.Close()
+	conn := newMqtt5Conn(gwConn, 4)
+
+	// send writes the MQTT 3.1.1 packet to conn and returns the MQTT 5
+	// packet received by the broker.
+	send := func(pkt mqttPackets.ControlPacket) *mqtt5Reader {
+		buff := &bytes.Buffer{}
+		if err := pkt.Write(buff); err != nil {
+			t.Fatal(err)
+		}
+		errs := make(chan error, 1)
+		go func() {
+			_, err := conn.Write(buff.Bytes())
+			errs <- err
+		}()
+		var raw []byte
+		for {
+			if pkt, ok := nextMqtt5Packet(raw); ok {
+				assert.Len(raw, len(pkt))
+				break
+			}
+			b := make([]byte, maxTestPktLength)
+			n, err := brokerConn.Read(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw = append(raw, b[:n]...)
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		r := &mqtt5Reader{data: raw}
+		r.byte()
+		r.varInt()
+		return r
+	}
+	// recv writes the MQTT 5 packet to the broker side of the connection and
+	// returns the MQTT 3.1.1 packet read from conn.
+	recv := func(header byte, body []byte) (mqttPackets.ControlPacket, error) {
+		buff := &bytes.Buffer{}
+		buff.WriteByte(header)
+		writeMqtt5VarInt(buff, len(body))
+		buff.Write(body)
+		go brokerConn.Write(buff.Bytes())
+		return mqttPackets.ReadPacket(conn)
+	}
+
+	// GW --CONNECT--> MQTT broker
+	connect := mqttPackets.NewControlPacket(mqttPackets.Connect).(*mqttPackets.ConnectPacket)
+	connect.ProtocolName = "MQTT"
+	connect.ProtocolVersion = 4
+	connect.ClientIdentifier = "test-client"
+	connect.Keepalive = 60
+	r := send(connect)
+	assert.Equal("MQTT", r.string())
+	assert.Equal(byte(5), r.byte())
+	assert.Equal(byte(0), r.byte())
+	assert.Equal(uint16(60), r.uint16())
+	assert.Equal(mqtt5Properties{topicAliasMaximum: 4}, r.properties())
+	assert.Equal("test-client", r.string())
+	assert.NoError(r.err)
+	assert.Empty(r.data)
+
+	// GW <--CONNACK-- MQTT broker (Topic Alias Maximum = 2)
+	pkt, err := recv(mqttPackets.Connack<<4, []byte{0, 0, 3, mqtt5PropTopicAliasMaximum, 0, 2})
+	if assert.NoError(err) {
+		assert.Equal(byte(mqttPackets.Accepted), pkt.(*mqttPackets.ConnackPacket).ReturnCode)
+	}
+
+	// GW --PUBLISH--> MQTT broker
+	publish := func(topic string) (string, mqtt5Properties) {
+		pkt := mqttPackets.NewControlPacket(mqttPackets.Publish).(*mqttPackets.PublishPacket)
+		pkt.Qos = 1
+		pkt.MessageID = 7
+		pkt.TopicName = topic
+		pkt.Payload = []byte("payload")
+		r := send(pkt)
+		topic = r.string()
+		assert.Equal(uint16(7), r.uint16())
+		props := r.properties()
+		assert.Equal("payload", string(r.rest()))
+		assert.NoError(r.err)
+		return topic, props
+	}
+	for i, c := range []struct {
+		publish string
+		topic   string
+		alias   uint16
+	}{
+		{"test/a", "test/a", 1},
+		{"test/b", "test/b", 2},
+		{"test/a", "", 1},
+		{"test/c", "test/c", 2}, // least recently used alias reassigned
+		{"test/a", "", 1},
+		{"test/c", "", 2},
+	} {
+		topic, props := publish(c.publish)
+		assert.Equal(c.topic, topic, i)
+		assert.Equal(c.alias, props.topicAlias, i)
+	}
+
+	// GW <--PUBLISH-- MQTT broker
+	for _, topic := range []string{"test/x", ""} {
+		body := &bytes.Buffer{}
+		writeMqtt5String(body, topic)
+		writeMqtt5Properties(body, []byte{mqtt5PropTopicAlias, 0, 3})
+		body.WriteString("payload")
+		pkt, err := recv(mqttPackets.Publish<<4, body.Bytes())
+		if assert.NoError(err) {
+			assert.Equal("test/x", pkt.(*mqttPackets.PublishPacket).TopicName)
+			assert.Equal([]byte("payload"), pkt.(*mqttPackets.PublishPacket).Payload)
+		}
+	}
+
+	// GW --SUBSCRIBE--> MQTT broker
+	subscribe := mqttPackets.NewControlPacket(mqttPackets.Subscribe).(*mqttPackets.SubscribePacket)
+	subscribe.MessageID = 8
+	subscribe.Topics = []string{"test/#"}
+	subscribe.Qoss = []byte{1}
+	r = send(subscribe)
+	assert.Equal(uint16(8), r.uint16())
+	assert.Equal(mqtt5Properties{}, r.properties())
+	assert.Equal("test/#", r.string())
+	assert.Equal(byte(1), r.byte())
+	assert.NoError(r.err)
+
+	// GW <--SUBACK-- MQTT broker (Not authorized)
+	pkt, err = recv(mqttPackets.Suback<<4, []byte{0, 8, 0, 0x87})
+	if assert.NoError(err) {
+		assert.Equal([]byte{0x80}, pkt.(*mqttPackets.SubackPacket).ReturnCodes)
+	}
+
+	// GW <--PUBACK-- MQTT broker (with a reason code and properties)
+	pkt, err = recv(mqttPackets.Puback<<4, []byte{0, 7, 0x10, 0})
+	if assert.NoError(err) {
+		assert.Equal(uint16(7), pkt.(*mqttPackets.PubackPacket).MessageID)
+	}
+
+	// GW <--DISCONNECT-- MQTT broker
+	_, err = recv(mqttPackets.Disconnect<<4, []byte{0x8B, 0})
+	assert.Error(err)
+}
+
+func TestGatewayDiscovery(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := &handlerConfig{
+		RetryDelay: time.Second,
+		RetryCount: 2,
+		GatewayID:  7,
+		Forwarders: newForwarders(),
+	}
+	client := newTestSetupWithConfig(t, cfg, topics.PredefinedTopics{})
+	defer client.cancel()
+	forwarder1 := newTestSetupWithConfig(t, cfg, topics.PredefinedTopics{})
+	defer forwarder1.cancel()
+	forwarder2 := newTestSetupWithConfig(t, cfg, topics.PredefinedTopics{})
+	defer forwarder2.cancel()
+
+	// client --SEARCHGW--> GW
+	client.snSend(snMsgs.NewSearchGwMessage(1), false)
+
+	// client <--GWINFO-- GW
+	snGwInfo := client.snRecv().(*snMsgs.GwInfoMessage)
+	assert.Equal(uint8(7), snGwInfo.GatewayID)
+
+	// Both forwarders relay a SEARCHGW so that the gateway knows them.
+	for i, forwarder := range []*testSetup{forwarder1, forwarder2} {
+		nodeID := []byte{byte(i)}
+		// forwarder --ENCAPSULATED(SEARCHGW)--> GW
+		forwarder.snSend(snMsgs.NewEncapsulatedMessage(0, nodeID, snMsgs.NewSearchGwMessage(2)), false)
+
+		// forwarder <--ENCAPSULATED(GWINFO)-- GW
+		snEncapsulated := forwarder.snRecv().(*snMsgs.EncapsulatedMessage)
+		assert.Equal(uint8(2), snEncapsulated.Radius)
+		assert.Equal(nodeID, snEncapsulated.WirelessNodeID)
+		snGwInfo := snEncapsulated.Message.(*snMsgs.GwInfoMessage)
+		assert.Equal(uint8(7), snGwInfo.GatewayID)
+	}
+
+	// forwarder1 --ENCAPSULATED(ADVERTISE)--> GW
+	snAdvertise := snMsgs.NewAdvertiseMessage(3, 900)
+	forwarder1.snSend(snMsgs.NewEncapsulatedMessage(2, []byte{1}, snAdvertise), false)
+
+	// forwarder2 <--ENCAPSULATED(ADVERTISE)-- GW
+	snEncapsulated := forwarder2.snRecv().(*snMsgs.EncapsulatedMessage)
+	assert.Equal(uint8(1), snEncapsulated.Radius)
+	assert.Equal(snAdvertise, snEncapsulated.Message)
+	forwarder1.assertConnEmpty("MQTT-SN", forwarder1.snConn, connEmptyTimeout)
+
+	// The radius is exhausted, the GWINFO is not re-broadcast.
+	// forwarder1 --ENCAPSULATED(GWINFO)--> GW
+	forwarder1.snSend(snMsgs.NewEncapsulatedMessage(1, []byte{1}, snMsgs.NewGwInfoMessage(3, nil)), false)
+	forwarder2.assertConnEmpty("MQTT-SN", forwarder2.snConn, connEmptyTimeout)
+}
+
+func TestBilling(t *testing.T) {
+	assert := assert.New(t)
+
+	meter := newByteMeter()
+	activity := newClientActivity()
+	activity.meter = meter
+
+	// CONNECT is received before the ClientID is known.
+	activity.messageReceived(20)
+	activity.setClientID("test-client")
+	activity.messageSent(3)
+	activity.messageReceived(10)
+
+	other := newClientActivity()
+	other.meter = meter
+	other.setClientID("other-client")
+	other.messageSent(5)
+
+	record := meter.take()
+	assert.Equal([]ByteCount{
+		{ClientID: "other-client", BytesIn: 0, BytesOut: 5},
+		{ClientID: "test-client", BytesIn: 30, BytesOut: 3},
+	}, record.Counts)
+	assert.Empty(meter.take().Counts)
+
+	// Records which could not be flushed are not lost.
+	meter.restore(record)
+	activity.messageSent(1)
+	file := filepath.Join(t.TempDir(), "billing.jsonl")
+	sink := &FileBillingSink{File: file}
+	for i := 0; i < 2; i++ {
+		if err := sink.Flush(context.Background(), meter.take()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Len(lines, 2)
+	var flushed BillingRecord
+	if err := json.Unmarshal([]byte(lines[0]), &flushed); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal([]ByteCount{
+		{ClientID: "other-client", BytesIn: 0, BytesOut: 5},
+		{ClientID: "test-client", BytesIn: 30, BytesOut: 4},
+	}, flushed.Counts)
+}
+
+func TestCIDRTagger(t *testing.T) {
+	assert := assert.New(t)
+
+	tagger, err := NewCIDRTagger([]CIDRRule{
+		{CIDR: "10.1.0.0/16", Tags: map[string]string{"site": "prague"}},
+		{CIDR: "10.0.0.0/8", Tags: map[string]string{"site": "other"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := tagger.Tags(&net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1883})
+	assert.Equal(map[string]string{"site": "prague"}, tags)
+	tags = tagger.Tags(&net.UDPAddr{IP: net.ParseIP("10.2.2.3"), Port: 1883})
+	assert.Equal(map[string]string{"site": "other"}, tags)
+	assert.Nil(tagger.Tags(&net.UDPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1883}))
+
+	_, err = NewCIDRTagger([]CIDRRule{{CIDR: "10.1.0.0"}})
+	assert.Error(err)
+
+	s := newStats()
+	s.clientTagged(tags)
+	s.clientTagged(tags)
+	assert.Equal(map[string]uint64{"site=other": 2}, s.report().ClientsByTag)
+}
+
+func TestSessionTakeover(t *testing.T) {
+	assert := assert.New(t)
+
+	active := newTestSetup(t, false, topics.PredefinedTopics{})
+	defer active.cancel()
+	active.connect()
+	topicID := active.register("test-topic-0")
+	active.handler.id = "10.0.0.1:1883"
+
+	session, ok := active.handler.session()
+	assert.True(ok)
+	assert.Equal("test-client", session.ClientID)
+	assert.Equal(util.StateActive, session.State)
+	assert.Equal(uint16(1), session.KeepAlive)
+	assert.Equal(map[uint16]string{topicID: "test-topic-0"}, session.Topics)
+
+	// Replicate the session to the standby gateway.
+	store := NewSessionStore()
+	sink := &HTTPReplicationSink{URL: "http://standby/sessions"}
+	sink.Client = &http.Client{Transport: handlerTransport{store}}
+	if err := sink.Replicate(context.Background(), []Session{session}); err != nil {
+		t.Fatal(err)
+	}
+	replicated, ok := store.Take(session.ID)
+	assert.True(ok)
+	assert.Equal(session, replicated)
+	_, ok = store.Take(session.ID)
+	assert.False(ok)
+
+	cfg := &handlerConfig{
+		RetryDelay: time.Second,
+		RetryCount: 2,
+	}
+	stp := newTestSetupWithSession(t, cfg, topics.PredefinedTopics{}, &replicated)
+	defer stp.cancel()
+
+	// GW --CONNECT--> MQTT broker
+	mqttConnect := stp.mqttRecv().(*mqttPackets.ConnectPacket)
+	assert.Equal("test-client", mqttConnect.ClientIdentifier)
+	assert.False(mqttConnect.CleanSession)
+	assert.Equal(uint16(1), mqttConnect.Keepalive)
+
+	// GW <--CONNACK-- MQTT broker
+	mqttConnack := mqttPackets.NewControlPacket(mqttPackets.Connack).(*mqttPackets.ConnackPacket)
+	mqttConnack.ReturnCode = mqttPackets.Accepted
+	stp.mqttSend(mqttConnack, false)
+
+	// client --PUBLISH--> GW using the TopicID registered at the active
+	// gateway.
+	snPublish := snMsgs.NewPublishMessage(topicID, snMsgs.TIT_REGISTERED, []byte("test-msg-0"), 0, false, false)
+	stp.snSend(snPublish, true)
+
+	// GW --PUBLISH--> MQTT broker
+	mqttPublish := stp.mqttRecv().(*mqttPackets.PublishPacket)
+	assert.Equal("test-topic-0", mqttPublish.TopicName)
+
+	// New registrations do not reuse the restored TopicIDs.
+	assert.Greater(stp.register("test-topic-1"), topicID)
+
+	stp.disconnect()
+}
+
+func TestSessionStoreSecurity(t *testing.T) {
+	assert := assert.New(t)
+
+	store := NewSessionStore()
+	store.Secret = "secret"
+	sessions := []Session{{ID: "10.0.0.1:1883", ClientID: "test-client"}}
+
+	// A snapshot without the secret is refused.
+	sink := &HTTPReplicationSink{URL: "http://standby/sessions"}
+	sink.Client = &http.Client{Transport: handlerTransport{store}}
+	assert.Error(sink.Replicate(context.Background(), sessions))
+	sink.Secret = "wrong"
+	assert.Error(sink.Replicate(context.Background(), sessions))
+	_, ok := store.Take("10.0.0.1:1883")
+	assert.False(ok)
+
+	sink.Secret = "secret"
+	assert.NoError(sink.Replicate(context.Background(), sessions))
+
+	// An oversized snapshot is refused.
+	store.MaxSize = 16
+	assert.Error(sink.Replicate(context.Background(), sessions))
+	_, ok = store.Take("10.0.0.1:1883")
+	assert.True(ok)
+	store.MaxSize = 0
+	assert.NoError(sink.Replicate(context.Background(), sessions))
+
+	// Stale snapshots are not taken over.
+	store.MaxAge = 50 * time.Millisecond
+	time.Sleep(100 * time.Millisecond)
+	_, ok = store.Take("10.0.0.1:1883")
+	assert.False(ok)
+}
+
+func TestSessionTTL(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := &handlerConfig{
+		RetryDelay: time.Second,
+		RetryCount: 2,
+		SessionTTL: 200 * time.Millisecond,
+	}
+	stp := newTestSetupWithConfig(t, cfg, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	stp.connect()
+
+	// No message from the client for SessionTTL.
+
+	// GW --DISCONNECT--> MQTT broker
+	mqttDisconnect := stp.mqttRecv().(*mqttPackets.DisconnectPacket)
+	assert.Equal(uint8(mqttPackets.Disconnect), mqttDisconnect.MessageType)
+
+	// client <--DISCONNECT-- GW
+	_, ok := stp.snRecv().(*snMsgs.DisconnectMessage)
+	assert.True(ok)
+
+	stp.assertHandlerDone()
+	assert.Equal(uint64(1), stp.handler.stats.report().SessionsPurged)
+}
+
+func TestSessionTTLSleep(t *testing.T) {
+	assert := assert.New(t)
+
+	ttl := 200 * time.Millisecond
+	cfg := &handlerConfig{
+		RetryDelay: time.Second,
+		RetryCount: 2,
+		SessionTTL: ttl,
+	}
+	stp := newTestSetupWithConfig(t, cfg, topics.PredefinedTopics{})
+	defer stp.cancel()
+
+	stp.connect()
+
+	// client --DISCONNECT(duration)--> GW
+	sleepDuration := time.Second
+	snDisconnect := snMsgs.NewDisconnectMessage(uint16(sleepDuration.Seconds()))
+	stp.snSend(snDisconnect, false)
+	asleep := time.Now()
+
+	// client <--DISCONNECT-- GW
+	_, ok := stp.snRecv().(*snMsgs.DisconnectMessage)
+	assert.True(ok)
+
+	// The session does not expire while the client sleeps.
+	for {
+		mqttMsg := stp.mqttRecv()
+		if _, ok := mqttMsg.(*mqttPackets.PingreqPacket); ok {
+			continue
+		}
+		// GW --DISCONNECT--> MQTT broker
+		_, ok := mqttMsg.(*mqttPackets.DisconnectPacket)
+		assert.True(ok)
+		break
+	}
+	assert.GreaterOrEqual(int64(time.Since(asleep)), int64(sleepDuration+ttl))
+
+	stp.assertHandlerDone()
+	assert.Equal(uint64(1), stp.handler.stats.report().SessionsPurged)
+}
+
+func TestPurgeSessions(t *testing.T) {
+	assert := assert.New(t)
+
+	store := NewSessionStore()
+	store.Update([]Session{
+		{ID: "10.0.0.1:1883", ClientID: "sensor-1"},
+		{ID: "10.0.0.2:1883", ClientID: "meter-1"},
+		{ID: "10.0.0.3:1883", ClientID: "sensor-2", LastActivity: time.Now().Add(-time.Hour)},
+		{ID: "10.0.0.4:1883", ClientID: "site-1/sensor-3"},
+		// Asleep for longer than the TTL.
+		{ID: "10.0.0.5:1883", ClientID: "meter-2", State: util.StateAsleep,
+			SleepDuration: 2 * time.Hour, LastActivity: time.Now().Add(-time.Hour)},
+	})
+	gw := NewGateway(util.NoOpLogger{}, &GatewayConfig{
+		StandbySessions: store,
+		ClientMetadata:  true,
+		SessionTTL:      time.Minute,
+	})
+
+	stp := newTestSetup(t, false, topics.PredefinedTopics{})
+	defer stp.cancel()
+	stp.connect()
+	gw.clients.Store(stp.handler.id, stp.handler)
+	gw.inventory.update("test-client", map[string]string{"fw": "1.0"})
+	gw.inventory.update("meter-1", map[string]string{"fw": "2.0"})
+
+	// Expired sessions are not taken over.
+	_, ok := gw.takeSession("10.0.0.3:1883")
+	assert.False(ok)
+	_, ok = gw.takeSession("10.0.0.5:1883")
+	assert.True(ok)
+
+	_, err := gw.PurgeSessions("[")
+	assert.Error(err)
+
+	n, err := gw.PurgeSessions("test-*")
+	assert.NoError(err)
+	assert.Equal(1, n)
+
+	// GW --DISCONNECT--> MQTT broker
+	_, ok = stp.mqttRecv().(*mqttPackets.DisconnectPacket)
+	assert.True(ok)
+	// client <--DISCONNECT-- GW
+	_, ok = stp.snRecv().(*snMsgs.DisconnectMessage)
+	assert.True(ok)
+	stp.assertHandlerDone()
+
+	n, err = gw.PurgeSessions("sensor-*")
+	assert.NoError(err)
+	assert.Equal(1, n)
+	_, ok = store.Take("10.0.0.1:1883")
+	assert.False(ok)
+	_, ok = store.Take("10.0.0.2:1883")
+	assert.True(ok)
+
+	// "*" matches "/" in ClientIDs.
+	n, err = gw.PurgeSessions("site-1*")
+	assert.NoError(err)
+	assert.Equal(1, n)
+
+	inventory := gw.Inventory()
+	if assert.Len(inventory, 1) {
+		assert.Equal("meter-1", inventory[0].ClientID)
+	}
+}
+
+func TestSessionSnapshotVersions(t *testing.T) {
+	assert := assert.New(t)
+
+	expected := []Session{{
+		ID:        "10.0.0.1:1883",
+		ClientID:  "test-client",
+		State:     util.StateActive,
+		KeepAlive: 60,
+		Topics:    map[uint16]string{1: "test/topic"},
+	}}
+
+	// Current version.
+	data, err := EncodeSessionSnapshot(expected)
+	assert.NoError(err)
+	sessions, err := DecodeSessionSnapshot(data)
+	assert.NoError(err)
+	assert.Equal(expected, sessions)
+
+	// Version 1 (unversioned).
+	v1 := `[{"id":"10.0.0.1:1883","client_id":"test-client","state":1,"keepalive":60,"topics":{"1":"test/topic"}}]`
+	sessions, err = DecodeSessionSnapshot([]byte(v1))
+	assert.NoError(err)
+	assert.Equal(expected, sessions)
+
+	// Newer version.
+	_, err = DecodeSessionSnapshot([]byte(`{"version":99,"sessions":[]}`))
+	assert.Error(err)
+
+	// Missing version.
+	_, err = DecodeSessionSnapshot([]byte(`{"sessions":[]}`))
+	assert.Equal(errSnapshotVersionMissing, err)
+}
+
+func TestSysTopics(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := &handlerConfig{
+		RetryDelay: time.Second,
+		RetryCount: 2,
+		SysTopics:  true,
+	}
+	stp := newTestSetupWithConfig(t, cfg, topics.PredefinedTopics{})
+	defer stp.cancel()
+	stp.connect()
+
+	// client --SUBSCRIBE--> GW
+	snSubscribe := snMsgs.NewSubscribeMessage(0, snMsgs.TIT_STRING, []byte(SysTopicPrefix+"version"), 1, false)
+	stp.snSend(snSubscribe, true)
+
+	// client <--SUBACK-- GW (not forwarded to the MQTT broker)
+	snSuback := stp.snRecv().(*snMsgs.SubackMessage)
+	assert.Equal(snMsgs.RC_ACCEPTED, snSuback.ReturnCode)
+	assert.Equal(snSubscribe.MessageID(), snSuback.MessageID())
+	versionTopicID := snSuback.TopicID
+
+	// client <--PUBLISH-- GW
+	snPublish := stp.snRecv().(*snMsgs.PublishMessage)
+	assert.Equal(versionTopicID, snPublish.TopicID)
+	assert.Equal([]byte(bisquitt.Version()), snPublish.Data)
+	assert.Equal(uint8(0), snPublish.QOS)
+	assert.True(snPublish.Retain)
+
+	// client --SUBSCRIBE--> GW
+	snSubscribe = snMsgs.NewSubscribeMessage(0, snMsgs.TIT_STRING, []byte(SysTopicPrefix+"+"), 0, false)
+	stp.snSend(snSubscribe, true)
+
+	// client <--SUBACK-- GW
+	snSuback = stp.snRecv().(*snMsgs.SubackMessage)
+	assert.Equal(snMsgs.RC_ACCEPTED, snSuback.ReturnCode)
+	assert.Equal(uint16(0), snSuback.TopicID)
+
+	// client <--PUBLISH-- GW (already registered topic)
+	snPublish = stp.snRecv().(*snMsgs.PublishMessage)
+	assert.Equal(versionTopicID, snPublish.TopicID)
+
+	// client <--REGISTER-- GW
+	snRegister := stp.snRecv().(*snMsgs.RegisterMessage)
+	assert.Equal(SysTopicPrefix+"uptime", snRegister.TopicName)
+	snRegister2 := stp.snRecv().(*snMsgs.RegisterMessage)
+	assert.Equal(SysTopicPrefix+"capabilities", snRegister2.TopicName)
+
+	// client --REGACK--> GW
+	snRegack := snMsgs.NewRegackMessage(snRegister.TopicID, snMsgs.RC_ACCEPTED)
+	snRegack.SetMessageID(snRegister.MessageID())
+	stp.snSend(snRegack, false)
+
+	// client <--PUBLISH-- GW
+	snPublish = stp.snRecv().(*snMsgs.PublishMessage)
+	assert.Equal(snRegister.TopicID, snPublish.TopicID)
+	assert.Equal([]byte("0"), snPublish.Data)
+
+	// client --REGACK--> GW
+	snRegack = snMsgs.NewRegackMessage(snRegister2.TopicID, snMsgs.RC_ACCEPTED)
+	snRegack.SetMessageID(snRegister2.MessageID())
+	stp.snSend(snRegack, false)
+
+	// client <--PUBLISH-- GW
+	snPublish = stp.snRecv().(*snMsgs.PublishMessage)
+	assert.Equal(snRegister2.TopicID, snPublish.TopicID)
+	var capabilities Capabilities
+	if err := json.Unmarshal(snPublish.Data, &capabilities); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(Capabilities{
+		Version:     bisquitt.Version(),
+		MaxPayload:  snMsgs.MaxPayloadLength,
+		AuthMethods: []string{},
+		Sleep:       true,
+		Compression: []string{},
+	}, capabilities)
+
+	// client --UNSUBSCRIBE--> GW
+	snUnsubscribe := snMsgs.NewUnsubscribeMessage(0, snMsgs.TIT_STRING, []byte(SysTopicPrefix+"+"))
+	stp.snSend(snUnsubscribe, true)
+
+	// client <--UNSUBACK-- GW
+	snUnsuback := stp.snRecv().(*snMsgs.UnsubackMessage)
+	assert.Equal(snUnsubscribe.MessageID(), snUnsuback.MessageID())
+
+	// No SUBSCRIBE or UNSUBSCRIBE was forwarded to the MQTT broker =>
+	// DISCONNECT is the next MQTT message.
+	stp.disconnect()
+}
+
+func TestCanary(t *testing.T) {
+	assert := assert.New(t)
+
+	broker := newEchoBroker(t)
+	defer broker.Close()
+
+	cfg := &GatewayConfig{
+		MqttBrokerAddress:     broker.Addr().(*net.TCPAddr),
+		MqttConnectionTimeout: time.Second,
+		RetryDelay:            time.Second,
+		RetryCount:            2,
+		Canary: &CanaryConfig{
+			Interval: 100 * time.Millisecond,
+			Timeout:  time.Second,
+		},
+	}
+	gw := NewGateway(util.NewDebugLogger("gw-Canary"), cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- gw.ListenAndServe(ctx, "127.0.0.1:0")
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, ok := gw.Canary()
+		if ok && status.Runs > 0 {
+			assert.Equal(uint64(0), status.Failures, status.LastError)
+			assert.Greater(status.LastLatency, time.Duration(0))
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("canary did not run")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.NotNil(gw.Report().Canary)
+
+	cancel()
+	assert.NoError(<-done)
+}
+
+func TestTransactionSweeper(t *testing.T) {
+	assert := assert.New(t)
+
+	stp := newTestSetup(t, false, topics.PredefinedTopics{})
+	defer stp.cancel()
+	stp.connect()
+
+	// A leaked transaction which does not remove itself from the store.
+	leaked := transactions.NewTransactionBase(nil)
+	stp.handler.transactions.Store(100, leaked)
+
+	stp.handler.sweepTransactions(time.Now().Add(-time.Minute))
+	_, ok := stp.handler.transactions.Get(100)
+	assert.True(ok)
+
+	stp.handler.sweepTransactions(time.Now().Add(time.Minute))
+	_, ok = stp.handler.transactions.Get(100)
+	assert.False(ok)
+	assert.Equal(ErrTransactionExpired, leaked.Err())
+	assert.Equal(uint64(1), stp.handler.stats.report().Errors["tx_expired"])
+
+	stp.disconnect()
+}
+
+// newEchoBroker starts a minimal MQTT broker which acknowledges everything
+// and sends every published message back to its publisher.
+func newEchoBroker(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveEchoBroker(conn)
+		}
+	}()
+	return listener
+}
+
+func serveEchoBroker(conn net.Conn) {
+	defer conn.Close()
+	for {
+		msg, err := mqttPackets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		var replies []mqttPackets.ControlPacket
+		switch m := msg.(type) {
+		case *mqttPackets.ConnectPacket:
+			connack := mqttPackets.NewControlPacket(mqttPackets.Connack).(*mqttPackets.ConnackPacket)
+			connack.ReturnCode = mqttPackets.Accepted
+			replies = append(replies, connack)
+		case *mqttPackets.SubscribePacket:
+			suback := mqttPackets.NewControlPacket(mqttPackets.Suback).(*mqttPackets.SubackPacket)
+			suback.MessageID = m.MessageID
+			suback.ReturnCodes = m.Qoss
+			replies = append(replies, suback)
+		case *mqttPackets.UnsubscribePacket:
+			unsuback := mqttPackets.NewControlPacket(mqttPackets.Unsuback).(*mqttPackets.UnsubackPacket)
+			unsuback.MessageID = m.MessageID
+			replies = append(replies, unsuback)
+		case *mqttPackets.PublishPacket:
+			if m.Qos == 1 {
+				puback := mqttPackets.NewControlPacket(mqttPackets.Puback).(*mqttPackets.PubackPacket)
+				puback.MessageID = m.MessageID
+				replies = append(replies, puback)
+			}
+			echo := mqttPackets.NewControlPacket(mqttPackets.Publish).(*mqttPackets.PublishPacket)
+			echo.TopicName = m.TopicName
+			echo.Payload = m.Payload
+			replies = append(replies, echo)
+		case *mqttPackets.PingreqPacket:
+			replies = append(replies, mqttPackets.NewControlPacket(mqttPackets.Pingresp))
+		case *mqttPackets.DisconnectPacket:
+			return
+		}
+		for _, reply := range replies {
+			if err := reply.Write(conn); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handlerTransport passes HTTP requests directly to a http.Handler.
+type handlerTransport struct {
+	handler http.Handler
+}
+
+func (t handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	t.handler.ServeHTTP(w, req)
+	return w.Result(), nil
+}
+
+//
+// testSetup
+//
+
+type testSetup struct {
+	ID            string
+	t             *testing.T
+	mqttConn      net.Conn
+	snConn        net.Conn
+	snNextMsgID   uint16
+	mqttNextMsgID uint16
+	ctx           context.Context
+	cancel        context.CancelFunc
+	handler       *handler
+	handlerDone   chan struct{}
+	// Fault injection into the gateway side of the MQTT connection.
+	mqttFaults *faultyConn
+	// Session taken over by the handler, if any.
+	session *Session
+	// Traffic recording, if set (see golden_test.go).
+	recording *goldenRecording
+}
+
+func newTestSetup(t *testing.T, auth bool, predefinedTopics topics.PredefinedTopics) *testSetup {
+	cfg := &handlerConfig{
+		AuthEnabled: auth,
+		RetryDelay:  time.Second,
+		RetryCount:  2,
+	}
+	return newTestSetupWithConfig(t, cfg, predefinedTopics)
+}
+
+func newTestSetupWithConfig(t *testing.T, cfg *handlerConfig, predefinedTopics topics.PredefinedTopics) *testSetup {
+	return newTestSetupWithSession(t, cfg, predefinedTopics, nil)
+}
+
+// newTestSetupWithSession creates a handler which takes over the given
+// session, if not nil.
+func newTestSetupWithSession(t *testing.T, cfg *handlerConfig, predefinedTopics topics.PredefinedTopics, session *Session) *testSetup {
+	ctx, cancel := context.WithCancel(context.Background())
+	handlerDone := make(chan struct{})
+	// Test name without "Test" prefix.
+	id := reflect.ValueOf(t).Elem().FieldByName("name").String()[4:]
+	stp := &testSetup{
+		ID:            id,
+		t:             t,
+		ctx:           ctx,
+		cancel:        cancel,
+		handlerDone:   handlerDone,
+		snNextMsgID:   1,
+		mqttNextMsgID: 1,
+		session:       session,
+	}
+	stp.newHandler(cfg, predefinedTopics)
+	return stp
+}
+
+func (stp *testSetup) newHandler(cfg *handlerConfig, predefinedTopics topics.PredefinedTopics) {
+	log := util.NewDebugLogger("h-" + stp.ID)
+
+	var snListener *net.UnixListener
+	var mqttListener *net.UnixListener
+	snListener, stp.snConn = stp.createSocketPair("unixpacket")
+	mqttListener, stp.mqttConn = stp.createSocketPair("unix")
+
+	handlerChan := make(chan *handler)
+	go func() {
+		defer close(stp.handlerDone)
+
+		snConnGateway, err := snListener.AcceptUnix()
+		if err != nil {
+			stp.t.Fatal(err)
+		}
+		mqttConnGateway, err := mqttListener.AcceptUnix()
+		if err != nil {
+			stp.t.Fatal(err)
+		}
+
+		handler := newHandler(cfg, predefinedTopics, log)
+		if stp.session != nil {
+			handler.restore(*stp.session)
+		}
+		stp.mqttFaults = &faultyConn{Conn: mqttConnGateway}
+		handler.mockupDialFunc = func() net.Conn {
+			return stp.mqttFaults
+		}
+		select {
+		case <-stp.ctx.Done():
+			return
+		case handlerChan <- handler:
+			// continue
+		}
+		handler.run(stp.ctx, snConnGateway)
+	}()
+
+	select {
+	case <-stp.ctx.Done():
+		return
+	case stp.handler = <-handlerChan:
+		// continue
+	}
+}
+
+func (stp *testSetup) createSocketPair(sockType string) (*net.UnixListener, *net.UnixConn) {
+	// NOTE: "@" means "unnamed socket"
+	socket := fmt.Sprintf("@%d", rand.Uint64())
+	addr := &net.UnixAddr{Name: socket, Net: sockType}
+
+	listener, err := net.ListenUnix(sockType, addr)
+	if err != nil {
+		stp.t.Fatal(err)
+	}
+
+	conn, err := net.DialUnix(sockType, nil, addr)
+	if err != nil {
+		stp.t.Fatal(err)
+	}
+
+	return listener, conn
+}
+
+func (stp *testSetup) snSend(msg snMsgs.Message, setMsgID bool) {
+	if setMsgID {
+		if msg2, ok := msg.(snMsgs.MessageWithID); ok {
+			msg2.SetMessageID(stp.snNextMsgID)
+			stp.snNextMsgID++
+		}
+	}
+
+	buff := &bytes.Buffer{}
+	if err := msg.Write(buff); err != nil {
+		stp.t.Fatal(err)
+	}
+	stp.recording.add(goldenClientToGateway, buff.Bytes(), msg)
+	if _, err := stp.snConn.Write(buff.Bytes()); err != nil {
+		stp.t.Fatal(err)
+	}
+}
+
+func (stp *testSetup) snRecv() snMsgs.Message {
+	buff := make([]byte, maxTestPktLength)
+	n, err := stp.snConn.Read(buff)
+	if err != nil {
+		if err != io.EOF {
+			stp.t.Fatal(err)
+		}
+	}
+
+	pktReader := bytes.NewReader(buff[:n])
+	header := &snMsgs.Header{}
+	header.Unpack(pktReader)
+	msg := snMsgs.NewMessageWithHeader(*header)
+	msg.Unpack(pktReader)
+	stp.recording.add(goldenGatewayToClient, buff[:n], msg)
+
+	return msg
+}
+
+func (stp *testSetup) mqttSend(msg mqttPackets.ControlPacket, setMsgID bool) {
+	if setMsgID {
+		switch msg2 := msg.(type) {
+		case *mqttPackets.PublishPacket:
+			msg2.MessageID = stp.mqttNextMsgID
+		default:
+			stp.t.Fatalf("Cannot set MsgID for %v", msg)
+		}
+		stp.mqttNextMsgID++
+	}
+
+	buff := &bytes.Buffer{}
+	if err := msg.Write(buff); err != nil {
+		stp.t.Fatal(err)
+	}
+	stp.recording.add(goldenBrokerToGateway, buff.Bytes(), msg)
+	if _, err := stp.mqttConn.Write(buff.Bytes()); err != nil {
+		stp.t.Fatal(err)
+	}
+}
+
+func (stp *testSetup) mqttRecv() mqttPackets.ControlPacket {
+	msg, err := mqttPackets.ReadPacket(stp.mqttConn)
+	if err != nil {
+		stp.t.Fatal(err)
+	}
+	if stp.recording != nil {
+		stp.recording.add(goldenGatewayToBroker, encodeMqtt(stp.t, msg), msg)
+	}
+
+	return msg
+}
+
+func testRead(connID string, conn net.Conn, timeout time.Duration) ([]byte, error) {
+	buff := make([]byte, maxTestPktLength)
+	err := conn.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return nil, fmt.Errorf("Can't set read deadline on %s connection: %s", connID, err)
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	n, err := conn.Read(buff)
+	if err != nil {
+		return nil, err
+	}
+	return buff[:n], nil
+}
+
+func (stp *testSetup) assertConnEmpty(connID string, conn net.Conn, timeout time.Duration) {
+	data, err := testRead(connID, conn, timeout)
+	assert.Len(stp.t, data, 0, "No data expected on %s connection, got: %v", connID, data)
+	if err != nil {
+		switch e := err.(type) {
+		case net.Error:
+			if e.Temporary() && e.Timeout() {
+				return
+			}
+		}
+		stp.t.Errorf("Unexpected error on %s connection: %s", connID, err)
+	}
+}
+
+func (stp *testSetup) assertConnClosed(connID string, conn net.Conn, timeout time.Duration) {
+	assert := assert.New(stp.t)
+
+	data, err := testRead(connID, conn, timeout)
+	assert.Len(data, 0, "%s connection: no data expected, got: %v", connID, data)
+	if err != nil {
 		switch e := err.(type) {
 		case net.Error:
 			if e.Temporary() && e.Timeout() {
@@ -1520,6 +4076,7 @@ func (stp *testSetup) subscribe(topic string, qos uint8) uint16 {
 	snSuback := stp.snRecv().(*snMsgs.SubackMessage)
 	assert.Equal(snSubscribe.MessageID(), snSuback.MessageID())
 	assert.Equal(snMsgs.RC_ACCEPTED, snSuback.ReturnCode)
+	assert.Equal(qos, snSuback.QOS)
 	if hasWildcard(topic) {
 		assert.Equal(uint16(0), snSuback.TopicID)
 	} else {
@@ -1578,3 +4135,55 @@ func (stp *testSetup) disconnect() {
 
 	stp.assertHandlerDone()
 }
+
+//
+// faultyConn
+//
+
+// faultyConn wraps the gateway side of the MQTT connection and injects faults
+// into it to simulate a slow or misbehaving MQTT broker.
+type faultyConn struct {
+	net.Conn
+	lock    sync.Mutex
+	latency time.Duration
+	// Returned by the subsequent reads before the data sent by the broker.
+	garbage []byte
+}
+
+// setLatency delays delivery of all the subsequent data sent by the broker.
+func (c *faultyConn) setLatency(latency time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.latency = latency
+}
+
+// injectGarbage makes the gateway receive the given data as if it was sent by
+// the broker.
+func (c *faultyConn) injectGarbage(data []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.garbage = append(c.garbage, data...)
+}
+
+// drop closes the connection abruptly.
+func (c *faultyConn) drop() {
+	c.Conn.Close()
+}
+
+func (c *faultyConn) Read(p []byte) (int, error) {
+	c.lock.Lock()
+	if len(c.garbage) > 0 {
+		n := copy(p, c.garbage)
+		c.garbage = c.garbage[n:]
+		c.lock.Unlock()
+		return n, nil
+	}
+	latency := c.latency
+	c.lock.Unlock()
+
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		time.Sleep(latency)
+	}
+	return n, err
+}
@@ -0,0 +1,252 @@
+// Golden protocol recordings.
+//
+// A golden scenario drives a handler using the usual test helpers. Its
+// traffic (client <-> gateway and gateway <-> MQTT broker) is recorded into
+// a text file in testdata/golden, one packet per line in hex. TestGolden
+// replays the recordings against a new handler: the recorded client and
+// broker packets are sent to the handler and the packets sent by the handler
+// must match the recorded ones byte by byte. Hence, any change of the
+// protocol behavior shows up as a diff of the golden files.
+//
+// Run
+//
+//	go test ./gateway -run TestGolden -update-golden
+//
+// to re-record the golden files after an intended change.
+
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	mqttPackets "github.com/eclipse/paho.mqtt.golang/packets"
+	snMsgs "github.com/energomonitor/bisquitt/messages"
+	"github.com/energomonitor/bisquitt/topics"
+	"github.com/stretchr/testify/assert"
+)
+
+var updateGolden = flag.Bool("update-golden", false, "re-record golden protocol recordings")
+
+// goldenDirection identifies the connection and the direction of a recorded
+// packet.
+type goldenDirection string
+
+const (
+	goldenClientToGateway goldenDirection = "c>g"
+	goldenGatewayToClient goldenDirection = "g>c"
+	goldenBrokerToGateway goldenDirection = "b>g"
+	goldenGatewayToBroker goldenDirection = "g>b"
+)
+
+type goldenPacket struct {
+	direction goldenDirection
+	data      []byte
+	// Human-readable description, not used by replay.
+	comment string
+}
+
+// goldenRecording is a sequence of packets in the order the test has sent or
+// received them. A nil *goldenRecording records nothing.
+type goldenRecording struct {
+	packets []goldenPacket
+}
+
+func (r *goldenRecording) add(direction goldenDirection, data []byte, msg fmt.Stringer) {
+	if r == nil {
+		return
+	}
+	r.packets = append(r.packets, goldenPacket{
+		direction: direction,
+		data:      append([]byte(nil), data...),
+		comment:   msg.String(),
+	})
+}
+
+func (r *goldenRecording) write(file string) error {
+	buff := &bytes.Buffer{}
+	fmt.Fprintf(buff, "# Generated by: go test ./gateway -run TestGolden -update-golden\n")
+	for _, pkt := range r.packets {
+		fmt.Fprintf(buff, "# %s\n", strings.TrimSpace(strings.ReplaceAll(pkt.comment, "\n", " ")))
+		fmt.Fprintf(buff, "%s % x\n", pkt.direction, pkt.data)
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, buff.Bytes(), 0644)
+}
+
+func readGoldenRecording(file string) (*goldenRecording, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := &goldenRecording{}
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: invalid format", file, lineNo)
+		}
+		direction := goldenDirection(fields[0])
+		switch direction {
+		case goldenClientToGateway, goldenGatewayToClient, goldenBrokerToGateway, goldenGatewayToBroker:
+		default:
+			return nil, fmt.Errorf("%s:%d: invalid direction %q", file, lineNo, direction)
+		}
+		data, err := hex.DecodeString(strings.ReplaceAll(fields[1], " ", ""))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", file, lineNo, err)
+		}
+		r.packets = append(r.packets, goldenPacket{
+			direction: direction,
+			data:      data,
+		})
+	}
+	return r, scanner.Err()
+}
+
+func encodeMqtt(t *testing.T, msg mqttPackets.ControlPacket) []byte {
+	buff := &bytes.Buffer{}
+	if err := msg.Write(buff); err != nil {
+		t.Fatal(err)
+	}
+	return buff.Bytes()
+}
+
+// replay sends the recorded client and broker packets to the handler and
+// checks the handler's packets against the recorded ones.
+func (r *goldenRecording) replay(stp *testSetup) {
+	assert := assert.New(stp.t)
+
+	for i, pkt := range r.packets {
+		switch pkt.direction {
+		case goldenClientToGateway:
+			if _, err := stp.snConn.Write(pkt.data); err != nil {
+				stp.t.Fatal(err)
+			}
+		case goldenBrokerToGateway:
+			if _, err := stp.mqttConn.Write(pkt.data); err != nil {
+				stp.t.Fatal(err)
+			}
+		case goldenGatewayToClient:
+			buff := make([]byte, maxTestPktLength)
+			n, err := stp.snConn.Read(buff)
+			if err != nil {
+				stp.t.Fatal(err)
+			}
+			if !assert.Equal(pkt.data, buff[:n], "packet %d (%s)", i+1, pkt.direction) {
+				return
+			}
+		case goldenGatewayToBroker:
+			msg, err := mqttPackets.ReadPacket(stp.mqttConn)
+			if err != nil {
+				stp.t.Fatal(err)
+			}
+			if !assert.Equal(pkt.data, encodeMqtt(stp.t, msg), "packet %d (%s)", i+1, pkt.direction) {
+				return
+			}
+		}
+	}
+	stp.assertHandlerDone()
+}
+
+// Golden scenarios. Every scenario must end with a disconnected client.
+var goldenScenarios = map[string]func(stp *testSetup){
+	"connect": func(stp *testSetup) {
+		stp.connect()
+		stp.register("test/topic")
+		stp.disconnect()
+	},
+	"client-publish-qos1": func(stp *testSetup) {
+		stp.connect()
+		topicID := stp.register("test/topic")
+
+		// client --PUBLISH--> GW
+		snPublish := snMsgs.NewPublishMessage(topicID, snMsgs.TIT_REGISTERED, []byte("test-msg"), 1, false, false)
+		stp.snSend(snPublish, true)
+
+		// GW --PUBLISH--> MQTT broker
+		mqttPublish := stp.mqttRecv().(*mqttPackets.PublishPacket)
+
+		// GW <--PUBACK-- MQTT broker
+		mqttPuback := mqttPackets.NewControlPacket(mqttPackets.Puback).(*mqttPackets.PubackPacket)
+		mqttPuback.MessageID = mqttPublish.MessageID
+		stp.mqttSend(mqttPuback, false)
+
+		// client <--PUBACK-- GW
+		stp.snRecv()
+
+		stp.disconnect()
+	},
+	"broker-publish-qos1": func(stp *testSetup) {
+		stp.connect()
+		stp.subscribe("test/+", 1)
+
+		// GW <--PUBLISH-- MQTT broker
+		mqttPublish := mqttPackets.NewControlPacket(mqttPackets.Publish).(*mqttPackets.PublishPacket)
+		mqttPublish.Qos = 1
+		mqttPublish.TopicName = "test/topic"
+		mqttPublish.Payload = []byte("test-msg")
+		stp.mqttSend(mqttPublish, true)
+
+		// client <--REGISTER-- GW
+		snRegister := stp.snRecv().(*snMsgs.RegisterMessage)
+
+		// client --REGACK--> GW
+		snRegack := snMsgs.NewRegackMessage(snRegister.TopicID, snMsgs.RC_ACCEPTED)
+		snRegack.SetMessageID(snRegister.MessageID())
+		stp.snSend(snRegack, false)
+
+		// client <--PUBLISH-- GW
+		snPublish := stp.snRecv().(*snMsgs.PublishMessage)
+
+		// client --PUBACK--> GW
+		snPuback := snMsgs.NewPubackMessage(snPublish.TopicID, snMsgs.RC_ACCEPTED)
+		snPuback.SetMessageID(snPublish.MessageID())
+		stp.snSend(snPuback, false)
+
+		// GW --PUBACK--> MQTT broker
+		stp.mqttRecv()
+
+		stp.disconnect()
+	},
+}
+
+func TestGolden(t *testing.T) {
+	for name, scenario := range goldenScenarios {
+		file := filepath.Join("testdata", "golden", name+".txt")
+		if *updateGolden {
+			stp := newTestSetup(t, false, topics.PredefinedTopics{})
+			stp.recording = &goldenRecording{}
+			scenario(stp)
+			stp.cancel()
+			if err := stp.recording.write(file); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+
+		recording, err := readGoldenRecording(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stp := newTestSetup(t, false, topics.PredefinedTopics{})
+		recording.replay(stp)
+		stp.cancel()
+	}
+}
@@ -8,6 +8,7 @@
 // - If the goroutine wants to (cleanly) cancel the whole Handler, it returns `Shutdown`.
 // - If any of the goroutines returns any error other than `Shutdown`, the Handler
 //   is canceled and the error is returned to the Gateway.
+// - A panic in any of the goroutines is converted to an error (see quarantine.go).
 // - `Handler.Run()` returns after all goroutines exit.
 // - Open connections should be closed at the same level they were opened, i.e.
 //   the MQTT-SN connection must be closed by Gateway and the MQTT connection is
@@ -22,6 +23,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"strings"
 	"sync"
@@ -46,12 +48,32 @@ type handler struct {
 	mqttConn         *util.ConnWithContext
 	registeredTopics sync.Map // uint16 => string
 	predefinedTopics topics.PredefinedTopics
+	keepAliveLock    sync.Mutex
 	keepAlive        uint16
+	mqttKeepAlive    uint16
+	keepAliveStarted bool
+	sleepPinger      sleepPinger
 	clientID         string
 	topicID          *util.IDSequence
 	msgBuffer        []snMsgs.Message
-	group            *errgroup.Group
+	msgBufferLock    sync.Mutex
+	group            *guardedGroup
 	transactions     *transactions.TransactionStore
+	stats            *stats
+	activity         *clientActivity
+	deliveries       deliveryQueue
+	logRing          *util.LogRing
+	snBuffer         []byte
+	downlink         *downlinkShaper
+	upstreams        []*upstream
+	routed           routeTable
+	purge            *sessionPurge
+	// Serializes handling of messages received from the MQTT broker and
+	// the routes' brokers (see routing.go).
+	upstreamLock sync.Mutex
+	// Set if the session was taken over from the active gateway and the
+	// MQTT connection has not been re-established yet.
+	restored bool
 	// for testing
 	mockupDialFunc func() net.Conn
 }
@@ -93,6 +115,61 @@ type handlerConfig struct {
 	RetryDelay time.Duration
 	// NRetry in MQTT-SN specification
 	RetryCount uint
+	EventHook  EventHook
+	Filter     *Filter
+	// If non-zero, overrides the keepalive requested by the client in the
+	// MQTT connection.
+	MqttKeepAlive time.Duration
+	// Connect to the MQTT broker using MQTT 5 (see mqtt5.go).
+	Mqtt5                 bool
+	MqttTopicAliasMaximum uint16
+	// Delivery order of messages buffered for sleeping clients.
+	DownlinkPriorities TopicPriorities
+	// Serve SysTopicPrefix topics by the gateway itself.
+	SysTopics bool
+	// Transactions older than this are considered leaked and removed.
+	TransactionMaxLifetime time.Duration
+	// Do not keep the order of messages sent to the client (see
+	// ordering.go).
+	UnorderedDelivery bool
+	// Number of recent log lines kept in memory (see Gateway.ClientLog).
+	ClientLogSize int
+	// Maximum size of a datagram carrying multiple messages buffered for
+	// a sleeping client. Zero disables coalescing.
+	CoalesceSize int
+	// Topics registered by the gateway right after CONNACK.
+	PushTopics []string
+	// Limits of messages sent by the MQTT broker to the client, zero means
+	// no limit (see shaping.go).
+	DownlinkMessageRate float64
+	DownlinkByteRate    int
+	// Retain flag modifications of messages published by the client.
+	RetainRules RetainRules
+	// Topics routed to other MQTT brokers (see routing.go).
+	Routes Routes
+	// Refuse messages deviating from the MQTT-SN specification (see
+	// strict.go).
+	StrictSpec bool
+	// Purge the session if the client has not sent any message for this
+	// long. Zero disables the expiry (see purge.go).
+	SessionTTL time.Duration
+	// Metadata of all the clients, shared by all the handlers. Nil if
+	// clients' metadata is not accepted (see metadata.go).
+	Inventory *inventory
+	// Clients refused because of repeated handler panics, shared by all
+	// the handlers. Nil disables the quarantine.
+	Quarantine *quarantine
+	// Latencies of the clients' QoS 1 PUBLISHes, shared by all the
+	// handlers. Nil if no SLOs are declared (see slo.go).
+	SLO *sloTracker
+	// QoS 1 PUBLISHes acknowledged to the clients, shared by all the
+	// handlers. Nil disables the replay protection (see dedup.go).
+	Dedup *dedupWindow
+	// Sent in GWINFO messages (see discovery.go).
+	GatewayID uint8
+	// Forwarders known to the gateway, shared by all the handlers. Nil
+	// disables the re-broadcasting (see discovery.go).
+	Forwarders *forwarders
 }
 
 func newHandler(cfg *handlerConfig, predefinedTopics topics.PredefinedTopics,
@@ -105,17 +182,29 @@ func newHandler(cfg *handlerConfig, predefinedTopics topics.PredefinedTopics,
 		predefinedTopics: predefinedTopics,
 		topicID:          util.NewIDSequence(snMsgs.MinTopicID, snMsgs.MaxTopicID),
 		transactions:     transactions.NewTransactionStore(),
+		stats:            newStats(),
+		activity:         newClientActivity(),
+		purge:            newSessionPurge(),
+	}
+	h.downlink = newDownlinkShaper(cfg.DownlinkMessageRate, cfg.DownlinkByteRate)
+	for i := range cfg.Routes {
+		h.upstreams = append(h.upstreams, newUpstream(h, &cfg.Routes[i]))
+	}
+	if cfg.ClientLogSize > 0 {
+		h.logRing = util.NewLogRing(cfg.ClientLogSize)
+		h.log = util.NewRingLogger(logger, h.logRing)
 	}
 
 	return h
 }
 
-func (h *handler) run(ctx context.Context, snConn net.Conn) error {
+func (h *handler) serve(ctx context.Context, snConn net.Conn) error {
 	h.log.Debug("Handler starts.")
 	defer h.log.Debug("Handler quits.")
+	defer h.emit(EventClosed)
 
-	var groupCtx context.Context
-	h.group, groupCtx = errgroup.WithContext(ctx)
+	group, groupCtx := errgroup.WithContext(ctx)
+	h.group = &guardedGroup{Group: group, handler: h}
 
 	// We must create a separate MQTT-SN connection context because we want to
 	// send DISCONNECT message when the handler is destroyed => we don't want
@@ -157,6 +246,7 @@ func (h *handler) run(ctx context.Context, snConn net.Conn) error {
 		mqttConn, err = dialer.DialContext(ctx, "tcp", h.cfg.MqttBrokerAddress.String())
 		if err != nil {
 			h.log.Error("Error connecting to MQTT broker: %s", err)
+			h.stats.count(&h.stats.mqttDialErrors)
 			snMsg := snMsgs.NewConnackMessage(snMsgs.RC_CONGESTION)
 			if err := h.snSend(snMsg); err != nil {
 				h.log.Error("Error sending CONNACK to a connection: %s", err)
@@ -165,14 +255,27 @@ func (h *handler) run(ctx context.Context, snConn net.Conn) error {
 		}
 	}
 	h.log.Debug("Connected to MQTT broker")
+	h.stats.clientConnected()
+	defer h.stats.clientDisconnected()
+	defer h.cfg.Forwarders.remove(h)
 	defer func() {
 		h.log.Debug("Closing MQTT connection")
 		if err := mqttConn.Close(); err != nil {
 			h.log.Error("Error closing MQTT connection: %s", err)
 		}
 	}()
+	if h.cfg.Mqtt5 {
+		mqttConn = newMqtt5Conn(mqttConn, h.cfg.MqttTopicAliasMaximum)
+	}
 	h.mqttConn = util.NewConnWithContext(groupCtx, mqttConn, connTimeout)
 
+	if h.restored {
+		if err := h.resumeSession(groupCtx); err != nil {
+			h.log.Error("Cannot resume session: %s", err)
+			return err
+		}
+	}
+
 	h.group.Go(func() error {
 		return h.mqttReceiveLoop(groupCtx)
 	})
@@ -181,6 +284,14 @@ func (h *handler) run(ctx context.Context, snConn net.Conn) error {
 		return h.snReceiveLoop(snCtx)
 	})
 
+	h.group.Go(func() error {
+		return h.transactionSweeper(groupCtx)
+	})
+
+	h.group.Go(func() error {
+		return h.sessionPurger(groupCtx)
+	})
+
 	err := h.group.Wait()
 	if err == Shutdown {
 		return nil
@@ -191,10 +302,47 @@ func (h *handler) run(ctx context.Context, snConn net.Conn) error {
 	return err
 }
 
+// setKeepAlive sets the client's keepalive and the MQTT keepalive derived
+// from it.
+func (h *handler) setKeepAlive(keepAlive uint16) {
+	h.keepAliveLock.Lock()
+	defer h.keepAliveLock.Unlock()
+	h.keepAlive = keepAlive
+	h.mqttKeepAlive = keepAlive
+	if h.cfg.MqttKeepAlive > MaxMqttKeepAlive {
+		// Refused by the CLI and reported by the self-check.
+		h.mqttKeepAlive = math.MaxUint16
+	} else if h.cfg.MqttKeepAlive > 0 {
+		h.mqttKeepAlive = uint16(h.cfg.MqttKeepAlive / time.Second)
+		if h.mqttKeepAlive == 0 {
+			h.mqttKeepAlive = 1
+		}
+	}
+}
+
+func (h *handler) sessionKeepAlive() uint16 {
+	h.keepAliveLock.Lock()
+	defer h.keepAliveLock.Unlock()
+	return h.keepAlive
+}
+
+// keepAlives returns the client's keepalive and the MQTT keepalive.
+func (h *handler) keepAlives() (uint16, uint16) {
+	h.keepAliveLock.Lock()
+	defer h.keepAliveLock.Unlock()
+	return h.keepAlive, h.mqttKeepAlive
+}
+
 func (h *handler) setState(new util.ClientState) {
-	old := h.state.Set(new)
+	h.stateChanged(h.state.Set(new), new)
+}
+
+// stateChanged notifies about a state change done by h.state.Set. Must not be
+// called with any lock held because the EventHook is called synchronously.
+func (h *handler) stateChanged(old, new util.ClientState) {
 	if new != old {
 		h.log.Debug("State changed to %q.", new)
+		h.emit(EventStateChanged)
 	}
 }
 
@@ -210,7 +358,7 @@ func (h *handler) findRegisteredTopicID(topic string) (topicID uint16, found boo
 	return topicID, found
 }
 
-func (h *handler) findTopicID(topic string) (uint16, uint8, bool) {
+func (h *handler) findTopicID(topic string) (uint16, snMsgs.TopicIDType, bool) {
 	topicID, ok := h.findRegisteredTopicID(topic)
 	if ok {
 		return topicID, snMsgs.TIT_REGISTERED, true
@@ -226,15 +374,26 @@ func (h *handler) findTopicID(topic string) (uint16, uint8, bool) {
 func (h *handler) handleClientPublish(ctx context.Context, snPublish *snMsgs.PublishMessage) error {
 	msgID := snPublish.MessageID()
 
+	if snPublish.QOS == 3 && snPublish.TopicIDType == snMsgs.TIT_REGISTERED &&
+		!h.tolerate(&h.stats.devQOSM1TopicID, "QoS -1 PUBLISH with a registered TopicID", snPublish) {
+		return nil
+	}
+	dup := snPublish.DUP()
+	if dup && (snPublish.QOS == 0 || snPublish.QOS == 3) {
+		if !h.tolerate(&h.stats.devDupQOS0, "DUP flag set in QoS 0 PUBLISH", snPublish) {
+			return nil
+		}
+		dup = false
+	}
+
 	mqPublish := mqttPackets.NewControlPacket(mqttPackets.Publish).(*mqttPackets.PublishPacket)
 	mqPublish.MessageID = msgID
-	mqPublish.Dup = snPublish.DUP()
+	mqPublish.Dup = dup
 	if snPublish.QOS == 3 {
 		mqPublish.Qos = 0
 	} else {
 		mqPublish.Qos = snPublish.QOS
 	}
-	mqPublish.Retain = snPublish.Retain
 	var topic string
 	switch snPublish.TopicIDType {
 	case snMsgs.TIT_REGISTERED:
@@ -251,41 +410,81 @@ func (h *handler) handleClientPublish(ctx context.Context, snPublish *snMsgs.Pub
 		}
 	case snMsgs.TIT_SHORT:
 		topic = snMsgs.DecodeShortTopic(snPublish.TopicID)
+		// A topic name must not contain wildcards, the MQTT broker would
+		// close the connection.
+		// [MQTT 3.1.1 specification, chapter 3.3.2.1 Topic Name]
+		if hasWildcard(topic) {
+			h.log.Debug("PUBLISH to short topic %q containing wildcards refused", topic)
+			h.stats.count(&h.stats.msgsInvalidTopic)
+			return h.rejectPublish(snPublish, snMsgs.RC_NOT_SUPPORTED)
+		}
 	}
-	if snPublish.QOS == 1 {
-		h.transactions.Store(msgID, newClientPublishQOS1Transaction(ctx, h, msgID, snPublish.TopicID))
+	if h.cfg.Inventory != nil && topic == MetadataTopic {
+		return h.handleMetadata(snPublish)
+	}
+	if snPublish.QOS == 1 && h.cfg.Dedup.duplicate(h.dedupKey(snPublish, topic)) {
+		h.log.Debug("Already acknowledged PUBLISH dropped: %v", snPublish)
+		h.stats.count(&h.stats.msgsDuplicate)
+		return h.acknowledgeDropped(snPublish)
+	}
+	if !h.cfg.Filter.Allow(topic, snPublish.Data) {
+		h.log.Debug("PUBLISH to %q dropped by filter", topic)
+		h.stats.count(&h.stats.msgsFiltered)
+		return h.acknowledgeDropped(snPublish)
 	}
 	mqPublish.TopicName = topic
 	mqPublish.Payload = snPublish.Data
+	mqPublish.Retain = h.applyRetainRules(topic, snPublish.Retain)
+	if u := h.upstreamFor(topic); u != nil {
+		return h.routePublish(ctx, u, snPublish, mqPublish)
+	}
+	if snPublish.QOS == 1 {
+		h.transactions.Store(msgID, newClientPublishQOS1Transaction(ctx, h, snPublish, topic))
+	}
 
 	return h.mqttSend(mqPublish)
 }
 
-func (h *handler) handleBrokerPublish(ctx context.Context, mqPublish *mqttPackets.PublishPacket) error {
-	msgID := mqPublish.MessageID
+// rejectPublish refuses a client PUBLISH with the given return code. A QoS 0
+// or -1 PUBLISH is not acknowledged, hence it's dropped silently.
+func (h *handler) rejectPublish(snPublish *snMsgs.PublishMessage, returnCode snMsgs.ReturnCode) error {
+	if snPublish.QOS != 1 && snPublish.QOS != 2 {
+		return nil
+	}
+	snPuback := snMsgs.NewPubackMessage(snPublish.TopicID, returnCode)
+	snPuback.CopyMessageID(snPublish)
+	return h.snSend(snPuback)
+}
 
-	// Get TopicID
-	var needsRegister bool
-	var topicID uint16
-	var topicIDType uint8
-	if snMsgs.IsShortTopic(mqPublish.TopicName) {
-		topicID = snMsgs.EncodeShortTopic(mqPublish.TopicName)
-		topicIDType = snMsgs.TIT_SHORT
-		needsRegister = false
-	} else {
-		var ok bool
-		topicID, topicIDType, ok = h.findTopicID(mqPublish.TopicName)
-		needsRegister = !ok
+// acknowledgeDropped acknowledges a client PUBLISH which is not forwarded to
+// the MQTT broker so that the client does not retransmit it.
+func (h *handler) acknowledgeDropped(snPublish *snMsgs.PublishMessage) error {
+	switch snPublish.QOS {
+	case 1:
+		snPuback := snMsgs.NewPubackMessage(snPublish.TopicID, snMsgs.RC_ACCEPTED)
+		snPuback.CopyMessageID(snPublish)
+		return h.snSend(snPuback)
+	case 2:
+		// The subsequent PUBREL is forwarded to the MQTT broker which must
+		// respond with PUBCOMP even if it does not know the MsgID.
+		// [MQTT 3.1.1 specification, chapter 4.3.3]
+		snPubrec := snMsgs.NewPubrecMessage()
+		snPubrec.CopyMessageID(snPublish)
+		return h.snSend(snPubrec)
 	}
+	return nil
+}
 
-	snPublish := snMsgs.NewPublishMessage(topicID, topicIDType,
-		mqPublish.Payload, mqPublish.Qos, mqPublish.Retain, mqPublish.Dup)
-	snPublish.SetMessageID(mqPublish.MessageID)
+// deliverBrokerPublish sends a PUBLISH received from the MQTT broker to the
+// client. Returns the transaction delivering the message or nil if the
+// message has been sent without a transaction.
+func (h *handler) deliverBrokerPublish(ctx context.Context, mqPublish *mqttPackets.PublishPacket) (brokerPublishTransaction, error) {
+	msgID := mqPublish.MessageID
 
 	if mqPublish.Qos == 0 {
 		// QOS 0 publish without topic registration does not need a transaction
-		if !needsRegister {
-			return h.snSend(snPublish)
+		if sent, err := h.sendBrokerPublishQOS0(mqPublish); sent || err != nil {
+			return nil, err
 		}
 
 		// We are reusing PUBLISH message's MsgID because we
@@ -305,19 +504,17 @@ func (h *handler) handleBrokerPublish(ctx context.Context, mqPublish *mqttPacket
 		// But there's a big problem when PUBLISH is QoS 0, i.e.
 		// its MsgID is 0. We use a very dirty hack here to choose
 		// an "almost surely available" MsgID :(
-		found := false
-		for i := snMsgs.MaxMessageID; i >= snMsgs.MinMessageID; i-- {
-			if _, ok := h.transactions.Get(i); !ok {
-				msgID = i
-				found = true
-				break
-			}
-		}
-		if !found {
-			return errors.New("cannot find available MsgID")
+		var ok bool
+		if msgID, ok = h.availableMsgID(); !ok {
+			return nil, errors.New("cannot find available MsgID")
 		}
 	}
 
+	topicID, topicIDType, needsRegister := h.brokerPublishTopicID(mqPublish.TopicName)
+	snPublish := snMsgs.NewPublishMessage(topicID, topicIDType,
+		mqPublish.Payload, mqPublish.Qos, mqPublish.Retain, mqPublish.Dup)
+	snPublish.SetMessageID(mqPublish.MessageID)
+
 	var transaction brokerPublishTransaction
 	switch mqPublish.Qos {
 	case 0:
@@ -327,7 +524,7 @@ func (h *handler) handleBrokerPublish(ctx context.Context, mqPublish *mqttPacket
 	case 2:
 		transaction = newBrokerPublishQOS2Transaction(ctx, h, msgID)
 	default:
-		return fmt.Errorf("Invalid QoS in %v", mqPublish)
+		return nil, fmt.Errorf("Invalid QoS in %v", mqPublish)
 	}
 
 	var snMsg snMsgs.Message
@@ -335,7 +532,7 @@ func (h *handler) handleBrokerPublish(ctx context.Context, mqPublish *mqttPacket
 	if needsRegister {
 		topicID, err := h.newTopicID()
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		// snPublish will be sent after REGACK is received
@@ -357,7 +554,48 @@ func (h *handler) handleBrokerPublish(ctx context.Context, mqPublish *mqttPacket
 	}
 
 	h.transactions.Store(msgID, transaction)
-	return transaction.ProceedSN(nextState, snMsg)
+	return transaction, transaction.ProceedSN(nextState, snMsg)
+}
+
+// brokerPublishTopicID returns the TopicID used to send a PUBLISH on the given
+// topic received from the MQTT broker to the client. needsRegister is set if
+// the topic must be registered first.
+func (h *handler) brokerPublishTopicID(topic string) (topicID uint16, topicIDType snMsgs.TopicIDType, needsRegister bool) {
+	if snMsgs.IsShortTopic(topic) {
+		return snMsgs.EncodeShortTopic(topic), snMsgs.TIT_SHORT, false
+	}
+	topicID, topicIDType, ok := h.findTopicID(topic)
+	return topicID, topicIDType, !ok
+}
+
+// sendBrokerPublishQOS0 is a fast path for QoS 0 PUBLISH received from the
+// MQTT broker: if its topic needs no registration, the message is sent to the
+// client right away, without any transaction. Returns false if the message
+// has not been sent.
+func (h *handler) sendBrokerPublishQOS0(mqPublish *mqttPackets.PublishPacket) (bool, error) {
+	topicID, topicIDType, needsRegister := h.brokerPublishTopicID(mqPublish.TopicName)
+	if needsRegister {
+		return false, nil
+	}
+	snPublish := snMsgs.NewPublishMessage(topicID, topicIDType,
+		mqPublish.Payload, 0, mqPublish.Retain, mqPublish.Dup)
+	return true, h.snSend(snPublish)
+}
+
+// availableMsgID returns a MsgID not used by any transaction for a message
+// initiated by the gateway. The MsgIDs are searched from the top of the range
+// because the MQTT broker assigns MsgIDs from the bottom.
+func (h *handler) availableMsgID() (uint16, bool) {
+	for i := snMsgs.MaxMessageID; i >= snMsgs.MinMessageID; i-- {
+		if _, ok := h.transactions.Get(i); ok {
+			continue
+		}
+		if h.routed.inDownlink(i) {
+			continue
+		}
+		return i, true
+	}
+	return 0, false
 }
 
 func (h *handler) handleMqtt(ctx context.Context, msg mqttPackets.ControlPacket) error {
@@ -367,12 +605,20 @@ func (h *handler) handleMqtt(ctx context.Context, msg mqttPackets.ControlPacket)
 	// Client CONNECT transaction.
 	case *mqttPackets.ConnackPacket:
 		transactionx, _ := h.transactions.GetByType(snMsgs.CONNECT)
+		if transactionx == nil && h.restored {
+			return h.restoredConnack(ctx, mqMsg)
+		}
 		transaction, ok := transactionx.(*connectTransaction)
 		if !ok {
 			h.log.Error("Unexpected transaction type %T for message: %v", transactionx, mqMsg)
 			return nil
 		}
-		return transaction.Connack(mqMsg)
+		if err := transaction.Connack(mqMsg); err != nil {
+			return err
+		}
+		h.startKeepAliveOnce(ctx)
+		h.startRoutes(ctx, transaction.mqConnect)
+		return h.pushRegisters(ctx)
 
 	// Client PUBLISH QoS 1 transaction.
 	case *mqttPackets.PubackPacket:
@@ -414,8 +660,9 @@ func (h *handler) handleMqtt(ctx context.Context, msg mqttPackets.ControlPacket)
 
 	// Client PING transaction (keepalive).
 	case *mqttPackets.PingrespPacket:
-		// Response to sleepPinger pings => do not pass to the sleeping client.
-		if h.state.Get() != util.StateActive {
+		// Response to sleepPinger or brokerPinger pings => do not pass to
+		// the client.
+		if h.state.Get() != util.StateActive || h.cfg.MqttKeepAlive > 0 {
 			return nil
 		}
 		return h.snSend(snMsgs.NewPingrespMessage())
@@ -443,17 +690,24 @@ func (h *handler) snReceiveLoop(ctx context.Context) error {
 	h.log.Debug("MQTT-SN receiver starts.")
 	defer h.log.Debug("MQTT-SN receiver quits.")
 	for {
-		msg, err := h.snReceive()
-		if err != nil {
-			if err == context.Canceled {
-				return nil
+		msgs, reservedFlags, receiveErr := h.snReceive()
+		if receiveErr == context.Canceled {
+			return nil
+		}
+		for i, msg := range msgs {
+			if reservedFlags[i] && !h.tolerate(&h.stats.devReservedFlags, "Reserved flags set", msg) {
+				if err := h.refuse(msg); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := h.handleMqttSn(ctx, msg); err != nil {
+				return err
 			}
-			h.log.Error("MQTT-SN receive error: %v", err)
-			return err
 		}
-		err = h.handleMqttSn(ctx, msg)
-		if err != nil {
-			return err
+		if receiveErr != nil {
+			h.log.Error("MQTT-SN receive error: %v", receiveErr)
+			return receiveErr
 		}
 	}
 }
@@ -478,7 +732,10 @@ func (h *handler) mqttReceiveLoop(ctx context.Context) error {
 			h.log.Error("MQTT decode error: %v", err)
 			return err
 		}
-		if err := h.handleMqtt(ctx, msg); err != nil {
+		h.upstreamLock.Lock()
+		err = h.handleMqtt(ctx, msg)
+		h.upstreamLock.Unlock()
+		if err != nil {
 			return err
 		}
 	}
@@ -524,6 +781,16 @@ func (h *handler) handleConnect(ctx context.Context, snConnect *snMsgs.ConnectMe
 		return h.snSend(reply)
 	}
 
+	if h.cfg.Quarantine.holds(string(snConnect.ClientID), h.id) {
+		h.log.Info("Client %q is quarantined, refusing CONNECT.", snConnect.ClientID)
+		h.stats.count(&h.stats.quarantined)
+		reply := snMsgs.NewConnackMessage(snMsgs.RC_CONGESTION)
+		if err := h.snSend(reply); err != nil {
+			return err
+		}
+		return Shutdown
+	}
+
 	if h.state.Get() == util.StateAwake {
 		h.setState(util.StateActive)
 		reply := &snMsgs.ConnackMessage{
@@ -538,16 +805,21 @@ func (h *handler) handleConnect(ctx context.Context, snConnect *snMsgs.ConnectMe
 	// detect lost connection (unlike TCP in MQTT). This would lead
 	// to a potential dead Handlers accumulation and such to
 	// exploitable memory leaks.
-	// Hence, we simply do not accept zero keepalive.
+	// Hence, we simply do not accept zero keepalive, not even in the
+	// lenient mode (see strict.go).
 	if snConnect.Duration == 0 {
-		reply := &snMsgs.ConnackMessage{
-			ReturnCode: snMsgs.RC_NOT_SUPPORTED,
-		}
-		return h.snSend(reply)
+		h.stats.count(&h.stats.devKeepAliveZero)
+		return h.snSend(snMsgs.NewConnackMessage(snMsgs.RC_NOT_SUPPORTED))
 	}
 
-	h.keepAlive = snConnect.Duration
+	h.setKeepAlive(snConnect.Duration)
+	_, mqttKeepAlive := h.keepAlives()
 	h.clientID = string(snConnect.ClientID)
+	h.activity.setClientID(h.clientID)
+	if snConnect.CleanSession {
+		// The client numbers its messages anew (see dedup.go).
+		h.cfg.Dedup.forget(h.clientID)
+	}
 
 	mqConnect := &mqttPackets.ConnectPacket{
 		FixedHeader: mqttPackets.FixedHeader{
@@ -555,7 +827,7 @@ func (h *handler) handleConnect(ctx context.Context, snConnect *snMsgs.ConnectMe
 		},
 		ClientIdentifier: h.clientID,
 		CleanSession:     snConnect.CleanSession,
-		Keepalive:        h.keepAlive,
+		Keepalive:        mqttKeepAlive,
 		ProtocolVersion:  4,
 		ProtocolName:     "MQTT",
 		UsernameFlag:     h.cfg.MqttUser != nil,
@@ -587,8 +859,15 @@ func (h *handler) handleSubscribe(ctx context.Context, snSubscribe *snMsgs.Subsc
 	case snMsgs.TIT_STRING:
 		topic = string(snSubscribe.TopicName)
 		if !hasWildcard(topic) {
+			// We must register the topic here, even when we can get
+			// a non-successful SUBACK later because MQTT specification says
+			// explicitly:
+			// The Server is permitted to start sending PUBLISH packets matching
+			// the Subscription before the Server sends the SUBACK Packet.
+			// [MQTT v.5.0, chapter 3.8.4 SUBSCRIBE Actions]
+			// An already registered topic keeps its TopicID.
 			var err error
-			topicID, err = h.newTopicID()
+			topicID, err = h.registerTopic(topic)
 			if err != nil {
 				snSuback := snMsgs.NewSubackMessage(0, 0, snMsgs.RC_INVALID_TOPIC_ID)
 				// We are kind of misusing the "invalid topic ID" return code here.
@@ -596,13 +875,6 @@ func (h *handler) handleSubscribe(ctx context.Context, snSubscribe *snMsgs.Subsc
 				snSuback.CopyMessageID(snSubscribe)
 				return h.snSend(snSuback)
 			}
-			// We must register the topic here, even when we can get
-			// a non-successful SUBACK later because MQTT specification says
-			// explicitly:
-			// The Server is permitted to start sending PUBLISH packets matching
-			// the Subscription before the Server sends the SUBACK Packet.
-			// [MQTT v.5.0, chapter 3.8.4 SUBSCRIBE Actions]
-			h.registeredTopics.Store(topicID, topic)
 		}
 		// topicID remains zero if client is subscribing to a wildcard topic.
 	case snMsgs.TIT_PREDEFINED:
@@ -617,6 +889,10 @@ func (h *handler) handleSubscribe(ctx context.Context, snSubscribe *snMsgs.Subsc
 		// topicID remains zero.
 	}
 
+	if h.cfg.SysTopics && isSysTopic(topic) {
+		return h.handleSysSubscribe(ctx, snSubscribe, topic, topicID)
+	}
+
 	msgID := snSubscribe.MessageID()
 	transaction := newSubscribeTransaction(ctx, h, msgID, topicID)
 	h.transactions.Store(msgID, transaction)
@@ -626,6 +902,9 @@ func (h *handler) handleSubscribe(ctx context.Context, snSubscribe *snMsgs.Subsc
 	mqSubscribe.Dup = snSubscribe.DUP()
 	mqSubscribe.Qoss = []byte{snSubscribe.QOS}
 	mqSubscribe.Topics = []string{topic}
+	if u := h.upstreamFor(topic); u != nil {
+		return h.routeSubscribe(u, mqSubscribe)
+	}
 	return h.mqttSend(mqSubscribe)
 }
 
@@ -644,9 +923,18 @@ func (h *handler) handleUnsubscribe(_ context.Context, snUnsubscribe *snMsgs.Uns
 		topic = snMsgs.DecodeShortTopic(snUnsubscribe.TopicID)
 	}
 
+	if h.cfg.SysTopics && isSysTopic(topic) {
+		snUnsuback := snMsgs.NewUnsubackMessage()
+		snUnsuback.CopyMessageID(snUnsubscribe)
+		return h.snSend(snUnsuback)
+	}
+
 	mqUnsubscribe := mqttPackets.NewControlPacket(mqttPackets.Unsubscribe).(*mqttPackets.UnsubscribePacket)
 	mqUnsubscribe.MessageID = snUnsubscribe.MessageID()
 	mqUnsubscribe.Topics = []string{topic}
+	if u := h.upstreamFor(topic); u != nil {
+		return h.routeUnsubscribe(u, mqUnsubscribe)
+	}
 	return h.mqttSend(mqUnsubscribe)
 }
 
@@ -678,6 +966,9 @@ func (h *handler) checkMessageLegal(msg snMsgs.Message) error {
 	// responds to DISCONNECT => we must enable DISCONNECT message.
 	case *snMsgs.DisconnectMessage:
 		return nil
+	// Gateway discovery needs no connection.
+	case *snMsgs.SearchGwMessage, *snMsgs.EncapsulatedMessage:
+		return nil
 	case *snMsgs.PublishMessage:
 		// MQTT-SN specification v. 1.2, chapter 6.8 PUBLISH with QoS Level -1
 		// QOS 3 messages with short or predefined topics are allowed
@@ -760,6 +1051,9 @@ func (h *handler) handleMqttSn(ctx context.Context, msg snMsgs.Message) error {
 
 	// Client PUBLISH QoS 2 transaction.
 	case *snMsgs.PubrelMessage:
+		if routed, err := h.routePubrel(snMsg); routed || err != nil {
+			return err
+		}
 		mqPubrel := mqttPackets.NewControlPacket(mqttPackets.Pubrel).(*mqttPackets.PubrelPacket)
 		mqPubrel.MessageID = snMsg.MessageID()
 		return h.mqttSend(mqPubrel)
@@ -776,13 +1070,24 @@ func (h *handler) handleMqttSn(ctx context.Context, msg snMsgs.Message) error {
 	case *snMsgs.PingreqMessage:
 		if h.state.Get() == util.StateAsleep {
 			// Must be set before snSend otherwise the messages will be queued...
-			h.setState(util.StateAwake)
-			for _, m2 := range h.msgBuffer {
+			h.msgBufferLock.Lock()
+			oldState := h.state.Set(util.StateAwake)
+			msgBuffer := h.msgBuffer
+			h.msgBuffer = nil
+			h.msgBufferLock.Unlock()
+			h.stateChanged(oldState, util.StateAwake)
+			h.sortByPriority(msgBuffer)
+			if h.cfg.CoalesceSize > 0 {
+				return h.snSendCoalesced(append(msgBuffer, snMsgs.NewPingrespMessage()))
+			}
+			for _, m2 := range msgBuffer {
 				if err := h.snSend(m2); err != nil {
 					return err
 				}
 			}
-			h.msgBuffer = nil
+			return h.snSend(snMsgs.NewPingrespMessage())
+		} else if h.cfg.MqttKeepAlive > 0 {
+			// The MQTT connection is kept alive by brokerPinger.
 			return h.snSend(snMsgs.NewPingrespMessage())
 		} else {
 			mqMsg := mqttPackets.NewControlPacket(mqttPackets.Pingreq).(*mqttPackets.PingreqPacket)
@@ -791,9 +1096,14 @@ func (h *handler) handleMqttSn(ctx context.Context, msg snMsgs.Message) error {
 
 	// Client DISCONNECT transaction.
 	case *snMsgs.DisconnectMessage:
+		if snMsg.Duration == 0 && snMsg.VarPartLength() > 0 &&
+			!h.tolerate(&h.stats.devSleepZero, "Zero sleep Duration", snMsg) {
+			return h.refuse(snMsg)
+		}
 		if snMsg.Duration == 0 {
 			mqMsg := mqttPackets.NewControlPacket(mqttPackets.Disconnect).(*mqttPackets.DisconnectPacket)
 			h.mqttSend(mqMsg)
+			h.disconnectRoutes()
 			h.setState(util.StateDisconnected)
 			m3 := snMsgs.NewDisconnectMessage(0)
 			if err := h.snSend(m3); err != nil {
@@ -802,18 +1112,19 @@ func (h *handler) handleMqttSn(ctx context.Context, msg snMsgs.Message) error {
 			return Shutdown
 		} else {
 			h.log.Debug("Going to sleep for %vs", snMsg.Duration)
-			if h.keepAlive != 0 && snMsg.Duration > h.keepAlive {
-				// We must ensure MQTT gateway considers client alive during sleep period.
-				cancelPinger := h.startSleepPinger(ctx)
-				time.AfterFunc(time.Duration(snMsg.Duration)*time.Second, cancelPinger)
-			}
+			h.msgBufferLock.Lock()
 			h.msgBuffer = nil
+			h.msgBufferLock.Unlock()
 			m2 := snMsgs.NewDisconnectMessage(0)
 			if err := h.snSend(m2); err != nil {
 				return err
 			}
 			// Must be set after snSend otherwise the message will be queued...
 			h.setState(util.StateAsleep)
+			if h.cfg.MqttKeepAlive == 0 && h.sessionKeepAlive() != 0 {
+				// We must ensure MQTT broker considers client alive during sleep period.
+				h.startSleepPinger(ctx, time.Duration(snMsg.Duration)*time.Second)
+			}
 			return nil
 		}
 
@@ -857,75 +1168,158 @@ func (h *handler) handleMqttSn(ctx context.Context, msg snMsgs.Message) error {
 		h.log.Error("Unexpected transaction type %T for message: %v", transactionx, snMsg)
 		return nil
 
+	// Gateway discovery.
+	case *snMsgs.SearchGwMessage:
+		return h.handleSearchGw(snMsg)
+
+	// Gateway discovery through a forwarder.
+	case *snMsgs.EncapsulatedMessage:
+		return h.handleEncapsulated(snMsg)
+
 	default:
 		return fmt.Errorf("Unsupported MQTT-SN message type: %v", msg)
 	}
 }
 
-func (h *handler) startSleepPinger(ctx context.Context) context.CancelFunc {
-	ctx2, cancel := context.WithCancel(ctx)
+// sleepPinger keeps the MQTT connection alive on behalf of a sleeping client.
+type sleepPinger struct {
+	lock          sync.Mutex
+	running       bool
+	sleepDuration time.Duration
+}
+
+// startSleepPinger starts sending PINGREQs to the MQTT broker while the
+// client is asleep or awake. The client's PINGREQs are answered by the gateway
+// itself in the asleep state, hence the broker would consider the client
+// lost otherwise. If the pinger is already running, only its sleep duration
+// is updated.
+//
+// The pinger quits when the client becomes active (it pings the broker
+// itself then) or when the client has not sent any message for one and a half
+// times the sleep duration (it is lost then and the broker should notice it).
+func (h *handler) startSleepPinger(ctx context.Context, sleepDuration time.Duration) {
+	p := &h.sleepPinger
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.sleepDuration = sleepDuration
+	if p.running {
+		return
+	}
+	p.running = true
+
 	h.group.Go(func() error {
 		h.log.Debug("Sleep pinger starts.")
 		defer h.log.Debug("Sleep pinger quits.")
+		ticker := time.NewTicker(time.Duration(h.sessionKeepAlive()) * time.Second)
+		defer ticker.Stop()
 		for {
 			select {
-			case <-time.After(time.Duration(h.keepAlive) * time.Second):
+			case <-ticker.C:
+				if !h.sleepPingerContinue() {
+					return nil
+				}
 				m := mqttPackets.NewControlPacket(mqttPackets.Pingreq).(*mqttPackets.PingreqPacket)
 				if err := h.mqttSend(m); err != nil {
 					return err
 				}
-			case <-ctx2.Done():
+			case <-ctx.Done():
 				return nil
 			}
 		}
 	})
-	return cancel
+}
+
+// sleepPingerContinue reports whether the sleep pinger should send another
+// PINGREQ. If not, the pinger is marked as stopped.
+func (h *handler) sleepPingerContinue() bool {
+	p := &h.sleepPinger
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	switch h.state.Get() {
+	case util.StateAsleep, util.StateAwake:
+		if time.Since(h.activity.last()) <= p.sleepDuration*3/2 {
+			return true
+		}
+		h.log.Debug("No message from the sleeping client for %s.", p.sleepDuration*3/2)
+	}
+	p.running = false
+	return false
 }
 
 func (h *handler) snSend(msg snMsgs.Message) error {
+	h.msgBufferLock.Lock()
 	if h.state.Get() == util.StateAsleep {
 		h.log.Debug("Queued %v", msg)
 		h.msgBuffer = append(h.msgBuffer, msg)
+		h.msgBufferLock.Unlock()
 		// TODO: Potentional serialization errors will be delayed!
 		return nil
 	}
+	h.msgBufferLock.Unlock()
 	h.log.Debug("<- %v", msg)
-	err := msg.Write(h.snConn)
+	buff := &bytes.Buffer{}
+	if err := msg.Write(buff); err != nil {
+		return err
+	}
+	n, err := h.snConn.Write(buff.Bytes())
 	if err != nil {
 		return err
 	}
+	h.stats.messageSent(msg.MessageType())
+	h.activity.messageSent(n)
 
 	return nil
 }
 
-func (h *handler) snReceive() (snMsgs.Message, error) {
-	// TODO: make static...
-	buffer := make([]byte, snMsgs.MaxPacketLen)
+// snReceive returns the messages of the received datagram. A datagram can
+// contain multiple messages, e.g. concatenated by a forwarder.
+// reservedFlags[i] is set if the i-th message's Flags field has reserved bits
+// set (see strict.go). If some of the messages cannot be parsed, the error is
+// returned along with the parsed ones.
+func (h *handler) snReceive() (msgs []snMsgs.Message, reservedFlags []bool, err error) {
+	// snReceive is called by snReceiveLoop only and the messages do not
+	// reference the buffer after Unpack, hence the buffer can be reused.
+	if h.snBuffer == nil {
+		h.snBuffer = make([]byte, snMsgs.MaxPacketLen)
+	}
+	buffer := h.snBuffer
 
 	// TODO: Here, we rely on the assumption that we always read precissely one
 	// whole packet. This is not guaranteed in the pion/dtls API documentation.
 	n, err := h.snConn.Read(buffer)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	pkt := buffer[:n]
 
 	if len(pkt) < 2 {
-		return nil, errors.New("Illegal packet: too short")
+		return nil, nil, errors.New("Illegal packet: too short")
 	}
 
-	pktReader := bytes.NewReader(pkt)
-	header := &snMsgs.Header{}
-	header.Unpack(pktReader)
-	msg := snMsgs.NewMessageWithHeader(*header)
-	msg.Unpack(pktReader)
-
-	h.log.Debug("-> %v", msg)
-	return msg, nil
+	msgs, raws, errs := snMsgs.ParseDatagramRaw(pkt)
+	h.activity.messageReceived(n)
+	reservedFlags = make([]bool, len(msgs))
+	for i, msg := range msgs {
+		rawReader := bytes.NewReader(raws[i])
+		var header snMsgs.Header
+		header.Unpack(rawReader)
+		reservedFlags[i] = hasReservedFlags(msg.MessageType(), raws[i][len(raws[i])-rawReader.Len():])
+		h.stats.messageReceived(msg.MessageType())
+		h.log.Debug("-> %v", msg)
+	}
+	if len(errs) > 0 {
+		err = fmt.Errorf("Illegal packet: %s", errs[0])
+	}
+	return msgs, reservedFlags, err
 }
 
 func (h *handler) mqttSend(msg mqttPackets.ControlPacket) error {
+	if len(h.upstreams) > 0 {
+		if routed, err := h.routeAck(msg); routed || err != nil {
+			return err
+		}
+	}
 	h.log.Debug("<= %v", msg)
 	buff := &bytes.Buffer{}
 	err := msg.Write(buff)
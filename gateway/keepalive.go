@@ -0,0 +1,94 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/energomonitor/bisquitt/util"
+
+	mqttPackets "github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+var ErrClientKeepAliveTimeout = errors.New("client keepalive timeout")
+
+// MaxMqttKeepAlive is the longest keepalive expressible in the MQTT CONNECT
+// packet (see GatewayConfig.MqttKeepAlive).
+const MaxMqttKeepAlive = math.MaxUint16 * time.Second
+
+// startKeepAliveOnce starts the keepalive (see startKeepAlive) unless it's
+// disabled or already running. It must be called after the MQTT broker has
+// accepted the connection, from the MQTT receive goroutine only.
+func (h *handler) startKeepAliveOnce(ctx context.Context) {
+	if h.cfg.MqttKeepAlive > 0 && !h.keepAliveStarted {
+		h.keepAliveStarted = true
+		h.startKeepAlive(ctx)
+	}
+}
+
+// startKeepAlive is used when the MQTT keepalive differs from the client's
+// one (see handlerConfig.MqttKeepAlive). The client's PINGREQs are not
+// forwarded to the MQTT broker in such a case, hence the handler must keep
+// the MQTT connection alive itself and detect lost clients on its own.
+func (h *handler) startKeepAlive(ctx context.Context) {
+	h.group.Go(func() error {
+		return h.brokerPinger(ctx)
+	})
+	if h.sessionKeepAlive() == 0 {
+		// Keepalive disabled by the client.
+		return
+	}
+	h.group.Go(func() error {
+		return h.clientWatchdog(ctx)
+	})
+}
+
+func (h *handler) brokerPinger(ctx context.Context) error {
+	h.log.Debug("Broker pinger starts.")
+	defer h.log.Debug("Broker pinger quits.")
+
+	_, mqttKeepAlive := h.keepAlives()
+	ticker := time.NewTicker(time.Duration(mqttKeepAlive) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m := mqttPackets.NewControlPacket(mqttPackets.Pingreq).(*mqttPackets.PingreqPacket)
+			if err := h.mqttSend(m); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// clientWatchdog shuts the handler down if the client does not send any
+// message within one and a half times its keepalive period. We use the same
+// grace period as MQTT brokers do.
+// [MQTT 3.1.1 specification, chapter 3.1.2.10 Keep Alive]
+func (h *handler) clientWatchdog(ctx context.Context) error {
+	h.log.Debug("Client watchdog starts.")
+	defer h.log.Debug("Client watchdog quits.")
+
+	keepAlive := time.Duration(h.sessionKeepAlive()) * time.Second
+	timeout := keepAlive * 3 / 2
+	ticker := time.NewTicker(keepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// Sleeping clients are not expected to send anything.
+			if h.state.Get() == util.StateAsleep {
+				continue
+			}
+			if time.Since(h.activity.last()) > timeout {
+				h.log.Error("No message from client for %s", timeout)
+				return ErrClientKeepAliveTimeout
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,112 @@
+// Client metadata registry.
+//
+// If GatewayConfig.ClientMetadata is set, clients can publish their metadata
+// (firmware version, hardware model etc.) to MetadataTopic, typically right
+// after CONNECT. The payload is a JSON object with string values, e.g.
+//
+//	{"fw": "1.4.2", "hw": "rev-b"}
+//
+// The message is not forwarded to the MQTT broker. The metadata replaces the
+// previously published one and is available in ClientInfo.Metadata (hence to
+// EventHook, see EventMetadataChanged), in the replicated session and in the
+// gateway's inventory (see Gateway.Inventory) which keeps the metadata of
+// disconnected clients too, so that a fleet inventory needs no separate
+// channel.
+
+package gateway
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	snMsgs "github.com/energomonitor/bisquitt/messages"
+)
+
+// MetadataTopic is the topic clients publish their metadata to. It can also
+// be used as a predefined topic.
+const MetadataTopic = SysTopicPrefix + "metadata"
+
+// ClientMetadata is the metadata last published by a client.
+type ClientMetadata struct {
+	ClientID string            `json:"client_id"`
+	Metadata map[string]string `json:"metadata"`
+	// Time the metadata was published.
+	Updated time.Time `json:"updated"`
+}
+
+// inventory keeps the metadata of all the clients, shared by all the
+// handlers. It's safe for concurrent use.
+type inventory struct {
+	lock    sync.Mutex
+	clients map[string]ClientMetadata // ClientID => metadata
+}
+
+func newInventory() *inventory {
+	return &inventory{
+		clients: make(map[string]ClientMetadata),
+	}
+}
+
+func (i *inventory) update(clientID string, metadata map[string]string) {
+	if i == nil {
+		return
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.clients[clientID] = ClientMetadata{
+		ClientID: clientID,
+		Metadata: metadata,
+		Updated:  time.Now(),
+	}
+}
+
+// Inventory returns the metadata last published by every client since the
+// gateway start, sorted by ClientID. Returns nil if
+// GatewayConfig.ClientMetadata is not set.
+func (gw *Gateway) Inventory() []ClientMetadata {
+	i := gw.inventory
+	if i == nil {
+		return nil
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	result := make([]ClientMetadata, 0, len(i.clients))
+	for _, m := range i.clients {
+		result = append(result, ClientMetadata{
+			ClientID: m.ClientID,
+			Metadata: copyMetadata(m.Metadata),
+			Updated:  m.Updated,
+		})
+	}
+	sort.Slice(result, func(a, b int) bool {
+		return result[a].ClientID < result[b].ClientID
+	})
+	return result
+}
+
+func copyMetadata(metadata map[string]string) map[string]string {
+	if metadata == nil {
+		return nil
+	}
+	result := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		result[k] = v
+	}
+	return result
+}
+
+// handleMetadata handles the client's PUBLISH to MetadataTopic.
+func (h *handler) handleMetadata(snPublish *snMsgs.PublishMessage) error {
+	var metadata map[string]string
+	if err := json.Unmarshal(snPublish.Data, &metadata); err != nil || metadata == nil {
+		h.log.Info("Invalid metadata refused: %q", snPublish.Data)
+		return h.rejectPublish(snPublish, snMsgs.RC_NOT_SUPPORTED)
+	}
+	h.log.Debug("Client metadata: %v", metadata)
+	h.activity.setMetadata(metadata)
+	h.cfg.Inventory.update(h.activity.client(), metadata)
+	h.emit(EventMetadataChanged)
+	return h.acknowledgeDropped(snPublish)
+}
@@ -0,0 +1,535 @@
+// MQTT 5 broker connection.
+//
+// The gateway speaks MQTT 3.1.1 internally. If GatewayConfig.Mqtt5 is set,
+// the connection to the MQTT broker is wrapped by mqtt5Conn which translates
+// the packets to MQTT 5 and back on the wire. The only MQTT 5 feature used is
+// topic aliases, which cut the upstream bandwidth of clients publishing
+// repeatedly on long topics, much like TopicIDs registered by MQTT-SN
+// clients do:
+//
+//  - The broker announces how many aliases it accepts in CONNACK (Topic
+//    Alias Maximum). The topics of PUBLISHes sent to the broker are assigned
+//    aliases on first use; a PUBLISH on a topic with an alias is sent with an
+//    empty topic name. When all the aliases are taken, the least recently
+//    used one is reassigned.
+//  - The gateway accepts up to GatewayConfig.MqttTopicAliasMaximum aliases
+//    from the broker (announced in CONNECT). Zero means no aliases.
+//
+// The translation is lossy where MQTT 3.1.1 cannot express MQTT 5 semantics:
+// properties other than the above are dropped and negative PUBACK, PUBREC
+// and PUBCOMP reason codes are passed as plain acknowledgements. A session
+// requested with CleanSession=false never expires. A DISCONNECT sent by the
+// broker is reported as a connection error. AUTH is not supported.
+//
+// The routed connections to other brokers (see GatewayConfig.Routes) always
+// use MQTT 3.1.1.
+
+package gateway
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	mqttPackets "github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// MQTT 5 protocol level.
+const mqtt5ProtocolLevel = 5
+
+// MQTT 5 property identifiers used by the gateway.
+const (
+	mqtt5PropSessionExpiryInterval = 0x11
+	mqtt5PropTopicAliasMaximum     = 0x22
+	mqtt5PropTopicAlias            = 0x23
+	mqtt5PropReasonString          = 0x1F
+)
+
+var errMqtt5Malformed = errors.New("malformed MQTT 5 packet")
+
+// mqtt5Conn translates MQTT 3.1.1 packets written to it to MQTT 5 and MQTT 5
+// packets read from the underlying connection to MQTT 3.1.1. Each Write must
+// contain whole packets.
+type mqtt5Conn struct {
+	net.Conn
+	// Serializes writes so that aliases are assigned in the order in which
+	// the PUBLISHes are sent.
+	writeLock  sync.Mutex
+	outAliases topicAliases
+	// Read side, used by a single reader.
+	inAliasMax uint16
+	inAliases  map[uint16]string
+	in         []byte // received MQTT 5 data not translated yet
+	out        []byte // translated MQTT 3.1.1 data not read yet
+}
+
+func newMqtt5Conn(conn net.Conn, topicAliasMaximum uint16) *mqtt5Conn {
+	return &mqtt5Conn{
+		Conn:       conn,
+		inAliasMax: topicAliasMaximum,
+		inAliases:  make(map[uint16]string),
+	}
+}
+
+func (c *mqtt5Conn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	r := bytes.NewReader(b)
+	buf := &bytes.Buffer{}
+	for r.Len() > 0 {
+		pkt, err := mqttPackets.ReadPacket(r)
+		if err != nil {
+			return 0, fmt.Errorf("cannot translate to MQTT 5: %s", err)
+		}
+		if err := c.encode(buf, pkt); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := c.Conn.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *mqtt5Conn) Read(p []byte) (int, error) {
+	for len(c.out) == 0 {
+		raw, ok := nextMqtt5Packet(c.in)
+		if !ok {
+			buf := make([]byte, 4096)
+			n, err := c.Conn.Read(buf)
+			c.in = append(c.in, buf[:n]...)
+			if err != nil {
+				// Possibly a read timeout, the data read so far are kept.
+				return 0, err
+			}
+			continue
+		}
+		c.in = c.in[len(raw):]
+		pkt, err := c.decode(raw)
+		if err != nil {
+			return 0, err
+		}
+		out := &bytes.Buffer{}
+		if err := pkt.Write(out); err != nil {
+			return 0, err
+		}
+		c.out = out.Bytes()
+	}
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+// encode writes the MQTT 3.1.1 packet to buf in MQTT 5 format.
+func (c *mqtt5Conn) encode(buf *bytes.Buffer, pkt mqttPackets.ControlPacket) error {
+	var body bytes.Buffer
+	var header byte
+	switch p := pkt.(type) {
+	case *mqttPackets.ConnectPacket:
+		header = mqttPackets.Connect << 4
+		writeMqtt5String(&body, p.ProtocolName)
+		body.WriteByte(mqtt5ProtocolLevel)
+		body.WriteByte(boolBit(p.UsernameFlag)<<7 | boolBit(p.PasswordFlag)<<6 |
+			boolBit(p.WillRetain)<<5 | p.WillQos<<3 | boolBit(p.WillFlag)<<2 |
+			boolBit(p.CleanSession)<<1)
+		writeMqtt5Uint16(&body, p.Keepalive)
+		var props bytes.Buffer
+		if !p.CleanSession {
+			// MQTT 3.1.1 sessions do not expire.
+			props.WriteByte(mqtt5PropSessionExpiryInterval)
+			props.Write([]byte{0xFF, 0xFF, 0xFF, 0xFF})
+		}
+		if c.inAliasMax > 0 {
+			props.WriteByte(mqtt5PropTopicAliasMaximum)
+			writeMqtt5Uint16(&props, c.inAliasMax)
+		}
+		writeMqtt5Properties(&body, props.Bytes())
+		writeMqtt5String(&body, p.ClientIdentifier)
+		if p.WillFlag {
+			writeMqtt5Properties(&body, nil)
+			writeMqtt5String(&body, p.WillTopic)
+			writeMqtt5Binary(&body, p.WillMessage)
+		}
+		if p.UsernameFlag {
+			writeMqtt5String(&body, p.Username)
+		}
+		if p.PasswordFlag {
+			writeMqtt5Binary(&body, p.Password)
+		}
+	case *mqttPackets.PublishPacket:
+		header = mqttPackets.Publish<<4 | boolBit(p.Dup)<<3 | p.Qos<<1 | boolBit(p.Retain)
+		topic := p.TopicName
+		var props bytes.Buffer
+		if alias, known := c.outAliases.alias(topic); alias != 0 {
+			if known {
+				topic = ""
+			}
+			props.WriteByte(mqtt5PropTopicAlias)
+			writeMqtt5Uint16(&props, alias)
+		}
+		writeMqtt5String(&body, topic)
+		if p.Qos > 0 {
+			writeMqtt5Uint16(&body, p.MessageID)
+		}
+		writeMqtt5Properties(&body, props.Bytes())
+		body.Write(p.Payload)
+	case *mqttPackets.SubscribePacket:
+		header = mqttPackets.Subscribe<<4 | 0x02
+		writeMqtt5Uint16(&body, p.MessageID)
+		writeMqtt5Properties(&body, nil)
+		for i, topic := range p.Topics {
+			writeMqtt5String(&body, topic)
+			body.WriteByte(p.Qoss[i])
+		}
+	case *mqttPackets.UnsubscribePacket:
+		header = mqttPackets.Unsubscribe<<4 | 0x02
+		writeMqtt5Uint16(&body, p.MessageID)
+		writeMqtt5Properties(&body, nil)
+		for _, topic := range p.Topics {
+			writeMqtt5String(&body, topic)
+		}
+	case *mqttPackets.PubackPacket, *mqttPackets.PubrecPacket, *mqttPackets.PubrelPacket,
+		*mqttPackets.PubcompPacket, *mqttPackets.PingreqPacket, *mqttPackets.DisconnectPacket:
+		// The MQTT 3.1.1 format is a valid MQTT 5 packet with the Success
+		// reason code and no properties.
+		return pkt.Write(buf)
+	default:
+		return fmt.Errorf("cannot translate to MQTT 5: %v", pkt)
+	}
+	buf.WriteByte(header)
+	writeMqtt5VarInt(buf, body.Len())
+	buf.Write(body.Bytes())
+	return nil
+}
+
+// decode translates the raw MQTT 5 packet to MQTT 3.1.1.
+func (c *mqtt5Conn) decode(raw []byte) (mqttPackets.ControlPacket, error) {
+	r := &mqtt5Reader{data: raw}
+	header := r.byte()
+	r.varInt()
+	pktType := header >> 4
+	switch pktType {
+	case mqttPackets.Connack:
+		connack := mqttPackets.NewControlPacket(mqttPackets.Connack).(*mqttPackets.ConnackPacket)
+		connack.SessionPresent = r.byte()&0x01 != 0
+		connack.ReturnCode = mqtt5ConnackCode(r.byte())
+		props := r.properties()
+		if r.err != nil {
+			return nil, r.err
+		}
+		c.writeLock.Lock()
+		c.outAliases.setMax(props.topicAliasMaximum)
+		c.writeLock.Unlock()
+		return connack, nil
+	case mqttPackets.Publish:
+		publish := mqttPackets.NewControlPacket(mqttPackets.Publish).(*mqttPackets.PublishPacket)
+		publish.Dup = header&0x08 != 0
+		publish.Qos = header >> 1 & 0x03
+		publish.Retain = header&0x01 != 0
+		publish.TopicName = r.string()
+		if publish.Qos > 0 {
+			publish.MessageID = r.uint16()
+		}
+		props := r.properties()
+		publish.Payload = r.rest()
+		if r.err != nil {
+			return nil, r.err
+		}
+		if alias := props.topicAlias; alias != 0 {
+			if alias > c.inAliasMax {
+				return nil, fmt.Errorf("MQTT 5 topic alias %d exceeds maximum %d", alias, c.inAliasMax)
+			}
+			if publish.TopicName == "" {
+				topic, ok := c.inAliases[alias]
+				if !ok {
+					return nil, fmt.Errorf("unknown MQTT 5 topic alias %d", alias)
+				}
+				publish.TopicName = topic
+			} else {
+				c.inAliases[alias] = publish.TopicName
+			}
+		}
+		return publish, nil
+	case mqttPackets.Puback, mqttPackets.Pubrec, mqttPackets.Pubrel, mqttPackets.Pubcomp, mqttPackets.Unsuback:
+		// The reason codes and properties are dropped.
+		pkt := mqttPackets.NewControlPacket(pktType)
+		msgID := r.uint16()
+		if r.err != nil {
+			return nil, r.err
+		}
+		switch p := pkt.(type) {
+		case *mqttPackets.PubackPacket:
+			p.MessageID = msgID
+		case *mqttPackets.PubrecPacket:
+			p.MessageID = msgID
+		case *mqttPackets.PubrelPacket:
+			p.MessageID = msgID
+		case *mqttPackets.PubcompPacket:
+			p.MessageID = msgID
+		case *mqttPackets.UnsubackPacket:
+			p.MessageID = msgID
+		}
+		return pkt, nil
+	case mqttPackets.Suback:
+		suback := mqttPackets.NewControlPacket(mqttPackets.Suback).(*mqttPackets.SubackPacket)
+		suback.MessageID = r.uint16()
+		r.properties()
+		for _, code := range r.rest() {
+			if code > 2 {
+				// Any MQTT 5 failure reason code.
+				code = 0x80
+			}
+			suback.ReturnCodes = append(suback.ReturnCodes, code)
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+		return suback, nil
+	case mqttPackets.Pingresp:
+		return mqttPackets.NewControlPacket(mqttPackets.Pingresp), nil
+	case mqttPackets.Disconnect:
+		var code byte
+		var props mqtt5Properties
+		if len(r.data) > 0 {
+			code = r.byte()
+			props = r.properties()
+		}
+		return nil, fmt.Errorf("MQTT broker disconnected: reason code 0x%02x %s", code, props.reasonString)
+	default:
+		return nil, fmt.Errorf("unsupported MQTT 5 packet type %d", pktType)
+	}
+}
+
+// mqtt5ConnackCode translates an MQTT 5 CONNACK reason code to an MQTT 3.1.1
+// return code.
+func mqtt5ConnackCode(code byte) byte {
+	switch code {
+	case 0x00:
+		return mqttPackets.Accepted
+	case 0x84:
+		return mqttPackets.ErrRefusedBadProtocolVersion
+	case 0x85:
+		return mqttPackets.ErrRefusedIDRejected
+	case 0x86:
+		return mqttPackets.ErrRefusedBadUsernameOrPassword
+	case 0x87, 0x8A:
+		return mqttPackets.ErrRefusedNotAuthorised
+	default:
+		return mqttPackets.ErrRefusedServerUnavailable
+	}
+}
+
+// topicAliases assigns topic aliases to topics of the PUBLISHes sent to the
+// broker.
+type topicAliases struct {
+	max     uint16
+	aliases map[string]uint16 // topic => alias
+	topics  []string          // alias-1 => topic
+	lastUse []uint64          // alias-1 => tick
+	tick    uint64
+}
+
+func (a *topicAliases) setMax(max uint16) {
+	*a = topicAliases{
+		max:     max,
+		aliases: make(map[string]uint16),
+	}
+}
+
+// alias returns the alias of the topic; known is set if the alias has
+// already been sent to the broker along with the topic. Zero means the topic
+// has no alias.
+func (a *topicAliases) alias(topic string) (alias uint16, known bool) {
+	if a.max == 0 || topic == "" {
+		return 0, false
+	}
+	a.tick++
+	if alias, ok := a.aliases[topic]; ok {
+		a.lastUse[alias-1] = a.tick
+		return alias, true
+	}
+	if len(a.topics) < int(a.max) {
+		a.topics = append(a.topics, topic)
+		a.lastUse = append(a.lastUse, a.tick)
+		alias = uint16(len(a.topics))
+	} else {
+		// Reassign the least recently used alias.
+		lru := 0
+		for i := range a.lastUse {
+			if a.lastUse[i] < a.lastUse[lru] {
+				lru = i
+			}
+		}
+		delete(a.aliases, a.topics[lru])
+		a.topics[lru] = topic
+		a.lastUse[lru] = a.tick
+		alias = uint16(lru + 1)
+	}
+	a.aliases[topic] = alias
+	return alias, false
+}
+
+// mqtt5Properties are the MQTT 5 properties the gateway is interested in.
+type mqtt5Properties struct {
+	topicAliasMaximum uint16
+	topicAlias        uint16
+	reasonString      string
+}
+
+// mqtt5Reader reads MQTT 5 data types. The first error is kept in err,
+// subsequent reads return zero values.
+type mqtt5Reader struct {
+	data []byte
+	err  error
+}
+
+func (r *mqtt5Reader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.data) < n {
+		r.err = errMqtt5Malformed
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *mqtt5Reader) byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *mqtt5Reader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *mqtt5Reader) string() string {
+	return string(r.next(int(r.uint16())))
+}
+
+func (r *mqtt5Reader) varInt() int {
+	value := 0
+	for i := 0; i < 4; i++ {
+		b := r.byte()
+		value |= int(b&0x7F) << (7 * i)
+		if b&0x80 == 0 {
+			return value
+		}
+	}
+	if r.err == nil {
+		r.err = errMqtt5Malformed
+	}
+	return 0
+}
+
+func (r *mqtt5Reader) rest() []byte {
+	return r.next(len(r.data))
+}
+
+func (r *mqtt5Reader) properties() mqtt5Properties {
+	var props mqtt5Properties
+	p := &mqtt5Reader{data: r.next(r.varInt())}
+	for r.err == nil && p.err == nil && len(p.data) > 0 {
+		switch id := p.varInt(); id {
+		// Byte properties.
+		case 0x01, 0x17, 0x19, 0x24, 0x25, 0x28, 0x29, 0x2A:
+			p.next(1)
+		// Two byte integer properties.
+		case 0x13, 0x21:
+			p.next(2)
+		case mqtt5PropTopicAliasMaximum:
+			props.topicAliasMaximum = p.uint16()
+		case mqtt5PropTopicAlias:
+			props.topicAlias = p.uint16()
+		// Four byte integer properties.
+		case 0x02, 0x11, 0x18, 0x27:
+			p.next(4)
+		// Variable byte integer properties.
+		case 0x0B:
+			p.varInt()
+		// UTF-8 string and binary data properties.
+		case 0x03, 0x08, 0x09, 0x12, 0x15, 0x16, 0x1A, 0x1C:
+			p.string()
+		case mqtt5PropReasonString:
+			props.reasonString = p.string()
+		// UTF-8 string pair properties.
+		case 0x26:
+			p.string()
+			p.string()
+		default:
+			p.err = fmt.Errorf("unknown MQTT 5 property 0x%02x", id)
+		}
+	}
+	if r.err == nil {
+		r.err = p.err
+	}
+	return props
+}
+
+// nextMqtt5Packet returns the first packet in data if data contain the whole
+// packet.
+func nextMqtt5Packet(data []byte) ([]byte, bool) {
+	length := 0
+	for i := 1; i < len(data) && i <= 4; i++ {
+		length |= int(data[i]&0x7F) << (7 * (i - 1))
+		if data[i]&0x80 == 0 {
+			end := i + 1 + length
+			if len(data) < end {
+				return nil, false
+			}
+			return data[:end], true
+		}
+	}
+	return nil, false
+}
+
+func boolBit(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func writeMqtt5Uint16(buf *bytes.Buffer, v uint16) {
+	buf.WriteByte(byte(v >> 8))
+	buf.WriteByte(byte(v))
+}
+
+func writeMqtt5String(buf *bytes.Buffer, s string) {
+	writeMqtt5Uint16(buf, uint16(len(s)))
+	buf.WriteString(s)
+}
+
+func writeMqtt5Binary(buf *bytes.Buffer, b []byte) {
+	writeMqtt5Uint16(buf, uint16(len(b)))
+	buf.Write(b)
+}
+
+func writeMqtt5VarInt(buf *bytes.Buffer, v int) {
+	for {
+		b := byte(v & 0x7F)
+		v >>= 7
+		if v > 0 {
+			b |= 0x80
+		}
+		buf.WriteByte(b)
+		if v == 0 {
+			return
+		}
+	}
+}
+
+func writeMqtt5Properties(buf *bytes.Buffer, props []byte) {
+	writeMqtt5VarInt(buf, len(props))
+	buf.Write(props)
+}
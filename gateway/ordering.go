@@ -0,0 +1,136 @@
+// Delivery order of messages sent by the MQTT broker to a client.
+//
+// The MQTT broker sends messages on a topic to the gateway in order but a
+// message can be overtaken on its way to the client: a message waiting for
+// its topic registration (REGISTER/REGACK) can be overtaken by a later one
+// which is registered faster, and a retransmitted message arrives after the
+// messages sent meanwhile.
+//
+// Therefore, messages on a topic are delivered to the client one at a time:
+// a message is not sent to the client until the delivery of the previous
+// message on the same topic has finished, i.e. the previous message has been
+// acknowledged (or its delivery has failed). QoS 0 messages on a registered
+// topic need no acknowledgement, hence they are not delayed unless queued
+// behind a message awaiting acknowledgement. Messages on different topics are
+// delivered independently and their mutual order is not guaranteed.
+//
+// Delivering one message at a time limits the throughput on busy topics.
+// Deployments which prefer throughput to ordering can disable the ordering
+// using GatewayConfig.UnorderedDelivery.
+
+package gateway
+
+import (
+	"context"
+	"sync"
+
+	mqttPackets "github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// deliveryQueue holds messages waiting for the delivery of a previous message
+// on the same topic to finish.
+type deliveryQueue struct {
+	lock sync.Mutex
+	// Topic => waiting messages. A topic is present while a delivery on the
+	// topic is in progress.
+	waiting map[string][]*mqttPackets.PublishPacket
+}
+
+// push queues the message if a delivery on its topic is in progress.
+// Otherwise, it marks the delivery as in progress and returns false.
+func (q *deliveryQueue) push(mqPublish *mqttPackets.PublishPacket) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.waiting == nil {
+		q.waiting = make(map[string][]*mqttPackets.PublishPacket)
+	}
+	waiting, inProgress := q.waiting[mqPublish.TopicName]
+	if !inProgress {
+		q.waiting[mqPublish.TopicName] = nil
+		return false
+	}
+	q.waiting[mqPublish.TopicName] = append(waiting, mqPublish)
+	return true
+}
+
+// idle returns true if no delivery on the topic is in progress.
+func (q *deliveryQueue) idle(topic string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	_, inProgress := q.waiting[topic]
+	return !inProgress
+}
+
+// pop returns the next message waiting on the topic. If there is none, the
+// delivery on the topic is marked as finished and false is returned.
+func (q *deliveryQueue) pop(topic string) (*mqttPackets.PublishPacket, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	waiting := q.waiting[topic]
+	if len(waiting) == 0 {
+		delete(q.waiting, topic)
+		return nil, false
+	}
+	q.waiting[topic] = waiting[1:]
+	return waiting[0], true
+}
+
+func (h *handler) handleBrokerPublish(ctx context.Context, mqPublish *mqttPackets.PublishPacket) error {
+	if !h.shapeDownlink(ctx, mqPublish) {
+		return nil
+	}
+	if h.cfg.UnorderedDelivery {
+		_, err := h.deliverBrokerPublish(ctx, mqPublish)
+		return err
+	}
+	// Fast path: a QoS 0 message on an idle topic needs no delivery
+	// bookkeeping unless its topic must be registered. The delivery queues
+	// are pushed to and popped from with h.upstreamLock held only, hence the
+	// topic cannot become busy meanwhile.
+	if mqPublish.Qos == 0 && h.deliveries.idle(mqPublish.TopicName) {
+		if sent, err := h.sendBrokerPublishQOS0(mqPublish); sent || err != nil {
+			return err
+		}
+	}
+	if h.deliveries.push(mqPublish) {
+		h.log.Debug("Delivery of %v postponed", mqPublish)
+		return nil
+	}
+	return h.deliverOrdered(ctx, mqPublish)
+}
+
+// deliverOrdered delivers the message and all the messages queued on its
+// topic, one at a time. It must be called with h.upstreamLock held: the
+// deliveries must be serialized, e.g. two messages needing REGISTER would
+// get the same MsgID otherwise (see availableMsgID). The lock is released
+// while waiting for a message to be acknowledged.
+func (h *handler) deliverOrdered(ctx context.Context, mqPublish *mqttPackets.PublishPacket) error {
+	topic := mqPublish.TopicName
+	for {
+		transaction, err := h.deliverBrokerPublish(ctx, mqPublish)
+		if err != nil {
+			return err
+		}
+		if transaction != nil {
+			h.group.Go(func() error {
+				select {
+				case <-transaction.Done():
+				case <-ctx.Done():
+					return nil
+				}
+				h.upstreamLock.Lock()
+				defer h.upstreamLock.Unlock()
+				next, ok := h.deliveries.pop(topic)
+				if !ok {
+					return nil
+				}
+				return h.deliverOrdered(ctx, next)
+			})
+			return nil
+		}
+		var ok bool
+		if mqPublish, ok = h.deliveries.pop(topic); !ok {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package gateway
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	snMsgs "github.com/energomonitor/bisquitt/messages"
+	"github.com/energomonitor/bisquitt/topics"
+)
+
+// TopicPriority assigns a priority to messages sent to a client on topics
+// matching the Topic filter (may contain wildcards).
+type TopicPriority struct {
+	Topic    string
+	Priority int
+}
+
+// TopicPriorities decide the order in which messages buffered for a sleeping
+// client are delivered when the client wakes up. Messages with higher
+// priority are delivered first. The first matching TopicPriority is used,
+// messages not matching any of them have priority 0.
+type TopicPriorities []TopicPriority
+
+// ParseTopicPriorityOptions parses a command line topic priorities definition
+// in "topic;priority" format.
+func ParseTopicPriorityOptions(options ...string) (TopicPriorities, error) {
+	var result TopicPriorities
+	for _, line := range options {
+		fields := strings.Split(line, ";")
+		if len(fields) != 2 {
+			return nil, errors.New("invalid format (expects: topic;priority)")
+		}
+		priority, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, TopicPriority{
+			Topic:    fields[0],
+			Priority: priority,
+		})
+	}
+	return result, nil
+}
+
+func (p TopicPriorities) priority(topic string) int {
+	for _, tp := range p {
+		if topics.Match(tp.Topic, topic) {
+			return tp.Priority
+		}
+	}
+	return 0
+}
+
+// sortByPriority sorts the buffered messages by their topics priority. The
+// order of messages with the same priority is preserved.
+func (h *handler) sortByPriority(msgs []snMsgs.Message) {
+	if len(h.cfg.DownlinkPriorities) == 0 {
+		return
+	}
+	priorities := make(map[snMsgs.Message]int, len(msgs))
+	for _, msg := range msgs {
+		if topic, ok := h.messageTopic(msg); ok {
+			priorities[msg] = h.cfg.DownlinkPriorities.priority(topic)
+		}
+	}
+	sort.SliceStable(msgs, func(i, j int) bool {
+		return priorities[msgs[i]] > priorities[msgs[j]]
+	})
+}
+
+// messageTopic returns a topic name of a message sent to the client.
+func (h *handler) messageTopic(msg snMsgs.Message) (string, bool) {
+	switch m := msg.(type) {
+	case *snMsgs.RegisterMessage:
+		return m.TopicName, true
+	case *snMsgs.PublishMessage:
+		switch m.TopicIDType {
+		case snMsgs.TIT_REGISTERED:
+			if topic, ok := h.registeredTopics.Load(m.TopicID); ok {
+				return topic.(string), true
+			}
+		case snMsgs.TIT_PREDEFINED:
+			return h.predefinedTopics.GetTopicName(h.clientID, m.TopicID)
+		case snMsgs.TIT_SHORT:
+			return snMsgs.DecodeShortTopic(m.TopicID), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,194 @@
+// Session purge.
+//
+// Sessions of decommissioned devices would stay in the gateway forever:
+// a sleeping client is not expected to send anything, hence its handler (and
+// its MQTT connection) is kept, and a session replicated to the standby
+// gateway is kept in the SessionStore until it's taken over.
+//
+// A session whose client has not sent any message for GatewayConfig.SessionTTL
+// is purged: its handler sends DISCONNECT to the MQTT broker (hence the
+// client's will is not published) and quits. Expired replicated sessions are
+// not taken over and they are removed from the SessionStore. A sleeping
+// client is not expected to send anything during its sleep duration, hence
+// its TTL counts from the end of the sleep.
+//
+// Gateway.PurgeSessions purges the sessions of selected clients on demand.
+// The clients are selected by path.Match patterns, except that "/" is an
+// ordinary character in ClientIDs, i.e. "*" matches "/" too.
+
+package gateway
+
+import (
+	"context"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	mqttPackets "github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/energomonitor/bisquitt/util"
+)
+
+// sessionPurge is a request to purge the handler's session.
+type sessionPurge struct {
+	once sync.Once
+	ch   chan struct{}
+}
+
+func newSessionPurge() *sessionPurge {
+	return &sessionPurge{
+		ch: make(chan struct{}),
+	}
+}
+
+func (p *sessionPurge) request() {
+	p.once.Do(func() {
+		close(p.ch)
+	})
+}
+
+// sessionPurger purges the session when requested or when the client has
+// been inactive for the session TTL.
+func (h *handler) sessionPurger(ctx context.Context) error {
+	var expiry <-chan time.Time
+	ttl := h.cfg.SessionTTL
+	if ttl > 0 {
+		ticker := time.NewTicker(ttl / 2)
+		defer ticker.Stop()
+		expiry = ticker.C
+	}
+	for {
+		select {
+		case <-expiry:
+			idle := ttl + h.sleepingFor()
+			if time.Since(h.activity.last()) <= idle {
+				continue
+			}
+			h.log.Info("No message from client for %s, session expired.", idle)
+		case <-h.purge.ch:
+			h.log.Info("Session purged.")
+		case <-ctx.Done():
+			return nil
+		}
+		h.stats.count(&h.stats.sessionsPurged)
+		mqDisconnect := mqttPackets.NewControlPacket(mqttPackets.Disconnect)
+		if err := h.mqttSend(mqDisconnect); err != nil {
+			h.log.Error("Error sending DISCONNECT to MQTT broker: %s", err)
+		}
+		h.disconnectRoutes()
+		return Shutdown
+	}
+}
+
+// sleepingFor returns the sleep duration of a sleeping client, zero if the
+// client is not sleeping.
+func (h *handler) sleepingFor() time.Duration {
+	switch h.state.Get() {
+	case util.StateAsleep, util.StateAwake:
+		h.sleepPinger.lock.Lock()
+		defer h.sleepPinger.lock.Unlock()
+		return h.sleepPinger.sleepDuration
+	}
+	return 0
+}
+
+// PurgeSessions purges the sessions of all the clients whose ClientID
+// matches the pattern (see path.Match for the syntax, "*" matches "/" in
+// ClientIDs too): the clients' handlers
+// quit, their replicated sessions are removed from
+// GatewayConfig.StandbySessions and their metadata from the inventory (see
+// Gateway.Inventory). Returns the number of sessions purged.
+func (gw *Gateway) PurgeSessions(pattern string) (int, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return 0, err
+	}
+	n := 0
+	gw.clients.Range(func(_, value interface{}) bool {
+		h := value.(*handler)
+		if clientID := h.activity.client(); clientID != "" && matchClientID(pattern, clientID) {
+			h.purge.request()
+			n++
+		}
+		return true
+	})
+	if gw.cfg.StandbySessions != nil {
+		n += gw.cfg.StandbySessions.Purge(pattern)
+	}
+	gw.inventory.purge(pattern)
+	gw.log.Info("%d sessions of clients %q purged", n, pattern)
+	return n, nil
+}
+
+// The pattern must have been validated. Unlike in paths, "/" is an ordinary
+// character in ClientIDs. MQTT strings must not contain U+0000, hence it can
+// stand in for "/".
+func matchClientID(pattern, clientID string) bool {
+	ok, _ := path.Match(strings.ReplaceAll(pattern, "/", "\x00"),
+		strings.ReplaceAll(clientID, "/", "\x00"))
+	return ok
+}
+
+// Purge removes the sessions of all the clients whose ClientID matches the
+// pattern (see Gateway.PurgeSessions). Returns the number of sessions
+// removed.
+func (s *SessionStore) Purge(pattern string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n := 0
+	for id, session := range s.sessions {
+		if matchClientID(pattern, session.ClientID) {
+			delete(s.sessions, id)
+			n++
+		}
+	}
+	return n
+}
+
+// Expire removes the sessions whose client has not sent any message since
+// the given time. The sleep duration of a sleeping client is added to its
+// last activity. Returns the number of sessions removed.
+func (s *SessionStore) Expire(before time.Time) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n := 0
+	for id, session := range s.sessions {
+		if session.LastActivity.IsZero() {
+			continue
+		}
+		lastActivity := session.LastActivity
+		switch session.State {
+		case util.StateAsleep, util.StateAwake:
+			lastActivity = lastActivity.Add(session.SleepDuration)
+		}
+		if lastActivity.Before(before) {
+			delete(s.sessions, id)
+			n++
+		}
+	}
+	return n
+}
+
+// takeSession takes the replicated session of the handler with the given
+// ID over unless the session has expired.
+func (gw *Gateway) takeSession(id string) (Session, bool) {
+	ttl := gw.cfg.SessionTTL
+	if ttl > 0 {
+		if n := gw.cfg.StandbySessions.Expire(time.Now().Add(-ttl)); n > 0 {
+			gw.log.Info("%d expired standby sessions removed", n)
+		}
+	}
+	return gw.cfg.StandbySessions.Take(id)
+}
+
+func (i *inventory) purge(pattern string) {
+	if i == nil {
+		return
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	for clientID := range i.clients {
+		if matchClientID(pattern, clientID) {
+			delete(i.clients, clientID)
+		}
+	}
+}
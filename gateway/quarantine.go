@@ -0,0 +1,216 @@
+// Handler panic containment.
+//
+// A panic in any of the handler's goroutines (typically caused by a malformed
+// interaction hitting a bug, or by a panicking EventHook) is converted to an
+// error failing just the affected client's handler. The MQTT connection is
+// closed without DISCONNECT so that the MQTT broker publishes the client's
+// will, if any.
+//
+// Clients repeatedly crashing their handlers can be quarantined, i.e. their
+// CONNECTs are refused for a while (see GatewayConfig.QuarantineThreshold).
+
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/energomonitor/bisquitt/transactions"
+	"golang.org/x/sync/errgroup"
+)
+
+// Default time window in which panics are counted and default quarantine
+// duration (see GatewayConfig.QuarantineThreshold).
+const (
+	defaultQuarantineWindow   = time.Hour
+	defaultQuarantineDuration = time.Hour
+)
+
+type handlerPanicError struct {
+	value interface{}
+	stack []byte
+}
+
+func (e *handlerPanicError) Error() string {
+	return fmt.Sprintf("handler panic: %v", e.value)
+}
+
+// guardedGroup is an errgroup.Group converting panics of its goroutines to
+// handlerPanicErrors.
+type guardedGroup struct {
+	*errgroup.Group
+	handler *handler
+}
+
+func (g *guardedGroup) Go(f func() error) {
+	g.Group.Go(func() (err error) {
+		defer g.handler.recoverPanic(&err)
+		return f()
+	})
+}
+
+// fail fails the group with the given error as if one of its goroutines
+// returned it.
+func (g *guardedGroup) fail(err error) {
+	g.Group.Go(func() error {
+		return err
+	})
+}
+
+// guardRetry wraps a transaction's retry callback. The callback runs in
+// a timer goroutine, out of the handler's group, hence its panic would crash
+// the whole gateway otherwise. The panic fails the transaction and the
+// handler.
+func (h *handler) guardRetry(retry transactions.RTRetryCallback) transactions.RTRetryCallback {
+	return func(msg interface{}) (err error) {
+		defer h.failOnPanic(&err)
+		defer h.recoverPanic(&err)
+		return retry(msg)
+	}
+}
+
+// guardFinally wraps a transaction's finally callback which runs in a timer
+// goroutine if the transaction times out (see guardRetry).
+func (h *handler) guardFinally(finally transactions.FinallyCallback) transactions.FinallyCallback {
+	return func() {
+		var err error
+		defer h.failOnPanic(&err)
+		defer h.recoverPanic(&err)
+		finally()
+	}
+}
+
+// failOnPanic must be deferred after recoverPanic. It fails the handler if
+// recoverPanic caught a panic.
+func (h *handler) failOnPanic(err *error) {
+	if panicErr, ok := (*err).(*handlerPanicError); ok {
+		h.group.fail(panicErr)
+	}
+}
+
+// run serves the client. A panic fails the handler only.
+func (h *handler) run(ctx context.Context, snConn net.Conn) (err error) {
+	defer h.recoverPanic(&err)
+	return h.serve(ctx, snConn)
+}
+
+// recoverPanic must be deferred. It converts a panic to a handlerPanicError
+// stored to err.
+func (h *handler) recoverPanic(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	panicErr := &handlerPanicError{
+		value: r,
+		stack: debug.Stack(),
+	}
+	h.log.Error("Handler panic: %v\n%s", r, panicErr.stack)
+	h.stats.count(&h.stats.handlerPanics)
+	h.cfg.Quarantine.offend(h.quarantineKey())
+	*err = panicErr
+}
+
+// quarantineKey identifies the client in the quarantine. The client ID is
+// not known before CONNECT, the handler ID is used then.
+func (h *handler) quarantineKey() string {
+	if clientID := h.activity.client(); clientID != "" {
+		return clientID
+	}
+	return h.id
+}
+
+// quarantine keeps clients whose handlers panicked too often. It's safe for
+// concurrent use. A nil *quarantine quarantines nobody.
+type quarantine struct {
+	threshold int
+	window    time.Duration
+	duration  time.Duration
+	lock      sync.Mutex
+	panics    map[string][]time.Time // key => panic times within window
+	until     map[string]time.Time   // key => quarantine end
+}
+
+func newQuarantine(threshold int, window, duration time.Duration) *quarantine {
+	if window <= 0 {
+		window = defaultQuarantineWindow
+	}
+	if duration <= 0 {
+		duration = defaultQuarantineDuration
+	}
+	return &quarantine{
+		threshold: threshold,
+		window:    window,
+		duration:  duration,
+		panics:    make(map[string][]time.Time),
+		until:     make(map[string]time.Time),
+	}
+}
+
+// offend records a panic of the client with the given key and quarantines
+// the client if it has reached the threshold.
+func (q *quarantine) offend(key string) {
+	if q == nil {
+		return
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	now := time.Now()
+	q.prune(now)
+	recent := append(q.panics[key], now)
+	if len(recent) < q.threshold {
+		q.panics[key] = recent
+		return
+	}
+	delete(q.panics, key)
+	q.until[key] = now.Add(q.duration)
+}
+
+// prune forgets panics out of the window and ended quarantines so that
+// clients which never come back do not occupy memory forever. Must be called
+// with q.lock held.
+func (q *quarantine) prune(now time.Time) {
+	for key, times := range q.panics {
+		var recent []time.Time
+		for _, t := range times {
+			if now.Sub(t) < q.window {
+				recent = append(recent, t)
+			}
+		}
+		if len(recent) == 0 {
+			delete(q.panics, key)
+		} else {
+			q.panics[key] = recent
+		}
+	}
+	for key, until := range q.until {
+		if !now.Before(until) {
+			delete(q.until, key)
+		}
+	}
+}
+
+// holds returns true if a client with any of the given keys is quarantined.
+func (q *quarantine) holds(keys ...string) bool {
+	if q == nil {
+		return false
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	now := time.Now()
+	for _, key := range keys {
+		until, ok := q.until[key]
+		if !ok {
+			continue
+		}
+		if now.Before(until) {
+			return true
+		}
+		delete(q.until, key)
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+// REGISTER messages pushed to the client right after CONNACK (see
+// handlerConfig.PushTopics) so that the client knows the TopicIDs before the
+// first use of the topics.
+
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	snMsgs "github.com/energomonitor/bisquitt/messages"
+	"github.com/energomonitor/bisquitt/transactions"
+	"github.com/energomonitor/bisquitt/util"
+)
+
+type registerTransaction struct {
+	*transactions.RetryTransaction
+	handler *handler
+	log     util.Logger
+}
+
+func newRegisterTransaction(ctx context.Context, h *handler, msgID uint16) *registerTransaction {
+	tLog := h.log.WithTag(fmt.Sprintf("REGISTERg(%d)", msgID))
+	tLog.Debug("Created.")
+	return &registerTransaction{
+		RetryTransaction: transactions.NewRetryTransaction(
+			ctx, h.cfg.RetryDelay, h.cfg.RetryCount,
+			h.guardRetry(func(lastMsg interface{}) error {
+				tLog.Debug("Resend.")
+				return h.snSend(lastMsg.(snMsgs.Message))
+			}),
+			h.guardFinally(func() {
+				h.transactions.Delete(msgID)
+				tLog.Debug("Deleted.")
+			}),
+		),
+		handler: h,
+		log:     tLog,
+	}
+}
+
+func (t *registerTransaction) Regack(snRegack *snMsgs.RegackMessage) error {
+	if snRegack.ReturnCode != snMsgs.RC_ACCEPTED {
+		t.Fail(fmt.Errorf("REGACK return code: %d", snRegack.ReturnCode))
+		return nil
+	}
+	snRegister := t.Data.(*snMsgs.RegisterMessage)
+	t.handler.registeredTopics.Store(snRegister.TopicID, snRegister.TopicName)
+	t.Success()
+	return nil
+}
+
+// pushRegisters sends REGISTER messages for all the handlerConfig.PushTopics
+// which the client does not know yet.
+func (h *handler) pushRegisters(ctx context.Context) error {
+	for _, topic := range h.cfg.PushTopics {
+		if hasWildcard(topic) || snMsgs.IsShortTopic(topic) {
+			continue
+		}
+		if _, _, ok := h.findTopicID(topic); ok {
+			continue
+		}
+		msgID, ok := h.availableMsgID()
+		if !ok {
+			return errors.New("cannot find available MsgID")
+		}
+		topicID, err := h.newTopicID()
+		if err != nil {
+			return err
+		}
+		transaction := newRegisterTransaction(ctx, h, msgID)
+		snRegister := snMsgs.NewRegisterMessage(topicID, topic)
+		snRegister.SetMessageID(msgID)
+		h.transactions.Store(msgID, transaction)
+		transaction.Proceed(nil, snRegister)
+		if err := h.snSend(snRegister); err != nil {
+			transaction.Fail(err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/energomonitor/bisquitt/topics"
+)
+
+// RetainAction is an action taken on the Retain flag of a message published
+// by a client.
+type RetainAction string
+
+const (
+	// Clear the Retain flag, e.g. to protect the MQTT broker from devices
+	// setting it on high-frequency telemetry.
+	RetainStrip RetainAction = "strip"
+	// Set the Retain flag.
+	RetainForce RetainAction = "force"
+)
+
+// RetainRule applies the Action to messages published by clients on topics
+// matching the Topic filter (may contain wildcards).
+type RetainRule struct {
+	Topic  string
+	Action RetainAction
+}
+
+// RetainRules modify the Retain flag of messages published by clients. The
+// first matching RetainRule is used, messages not matching any of them keep
+// their Retain flag.
+type RetainRules []RetainRule
+
+// ParseRetainRuleOptions parses a command line retain rules definition in
+// "topic;action" format.
+func ParseRetainRuleOptions(options ...string) (RetainRules, error) {
+	var result RetainRules
+	for _, line := range options {
+		fields := strings.Split(line, ";")
+		if len(fields) != 2 {
+			return nil, errors.New("invalid format (expects: topic;action)")
+		}
+		action := RetainAction(fields[1])
+		switch action {
+		case RetainStrip, RetainForce:
+		default:
+			return nil, fmt.Errorf("invalid action %q (expects: %s or %s)",
+				action, RetainStrip, RetainForce)
+		}
+		result = append(result, RetainRule{
+			Topic:  fields[0],
+			Action: action,
+		})
+	}
+	return result, nil
+}
+
+func (r RetainRules) action(topic string) (RetainAction, bool) {
+	for _, rule := range r {
+		if topics.Match(rule.Topic, topic) {
+			return rule.Action, true
+		}
+	}
+	return "", false
+}
+
+// applyRetainRules returns the Retain flag of a message published by the
+// client on the given topic modified by the retain rules.
+func (h *handler) applyRetainRules(topic string, retain bool) bool {
+	action, ok := h.cfg.RetainRules.action(topic)
+	if !ok {
+		return retain
+	}
+	switch {
+	case action == RetainStrip && retain:
+		h.log.Debug("Retain flag of PUBLISH to %q stripped", topic)
+		h.stats.count(&h.stats.retainStripped)
+		return false
+	case action == RetainForce && !retain:
+		h.log.Debug("Retain flag of PUBLISH to %q forced", topic)
+		h.stats.count(&h.stats.retainForced)
+		return true
+	}
+	return retain
+}
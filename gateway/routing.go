@@ -0,0 +1,722 @@
+// Topic routing to multiple upstreams.
+//
+// By default, all the client's traffic goes to the MQTT broker set by
+// GatewayConfig.MqttBrokerAddress. Routes send the traffic on selected topics
+// to other MQTT brokers (or bridges) instead, e.g. telemetry to a cloud broker
+// and commands to a local one. The first route whose topic filter matches the
+// topic of a client's PUBLISH, or the topic filter of a client's SUBSCRIBE or
+// UNSUBSCRIBE, is used. Subscriptions not matching any route (e.g. "#") are
+// made at the default MQTT broker only.
+//
+// Routing is first-match only: a topic's traffic is never split (e.g.
+// weighted) between more brokers.
+//
+// Once the client is connected, the handler opens an MQTT connection to every
+// route's broker using the client's ID and keepalive. The credentials used
+// for the default MQTT broker (GatewayConfig.MqttUser and MqttPassword or the
+// client's AUTH) are never sent to a route's broker, which often belongs to
+// a third party; the route's own credentials (Route.User and Route.Password)
+// are used instead, if any. The client's will is published by the default
+// MQTT broker only.
+//
+// A route can limit the QoS used on it (Route.MaxQOS). Messages published by
+// the client with a higher QoS are sent with the route's maximum QoS and the
+// gateway acknowledges them to the client itself. Subscriptions request at
+// most the route's maximum QoS, hence the client is granted it.
+//
+// A failure of a route's connection does not affect the client's session:
+// the route is reconnected after routeRetryDelay and the route's
+// subscriptions are renewed. Meanwhile, QoS 1 and 2 messages published to
+// the route are refused with RC_CONGESTION (QoS 0 ones are dropped) and so
+// are subscriptions.
+
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	snMsgs "github.com/energomonitor/bisquitt/messages"
+	"github.com/energomonitor/bisquitt/topics"
+	"github.com/energomonitor/bisquitt/util"
+
+	mqttPackets "github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Delay before a failed route is reconnected.
+const routeRetryDelay = 5 * time.Second
+
+var errRouteDown = errors.New("route not connected")
+
+// Route sends the client's traffic on topics matching the Topic filter (may
+// contain wildcards) to the Broker instead of the default MQTT broker.
+type Route struct {
+	Topic  string
+	Broker *net.TCPAddr
+	// Maximum QoS of messages published and subscriptions made through the
+	// route.
+	MaxQOS uint8
+	// Credentials for the route's broker. No credentials are sent if nil.
+	User     *string
+	Password []byte
+}
+
+// Routes are searched in order, the first matching Route is used.
+type Routes []Route
+
+// ParseRouteOptions parses a command line routes definition in
+// "topic;host:port[;maxqos[;user[;password]]]" format.
+func ParseRouteOptions(options ...string) (Routes, error) {
+	var result Routes
+	for _, line := range options {
+		fields := strings.Split(line, ";")
+		if len(fields) < 2 || len(fields) > 5 {
+			return nil, errors.New("invalid format (expects: topic;host:port[;maxqos[;user[;password]]])")
+		}
+		broker, err := net.ResolveTCPAddr("tcp", fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid broker address %q: %s", fields[1], err)
+		}
+		route := Route{
+			Topic:  fields[0],
+			Broker: broker,
+			MaxQOS: 2,
+		}
+		if len(fields) >= 3 && fields[2] != "" {
+			qos, err := strconv.ParseUint(fields[2], 10, 8)
+			if err != nil || qos > 2 {
+				return nil, fmt.Errorf("invalid QoS %q (expects: 0, 1 or 2)", fields[2])
+			}
+			route.MaxQOS = uint8(qos)
+		}
+		if len(fields) >= 4 {
+			user := fields[3]
+			route.User = &user
+		}
+		if len(fields) == 5 {
+			route.Password = []byte(fields[4])
+		}
+		result = append(result, route)
+	}
+	return result, nil
+}
+
+// upstream is the MQTT connection of a route. It's safe for concurrent use.
+type upstream struct {
+	route   *Route
+	handler *handler
+	log     util.Logger
+	lock    sync.Mutex
+	// nil if not connected
+	conn *util.ConnWithContext
+	// Cancels the current connection.
+	cancel context.CancelFunc
+	// Topic filter => requested QoS of subscriptions made through the route.
+	subscriptions map[string]uint8
+	// MsgIDs of messages downgraded from QoS 2 to QoS 1 which are
+	// acknowledged to the client by the gateway.
+	acknowledged map[uint16]bool
+	// MsgID of the SUBSCRIBE renewing the subscriptions, 0 if none.
+	renewMsgID uint16
+	// Set when the client disconnects.
+	closed bool
+}
+
+func newUpstream(h *handler, route *Route) *upstream {
+	return &upstream{
+		route:         route,
+		handler:       h,
+		log:           h.log.WithTag(fmt.Sprintf("ROUTE(%s)", route.Topic)),
+		subscriptions: make(map[string]uint8),
+		acknowledged:  make(map[uint16]bool),
+	}
+}
+
+// routedMsgID identifies a message exchanged with a route's broker.
+type routedMsgID struct {
+	upstream *upstream
+	msgID    uint16
+}
+
+// routeTable maps MsgIDs of messages exchanged through routes. It's safe for
+// concurrent use.
+type routeTable struct {
+	lock sync.Mutex
+	// Client's MsgID => route of a QoS 2 PUBLISH awaiting PUBREL and
+	// PUBCOMP. A nil upstream means the gateway completes the flow itself.
+	uplink map[uint16]*upstream
+	// Gateway's MsgID => route's MsgID of a QoS 1 or 2 PUBLISH sent by the
+	// route's broker.
+	downlink map[uint16]routedMsgID
+}
+
+func (t *routeTable) setUplink(msgID uint16, u *upstream) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.uplink == nil {
+		t.uplink = make(map[uint16]*upstream)
+	}
+	t.uplink[msgID] = u
+}
+
+func (t *routeTable) getUplink(msgID uint16) (*upstream, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	u, ok := t.uplink[msgID]
+	return u, ok
+}
+
+func (t *routeTable) deleteUplink(msgID uint16) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.uplink, msgID)
+}
+
+// inDownlink returns true if the gateway's MsgID is in use by a message sent
+// by a route's broker.
+func (t *routeTable) inDownlink(msgID uint16) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	_, ok := t.downlink[msgID]
+	return ok
+}
+
+// gatewayMsgID returns the gateway's MsgID of a message sent by the route's
+// broker, if known.
+func (t *routeTable) gatewayMsgID(u *upstream, msgID uint16) (uint16, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for gwMsgID, routed := range t.downlink {
+		if routed.upstream == u && routed.msgID == msgID {
+			return gwMsgID, true
+		}
+	}
+	return 0, false
+}
+
+func (t *routeTable) setDownlink(gwMsgID uint16, u *upstream, msgID uint16) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.downlink == nil {
+		t.downlink = make(map[uint16]routedMsgID)
+	}
+	t.downlink[gwMsgID] = routedMsgID{u, msgID}
+}
+
+// getDownlink returns the route of the message with the gateway's MsgID. The
+// mapping is removed if done is set.
+func (t *routeTable) getDownlink(gwMsgID uint16, done bool) (routedMsgID, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	routed, ok := t.downlink[gwMsgID]
+	if ok && done {
+		delete(t.downlink, gwMsgID)
+	}
+	return routed, ok
+}
+
+// upstreamFor returns the upstream of the first route matching the topic or
+// nil if the topic is not routed.
+func (h *handler) upstreamFor(topic string) *upstream {
+	for _, u := range h.upstreams {
+		if topics.Match(u.route.Topic, topic) {
+			return u
+		}
+	}
+	return nil
+}
+
+// startRoutes connects the routes' upstreams. The mqConnect is the client's
+// CONNECT sent to the default MQTT broker.
+func (h *handler) startRoutes(ctx context.Context, mqConnect *mqttPackets.ConnectPacket) {
+	for _, u := range h.upstreams {
+		u := u
+		connect := *mqConnect
+		// The default MQTT broker's credentials must not leak to the
+		// route's broker.
+		connect.UsernameFlag = u.route.User != nil
+		connect.Username = ""
+		if connect.UsernameFlag {
+			connect.Username = *u.route.User
+		}
+		connect.PasswordFlag = u.route.Password != nil
+		connect.Password = u.route.Password
+		connect.WillFlag = false
+		connect.WillQos = 0
+		connect.WillRetain = false
+		connect.WillTopic = ""
+		connect.WillMessage = nil
+		h.group.Go(func() error {
+			return u.run(ctx, &connect)
+		})
+	}
+}
+
+// disconnectRoutes sends DISCONNECT to the routes' brokers and stops the
+// routes.
+func (h *handler) disconnectRoutes() {
+	for _, u := range h.upstreams {
+		u.close()
+	}
+}
+
+// routePublish sends the client's PUBLISH through the route.
+func (h *handler) routePublish(ctx context.Context, u *upstream, snPublish *snMsgs.PublishMessage, mqPublish *mqttPackets.PublishPacket) error {
+	msgID := snPublish.MessageID()
+	downgraded := mqPublish.Qos > u.route.MaxQOS
+	if downgraded {
+		mqPublish.Qos = u.route.MaxQOS
+		if mqPublish.Qos == 1 {
+			u.acknowledge(msgID, true)
+		}
+	}
+	var transaction *clientPublishQOS1Transaction
+	if !downgraded {
+		switch mqPublish.Qos {
+		case 1:
+			transaction = newClientPublishQOS1Transaction(ctx, h, snPublish, mqPublish.TopicName)
+			h.transactions.Store(msgID, transaction)
+		case 2:
+			h.routed.setUplink(msgID, u)
+		}
+	}
+
+	if err := u.send(mqPublish); err != nil {
+		u.log.Debug("PUBLISH to %q refused: %s", mqPublish.TopicName, err)
+		if transaction != nil {
+			transaction.Fail(err)
+		}
+		u.acknowledge(msgID, false)
+		h.routed.deleteUplink(msgID)
+		return h.rejectPublish(snPublish, snMsgs.RC_CONGESTION)
+	}
+	if !downgraded {
+		return nil
+	}
+
+	switch snPublish.QOS {
+	case 1:
+		snPuback := snMsgs.NewPubackMessage(snPublish.TopicID, snMsgs.RC_ACCEPTED)
+		snPuback.CopyMessageID(snPublish)
+		return h.snSend(snPuback)
+	case 2:
+		h.routed.setUplink(msgID, nil)
+		snPubrec := snMsgs.NewPubrecMessage()
+		snPubrec.CopyMessageID(snPublish)
+		return h.snSend(snPubrec)
+	}
+	return nil
+}
+
+// routePubrel handles the client's PUBREL of a message published through
+// a route. Returns false if the message was not routed.
+func (h *handler) routePubrel(snPubrel *snMsgs.PubrelMessage) (bool, error) {
+	msgID := snPubrel.MessageID()
+	u, ok := h.routed.getUplink(msgID)
+	if !ok {
+		return false, nil
+	}
+	if u == nil {
+		h.routed.deleteUplink(msgID)
+		snPubcomp := snMsgs.NewPubcompMessage()
+		snPubcomp.SetMessageID(msgID)
+		return true, h.snSend(snPubcomp)
+	}
+	mqPubrel := mqttPackets.NewControlPacket(mqttPackets.Pubrel).(*mqttPackets.PubrelPacket)
+	mqPubrel.MessageID = msgID
+	if err := u.send(mqPubrel); err != nil {
+		// The client will retransmit PUBREL.
+		u.log.Debug("PUBREL not sent: %s", err)
+	}
+	return true, nil
+}
+
+// routeSubscribe sends the client's SUBSCRIBE through the route. The
+// subscribe transaction has already been stored.
+func (h *handler) routeSubscribe(u *upstream, mqSubscribe *mqttPackets.SubscribePacket) error {
+	if mqSubscribe.Qoss[0] > u.route.MaxQOS {
+		mqSubscribe.Qoss[0] = u.route.MaxQOS
+	}
+	u.subscribed(mqSubscribe.Topics[0], mqSubscribe.Qoss[0])
+	if err := u.send(mqSubscribe); err != nil {
+		u.log.Debug("SUBSCRIBE to %q refused: %s", mqSubscribe.Topics[0], err)
+		u.unsubscribed(mqSubscribe.Topics[0])
+		if transactionx, ok := h.transactions.Get(mqSubscribe.MessageID); ok {
+			transactionx.(*subscribeTransaction).Fail(err)
+		}
+		snSuback := snMsgs.NewSubackMessage(0, 0, snMsgs.RC_CONGESTION)
+		snSuback.SetMessageID(mqSubscribe.MessageID)
+		return h.snSend(snSuback)
+	}
+	return nil
+}
+
+// routeUnsubscribe sends the client's UNSUBSCRIBE through the route.
+func (h *handler) routeUnsubscribe(u *upstream, mqUnsubscribe *mqttPackets.UnsubscribePacket) error {
+	u.unsubscribed(mqUnsubscribe.Topics[0])
+	if err := u.send(mqUnsubscribe); err != nil {
+		// The subscription is not renewed when the route reconnects.
+		u.log.Debug("UNSUBSCRIBE from %q not sent: %s", mqUnsubscribe.Topics[0], err)
+		snUnsuback := snMsgs.NewUnsubackMessage()
+		snUnsuback.SetMessageID(mqUnsubscribe.MessageID)
+		return h.snSend(snUnsuback)
+	}
+	return nil
+}
+
+// routeAck sends an acknowledgement of a message sent by a route's broker to
+// the route. Returns false if the message was not routed.
+func (h *handler) routeAck(msg mqttPackets.ControlPacket) (bool, error) {
+	var msgType byte
+	var msgID uint16
+	switch mqMsg := msg.(type) {
+	case *mqttPackets.PubackPacket:
+		msgType, msgID = mqttPackets.Puback, mqMsg.MessageID
+	case *mqttPackets.PubrecPacket:
+		msgType, msgID = mqttPackets.Pubrec, mqMsg.MessageID
+	case *mqttPackets.PubcompPacket:
+		msgType, msgID = mqttPackets.Pubcomp, mqMsg.MessageID
+	default:
+		return false, nil
+	}
+	routed, ok := h.routed.getDownlink(msgID, msgType != mqttPackets.Pubrec)
+	if !ok {
+		return false, nil
+	}
+	// The message must not be modified, a transaction can resend it.
+	return true, routed.upstream.send(newAck(msgType, routed.msgID))
+}
+
+func newAck(msgType byte, msgID uint16) mqttPackets.ControlPacket {
+	msg := mqttPackets.NewControlPacket(msgType)
+	switch ack := msg.(type) {
+	case *mqttPackets.PubackPacket:
+		ack.MessageID = msgID
+	case *mqttPackets.PubrecPacket:
+		ack.MessageID = msgID
+	case *mqttPackets.PubrelPacket:
+		ack.MessageID = msgID
+	case *mqttPackets.PubcompPacket:
+		ack.MessageID = msgID
+	}
+	return msg
+}
+
+func (u *upstream) connected() bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.conn != nil
+}
+
+func (u *upstream) close() {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.closed = true
+	if u.conn == nil {
+		return
+	}
+	mqDisconnect := mqttPackets.NewControlPacket(mqttPackets.Disconnect)
+	if err := u.sendLocked(mqDisconnect); err != nil {
+		u.log.Error("Error sending DISCONNECT: %s", err)
+		return
+	}
+	u.cancel()
+}
+
+func (u *upstream) isClosed() bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.closed
+}
+
+// acknowledge marks the message as acknowledged to the client by the
+// gateway, i.e. the route's PUBACK is ignored.
+func (u *upstream) acknowledge(msgID uint16, acknowledged bool) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if acknowledged {
+		u.acknowledged[msgID] = true
+	} else {
+		delete(u.acknowledged, msgID)
+	}
+}
+
+func (u *upstream) subscribed(filter string, qos uint8) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.subscriptions[filter] = qos
+}
+
+func (u *upstream) unsubscribed(filter string) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	delete(u.subscriptions, filter)
+}
+
+// send returns errRouteDown if the route is not connected.
+func (u *upstream) send(msg mqttPackets.ControlPacket) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return u.sendLocked(msg)
+}
+
+func (u *upstream) sendLocked(msg mqttPackets.ControlPacket) error {
+	if u.conn == nil {
+		return errRouteDown
+	}
+	u.log.Debug("<= %v", msg)
+	buff := &bytes.Buffer{}
+	if err := msg.Write(buff); err != nil {
+		return err
+	}
+	if _, err := u.conn.Write(buff.Bytes()); err != nil {
+		u.log.Error("Write error: %s", err)
+		// The receive loop quits and the route is reconnected.
+		u.cancel()
+		u.conn = nil
+		return errRouteDown
+	}
+	return nil
+}
+
+// run keeps the route connected until ctx is cancelled. Only errors not
+// caused by the route's connection fail the handler.
+func (u *upstream) run(ctx context.Context, connect *mqttPackets.ConnectPacket) error {
+	u.log.Debug("Route starts.")
+	defer u.log.Debug("Route quits.")
+	for {
+		err := u.session(ctx, connect)
+		if ctx.Err() != nil || u.isClosed() {
+			return nil
+		}
+		var routeErr *routeError
+		if !errors.As(err, &routeErr) {
+			return err
+		}
+		u.log.Error("Route failed: %s", routeErr.err)
+		u.handler.stats.count(&u.handler.stats.routeFailures)
+
+		timer := time.NewTimer(routeRetryDelay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		}
+	}
+}
+
+// routeError is a failure of the route's connection.
+type routeError struct {
+	err error
+}
+
+func (e *routeError) Error() string {
+	return e.err.Error()
+}
+
+// session connects the route and handles messages received from it until
+// the connection fails.
+func (u *upstream) session(ctx context.Context, connect *mqttPackets.ConnectPacket) error {
+	h := u.handler
+	u.log.Debug("Connecting to MQTT broker %s", u.route.Broker)
+	dialer := &net.Dialer{
+		Timeout: h.cfg.MqttConnectionTimeout,
+	}
+	netConn, err := dialer.DialContext(ctx, "tcp", u.route.Broker.String())
+	if err != nil {
+		return &routeError{err}
+	}
+	defer func() {
+		if err := netConn.Close(); err != nil {
+			u.log.Error("Error closing MQTT connection: %s", err)
+		}
+	}()
+
+	sessionCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	connackCtx, connackCancel := context.WithTimeout(sessionCtx, connectTransactionTimeout)
+	defer connackCancel()
+	connackConn := util.NewConnWithContext(connackCtx, netConn, connTimeout)
+	u.log.Debug("<= %v", connect)
+	if err := connect.Write(connackConn); err != nil {
+		return &routeError{err}
+	}
+	msg, err := mqttPackets.ReadPacket(connackConn)
+	if err != nil {
+		return &routeError{err}
+	}
+	u.log.Debug("=> %v", msg)
+	mqConnack, ok := msg.(*mqttPackets.ConnackPacket)
+	if !ok {
+		return &routeError{fmt.Errorf("unexpected message: %v", msg)}
+	}
+	if mqConnack.ReturnCode != mqttPackets.Accepted {
+		return &routeError{fmt.Errorf("CONNECT refused with return code %d", mqConnack.ReturnCode)}
+	}
+
+	conn := util.NewConnWithContext(sessionCtx, netConn, connTimeout)
+	defer u.disconnect()
+	if err := u.connect(conn, cancel, mqConnack.SessionPresent); err != nil {
+		return &routeError{err}
+	}
+	u.log.Debug("Connected to MQTT broker")
+
+	if connect.Keepalive > 0 {
+		h.group.Go(func() error {
+			u.pinger(sessionCtx, time.Duration(connect.Keepalive)*time.Second)
+			return nil
+		})
+	}
+
+	for {
+		msg, err := mqttPackets.ReadPacket(conn)
+		if err != nil {
+			if err == context.Canceled {
+				err = errors.New("connection closed")
+			}
+			return &routeError{err}
+		}
+		u.log.Debug("=> %v", msg)
+		msg, err = u.receive(msg)
+		if err != nil {
+			return &routeError{err}
+		}
+		if msg == nil {
+			continue
+		}
+		h.upstreamLock.Lock()
+		err = h.handleMqtt(ctx, msg)
+		h.upstreamLock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// connect sets the connection and renews the route's subscriptions unless
+// the route's broker kept the session.
+func (u *upstream) connect(conn *util.ConnWithContext, cancel context.CancelFunc, sessionPresent bool) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.closed {
+		return errRouteDown
+	}
+	u.conn = conn
+	u.cancel = cancel
+	if sessionPresent || len(u.subscriptions) == 0 {
+		return nil
+	}
+	msgID, ok := u.handler.availableMsgID()
+	if !ok {
+		return errors.New("cannot find available MsgID")
+	}
+	mqSubscribe := mqttPackets.NewControlPacket(mqttPackets.Subscribe).(*mqttPackets.SubscribePacket)
+	mqSubscribe.MessageID = msgID
+	for filter, qos := range u.subscriptions {
+		mqSubscribe.Topics = append(mqSubscribe.Topics, filter)
+		mqSubscribe.Qoss = append(mqSubscribe.Qoss, qos)
+	}
+	u.renewMsgID = msgID
+	return u.sendLocked(mqSubscribe)
+}
+
+func (u *upstream) disconnect() {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.conn = nil
+	u.cancel = nil
+	u.renewMsgID = 0
+}
+
+func (u *upstream) pinger(ctx context.Context, keepAlive time.Duration) {
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m := mqttPackets.NewControlPacket(mqttPackets.Pingreq)
+			if err := u.send(m); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// receive translates a message received from the route's broker to
+// a message handled by handleMqtt. Returns nil if the message is handled by
+// the upstream itself.
+func (u *upstream) receive(msg mqttPackets.ControlPacket) (mqttPackets.ControlPacket, error) {
+	h := u.handler
+	switch mqMsg := msg.(type) {
+	case *mqttPackets.PingrespPacket:
+		return nil, nil
+
+	case *mqttPackets.PublishPacket:
+		if mqMsg.Qos == 0 {
+			return mqMsg, nil
+		}
+		// MsgIDs of the route's broker could collide with the default
+		// MQTT broker's ones.
+		gwMsgID, ok := h.routed.gatewayMsgID(u, mqMsg.MessageID)
+		if !ok {
+			if gwMsgID, ok = h.availableMsgID(); !ok {
+				return nil, errors.New("cannot find available MsgID")
+			}
+			h.routed.setDownlink(gwMsgID, u, mqMsg.MessageID)
+		}
+		mqMsg.MessageID = gwMsgID
+		return mqMsg, nil
+
+	case *mqttPackets.PubrelPacket:
+		gwMsgID, ok := h.routed.gatewayMsgID(u, mqMsg.MessageID)
+		if !ok {
+			// Already completed, the PUBCOMP was probably lost.
+			return nil, u.send(newAck(mqttPackets.Pubcomp, mqMsg.MessageID))
+		}
+		mqMsg.MessageID = gwMsgID
+		return mqMsg, nil
+
+	case *mqttPackets.PubackPacket:
+		u.lock.Lock()
+		acknowledged := u.acknowledged[mqMsg.MessageID]
+		delete(u.acknowledged, mqMsg.MessageID)
+		u.lock.Unlock()
+		if acknowledged {
+			return nil, nil
+		}
+		return mqMsg, nil
+
+	case *mqttPackets.PubrecPacket:
+		return mqMsg, nil
+
+	case *mqttPackets.PubcompPacket:
+		h.routed.deleteUplink(mqMsg.MessageID)
+		return mqMsg, nil
+
+	case *mqttPackets.SubackPacket:
+		u.lock.Lock()
+		renewal := u.renewMsgID != 0 && u.renewMsgID == mqMsg.MessageID
+		if renewal {
+			u.renewMsgID = 0
+		}
+		u.lock.Unlock()
+		if renewal {
+			return nil, nil
+		}
+		return mqMsg, nil
+
+	case *mqttPackets.UnsubackPacket:
+		return mqMsg, nil
+	}
+	return nil, fmt.Errorf("unexpected message: %v", msg)
+}
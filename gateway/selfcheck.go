@@ -0,0 +1,230 @@
+// Startup self-check.
+//
+// A misconfiguration often shows up long after the gateway start, e.g. when
+// a client uses a shadowed predefined topic or when the certificate expires.
+// Gateway.SelfCheck validates the whole configuration in advance:
+//
+//   - predefined_topics: a topic predefined with more TopicIDs for the same
+//     client, a client's TopicID shadowing a different topic predefined for
+//     all the clients, a reserved TopicID or a predefined topic containing
+//     wildcards.
+//   - topics: an invalid topic filter in the filter rules, downlink
+//     priorities, retain rules, routes or latency SLOs, or a push topic
+//     containing wildcards.
+//   - broker: the MQTT broker or a route's broker is unreachable.
+//   - certificate: the DTLS certificate is expired or not yet valid.
+//   - keepalive: the MQTT keepalive override exceeds the MQTT maximum.
+//
+// ListenAndServe runs the self-check on start and logs the problems found.
+// If GatewayConfig.StrictConfig is set, it refuses to start instead.
+
+package gateway
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	snMsgs "github.com/energomonitor/bisquitt/messages"
+)
+
+// Timeout of the MQTT brokers reachability check if
+// GatewayConfig.MqttConnectionTimeout is zero.
+const selfCheckDialTimeout = 5 * time.Second
+
+// ConfigProblem is a configuration problem found by Gateway.SelfCheck.
+type ConfigProblem struct {
+	// Name of the check which found the problem, e.g. "predefined_topics".
+	Check   string `json:"check"`
+	Message string `json:"message"`
+}
+
+func (p ConfigProblem) String() string {
+	return fmt.Sprintf("%s: %s", p.Check, p.Message)
+}
+
+// SelfCheck validates the gateway configuration. Returns the problems found.
+func (gw *Gateway) SelfCheck(ctx context.Context) []ConfigProblem {
+	var problems []ConfigProblem
+	report := func(check, format string, a ...interface{}) {
+		problems = append(problems, ConfigProblem{
+			Check:   check,
+			Message: fmt.Sprintf(format, a...),
+		})
+	}
+	gw.checkPredefinedTopics(report)
+	gw.checkTopics(report)
+	gw.checkBrokers(ctx, report)
+	gw.checkCertificate(report)
+	gw.checkKeepAlive(report)
+	return problems
+}
+
+// selfCheck runs the self-check on start. Returns an error if the gateway
+// must not start.
+func (gw *Gateway) selfCheck(ctx context.Context) error {
+	problems := gw.SelfCheck(ctx)
+	for _, p := range problems {
+		if gw.cfg.StrictConfig {
+			gw.log.Error("Configuration check %s", p)
+		} else {
+			gw.log.Info("Configuration check warning %s", p)
+		}
+	}
+	if gw.cfg.StrictConfig && len(problems) > 0 {
+		return fmt.Errorf("configuration check failed: %d problems found", len(problems))
+	}
+	return nil
+}
+
+type problemReporter func(check, format string, a ...interface{})
+
+func (gw *Gateway) checkPredefinedTopics(report problemReporter) {
+	const check = "predefined_topics"
+	predefined := gw.cfg.PredefinedTopics
+	// Sorted for a stable output.
+	clientIDs := make([]string, 0, len(predefined))
+	for clientID := range predefined {
+		clientIDs = append(clientIDs, clientID)
+	}
+	sort.Strings(clientIDs)
+	for _, clientID := range clientIDs {
+		clientTopics := predefined[clientID]
+		topicIDs := make([]int, 0, len(clientTopics))
+		for topicID := range clientTopics {
+			topicIDs = append(topicIDs, int(topicID))
+		}
+		sort.Ints(topicIDs)
+		seen := make(map[string]uint16)
+		for _, id := range topicIDs {
+			topicID := uint16(id)
+			topic := clientTopics[topicID]
+			if topicID < snMsgs.MinTopicID || topicID > snMsgs.MaxTopicID {
+				report(check, "client %q: reserved TopicID %d", clientID, topicID)
+			}
+			if hasWildcard(topic) {
+				report(check, "client %q: topic %q contains wildcards", clientID, topic)
+			}
+			if other, ok := seen[topic]; ok {
+				report(check, "client %q: topic %q predefined as TopicIDs %d and %d",
+					clientID, topic, other, topicID)
+			}
+			seen[topic] = topicID
+			if clientID == "*" {
+				continue
+			}
+			if shadowed, ok := predefined["*"][topicID]; ok && shadowed != topic {
+				report(check, "client %q: TopicID %d (%q) shadows topic %q predefined for all clients",
+					clientID, topicID, topic, shadowed)
+			}
+		}
+	}
+}
+
+func (gw *Gateway) checkTopics(report problemReporter) {
+	const check = "topics"
+	checkFilter := func(where, filter string) {
+		if err := validateTopicFilter(filter); err != nil {
+			report(check, "%s: topic filter %q: %s", where, filter, err)
+		}
+	}
+	if gw.cfg.Filter != nil {
+		for i, rule := range gw.cfg.Filter.rules {
+			if rule.Topic != "" {
+				checkFilter(fmt.Sprintf("filter rule %d", i+1), rule.Topic)
+			}
+		}
+	}
+	for _, p := range gw.cfg.DownlinkPriorities {
+		checkFilter("downlink priority", p.Topic)
+	}
+	for _, r := range gw.cfg.RetainRules {
+		checkFilter("retain rule", r.Topic)
+	}
+	for _, r := range gw.cfg.Routes {
+		checkFilter("route", r.Topic)
+	}
+	for _, slo := range gw.cfg.LatencySLOs {
+		checkFilter("latency SLO", slo.Topic)
+	}
+	for _, topic := range gw.cfg.PushTopics {
+		if hasWildcard(topic) {
+			report(check, "push topic %q contains wildcards", topic)
+		}
+	}
+}
+
+// validateTopicFilter checks the MQTT topic filter syntax [MQTT 3.1.1
+// specification, chapter 4.7].
+func validateTopicFilter(filter string) error {
+	if filter == "" {
+		return fmt.Errorf("empty")
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return fmt.Errorf(`"#" must be the last level`)
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return fmt.Errorf(`"+" must occupy an entire level`)
+		}
+	}
+	return nil
+}
+
+func (gw *Gateway) checkBrokers(ctx context.Context, report problemReporter) {
+	const check = "broker"
+	timeout := gw.cfg.MqttConnectionTimeout
+	if timeout == 0 {
+		timeout = selfCheckDialTimeout
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	dial := func(name string, address *net.TCPAddr) {
+		conn, err := dialer.DialContext(ctx, "tcp", address.String())
+		if err != nil {
+			report(check, "%s %s unreachable: %s", name, address, err)
+			return
+		}
+		conn.Close()
+	}
+	if gw.cfg.MqttBrokerAddress != nil {
+		dial("MQTT broker", gw.cfg.MqttBrokerAddress)
+	}
+	for _, r := range gw.cfg.Routes {
+		dial(fmt.Sprintf("route %q broker", r.Topic), r.Broker)
+	}
+}
+
+func (gw *Gateway) checkCertificate(report problemReporter) {
+	const check = "certificate"
+	certificate := gw.cfg.Certificate
+	if !gw.cfg.UseDTLS || gw.cfg.SelfSigned || certificate == nil || len(certificate.Certificate) == 0 {
+		return
+	}
+	leaf := certificate.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(certificate.Certificate[0]); err != nil {
+			report(check, "invalid certificate: %s", err)
+			return
+		}
+	}
+	now := time.Now()
+	if now.After(leaf.NotAfter) {
+		report(check, "certificate %q expired on %s", leaf.Subject, leaf.NotAfter)
+	}
+	if now.Before(leaf.NotBefore) {
+		report(check, "certificate %q not valid before %s", leaf.Subject, leaf.NotBefore)
+	}
+}
+
+func (gw *Gateway) checkKeepAlive(report problemReporter) {
+	const check = "keepalive"
+	if gw.cfg.MqttKeepAlive > MaxMqttKeepAlive {
+		report(check, "MQTT keepalive %s exceeds the maximum %s", gw.cfg.MqttKeepAlive, MaxMqttKeepAlive)
+	}
+}
@@ -0,0 +1,152 @@
+// Downlink shaping.
+//
+// A chatty MQTT broker topic could saturate a narrowband link shared by the
+// client's other traffic. Messages sent by the MQTT broker to a client can be
+// limited to a number of messages and/or bytes per second (see
+// GatewayConfig.DownlinkMessageRate and GatewayConfig.DownlinkByteRate) using
+// token buckets. A QoS 0 message exceeding the limit is dropped. A QoS 1 or
+// 2 message is delayed until the limit allows it; the delay also holds back
+// reading from the connection of the broker which sent the message, i.e. the
+// broker is slowed down by TCP flow control. Messages from the other brokers
+// (see routing.go) are handled meanwhile.
+
+package gateway
+
+import (
+	"context"
+	"time"
+
+	snMsgs "github.com/energomonitor/bisquitt/messages"
+
+	mqttPackets "github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// tokenBucket is not safe for concurrent use.
+type tokenBucket struct {
+	// Tokens added per second.
+	rate  float64
+	burst float64
+	// Can be negative if tokens were reserved in advance.
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// available reports whether n tokens are available.
+func (b *tokenBucket) available(now time.Time, n float64) bool {
+	if b == nil {
+		return true
+	}
+	b.refill(now)
+	return b.tokens >= n
+}
+
+// reserve takes n tokens and returns how long to wait until they are
+// actually available.
+func (b *tokenBucket) reserve(now time.Time, n float64) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.refill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// downlinkShaper limits messages sent by the MQTT brokers to the client. It
+// must be used with handler.upstreamLock held.
+type downlinkShaper struct {
+	// nil if not limited
+	messages *tokenBucket
+	bytes    *tokenBucket
+}
+
+func newDownlinkShaper(messageRate float64, byteRate int) *downlinkShaper {
+	if messageRate <= 0 && byteRate <= 0 {
+		return nil
+	}
+	s := &downlinkShaper{}
+	if messageRate > 0 {
+		burst := messageRate
+		if burst < 1 {
+			burst = 1
+		}
+		s.messages = newTokenBucket(messageRate, burst)
+	}
+	if byteRate > 0 {
+		// Any message must fit into the bucket.
+		burst := float64(byteRate)
+		if burst < snMsgs.MaxPacketLen {
+			burst = snMsgs.MaxPacketLen
+		}
+		s.bytes = newTokenBucket(float64(byteRate), burst)
+	}
+	return s
+}
+
+// shapeDownlink applies the downlink limits to the PUBLISH received from the
+// MQTT broker. Returns false if the message must be dropped. Must be called
+// with h.upstreamLock held; the lock is released while the message is
+// delayed.
+func (h *handler) shapeDownlink(ctx context.Context, mqPublish *mqttPackets.PublishPacket) bool {
+	s := h.downlink
+	if s == nil {
+		return true
+	}
+	// Size of the MQTT-SN PUBLISH (3-byte length field for long messages).
+	size := float64(7 + len(mqPublish.Payload))
+	if size > 255 {
+		size += 2
+	}
+	now := time.Now()
+
+	if mqPublish.Qos == 0 {
+		if !s.messages.available(now, 1) || !s.bytes.available(now, size) {
+			h.log.Debug("Downlink limit exceeded, %v dropped", mqPublish)
+			h.stats.count(&h.stats.msgsShaped)
+			return false
+		}
+		s.messages.reserve(now, 1)
+		s.bytes.reserve(now, size)
+		return true
+	}
+
+	delay := s.messages.reserve(now, 1)
+	if bytesDelay := s.bytes.reserve(now, size); bytesDelay > delay {
+		delay = bytesDelay
+	}
+	if delay == 0 {
+		return true
+	}
+	h.log.Debug("Downlink limit exceeded, %v delayed by %s", mqPublish, delay)
+	// The tokens are already reserved, the other brokers' messages can be
+	// handled meanwhile.
+	h.upstreamLock.Unlock()
+	defer h.upstreamLock.Lock()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
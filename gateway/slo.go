@@ -0,0 +1,257 @@
+// Latency SLOs.
+//
+// Operators can declare latency service level objectives for topics (see
+// GatewayConfig.LatencySLOs), e.g. "99% of QoS 1 messages published on
+// sensors/# are acknowledged by the MQTT broker within 500 ms". The latency
+// of a QoS 1 PUBLISH is the time between the PUBLISH reception from the
+// client and the PUBACK reception from the MQTT broker.
+//
+// A QoS 1 PUBLISH which is not acknowledged by the MQTT broker within
+// RetryDelay (or whose forwarding fails) is recorded with a latency of at
+// least RetryDelay, hence a broker which stops acknowledging breaches the
+// SLO.
+//
+// The latencies observed within the last sloWindow are checked every
+// sloCheckInterval. When the SLO becomes breached or is met again, the
+// gateway logs it and calls GatewayConfig.SLOAlertHook. The current state of
+// all the SLOs is available in Report.LatencySLOs.
+
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/energomonitor/bisquitt/topics"
+	"github.com/energomonitor/bisquitt/util"
+)
+
+const (
+	// Latencies older than this are not taken into account.
+	sloWindow = 5 * time.Minute
+	// Maximum number of latencies kept per SLO.
+	sloMaxSamples    = 10000
+	sloCheckInterval = 10 * time.Second
+	// Maximum number of alerts waiting for SLOAlertHook.
+	sloAlertQueueSize = 16
+)
+
+// LatencySLO is a latency objective for messages published by clients on
+// topics matching Topic: Percentile % of the messages must be acknowledged
+// by the MQTT broker within Latency.
+type LatencySLO struct {
+	// MQTT topic filter, may contain wildcards.
+	Topic      string
+	Percentile float64
+	Latency    time.Duration
+}
+
+// LatencySLOs are searched in order, the first matching LatencySLO is used.
+type LatencySLOs []LatencySLO
+
+// ParseLatencySLOOptions parses a command line latency SLOs definition in
+// "topic;percentile;latency" format, e.g. "sensors/#;99;500ms".
+func ParseLatencySLOOptions(options ...string) (LatencySLOs, error) {
+	var result LatencySLOs
+	for _, line := range options {
+		fields := strings.Split(line, ";")
+		if len(fields) != 3 {
+			return nil, errors.New("invalid format (expects: topic;percentile;latency)")
+		}
+		percentile, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || percentile <= 0 || percentile > 100 {
+			return nil, fmt.Errorf("invalid percentile %q (expects: 0-100)", fields[1])
+		}
+		latency, err := time.ParseDuration(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid latency %q: %s", fields[2], err)
+		}
+		result = append(result, LatencySLO{
+			Topic:      fields[0],
+			Percentile: percentile,
+			Latency:    latency,
+		})
+	}
+	return result, nil
+}
+
+// SLOStatus is the state of a LatencySLO.
+type SLOStatus struct {
+	Topic      string        `json:"topic"`
+	Percentile float64       `json:"percentile"`
+	Objective  time.Duration `json:"objective_ns"`
+	// The Percentile of the latencies observed within the last 5 minutes.
+	Observed time.Duration `json:"observed_ns"`
+	Samples  int           `json:"samples"`
+	Breached bool          `json:"breached"`
+	// Number of times the SLO has become breached.
+	Breaches uint64 `json:"breaches"`
+}
+
+// SLOAlertHook is called when a LatencySLO becomes breached or is met again.
+// The calls are serialized in a dedicated goroutine. If the hook falls
+// behind, the oldest pending alerts are dropped.
+type SLOAlertHook func(SLOStatus)
+
+type sloSample struct {
+	time    time.Time
+	latency time.Duration
+}
+
+type sloState struct {
+	slo     LatencySLO
+	samples []sloSample
+	status  SLOStatus
+}
+
+// sloTracker tracks the latencies of all the LatencySLOs, shared by all the
+// handlers. It's safe for concurrent use.
+type sloTracker struct {
+	log    util.Logger
+	hook   SLOAlertHook
+	lock   sync.Mutex
+	states []*sloState
+	// Runs the hook, set by loop.
+	hooks *util.WorkerPool
+}
+
+func newSLOTracker(slos LatencySLOs, hook SLOAlertHook, log util.Logger) *sloTracker {
+	t := &sloTracker{
+		log:  log,
+		hook: hook,
+	}
+	for _, slo := range slos {
+		t.states = append(t.states, &sloState{
+			slo: slo,
+			status: SLOStatus{
+				Topic:      slo.Topic,
+				Percentile: slo.Percentile,
+				Objective:  slo.Latency,
+			},
+		})
+	}
+	return t
+}
+
+// observe records the latency of a message published on the topic.
+func (t *sloTracker) observe(topic string, latency time.Duration) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, s := range t.states {
+		if topics.Match(s.slo.Topic, topic) {
+			if len(s.samples) >= sloMaxSamples {
+				s.samples = s.samples[1:]
+			}
+			s.samples = append(s.samples, sloSample{time: time.Now(), latency: latency})
+			return
+		}
+	}
+}
+
+// check evaluates all the SLOs. Returns the statuses of the SLOs which have
+// become breached or have been met again.
+func (t *sloTracker) check(now time.Time) []SLOStatus {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var changed []SLOStatus
+	for _, s := range t.states {
+		i := 0
+		for i < len(s.samples) && now.Sub(s.samples[i].time) > sloWindow {
+			i++
+		}
+		s.samples = s.samples[i:]
+		s.status.Samples = len(s.samples)
+		if len(s.samples) == 0 {
+			// Nothing to evaluate, keep the last state.
+			continue
+		}
+		latencies := make([]time.Duration, len(s.samples))
+		for i, sample := range s.samples {
+			latencies[i] = sample.latency
+		}
+		s.status.Observed = percentile(latencies, s.slo.Percentile)
+		breached := s.status.Observed > s.slo.Latency
+		if breached == s.status.Breached {
+			continue
+		}
+		s.status.Breached = breached
+		if breached {
+			s.status.Breaches++
+		}
+		changed = append(changed, s.status)
+	}
+	return changed
+}
+
+func (t *sloTracker) statuses() []SLOStatus {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	result := make([]SLOStatus, len(t.states))
+	for i, s := range t.states {
+		result[i] = s.status
+	}
+	return result
+}
+
+// percentile returns the p-th percentile (nearest rank) of the latencies.
+// The latencies are sorted in place.
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	sort.Slice(latencies, func(a, b int) bool {
+		return latencies[a] < latencies[b]
+	})
+	rank := int(math.Ceil(p / 100 * float64(len(latencies))))
+	if rank < 1 {
+		rank = 1
+	}
+	return latencies[rank-1]
+}
+
+func (t *sloTracker) loop(ctx context.Context) {
+	if t.hook != nil {
+		t.hooks = util.NewWorkerPool(ctx, 1, sloAlertQueueSize, util.DropOldest)
+	}
+	ticker := time.NewTicker(sloCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			t.alert(t.check(now))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (t *sloTracker) alert(changed []SLOStatus) {
+	for _, status := range changed {
+		if status.Breached {
+			t.log.Error("Latency SLO of %q breached: p%g = %s (objective: %s)",
+				status.Topic, status.Percentile, status.Observed, status.Objective)
+		} else {
+			t.log.Info("Latency SLO of %q met again: p%g = %s (objective: %s)",
+				status.Topic, status.Percentile, status.Observed, status.Objective)
+		}
+		switch {
+		case t.hooks != nil:
+			status := status
+			t.hooks.Submit(context.Background(), func() {
+				t.hook(status)
+			})
+		case t.hook != nil:
+			t.hook(status)
+		}
+	}
+}
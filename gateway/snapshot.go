@@ -0,0 +1,111 @@
+// Session snapshot format versioning.
+//
+// Session snapshots are exchanged between gateways which may run different
+// Bisquitt versions during an upgrade. Every snapshot therefore carries its
+// format version and older formats are migrated to the current one when
+// decoded.
+//
+// Compatibility policy: a gateway decodes snapshots of the current format
+// version and of at least one previous version. Snapshots of a newer version
+// are refused. Hence a standby gateway must be upgraded before the active
+// one.
+//
+// When the format changes incompatibly, increment SessionSnapshotVersion and
+// register a migration from the previous version in sessionMigrations.
+
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// SessionSnapshotVersion is the current version of the session snapshot
+// format.
+//
+// Versions:
+//
+//	1: bare JSON array of sessions (unversioned)
+//	2: JSON object with "version" and "sessions" keys
+const SessionSnapshotVersion = 2
+
+// SessionSnapshot is the session snapshot format.
+type SessionSnapshot struct {
+	Version  int       `json:"version"`
+	Sessions []Session `json:"sessions"`
+}
+
+var errSnapshotVersionMissing = errors.New("session snapshot version missing")
+
+// sessionMigration converts a snapshot of version N to version N+1.
+type sessionMigration func(data []byte) ([]byte, error)
+
+// Snapshot version => migration to the next version.
+var sessionMigrations = map[int]sessionMigration{
+	1: migrateSessionSnapshotV1,
+}
+
+func migrateSessionSnapshotV1(data []byte) ([]byte, error) {
+	var sessions []Session
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return nil, err
+	}
+	return json.Marshal(SessionSnapshot{
+		Version:  2,
+		Sessions: sessions,
+	})
+}
+
+// EncodeSessionSnapshot encodes sessions in the current snapshot format.
+func EncodeSessionSnapshot(sessions []Session) ([]byte, error) {
+	return json.Marshal(SessionSnapshot{
+		Version:  SessionSnapshotVersion,
+		Sessions: sessions,
+	})
+}
+
+// DecodeSessionSnapshot decodes a session snapshot, migrating it from an
+// older format version if necessary.
+func DecodeSessionSnapshot(data []byte) ([]Session, error) {
+	version, err := sessionSnapshotVersion(data)
+	if err != nil {
+		return nil, err
+	}
+	if version > SessionSnapshotVersion {
+		return nil, fmt.Errorf("unsupported session snapshot version %d (newest supported is %d)",
+			version, SessionSnapshotVersion)
+	}
+	for ; version < SessionSnapshotVersion; version++ {
+		migrate, ok := sessionMigrations[version]
+		if !ok {
+			return nil, fmt.Errorf("unsupported session snapshot version %d", version)
+		}
+		if data, err = migrate(data); err != nil {
+			return nil, fmt.Errorf("cannot migrate session snapshot from version %d: %s", version, err)
+		}
+	}
+	var snapshot SessionSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot.Sessions, nil
+}
+
+func sessionSnapshotVersion(data []byte) (int, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		return 1, nil
+	}
+	var header struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return 0, err
+	}
+	if header.Version <= 0 {
+		return 0, errSnapshotVersionMissing
+	}
+	return header.Version, nil
+}
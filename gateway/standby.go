@@ -0,0 +1,366 @@
+// Warm standby support.
+//
+// Two gateways can run as an active/standby pair sharing a virtual IP address
+// managed externally (e.g. by keepalived using VRRP). The active gateway
+// periodically replicates snapshots of its client sessions to the standby
+// one (see GatewayConfig.ReplicationSink). When the virtual IP address moves
+// to the standby gateway, a client whose session has been replicated is
+// served without a new CONNECT: the standby gateway reconnects to the MQTT
+// broker on the client's behalf with CleanSession=false so that the
+// broker-side subscriptions are preserved.
+//
+// Only plain UDP sessions can be taken over. A DTLS client must perform a new
+// handshake with the standby gateway, hence it must reconnect anyway.
+//
+// Trust model: a replicated session is resumed under the standby gateway's
+// MQTT broker credentials, with the replicated ClientID and without
+// authentication of the client. Whoever can submit a snapshot to the standby
+// gateway can thus impersonate any client. SessionStore.Secret should be set
+// (and the same HTTPReplicationSink.Secret used by the active gateway) unless
+// the SessionStore is reachable from trusted hosts only. The replication
+// traffic is not encrypted, hence it should not cross untrusted networks.
+//
+// Replicated snapshots older than SessionStore.MaxAge are not taken over.
+
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/energomonitor/bisquitt/util"
+
+	mqttPackets "github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// Default interval of session replication (see
+// GatewayConfig.ReplicationInterval).
+const defaultReplicationInterval = time.Second
+
+// Maximum time a ReplicationSink is given to replicate sessions.
+const replicationTimeout = 5 * time.Second
+
+// Default SessionStore.MaxAge.
+const defaultSnapshotMaxAge = 10 * time.Minute
+
+// Default SessionStore.MaxSize.
+const defaultSnapshotMaxSize = 64 << 20
+
+// Session is a snapshot of a client session which can be replicated to a
+// standby gateway.
+type Session struct {
+	// Handler ID, i.e. the client's remote address.
+	ID       string           `json:"id"`
+	ClientID string           `json:"client_id"`
+	State    util.ClientState `json:"state"`
+	// Keepalive requested by the client in seconds.
+	KeepAlive uint16 `json:"keepalive"`
+	// Sleep duration of a sleeping client.
+	SleepDuration time.Duration `json:"sleep_duration_ns,omitempty"`
+	// Registered TopicID => topic name.
+	Topics map[uint16]string `json:"topics,omitempty"`
+	// Metadata published by the client (see MetadataTopic).
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Time of the last message received from the client.
+	LastActivity time.Time `json:"last_activity,omitempty"`
+}
+
+// ReplicationSink receives snapshots of all the sessions of the active
+// gateway.
+type ReplicationSink interface {
+	Replicate(ctx context.Context, sessions []Session) error
+}
+
+// HTTPReplicationSink POSTs session snapshots (see SessionSnapshot) to the
+// given URL, typically served by a SessionStore of the standby gateway.
+type HTTPReplicationSink struct {
+	URL string
+	// Shared secret sent in the Authorization header, see
+	// SessionStore.Secret.
+	Secret string
+	// http.DefaultClient is used if nil.
+	Client *http.Client
+}
+
+func (s *HTTPReplicationSink) Replicate(ctx context.Context, sessions []Session) error {
+	data, err := EncodeSessionSnapshot(sessions)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.Secret != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Secret)
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("replication sink %s: unexpected status %s", s.URL, resp.Status)
+	}
+	return nil
+}
+
+// SessionStore holds sessions replicated from the active gateway. Every
+// replication replaces the whole content of the store. It's safe for
+// concurrent use.
+//
+// SessionStore implements http.Handler accepting POST requests sent by
+// HTTPReplicationSink.
+type SessionStore struct {
+	// If set, HTTP requests must carry the secret in the Authorization
+	// header ("Bearer <secret>").
+	Secret string
+	// Sessions are not taken over if the last replication is older (10
+	// minutes if zero), i.e. when the active gateway stopped replicating
+	// long ago.
+	MaxAge time.Duration
+	// Larger HTTP request bodies are refused (64 MiB if zero).
+	MaxSize int64
+
+	lock     sync.Mutex
+	sessions map[string]Session // ID => Session
+	updated  time.Time
+}
+
+func NewSessionStore() *SessionStore {
+	return &SessionStore{
+		sessions: make(map[string]Session),
+	}
+}
+
+// Update replaces the stored sessions with the given ones.
+func (s *SessionStore) Update(sessions []Session) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sessions = make(map[string]Session, len(sessions))
+	for _, session := range sessions {
+		s.sessions[session.ID] = session
+	}
+	s.updated = time.Now()
+}
+
+// Take removes the session with the given ID from the store and returns it.
+// All the sessions are discarded if the last replication is older than
+// MaxAge.
+func (s *SessionStore) Take(id string) (Session, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	maxAge := s.MaxAge
+	if maxAge <= 0 {
+		maxAge = defaultSnapshotMaxAge
+	}
+	if time.Since(s.updated) > maxAge {
+		s.sessions = make(map[string]Session)
+		return Session{}, false
+	}
+	session, ok := s.sessions[id]
+	if ok {
+		delete(s.sessions, id)
+	}
+	return session, ok
+}
+
+// Updated returns the time of the last replication.
+func (s *SessionStore) Updated() time.Time {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.updated
+}
+
+func (s *SessionStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Secret != "" {
+		auth := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(auth, []byte("Bearer "+s.Secret)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	maxSize := s.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultSnapshotMaxSize
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	sessions, err := DecodeSessionSnapshot(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.Update(sessions)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Sessions returns snapshots of all the connected client sessions, sorted by
+// ID.
+func (gw *Gateway) Sessions() []Session {
+	var sessions []Session
+	gw.clients.Range(func(_, value interface{}) bool {
+		if session, ok := value.(*handler).session(); ok {
+			sessions = append(sessions, session)
+		}
+		return true
+	})
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions
+}
+
+func (gw *Gateway) replicate() {
+	ctx, cancel := context.WithTimeout(context.Background(), replicationTimeout)
+	defer cancel()
+	if err := gw.cfg.ReplicationSink.Replicate(ctx, gw.Sessions()); err != nil {
+		gw.log.Error("Cannot replicate sessions: %s", err)
+	}
+}
+
+func (gw *Gateway) replicationLoop(ctx context.Context) {
+	interval := gw.cfg.ReplicationInterval
+	if interval <= 0 {
+		interval = defaultReplicationInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			gw.replicate()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// session returns a snapshot of the client session. Returns false if the
+// client is not connected.
+func (h *handler) session() (Session, bool) {
+	state := h.state.Get()
+	if state == util.StateDisconnected {
+		return Session{}, false
+	}
+	session := Session{
+		ID:        h.id,
+		ClientID:  h.activity.client(),
+		State:     state,
+		KeepAlive: h.sessionKeepAlive(),
+		Topics:    make(map[uint16]string),
+		Metadata:  h.clientInfo().Metadata,
+		// The session TTL continues on the standby gateway.
+		LastActivity: h.activity.last().UTC(),
+	}
+	if state == util.StateAsleep || state == util.StateAwake {
+		h.sleepPinger.lock.Lock()
+		session.SleepDuration = h.sleepPinger.sleepDuration
+		h.sleepPinger.lock.Unlock()
+	}
+	h.registeredTopics.Range(func(key, value interface{}) bool {
+		session.Topics[key.(uint16)] = value.(string)
+		return true
+	})
+	return session, true
+}
+
+// restore prepares the handler to continue a session taken over from the
+// active gateway. Must be called before run.
+func (h *handler) restore(session Session) {
+	h.clientID = session.ClientID
+	h.activity.setClientID(session.ClientID)
+	h.activity.setMetadata(session.Metadata)
+	if !session.LastActivity.IsZero() {
+		h.activity.lastActivity = session.LastActivity
+	}
+	h.setKeepAlive(session.KeepAlive)
+	var maxTopicID uint16
+	for topicID, topic := range session.Topics {
+		h.registeredTopics.Store(topicID, topic)
+		if topicID > maxTopicID {
+			maxTopicID = topicID
+		}
+	}
+	// Do not reuse TopicIDs of the restored topics.
+	if maxTopicID > 0 {
+		for {
+			if id, _ := h.topicID.Next(); id >= maxTopicID {
+				break
+			}
+		}
+	}
+	state := session.State
+	if state == util.StateAwake {
+		// Buffered messages were lost with the active gateway.
+		state = util.StateActive
+	}
+	h.sleepPinger.sleepDuration = session.SleepDuration
+	// The state is set before the MQTT connection is re-established so that
+	// the client's messages are not refused meanwhile.
+	h.state.Set(state)
+	h.restored = true
+}
+
+// resumeSession re-establishes the MQTT connection of a restored session.
+// The MQTT broker's CONNACK is handled by restoredConnack.
+func (h *handler) resumeSession(ctx context.Context) error {
+	h.log.Info("Resuming session of client %q", h.clientID)
+	_, mqttKeepAlive := h.keepAlives()
+	mqConnect := &mqttPackets.ConnectPacket{
+		FixedHeader: mqttPackets.FixedHeader{
+			MessageType: mqttPackets.Connect,
+		},
+		ClientIdentifier: h.clientID,
+		CleanSession:     false,
+		Keepalive:        mqttKeepAlive,
+		ProtocolVersion:  4,
+		ProtocolName:     "MQTT",
+		UsernameFlag:     h.cfg.MqttUser != nil,
+		PasswordFlag:     h.cfg.MqttPassword != nil,
+		Password:         h.cfg.MqttPassword,
+	}
+	if mqConnect.UsernameFlag {
+		mqConnect.Username = *h.cfg.MqttUser
+	}
+	if err := h.mqttSend(mqConnect); err != nil {
+		return err
+	}
+	h.startRoutes(ctx, mqConnect)
+	if h.cfg.MqttKeepAlive == 0 && h.state.Get() == util.StateAsleep && h.sleepPinger.sleepDuration > 0 {
+		h.startSleepPinger(ctx, h.sleepPinger.sleepDuration)
+	}
+	return nil
+}
+
+func (h *handler) restoredConnack(ctx context.Context, mqConnack *mqttPackets.ConnackPacket) error {
+	h.restored = false
+	if mqConnack.ReturnCode != mqttPackets.Accepted {
+		h.state.Set(util.StateDisconnected)
+		return fmt.Errorf("session resumption refused by MQTT broker with return code %d",
+			mqConnack.ReturnCode)
+	}
+	h.log.Debug("Session resumed in %q state.", h.state.Get())
+	h.startKeepAliveOnce(ctx)
+	h.emit(EventSessionRestored)
+	return nil
+}
@@ -0,0 +1,198 @@
+package gateway
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	snMsgs "github.com/energomonitor/bisquitt/messages"
+	"github.com/energomonitor/bisquitt/util"
+)
+
+// stats collects gateway-wide counters. All the counters are updated
+// atomically, hence stats is safe for concurrent use by all the handlers.
+type stats struct {
+	startTime        time.Time
+	clientsServed    uint64
+	clientsConnected int64
+	msgsReceived     [256]uint64
+	msgsSent         [256]uint64
+	acceptErrors     uint64
+	handshakeErrors  uint64
+	mqttDialErrors   uint64
+	handlerErrors    uint64
+	msgsFiltered     uint64
+	msgsInvalidTopic uint64
+	msgsShaped       uint64
+	msgsDuplicate    uint64
+	txsExpired       uint64
+	handlerPanics    uint64
+	quarantined      uint64 // CONNECTs refused due to quarantine
+	retainStripped   uint64
+	retainForced     uint64
+	routeFailures    uint64
+	sessionsPurged   uint64
+	persistSessions  uint64 // CONNECTs with CleanSession=false
+	devReservedFlags uint64
+	devQOSM1TopicID  uint64
+	devDupQOS0       uint64
+	devKeepAliveZero uint64
+	devSleepZero     uint64
+	tagsLock         sync.Mutex
+	clientsByTag     map[string]uint64 // "key=value" => clients served
+}
+
+func newStats() *stats {
+	return &stats{
+		startTime:    time.Now(),
+		clientsByTag: make(map[string]uint64),
+	}
+}
+
+func (s *stats) clientConnected() {
+	atomic.AddUint64(&s.clientsServed, 1)
+	atomic.AddInt64(&s.clientsConnected, 1)
+}
+
+func (s *stats) clientTagged(tags map[string]string) {
+	s.tagsLock.Lock()
+	defer s.tagsLock.Unlock()
+	for k, v := range tags {
+		s.clientsByTag[fmt.Sprintf("%s=%s", k, v)]++
+	}
+}
+
+func (s *stats) clientDisconnected() {
+	atomic.AddInt64(&s.clientsConnected, -1)
+}
+
+func (s *stats) messageReceived(msgType snMsgs.MessageType) {
+	atomic.AddUint64(&s.msgsReceived[msgType], 1)
+}
+
+func (s *stats) messageSent(msgType snMsgs.MessageType) {
+	atomic.AddUint64(&s.msgsSent[msgType], 1)
+}
+
+func (s *stats) count(counter *uint64) {
+	atomic.AddUint64(counter, 1)
+}
+
+// Report is a point-in-time summary of the gateway activity.
+type Report struct {
+	StartTime        time.Time         `json:"start_time"`
+	Uptime           time.Duration     `json:"uptime_ns"`
+	ClientsServed    uint64            `json:"clients_served"`
+	ClientsConnected int64             `json:"clients_connected"`
+	MessagesReceived map[string]uint64 `json:"messages_received"`
+	MessagesSent     map[string]uint64 `json:"messages_sent"`
+	MessagesDropped  map[string]uint64 `json:"messages_dropped"`
+	// Messages published by clients modified by the gateway.
+	MessagesModified map[string]uint64 `json:"messages_modified"`
+	ClientsByTag     map[string]uint64 `json:"clients_by_tag"`
+	Errors           map[string]uint64 `json:"errors"`
+	// Clients connected with CleanSession=false, i.e. with a session
+	// persisted by the MQTT broker.
+	SessionsPersisted uint64 `json:"sessions_persisted"`
+	// Sessions purged due to GatewayConfig.SessionTTL or by
+	// Gateway.PurgeSessions.
+	SessionsPurged uint64 `json:"sessions_purged"`
+	// Client messages deviating from the MQTT-SN specification (see
+	// GatewayConfig.StrictSpec).
+	Deviations map[string]uint64 `json:"deviations"`
+	// Set if the canary is enabled (see CanaryConfig).
+	Canary *CanaryStatus `json:"canary,omitempty"`
+	// Set if GatewayConfig.LatencySLOs are set.
+	LatencySLOs []SLOStatus `json:"latency_slos,omitempty"`
+}
+
+func (s *stats) report() *Report {
+	r := &Report{
+		StartTime:        s.startTime,
+		Uptime:           time.Since(s.startTime),
+		ClientsServed:    atomic.LoadUint64(&s.clientsServed),
+		ClientsConnected: atomic.LoadInt64(&s.clientsConnected),
+		MessagesReceived: make(map[string]uint64),
+		MessagesSent:     make(map[string]uint64),
+		MessagesDropped: map[string]uint64{
+			"filter":        atomic.LoadUint64(&s.msgsFiltered),
+			"invalid_topic": atomic.LoadUint64(&s.msgsInvalidTopic),
+			"downlink_rate": atomic.LoadUint64(&s.msgsShaped),
+			"duplicate":     atomic.LoadUint64(&s.msgsDuplicate),
+		},
+		MessagesModified: map[string]uint64{
+			"retain_stripped": atomic.LoadUint64(&s.retainStripped),
+			"retain_forced":   atomic.LoadUint64(&s.retainForced),
+		},
+		ClientsByTag: make(map[string]uint64),
+		Deviations: map[string]uint64{
+			"reserved_flags":  atomic.LoadUint64(&s.devReservedFlags),
+			"qos_m1_topic_id": atomic.LoadUint64(&s.devQOSM1TopicID),
+			"dup_qos0":        atomic.LoadUint64(&s.devDupQOS0),
+			"keepalive_zero":  atomic.LoadUint64(&s.devKeepAliveZero),
+			"sleep_zero":      atomic.LoadUint64(&s.devSleepZero),
+		},
+		Errors: map[string]uint64{
+			"accept":         atomic.LoadUint64(&s.acceptErrors),
+			"dtls_handshake": atomic.LoadUint64(&s.handshakeErrors),
+			"mqtt_dial":      atomic.LoadUint64(&s.mqttDialErrors),
+			"handler":        atomic.LoadUint64(&s.handlerErrors),
+			"tx_expired":     atomic.LoadUint64(&s.txsExpired),
+			"handler_panic":  atomic.LoadUint64(&s.handlerPanics),
+			"quarantined":    atomic.LoadUint64(&s.quarantined),
+			"route":          atomic.LoadUint64(&s.routeFailures),
+		},
+		SessionsPersisted: atomic.LoadUint64(&s.persistSessions),
+		SessionsPurged:    atomic.LoadUint64(&s.sessionsPurged),
+	}
+	s.tagsLock.Lock()
+	for tag, n := range s.clientsByTag {
+		r.ClientsByTag[tag] = n
+	}
+	s.tagsLock.Unlock()
+	for i := range s.msgsReceived {
+		if n := atomic.LoadUint64(&s.msgsReceived[i]); n > 0 {
+			r.MessagesReceived[snMsgs.MessageType(i).String()] = n
+		}
+		if n := atomic.LoadUint64(&s.msgsSent[i]); n > 0 {
+			r.MessagesSent[snMsgs.MessageType(i).String()] = n
+		}
+	}
+	return r
+}
+
+// Log writes the report to the given logger.
+func (r *Report) Log(log util.Logger) {
+	log.Info("Uptime: %s", r.Uptime.Round(time.Second))
+	log.Info("Clients served: %d (connected: %d)", r.ClientsServed, r.ClientsConnected)
+	log.Info("Messages received: %v", r.MessagesReceived)
+	log.Info("Messages sent: %v", r.MessagesSent)
+	log.Info("Messages dropped: %v", r.MessagesDropped)
+	log.Info("Messages modified: %v", r.MessagesModified)
+	if len(r.ClientsByTag) > 0 {
+		log.Info("Clients served by tag: %v", r.ClientsByTag)
+	}
+	log.Info("Errors: %v", r.Errors)
+	log.Info("Sessions persisted: %d", r.SessionsPersisted)
+	log.Info("Sessions purged: %d", r.SessionsPurged)
+	log.Info("Protocol deviations: %v", r.Deviations)
+	if r.Canary != nil {
+		log.Info("Canary runs: %d (failed: %d)", r.Canary.Runs, r.Canary.Failures)
+	}
+	for _, s := range r.LatencySLOs {
+		log.Info("Latency SLO of %q: p%g = %s (objective: %s, breaches: %d)",
+			s.Topic, s.Percentile, s.Observed, s.Objective, s.Breaches)
+	}
+}
+
+// WriteFile writes the report to the given file in JSON format.
+func (r *Report) WriteFile(file string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, append(data, '\n'), 0644)
+}
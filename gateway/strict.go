@@ -0,0 +1,88 @@
+// Strict and lenient MQTT-SN specification compliance.
+//
+// Real-world MQTT-SN clients often deviate from the MQTT-SN specification
+// v. 1.2 in ways which do not prevent the gateway from understanding them.
+// By default, the gateway is lenient: it tolerates the deviations listed
+// below. If GatewayConfig.StrictSpec is set, messages deviating from the
+// specification are refused instead: PUBLISH, SUBSCRIBE and CONNECT are
+// answered with RC_NOT_SUPPORTED if they expect an answer, other messages
+// are dropped. Either way, every deviation is logged and counted in
+// Report.Deviations.
+//
+// Deviations:
+//   - reserved_flags: reserved bits of the Flags field are set, e.g. Retain
+//     in SUBSCRIBE. Lenient mode ignores them.
+//   - qos_m1_topic_id: QoS -1 PUBLISH uses a registered TopicID. Only short
+//     topic names and predefined TopicIDs can be used with QoS -1
+//     [MQTT-SN specification v. 1.2, chapter 6.8]. Lenient mode accepts it
+//     from a connected client.
+//   - dup_qos0: QoS 0 or -1 PUBLISH has the DUP flag set. Lenient mode
+//     clears it because the MQTT broker would consider the message
+//     malformed [MQTT 3.1.1 specification, chapter 3.3.1.1].
+//   - keepalive_zero: CONNECT with zero KeepAlive Duration, meaning "no
+//     keepalive" in MQTT. A lost client would never be detected over UDP,
+//     hence the CONNECT is refused even in lenient mode.
+//   - sleep_zero: DISCONNECT with zero sleep Duration. The Duration field is
+//     only included by a client going to sleep [MQTT-SN specification
+//     v. 1.2, chapter 5.4.21]. Lenient mode handles it as a plain
+//     DISCONNECT.
+
+package gateway
+
+import (
+	snMsgs "github.com/energomonitor/bisquitt/messages"
+)
+
+// Flags field bits defined for the messages which include the Flags field.
+var definedFlags = map[snMsgs.MessageType]byte{
+	// Will, CleanSession
+	snMsgs.CONNECT: 0x0c,
+	// QoS, Retain
+	snMsgs.WILLTOPIC:    0x70,
+	snMsgs.WILLTOPICUPD: 0x70,
+	// DUP, QoS, Retain, TopicIdType
+	snMsgs.PUBLISH: 0xf3,
+	// DUP, QoS, TopicIdType
+	snMsgs.SUBSCRIBE: 0xe3,
+	// TopicIdType
+	snMsgs.UNSUBSCRIBE: 0x03,
+}
+
+// hasReservedFlags returns true if the message of the given type has
+// reserved bits of its Flags field set. The body is the message without the
+// header.
+func hasReservedFlags(msgType snMsgs.MessageType, body []byte) bool {
+	defined, ok := definedFlags[msgType]
+	if !ok || len(body) == 0 {
+		// No Flags field (an empty WILLTOPIC deletes the will).
+		return false
+	}
+	return body[0]&^defined != 0
+}
+
+// tolerate logs and counts the deviation and returns true if the gateway
+// is lenient.
+func (h *handler) tolerate(counter *uint64, description string, msg snMsgs.Message) bool {
+	h.stats.count(counter)
+	if h.cfg.StrictSpec {
+		h.log.Info("%s, message refused: %v", description, msg)
+		return false
+	}
+	h.log.Debug("%s, message tolerated: %v", description, msg)
+	return true
+}
+
+// refuse answers a message refused in the strict mode.
+func (h *handler) refuse(msg snMsgs.Message) error {
+	switch snMsg := msg.(type) {
+	case *snMsgs.ConnectMessage:
+		return h.snSend(snMsgs.NewConnackMessage(snMsgs.RC_NOT_SUPPORTED))
+	case *snMsgs.PublishMessage:
+		return h.rejectPublish(snMsg, snMsgs.RC_NOT_SUPPORTED)
+	case *snMsgs.SubscribeMessage:
+		snSuback := snMsgs.NewSubackMessage(0, 0, snMsgs.RC_NOT_SUPPORTED)
+		snSuback.CopyMessageID(snMsg)
+		return h.snSend(snSuback)
+	}
+	return nil
+}
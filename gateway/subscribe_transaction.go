@@ -26,10 +26,10 @@ func newSubscribeTransaction(ctx context.Context, h *handler, msgID uint16, topi
 	return &subscribeTransaction{
 		TimedTransaction: transactions.NewTimedTransaction(
 			ctx, h.cfg.RetryDelay,
-			func() {
+			h.guardFinally(func() {
 				h.transactions.Delete(msgID)
 				tLog.Debug("Deleted.")
-			},
+			}),
 		),
 		handler: h,
 		log:     tLog,
@@ -46,14 +46,16 @@ func (t *subscribeTransaction) Suback(mqSuback *mqttPackets.SubackPacket) error
 	// MQTT Return codes 0-2 means "Success, QoS 0-2" but in MQTT-SN only 0
 	// means success!
 	var returnCode snMsgs.ReturnCode
+	var grantedQos uint8
 	if mqSuback.ReturnCodes[0] <= 2 {
 		returnCode = snMsgs.RC_ACCEPTED
+		grantedQos = mqSuback.ReturnCodes[0]
 		t.Success()
 	} else {
 		returnCode = snMsgs.RC_NOT_SUPPORTED
 		t.Fail(fmt.Errorf("MQTT SUBACK return code: %d", mqSuback.ReturnCodes[0]))
 	}
-	snMsg := snMsgs.NewSubackMessage(t.topicID, mqSuback.Qos, returnCode)
+	snMsg := snMsgs.NewSubackMessage(t.topicID, grantedQos, returnCode)
 	snMsg.SetMessageID(mqSuback.MessageID)
 	return t.handler.snSend(snMsg)
 }
@@ -0,0 +1,48 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Default maximal transaction lifetime (see
+// GatewayConfig.TransactionMaxLifetime).
+const defaultTransactionMaxLifetime = time.Hour
+
+var ErrTransactionExpired = errors.New("transaction expired")
+
+// transactionSweeper force-fails transactions exceeding the maximal lifetime.
+// All the transactions should finish on their own (successfully or by timeout)
+// but a transaction can leak due to a bug or an unexpected sequence of lost
+// messages. A leaked transaction would hold its MsgID and memory for the
+// whole, possibly months-long, handler lifetime.
+func (h *handler) transactionSweeper(ctx context.Context) error {
+	maxLifetime := h.cfg.TransactionMaxLifetime
+	if maxLifetime <= 0 {
+		maxLifetime = defaultTransactionMaxLifetime
+	}
+	ticker := time.NewTicker(maxLifetime / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.sweepTransactions(time.Now().Add(-maxLifetime))
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// sweepTransactions fails and removes all the transactions stored before the
+// given time.
+func (h *handler) sweepTransactions(before time.Time) {
+	for _, transaction := range h.transactions.StoredBefore(before) {
+		h.log.Error("Transaction %T expired", transaction)
+		transaction.Fail(ErrTransactionExpired)
+		// The transaction should have removed itself in its "finally"
+		// callback but we can't rely on it, it has leaked after all.
+		h.transactions.Remove(transaction)
+		h.stats.count(&h.stats.txsExpired)
+	}
+}
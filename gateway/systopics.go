@@ -0,0 +1,110 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/energomonitor/bisquitt"
+	snMsgs "github.com/energomonitor/bisquitt/messages"
+	"github.com/energomonitor/bisquitt/topics"
+
+	mqttPackets "github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// SysTopicPrefix is the prefix of the topics served by the gateway itself if
+// GatewayConfig.SysTopics is set. Subscriptions to these topics are not
+// forwarded to the MQTT broker. Instead, the gateway publishes the current
+// values of the matching topics to the client right after SUBACK, hence
+// any MQTT-SN client can be used to query the gateway state.
+//
+// The topics can also be used as predefined topics.
+const SysTopicPrefix = "$SYS/bisquitt/"
+
+// Topics served by the gateway (without SysTopicPrefix).
+const (
+	sysTopicVersion          = "version"
+	sysTopicUptime           = "uptime"
+	sysTopicClientsConnected = "clients/connected"
+	sysTopicClientsServed    = "clients/served"
+	sysTopicCapabilities     = "capabilities"
+)
+
+// Capabilities describes the features supported by the gateway. It is
+// published in JSON format on the SysTopicPrefix+"capabilities" topic so that
+// clients can discover them (see client.Client.GatewayInfo).
+type Capabilities struct {
+	Version string `json:"version"`
+	// Maximal PUBLISH payload length in bytes.
+	MaxPayload int `json:"max_payload"`
+	// Supported AUTH methods; empty if authentication is disabled.
+	AuthMethods []string `json:"auth_methods"`
+	// Sleeping clients support.
+	Sleep bool `json:"sleep"`
+	// Supported payload compression algorithms.
+	Compression []string `json:"compression"`
+}
+
+func (h *handler) capabilities() *Capabilities {
+	c := &Capabilities{
+		Version:     bisquitt.Version(),
+		MaxPayload:  snMsgs.MaxPayloadLength,
+		AuthMethods: []string{},
+		Sleep:       true,
+		Compression: []string{},
+	}
+	if h.cfg.AuthEnabled {
+		c.AuthMethods = append(c.AuthMethods, "PLAIN")
+	}
+	return c
+}
+
+func isSysTopic(topic string) bool {
+	return strings.HasPrefix(topic, SysTopicPrefix)
+}
+
+// sysTopicValues returns the current values of all the $SYS topics in
+// a stable order.
+func (h *handler) sysTopicValues() [][2]string {
+	report := h.stats.report()
+	// Capabilities is always serializable.
+	capabilities, _ := json.Marshal(h.capabilities())
+	return [][2]string{
+		{sysTopicVersion, bisquitt.Version()},
+		{sysTopicUptime, strconv.FormatInt(int64(report.Uptime/time.Second), 10)},
+		{sysTopicClientsConnected, strconv.FormatInt(report.ClientsConnected, 10)},
+		{sysTopicClientsServed, strconv.FormatUint(report.ClientsServed, 10)},
+		{sysTopicCapabilities, string(capabilities)},
+	}
+}
+
+// handleSysSubscribe acknowledges a subscription to the $SYS topics and
+// publishes the current values of the matching topics to the client. The
+// messages are delivered with QoS 0 and the Retain flag set, like messages
+// received from the MQTT broker, i.e. with h.upstreamLock held.
+func (h *handler) handleSysSubscribe(ctx context.Context, snSubscribe *snMsgs.SubscribeMessage, topic string, topicID uint16) error {
+	snSuback := snMsgs.NewSubackMessage(topicID, 0, snMsgs.RC_ACCEPTED)
+	snSuback.CopyMessageID(snSubscribe)
+	if err := h.snSend(snSuback); err != nil {
+		return err
+	}
+
+	h.upstreamLock.Lock()
+	defer h.upstreamLock.Unlock()
+	for _, value := range h.sysTopicValues() {
+		name := SysTopicPrefix + value[0]
+		if !topics.Match(topic, name) {
+			continue
+		}
+		mqPublish := mqttPackets.NewControlPacket(mqttPackets.Publish).(*mqttPackets.PublishPacket)
+		mqPublish.TopicName = name
+		mqPublish.Payload = []byte(value[1])
+		mqPublish.Retain = true
+		if err := h.handleBrokerPublish(ctx, mqPublish); err != nil {
+			return err
+		}
+	}
+	return nil
+}
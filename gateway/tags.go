@@ -0,0 +1,105 @@
+package gateway
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SourceTagger derives client metadata from the client's source address.
+// The tags are available in ClientInfo.Tags (hence to EventHook) and the
+// numbers of clients served per tag are included in Report.ClientsByTag.
+// That is all the gateway does with the tags: they do not affect topics
+// (the gateway does not rewrite topics at all) and the gateway's statistics
+// other than ClientsByTag are not broken down by tags. Per-site topics or
+// metrics can be derived from the tags in EventHook.
+//
+// A GeoIP database lookup can be plugged in by implementing this interface.
+type SourceTagger interface {
+	// Tags returns tags for the given address or nil if there are none.
+	// The returned map must not be modified later.
+	Tags(addr net.Addr) map[string]string
+}
+
+// CIDRRule assigns tags to clients from the given network.
+type CIDRRule struct {
+	CIDR string            `yaml:"cidr"`
+	Tags map[string]string `yaml:"tags"`
+
+	network *net.IPNet
+}
+
+// CIDRTagger tags clients using a static CIDR to tags map. The rules are
+// evaluated in order and the first matching rule wins.
+type CIDRTagger struct {
+	rules []CIDRRule
+}
+
+// NewCIDRTagger validates the given rules and creates a new CIDRTagger.
+func NewCIDRTagger(rules []CIDRRule) (*CIDRTagger, error) {
+	t := &CIDRTagger{
+		rules: make([]CIDRRule, len(rules)),
+	}
+	for i, rule := range rules {
+		_, network, err := net.ParseCIDR(rule.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("source tag rule %d: %s", i+1, err)
+		}
+		rule.network = network
+		t.rules[i] = rule
+	}
+	return t, nil
+}
+
+// ReadCIDRTagsFile reads CIDR tagging rules from a file in YAML format:
+//
+//	# Prague site uplink.
+//	- cidr: 10.1.0.0/16
+//	  tags:
+//	    site: prague
+//	# Everything else.
+//	- cidr: 0.0.0.0/0
+//	  tags:
+//	    site: other
+func ReadCIDRTagsFile(file string) (*CIDRTagger, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []CIDRRule
+	if err := yaml.NewDecoder(f).Decode(&rules); err != nil {
+		return nil, err
+	}
+	return NewCIDRTagger(rules)
+}
+
+func (t *CIDRTagger) Tags(addr net.Addr) map[string]string {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.IPAddr:
+		ip = a.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return nil
+		}
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return nil
+	}
+	for i := range t.rules {
+		if t.rules[i].network.Contains(ip) {
+			return t.rules[i].Tags
+		}
+	}
+	return nil
+}
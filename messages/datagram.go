@@ -0,0 +1,93 @@
+package messages
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// DatagramError describes a message of a datagram which could not be parsed
+// by ParseDatagram.
+type DatagramError struct {
+	// Offset of the message in the datagram.
+	Offset int
+	Err    error
+}
+
+func (e *DatagramError) Error() string {
+	return fmt.Sprintf("message at offset %d: %s", e.Offset, e.Err)
+}
+
+func (e *DatagramError) Unwrap() error {
+	return e.Err
+}
+
+// ParseDatagram parses a datagram containing one or more concatenated MQTT-SN
+// messages, as produced by some forwarders or by gateways coalescing
+// messages.
+//
+// Errors are isolated per message: a message which cannot be parsed is
+// skipped using the length from its header and the parsing continues with
+// the next message. The skipped messages are reported as *DatagramError
+// errors. If a message length is invalid, the rest of the datagram cannot be
+// split into messages and is reported as a single error.
+func ParseDatagram(data []byte) ([]Message, []error) {
+	msgs, _, errs := ParseDatagramRaw(data)
+	return msgs, errs
+}
+
+// ParseDatagramRaw is like ParseDatagram but it also returns the raw bytes
+// of every parsed message, including its header. They can be used to
+// inspect parts of the messages which are not kept when parsed, e.g.
+// reserved bits. The raw bytes reference data.
+func ParseDatagramRaw(data []byte) ([]Message, [][]byte, []error) {
+	var msgs []Message
+	var raws [][]byte
+	var errs []error
+	offset := 0
+	for offset < len(data) {
+		msg, length, err := parseMessage(data[offset:])
+		if err != nil {
+			errs = append(errs, &DatagramError{Offset: offset, Err: err})
+		}
+		if length == 0 {
+			break
+		}
+		if msg != nil {
+			msgs = append(msgs, msg)
+			raws = append(raws, data[offset:offset+length])
+		}
+		offset += length
+	}
+	return msgs, raws, errs
+}
+
+// parseMessage parses the first message of data. Returns the message length
+// or zero if the length is unknown.
+func parseMessage(data []byte) (Message, int, error) {
+	r := bytes.NewReader(data)
+	var h Header
+	if err := h.Unpack(r); err != nil {
+		return nil, 0, err
+	}
+	headerLength := len(data) - r.Len()
+	length := int(h.MessageLength())
+	if length < headerLength || length > len(data) {
+		return nil, 0, fmt.Errorf("invalid message length %d (%d bytes available)", length, len(data))
+	}
+	if !h.MessageType().IsValid() {
+		return nil, length, fmt.Errorf("invalid message type %s", h.MessageType())
+	}
+	msg := NewMessageWithHeader(h)
+	if h.MessageType() == ENCAPSULATED {
+		// The encapsulated message follows the encapsulation header and it's
+		// not included in its length.
+		if err := msg.Unpack(r); err != nil {
+			return nil, 0, err
+		}
+		return msg, len(data) - r.Len(), nil
+	}
+	if err := msg.Unpack(bytes.NewReader(data[headerLength:length])); err != nil {
+		return nil, length, err
+	}
+	return msg, length, nil
+}
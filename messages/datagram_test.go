@@ -0,0 +1,59 @@
+package messages
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDatagram(t *testing.T) {
+	assert := assert.New(t)
+	buf := bytes.NewBuffer(nil)
+
+	publish := NewPublishMessage(1, TIT_REGISTERED, []byte("test"), 1, false, false)
+	publish.SetMessageID(2)
+	pingresp := NewPingrespMessage()
+	encapsulated := NewEncapsulatedMessage(1, []byte{0x01}, NewPingreqMessage(nil))
+	for _, msg := range []Message{publish, encapsulated, pingresp} {
+		if err := msg.Write(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msgs, errs := ParseDatagram(buf.Bytes())
+	assert.Empty(errs)
+	if assert.Len(msgs, 3) {
+		assert.Equal(publish, msgs[0])
+		assert.Equal(encapsulated, msgs[1])
+		assert.Equal(pingresp, msgs[2])
+	}
+
+	_, raws, errs := ParseDatagramRaw(buf.Bytes())
+	assert.Empty(errs)
+	if assert.Len(raws, 3) {
+		assert.Equal(buf.Bytes()[:11], raws[0])
+		assert.Equal(buf.Bytes()[11:17], raws[1])
+		assert.Equal(buf.Bytes()[17:], raws[2])
+	}
+}
+
+func TestParseDatagramErrors(t *testing.T) {
+	assert := assert.New(t)
+	buf := bytes.NewBuffer(nil)
+
+	pingresp := NewPingrespMessage()
+	pingresp.Write(buf)
+	// Invalid message type.
+	buf.Write([]byte{3, 0xF0, 0})
+	pingresp.Write(buf)
+	// Length exceeding the datagram.
+	buf.Write([]byte{10, byte(PINGRESP)})
+
+	msgs, errs := ParseDatagram(buf.Bytes())
+	assert.Equal([]Message{pingresp, pingresp}, msgs)
+	if assert.Len(errs, 2) {
+		assert.Equal(2, errs[0].(*DatagramError).Offset)
+		assert.Equal(7, errs[1].(*DatagramError).Offset)
+	}
+}
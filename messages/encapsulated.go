@@ -0,0 +1,120 @@
+package messages
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const encapsulatedHeaderLength uint16 = 1
+
+// Ctrl field bit mask constants.
+//
+// See MQTT-SN specification v. 1.2, chapter 5.5 Forwarder Encapsulation.
+const ctrlRadiusBits = 0x03
+
+// MaxRadius is the maximal broadcast radius which can be encoded in the Ctrl
+// field of an encapsulated message.
+const MaxRadius uint8 = ctrlRadiusBits
+
+// EncapsulatedMessage is an MQTT-SN message encapsulated by a forwarder.
+//
+// The Length field of the encapsulation covers the encapsulation header only,
+// i.e. up to the end of the WirelessNodeID field. The encapsulated message
+// follows with its own header.
+//
+// See MQTT-SN specification v. 1.2, chapter 5.5 Forwarder Encapsulation.
+type EncapsulatedMessage struct {
+	Header
+	// Broadcast radius, only relevant in the gateway to forwarder
+	// direction.
+	Radius         uint8
+	WirelessNodeID []byte
+	Message        Message
+}
+
+// NOTE: Packet length is initialized in this constructor and recomputed in m.Write().
+func NewEncapsulatedMessage(radius uint8, wirelessNodeID []byte, msg Message) *EncapsulatedMessage {
+	m := &EncapsulatedMessage{
+		Header:         *NewHeader(ENCAPSULATED, 0),
+		Radius:         radius,
+		WirelessNodeID: wirelessNodeID,
+		Message:        msg,
+	}
+	m.computeLength()
+	return m
+}
+
+func (m *EncapsulatedMessage) computeLength() {
+	nodeIDLength := uint16(len(m.WirelessNodeID))
+	m.Header.SetVarPartLength(encapsulatedHeaderLength + nodeIDLength)
+}
+
+// DecrementRadius decrements the broadcast radius before the message is
+// re-broadcast. It returns false if the radius is exhausted and the message
+// must not be re-broadcast.
+func (m *EncapsulatedMessage) DecrementRadius() bool {
+	if m.Radius <= 1 {
+		return false
+	}
+	m.Radius--
+	return true
+}
+
+func (m *EncapsulatedMessage) Write(w io.Writer) error {
+	if m.Radius > MaxRadius {
+		return fmt.Errorf("broadcast radius %d out of range", m.Radius)
+	}
+	if m.Message == nil {
+		return errors.New("no encapsulated message")
+	}
+	m.computeLength()
+
+	buf := m.Header.pack()
+	buf.WriteByte(m.Radius & ctrlRadiusBits)
+	buf.Write(m.WirelessNodeID)
+	if err := m.Message.Write(&buf); err != nil {
+		return err
+	}
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+func (m *EncapsulatedMessage) Unpack(r io.Reader) (err error) {
+	if m.MessageLength() < m.HeaderLength()+encapsulatedHeaderLength {
+		return fmt.Errorf("encapsulation too short: %d bytes", m.MessageLength())
+	}
+	var ctrl uint8
+	if ctrl, err = readByte(r); err != nil {
+		return
+	}
+	m.Radius = ctrl & ctrlRadiusBits
+
+	m.WirelessNodeID = make([]byte, m.VarPartLength()-encapsulatedHeaderLength)
+	if _, err = io.ReadFull(r, m.WirelessNodeID); err != nil {
+		return
+	}
+
+	// The encapsulated message is read as a whole so that it can't read
+	// beyond its own length.
+	var header Header
+	if err = header.Unpack(r); err != nil {
+		return
+	}
+	if !header.MessageType().IsValid() || header.MessageType() == ENCAPSULATED {
+		return fmt.Errorf("invalid encapsulated message type %s", header.MessageType())
+	}
+	varPart := make([]byte, header.VarPartLength())
+	if _, err = io.ReadFull(r, varPart); err != nil {
+		return
+	}
+	m.Message = NewMessageWithHeader(header)
+	return m.Message.Unpack(bytes.NewReader(varPart))
+}
+
+func (m EncapsulatedMessage) String() string {
+	return fmt.Sprintf("ENCAPSULATED(Radius=%d,WirelessNodeID=%#v,Message=%v)",
+		m.Radius, m.WirelessNodeID, m.Message)
+}
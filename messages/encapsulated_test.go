@@ -0,0 +1,71 @@
+package messages
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncapsulatedStruct(t *testing.T) {
+	radius := uint8(2)
+	nodeID := []byte{0x01, 0x02, 0x03}
+	inner := NewSearchGwMessage(1)
+	msg := NewEncapsulatedMessage(radius, nodeID, inner)
+
+	if assert.NotNil(t, msg, "New message should not be nil") {
+		assert.Equal(t, "*messages.EncapsulatedMessage", reflect.TypeOf(msg).String(), "Type should be EncapsulatedMessage")
+		assert.Equal(t, uint16(6), msg.MessageLength(), "Default Length should be 6")
+		assert.Equal(t, radius, msg.Radius, "Bad Radius value")
+		assert.Equal(t, nodeID, msg.WirelessNodeID, "Bad WirelessNodeID value")
+		assert.Equal(t, inner, msg.Message, "Bad Message value")
+	}
+}
+
+func TestEncapsulatedMarshal(t *testing.T) {
+	assert := assert.New(t)
+	buf := bytes.NewBuffer(nil)
+
+	msg1 := NewEncapsulatedMessage(3, []byte{0xAB, 0xCD}, NewAdvertiseMessage(12, 900))
+	if err := msg1.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal([]byte{5, 0xFE, 0x03, 0xAB, 0xCD, 5, 0x00, 12, 0x03, 0x84}, buf.Bytes())
+
+	r := bytes.NewReader(buf.Bytes())
+	msg2, err := ReadPacket(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(msg1, msg2.(*EncapsulatedMessage))
+}
+
+func TestEncapsulatedRadius(t *testing.T) {
+	assert := assert.New(t)
+
+	msg := NewEncapsulatedMessage(2, nil, NewGwInfoMessage(1, nil))
+	assert.True(msg.DecrementRadius())
+	assert.Equal(uint8(1), msg.Radius)
+	assert.False(msg.DecrementRadius())
+	assert.Equal(uint8(1), msg.Radius)
+
+	msg.Radius = MaxRadius + 1
+	assert.Error(msg.Write(bytes.NewBuffer(nil)))
+}
+
+func TestEncapsulatedTooShort(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, length := range []uint16{0, 2} {
+		var header Header
+		if err := header.Unpack(bytes.NewReader([]byte{byte(length), byte(ENCAPSULATED)})); err != nil {
+			t.Fatal(err)
+		}
+		msg := NewMessageWithHeader(header)
+		r := bytes.NewReader([]byte{0x01, 2, byte(PINGREQ)})
+		assert.Error(msg.Unpack(r), "Length %d", length)
+		assert.Equal(3, r.Len(), "Length %d", length)
+	}
+}
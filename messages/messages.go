@@ -1,11 +1,14 @@
 // Package messages implements MQTT-SN version 1.2 messages structs.
 package messages
 
+//go:generate stringer -type=MessageType
+//go:generate stringer -type=ReturnCode -linecomment
+//go:generate stringer -type=TopicIDType -linecomment
+
 import (
 	"bytes"
 	"encoding/binary"
 	"errors"
-	"fmt"
 	"io"
 )
 
@@ -45,6 +48,7 @@ const shortHeaderLength = 2
 const longHeaderLength = 4
 
 type Message interface {
+	MessageType() MessageType
 	SetVarPartLength(uint16)
 	Write(io.Writer) error
 	Unpack(io.Reader) error
@@ -52,38 +56,38 @@ type Message interface {
 }
 
 // TopicID type constants.
+type TopicIDType uint8
+
 const (
-	TIT_REGISTERED uint8 = iota
-	TIT_PREDEFINED
-	TIT_SHORT
+	TIT_REGISTERED TopicIDType = iota // registered
+	TIT_PREDEFINED                    // predefined
+	TIT_SHORT                         // short
 )
 
-// Whole topic string included in the message (SUBSCRIBE message only).
-const TIT_STRING = uint8(0)
+// Whole topic string included in the message (SUBSCRIBE and UNSUBSCRIBE
+// messages only).
+const TIT_STRING TopicIDType = 0 // string
+
+// IsValid reports whether t is a TopicID type defined by the MQTT-SN
+// specification.
+func (t TopicIDType) IsValid() bool {
+	return t <= TIT_SHORT
+}
 
 // Return code constants.
 type ReturnCode uint8
 
 const (
-	RC_ACCEPTED ReturnCode = iota
-	RC_CONGESTION
-	RC_INVALID_TOPIC_ID
-	RC_NOT_SUPPORTED
+	RC_ACCEPTED         ReturnCode = iota // accepted
+	RC_CONGESTION                         // congestion
+	RC_INVALID_TOPIC_ID                   // invalid topic ID
+	RC_NOT_SUPPORTED                      // not supported
 )
 
-func (c ReturnCode) String() string {
-	switch c {
-	case RC_ACCEPTED:
-		return "accepted"
-	case RC_CONGESTION:
-		return "congestion"
-	case RC_INVALID_TOPIC_ID:
-		return "invalid topic ID"
-	case RC_NOT_SUPPORTED:
-		return "not supported"
-	default:
-		return fmt.Sprintf("unknown (%d)", c)
-	}
+// IsValid reports whether c is a return code defined by the MQTT-SN
+// specification.
+func (c ReturnCode) IsValid() bool {
+	return c <= RC_NOT_SUPPORTED
 }
 
 // Message ID range.
@@ -144,6 +148,11 @@ func (h *Header) MessageLength() uint16 {
 	return h.msgLength
 }
 
+// MessageType returns the message type.
+func (h *Header) MessageType() MessageType {
+	return h.msgType
+}
+
 // HeaderLength returns message header length.
 //
 // See MQTT-SN specification v. 1.2, chapter 5.2 General Message Format.
@@ -270,6 +279,8 @@ func NewMessageWithHeader(h Header) (m Message) {
 		m = &WillMsgUpdateMessage{Header: h}
 	case WILLMSGRESP:
 		m = &WillMsgRespMessage{Header: h}
+	case ENCAPSULATED:
+		m = &EncapsulatedMessage{Header: h}
 	}
 	return
 }
@@ -369,73 +380,26 @@ const (
 	WILLTOPICRESP MessageType = 0x1B
 	WILLMSGUPD    MessageType = 0x1C
 	WILLMSGRESP   MessageType = 0x1D
+	ENCAPSULATED  MessageType = 0xFE
 	// 0x03 is reserved
 	// 0x11 is reserved
 	// 0x19 is reserved
 	// 0x1E - 0xFD is reserved
-	// 0xFE - Encapsulated message
 	// 0xFF is reserved
 )
 
-func (t MessageType) String() string {
+// IsValid reports whether t is a message type defined by the MQTT-SN
+// specification.
+func (t MessageType) IsValid() bool {
 	switch t {
-	case ADVERTISE:
-		return "ADVERTISE"
-	case SEARCHGW:
-		return "SEARCHGW"
-	case GWINFO:
-		return "GWINFO"
-	case AUTH:
-		return "AUTH"
-	case CONNECT:
-		return "CONNECT"
-	case CONNACK:
-		return "CONNACK"
-	case WILLTOPICREQ:
-		return "WILLTOPICREQ"
-	case WILLTOPIC:
-		return "WILLTOPIC"
-	case WILLMSGREQ:
-		return "WILLMSGREQ"
-	case WILLMSG:
-		return "WILLMSG"
-	case REGISTER:
-		return "REGISTER"
-	case REGACK:
-		return "REGACK"
-	case PUBLISH:
-		return "PUBLISH"
-	case PUBACK:
-		return "PUBACK"
-	case PUBCOMP:
-		return "PUBCOMP"
-	case PUBREC:
-		return "PUBREC"
-	case PUBREL:
-		return "PUBREL"
-	case SUBSCRIBE:
-		return "SUBSCRIBE"
-	case SUBACK:
-		return "SUBACK"
-	case UNSUBSCRIBE:
-		return "UNSUBSCRIBE"
-	case UNSUBACK:
-		return "UNSUBACK"
-	case PINGREQ:
-		return "PINGREQ"
-	case PINGRESP:
-		return "PINGRESP"
-	case DISCONNECT:
-		return "DISCONNECT"
-	case WILLTOPICUPD:
-		return "WILLTOPICUPD"
-	case WILLTOPICRESP:
-		return "WILLTOPICRESP"
-	case WILLMSGUPD:
-		return "WILLMSGUPD"
-	case WILLMSGRESP:
-		return "WILLMSGRESP"
+	case ADVERTISE, SEARCHGW, GWINFO, AUTH, CONNECT, CONNACK,
+		WILLTOPICREQ, WILLTOPIC, WILLMSGREQ, WILLMSG, REGISTER, REGACK,
+		PUBLISH, PUBACK, PUBCOMP, PUBREC, PUBREL, SUBSCRIBE, SUBACK,
+		UNSUBSCRIBE, UNSUBACK, PINGREQ, PINGRESP, DISCONNECT,
+		WILLTOPICUPD, WILLTOPICRESP, WILLMSGUPD, WILLMSGRESP,
+		ENCAPSULATED:
+		return true
 	default:
-		return fmt.Sprintf("unknown (%d)", t)
+		return false
 	}
 }
@@ -0,0 +1,48 @@
+package messages
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageTypeString(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("ADVERTISE", ADVERTISE.String())
+	assert.Equal("PUBREL", PUBREL.String())
+	assert.Equal("SUBSCRIBE", SUBSCRIBE.String())
+	assert.Equal("WILLMSGRESP", WILLMSGRESP.String())
+	assert.Equal("ENCAPSULATED", ENCAPSULATED.String())
+	assert.Equal("MessageType(17)", MessageType(0x11).String())
+}
+
+func TestMessageTypeIsValid(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(CONNECT.IsValid())
+	assert.True(WILLMSGRESP.IsValid())
+	assert.True(ENCAPSULATED.IsValid())
+	assert.False(MessageType(0x11).IsValid())
+	assert.False(MessageType(0x19).IsValid())
+	assert.False(MessageType(0xFF).IsValid())
+}
+
+func TestReturnCode(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("congestion", RC_CONGESTION.String())
+	assert.Equal("not supported", RC_NOT_SUPPORTED.String())
+	assert.Equal("ReturnCode(4)", ReturnCode(4).String())
+	assert.True(RC_NOT_SUPPORTED.IsValid())
+	assert.False(ReturnCode(4).IsValid())
+}
+
+func TestTopicIDType(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("registered", TIT_REGISTERED.String())
+	assert.Equal("short", TIT_SHORT.String())
+	assert.True(TIT_SHORT.IsValid())
+	assert.False(TopicIDType(3).IsValid())
+}
@@ -13,13 +13,13 @@ type PublishMessage struct {
 	DUPProperty
 	Retain      bool
 	QOS         uint8
-	TopicIDType uint8
+	TopicIDType TopicIDType
 	TopicID     uint16
 	Data        []byte
 }
 
 // NOTE: Packet length is initialized in this constructor and recomputed in m.Write().
-func NewPublishMessage(topicID uint16, topicIDType uint8, payload []byte, qos uint8,
+func NewPublishMessage(topicID uint16, topicIDType TopicIDType, payload []byte, qos uint8,
 	retain bool, dup bool) *PublishMessage {
 	m := &PublishMessage{
 		Header:      *NewHeader(PUBLISH, 0),
@@ -48,7 +48,7 @@ func (m *PublishMessage) encodeFlags() byte {
 	if m.Retain {
 		b |= flagsRetainBit
 	}
-	b |= m.TopicIDType & flagsTopicIDTypeBits
+	b |= byte(m.TopicIDType) & flagsTopicIDTypeBits
 	return b
 }
 
@@ -56,7 +56,7 @@ func (m *PublishMessage) decodeFlags(b byte) {
 	m.dup = (b & flagsDUPBit) == flagsDUPBit
 	m.QOS = (b & flagsQOSBits) >> 5
 	m.Retain = (b & flagsRetainBit) == flagsRetainBit
-	m.TopicIDType = b & flagsTopicIDTypeBits
+	m.TopicIDType = TopicIDType(b & flagsTopicIDTypeBits)
 }
 
 func (m *PublishMessage) Write(w io.Writer) error {
@@ -12,13 +12,13 @@ type SubscribeMessage struct {
 	DUPProperty
 	MessageIDProperty
 	QOS         uint8
-	TopicIDType uint8
+	TopicIDType TopicIDType
 	TopicID     uint16
 	TopicName   []byte
 }
 
 // NOTE: Packet length is initialized in this constructor and recomputed in m.Write().
-func NewSubscribeMessage(topicID uint16, topicIDType uint8, topicName []byte, qos uint8, dup bool) *SubscribeMessage {
+func NewSubscribeMessage(topicID uint16, topicIDType TopicIDType, topicName []byte, qos uint8, dup bool) *SubscribeMessage {
 	m := &SubscribeMessage{
 		Header:      *NewHeader(SUBSCRIBE, 0),
 		DUPProperty: DUPProperty{dup},
@@ -48,14 +48,14 @@ func (m *SubscribeMessage) encodeFlags() byte {
 		b |= flagsDUPBit
 	}
 	b |= (m.QOS << 5) & flagsQOSBits
-	b |= m.TopicIDType & flagsTopicIDTypeBits
+	b |= byte(m.TopicIDType) & flagsTopicIDTypeBits
 	return b
 }
 
 func (m *SubscribeMessage) decodeFlags(b byte) {
 	m.dup = (b & flagsDUPBit) == flagsDUPBit
 	m.QOS = (b & flagsQOSBits) >> 5
-	m.TopicIDType = b & flagsTopicIDTypeBits
+	m.TopicIDType = TopicIDType(b & flagsTopicIDTypeBits)
 }
 
 func (m *SubscribeMessage) Write(w io.Writer) error {
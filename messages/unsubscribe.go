@@ -10,13 +10,13 @@ const unsubscribeHeaderLength uint16 = 3
 type UnsubscribeMessage struct {
 	Header
 	MessageIDProperty
-	TopicIDType uint8
+	TopicIDType TopicIDType
 	TopicID     uint16
 	TopicName   []byte
 }
 
 // NOTE: Packet length is initialized in this constructor and recomputed in m.Write().
-func NewUnsubscribeMessage(topicID uint16, topicIDType uint8, topicName []byte) *UnsubscribeMessage {
+func NewUnsubscribeMessage(topicID uint16, topicIDType TopicIDType, topicName []byte) *UnsubscribeMessage {
 	m := &UnsubscribeMessage{
 		Header:      *NewHeader(UNSUBSCRIBE, 0),
 		TopicIDType: topicIDType,
@@ -40,12 +40,12 @@ func (m *UnsubscribeMessage) computeLength() {
 
 func (m *UnsubscribeMessage) encodeFlags() byte {
 	var b byte
-	b |= m.TopicIDType & flagsTopicIDTypeBits
+	b |= byte(m.TopicIDType) & flagsTopicIDTypeBits
 	return b
 }
 
 func (m *UnsubscribeMessage) decodeFlags(b byte) {
-	m.TopicIDType = b & flagsTopicIDTypeBits
+	m.TopicIDType = TopicIDType(b & flagsTopicIDTypeBits)
 }
 
 func (m *UnsubscribeMessage) Write(w io.Writer) error {
@@ -0,0 +1,38 @@
+package topics
+
+import "strings"
+
+// Match reports whether the topic matches the given topic filter according to
+// the MQTT topic rules, i.e. the filter may contain "+" (single level) and
+// "#" (multi level) wildcards.
+func Match(filter, topic string) bool {
+	return match(strings.Split(filter, "/"), strings.Split(topic, "/"))
+}
+
+// Taken from Paho mqtt client:
+// https://github.com/eclipse/paho.mqtt.golang/blob/a140ed81404c0a4aa0e97c91e7b99d1577c45418/router.go#L33
+//
+// match takes a slice of strings which represent the route being tested having been split on '/'
+// separators, and a slice of strings representing the topic string in the published message, similarly
+// split.
+// The function determines if the topic string matches the route according to the MQTT topic rules
+// and returns a boolean of the outcome
+func match(route []string, topic []string) bool {
+	if len(route) == 0 {
+		return len(topic) == 0
+	}
+
+	if len(topic) == 0 {
+		return route[0] == "#"
+	}
+
+	if route[0] == "#" {
+		return true
+	}
+
+	if (route[0] == "+") || (route[0] == topic[0]) {
+		return match(route[1:], topic[1:])
+	}
+
+	return false
+}
@@ -0,0 +1,30 @@
+package topics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"a/b/c", "a/b/c", true},
+		{"a/b/c", "a/b", false},
+		{"a/b", "a/b/c", false},
+		{"a/+/c", "a/b/c", true},
+		{"a/+/c", "a/b/d", false},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "a/b/c", true},
+		{"+/+", "a/b", true},
+		{"+", "", true},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.match, Match(c.filter, c.topic), "filter %q, topic %q", c.filter, c.topic)
+	}
+}
@@ -0,0 +1,54 @@
+package transactions
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// Await blocks until the transaction completes or the context is done.
+// It returns the transaction error or the context error, respectively.
+func Await(ctx context.Context, t Transaction) error {
+	select {
+	case <-t.Done():
+		return t.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// TransactionWithResult is a Transaction which produces a result on
+// successful completion.
+type TransactionWithResult interface {
+	Transaction
+	// Result returns the transaction result or nil if there is none.
+	Result() interface{}
+}
+
+// AwaitResult blocks like Await and stores the result of a successfully
+// completed transaction in the value pointed to by result. The result type
+// must be assignable to the pointed-to value.
+//
+// Example:
+//
+//	var topicID uint16
+//	err := transactions.AwaitResult(ctx, registerTransaction, &topicID)
+func AwaitResult(ctx context.Context, t TransactionWithResult, result interface{}) error {
+	if err := Await(ctx, t); err != nil {
+		return err
+	}
+	dst := reflect.ValueOf(result)
+	if dst.Kind() != reflect.Ptr || dst.IsNil() {
+		return fmt.Errorf("result must be a non-nil pointer, got %T", result)
+	}
+	value := t.Result()
+	if value == nil {
+		return fmt.Errorf("transaction has no result")
+	}
+	src := reflect.ValueOf(value)
+	if !src.Type().AssignableTo(dst.Elem().Type()) {
+		return fmt.Errorf("transaction result type %T is not assignable to %s", value, dst.Elem().Type())
+	}
+	dst.Elem().Set(src)
+	return nil
+}
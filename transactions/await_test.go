@@ -0,0 +1,46 @@
+package transactions
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAwait(t *testing.T) {
+	assert := assert.New(t)
+
+	t1 := NewTransactionBase(nil)
+	t1.Success()
+	assert.NoError(Await(context.Background(), t1))
+
+	errFailed := errors.New("failed")
+	t2 := NewTransactionBase(nil)
+	t2.Fail(errFailed)
+	assert.Equal(errFailed, Await(context.Background(), t2))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(context.Canceled, Await(ctx, NewTransactionBase(nil)))
+}
+
+func TestAwaitResult(t *testing.T) {
+	assert := assert.New(t)
+
+	tr := NewTransactionBase(nil)
+	tr.SetResult(uint16(42))
+	tr.Success()
+
+	var topicID uint16
+	assert.NoError(AwaitResult(context.Background(), tr, &topicID))
+	assert.Equal(uint16(42), topicID)
+
+	var wrongType string
+	assert.Error(AwaitResult(context.Background(), tr, &wrongType))
+	assert.Error(AwaitResult(context.Background(), tr, topicID))
+
+	noResult := NewTransactionBase(nil)
+	noResult.Success()
+	assert.Error(AwaitResult(context.Background(), noResult, &topicID))
+}
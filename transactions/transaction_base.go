@@ -15,6 +15,7 @@ type TransactionBase struct {
 	mutex   sync.RWMutex
 	done    chan struct{}
 	err     error
+	result  interface{}
 	finally FinallyCallback
 }
 
@@ -63,6 +64,22 @@ func (t *TransactionBase) Err() error {
 	return t.err
 }
 
+// SetResult sets the transaction result. It is to be called before Success.
+func (t *TransactionBase) SetResult(result interface{}) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.result = result
+}
+
+// TransactionWithResult.Result() implementation.
+func (t *TransactionBase) Result() interface{} {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	return t.result
+}
+
 // Transaction.Fail() implementation.
 func (t *TransactionBase) Fail(e error) {
 	t.mutex.Lock()
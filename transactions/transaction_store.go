@@ -2,6 +2,7 @@ package transactions
 
 import (
 	"sync"
+	"time"
 
 	msgs "github.com/energomonitor/bisquitt/messages"
 )
@@ -13,15 +14,20 @@ import (
 // It's safe for concurrent use.
 type TransactionStore struct {
 	sync.RWMutex
-	byMsgID   map[uint16]Transaction
-	byMsgType map[msgs.MessageType]Transaction
+	byMsgID   map[uint16]storedTransaction
+	byMsgType map[msgs.MessageType]storedTransaction
+}
+
+type storedTransaction struct {
+	transaction Transaction
+	stored      time.Time
 }
 
 // NewTransactionStore creates a new transaction store.
 func NewTransactionStore() *TransactionStore {
 	return &TransactionStore{
-		byMsgID:   make(map[uint16]Transaction),
-		byMsgType: make(map[msgs.MessageType]Transaction),
+		byMsgID:   make(map[uint16]storedTransaction),
+		byMsgType: make(map[msgs.MessageType]storedTransaction),
 	}
 }
 
@@ -29,30 +35,30 @@ func NewTransactionStore() *TransactionStore {
 func (ts *TransactionStore) Store(msgID uint16, transaction Transaction) {
 	ts.Lock()
 	defer ts.Unlock()
-	ts.byMsgID[msgID] = transaction
+	ts.byMsgID[msgID] = storedTransaction{transaction, time.Now()}
 }
 
 // StoreByType inserts a new transaction to the store by the message type.
 func (ts *TransactionStore) StoreByType(msgType msgs.MessageType, transaction Transaction) {
 	ts.Lock()
 	defer ts.Unlock()
-	ts.byMsgType[msgType] = transaction
+	ts.byMsgType[msgType] = storedTransaction{transaction, time.Now()}
 }
 
 // Get retrieves a transaction from the store by the message ID.
 func (ts *TransactionStore) Get(msgID uint16) (Transaction, bool) {
 	ts.RLock()
 	defer ts.RUnlock()
-	transaction, ok := ts.byMsgID[msgID]
-	return transaction, ok
+	entry, ok := ts.byMsgID[msgID]
+	return entry.transaction, ok
 }
 
 // GetByType retrieves a transaction from the store by the message type.
 func (ts *TransactionStore) GetByType(msgType msgs.MessageType) (Transaction, bool) {
 	ts.Lock()
 	defer ts.Unlock()
-	transaction, ok := ts.byMsgType[msgType]
-	return transaction, ok
+	entry, ok := ts.byMsgType[msgType]
+	return entry.transaction, ok
 }
 
 // Delete removes a transaction from the store by the message ID.
@@ -68,3 +74,40 @@ func (ts *TransactionStore) DeleteByType(msgType msgs.MessageType) {
 	defer ts.Unlock()
 	delete(ts.byMsgType, msgType)
 }
+
+// StoredBefore returns all the transactions stored before the given time.
+func (ts *TransactionStore) StoredBefore(t time.Time) []Transaction {
+	ts.RLock()
+	defer ts.RUnlock()
+	var result []Transaction
+	for _, entry := range ts.byMsgID {
+		if entry.stored.Before(t) {
+			result = append(result, entry.transaction)
+		}
+	}
+	for _, entry := range ts.byMsgType {
+		if entry.stored.Before(t) {
+			result = append(result, entry.transaction)
+		}
+	}
+	return result
+}
+
+// Remove removes the given transaction from the store under all the message
+// IDs and message types it is stored by. Unlike Delete and DeleteByType, it
+// does not remove a different transaction which has replaced the given one
+// under the same key in the meantime, e.g. after the message ID was reused.
+func (ts *TransactionStore) Remove(transaction Transaction) {
+	ts.Lock()
+	defer ts.Unlock()
+	for msgID, entry := range ts.byMsgID {
+		if entry.transaction == transaction {
+			delete(ts.byMsgID, msgID)
+		}
+	}
+	for msgType, entry := range ts.byMsgType {
+		if entry.transaction == transaction {
+			delete(ts.byMsgType, msgType)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package transactions
+
+import (
+	"testing"
+	"time"
+
+	msgs "github.com/energomonitor/bisquitt/messages"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransactionStoreStoredBefore(t *testing.T) {
+	assert := assert.New(t)
+
+	ts := NewTransactionStore()
+	old1 := NewTransactionBase(nil)
+	old2 := NewTransactionBase(nil)
+	ts.Store(1, old1)
+	ts.StoreByType(msgs.CONNECT, old2)
+	time.Sleep(10 * time.Millisecond)
+	boundary := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	ts.Store(2, NewTransactionBase(nil))
+	ts.StoreByType(msgs.PINGREQ, NewTransactionBase(nil))
+
+	assert.Empty(ts.StoredBefore(time.Now().Add(-time.Hour)))
+	assert.ElementsMatch([]Transaction{old1, old2}, ts.StoredBefore(boundary))
+	assert.Len(ts.StoredBefore(time.Now().Add(time.Hour)), 4)
+
+	// Storing again resets the time.
+	ts.Store(1, old1)
+	assert.ElementsMatch([]Transaction{old2}, ts.StoredBefore(boundary))
+}
+
+func TestTransactionStoreRemove(t *testing.T) {
+	assert := assert.New(t)
+
+	ts := NewTransactionStore()
+	t1 := NewTransactionBase(nil)
+	t2 := NewTransactionBase(nil)
+	ts.Store(1, t1)
+	ts.Store(2, t1)
+	ts.StoreByType(msgs.CONNECT, t1)
+	ts.Store(3, t2)
+
+	// All the keys of the transaction are removed.
+	ts.Remove(t1)
+	_, ok := ts.Get(1)
+	assert.False(ok)
+	_, ok = ts.Get(2)
+	assert.False(ok)
+	_, ok = ts.GetByType(msgs.CONNECT)
+	assert.False(ok)
+	stored, ok := ts.Get(3)
+	assert.True(ok)
+	assert.Equal(t2, stored)
+
+	// Unlike Delete, Remove keeps another transaction which has reused
+	// the key.
+	ts.Store(1, t1)
+	ts.Store(1, t2)
+	ts.Remove(t1)
+	stored, ok = ts.Get(1)
+	assert.True(ok)
+	assert.Equal(t2, stored)
+
+	// Removing a transaction which is not stored is a no-op.
+	ts.Remove(NewTransactionBase(nil))
+	assert.Len(ts.StoredBefore(time.Now().Add(time.Hour)), 2)
+}
@@ -0,0 +1,101 @@
+package util
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff defaults used for zero Backoff fields.
+const (
+	DefaultBackoffInitial    = 100 * time.Millisecond
+	DefaultBackoffMax        = time.Minute
+	DefaultBackoffMultiplier = 2.0
+)
+
+// Backoff computes exponentially growing delays between successive
+// attempts of an operation. The zero value is ready to use with the
+// defaults above and no jitter.
+//
+// Backoff is not safe for concurrent use.
+type Backoff struct {
+	// Initial is the delay before the second attempt.
+	Initial time.Duration
+	// Max caps the delay.
+	Max time.Duration
+	// Multiplier is the delay growth factor.
+	Multiplier float64
+	// Jitter randomizes the delays to spread attempts of many clients.
+	// A delay d is chosen uniformly from [d*(1-Jitter), d]. Must be from
+	// [0, 1].
+	Jitter float64
+
+	attempt int
+}
+
+// Next returns the delay to wait before the next attempt.
+func (b *Backoff) Next() time.Duration {
+	initial := b.Initial
+	if initial <= 0 {
+		initial = DefaultBackoffInitial
+	}
+	max := b.Max
+	if max <= 0 {
+		max = DefaultBackoffMax
+	}
+	multiplier := b.Multiplier
+	if multiplier < 1 {
+		multiplier = DefaultBackoffMultiplier
+	}
+
+	d := float64(initial) * math.Pow(multiplier, float64(b.attempt))
+	if d > float64(max) {
+		d = float64(max)
+	} else {
+		b.attempt++
+	}
+	if b.Jitter > 0 {
+		d -= d * b.Jitter * rand.Float64()
+	}
+	return time.Duration(d)
+}
+
+// Reset restarts the delays from Initial, e.g. after a successful attempt.
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
+
+// Wait sleeps for the next delay. It returns ctx.Err() if the context is
+// canceled meanwhile.
+func (b *Backoff) Wait(ctx context.Context) error {
+	timer := time.NewTimer(b.Next())
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Retry calls f until it succeeds, attempts are exhausted (zero means
+// unlimited) or the context is canceled. The last f error or ctx.Err() is
+// returned.
+//
+//	b := &util.Backoff{Initial: time.Second, Max: time.Minute, Jitter: 0.2}
+//	err := util.Retry(ctx, b, 5, readSensor)
+func Retry(ctx context.Context, b *Backoff, attempts int, f func() error) error {
+	for i := 1; ; i++ {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		if attempts > 0 && i >= attempts {
+			return err
+		}
+		if err := b.Wait(ctx); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff_Next(t *testing.T) {
+	assert := assert.New(t)
+
+	b := &Backoff{
+		Initial: time.Second,
+		Max:     5 * time.Second,
+	}
+	assert.Equal(time.Second, b.Next())
+	assert.Equal(2*time.Second, b.Next())
+	assert.Equal(4*time.Second, b.Next())
+	assert.Equal(5*time.Second, b.Next())
+	assert.Equal(5*time.Second, b.Next())
+
+	b.Reset()
+	assert.Equal(time.Second, b.Next())
+}
+
+func TestBackoff_Jitter(t *testing.T) {
+	assert := assert.New(t)
+
+	b := &Backoff{
+		Initial: time.Second,
+		Jitter:  0.5,
+	}
+	for i := 0; i < 100; i++ {
+		b.Reset()
+		d := b.Next()
+		assert.GreaterOrEqual(int64(d), int64(500*time.Millisecond))
+		assert.LessOrEqual(int64(d), int64(time.Second))
+	}
+}
+
+func TestRetry(t *testing.T) {
+	assert := assert.New(t)
+
+	errFailed := errors.New("failed")
+	b := &Backoff{Initial: time.Millisecond}
+
+	calls := 0
+	err := Retry(context.Background(), b, 3, func() error {
+		calls++
+		return errFailed
+	})
+	assert.Equal(errFailed, err)
+	assert.Equal(3, calls)
+
+	b.Reset()
+	calls = 0
+	err = Retry(context.Background(), b, 0, func() error {
+		calls++
+		if calls < 5 {
+			return errFailed
+		}
+		return nil
+	})
+	assert.NoError(err)
+	assert.Equal(5, calls)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = Retry(ctx, b, 0, func() error {
+		return errFailed
+	})
+	assert.Equal(context.Canceled, err)
+}
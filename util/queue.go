@@ -0,0 +1,167 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// ErrQueueFull is returned by Queue.Push if the queue is full and its
+	// DropPolicy is DropNewest.
+	ErrQueueFull = errors.New("queue full")
+	// ErrQueueClosed is returned by Queue.Push and Queue.Pop if the queue
+	// is closed.
+	ErrQueueClosed = errors.New("queue closed")
+)
+
+// DropPolicy decides what happens when an item is pushed to a full Queue.
+type DropPolicy uint8
+
+const (
+	// Block blocks the pusher until there is free space in the queue.
+	Block DropPolicy = iota
+	// DropNewest drops the pushed item.
+	DropNewest
+	// DropOldest drops the oldest item in the queue to make space for the
+	// pushed one.
+	DropOldest
+)
+
+func (p DropPolicy) String() string {
+	switch p {
+	case Block:
+		return "block"
+	case DropNewest:
+		return "drop-newest"
+	case DropOldest:
+		return "drop-oldest"
+	default:
+		return "unknown"
+	}
+}
+
+// Queue is a bounded FIFO queue safe for concurrent use.
+type Queue struct {
+	items  chan interface{}
+	policy DropPolicy
+	// Serializes DropOldest pushes.
+	lock      sync.Mutex
+	dropped   uint64
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewQueue creates a new queue with the given capacity (at least 1).
+func NewQueue(capacity int, policy DropPolicy) *Queue {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &Queue{
+		items:  make(chan interface{}, capacity),
+		policy: policy,
+		done:   make(chan struct{}),
+	}
+}
+
+// Push appends the item to the queue. If the queue is full, the queue's
+// DropPolicy is applied: Push blocks until there is free space or the context
+// is canceled (Block), returns ErrQueueFull (DropNewest) or drops the oldest
+// item (DropOldest).
+func (q *Queue) Push(ctx context.Context, item interface{}) error {
+	select {
+	case <-q.done:
+		return ErrQueueClosed
+	default:
+	}
+
+	switch q.policy {
+	case DropNewest:
+		select {
+		case q.items <- item:
+			return nil
+		default:
+			atomic.AddUint64(&q.dropped, 1)
+			return ErrQueueFull
+		}
+	case DropOldest:
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		for {
+			select {
+			case q.items <- item:
+				return nil
+			default:
+			}
+			select {
+			case <-q.items:
+				atomic.AddUint64(&q.dropped, 1)
+			default:
+				// Emptied concurrently by Pop.
+			}
+		}
+	default:
+		select {
+		case q.items <- item:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-q.done:
+			return ErrQueueClosed
+		}
+	}
+}
+
+// TryPush appends the item to the queue unless the queue is full, regardless
+// of the queue's DropPolicy. Returns ErrQueueFull if the item was dropped.
+func (q *Queue) TryPush(item interface{}) error {
+	select {
+	case <-q.done:
+		return ErrQueueClosed
+	default:
+	}
+	select {
+	case q.items <- item:
+		return nil
+	default:
+		atomic.AddUint64(&q.dropped, 1)
+		return ErrQueueFull
+	}
+}
+
+// Pop removes and returns the oldest item. It blocks until an item is
+// available, the context is canceled or the queue is closed.
+func (q *Queue) Pop(ctx context.Context) (interface{}, error) {
+	select {
+	case <-q.done:
+		return nil, ErrQueueClosed
+	default:
+	}
+	select {
+	case item := <-q.items:
+		return item, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-q.done:
+		return nil, ErrQueueClosed
+	}
+}
+
+// Len returns the number of items in the queue.
+func (q *Queue) Len() int {
+	return len(q.items)
+}
+
+// Dropped returns the number of items dropped because the queue was full.
+func (q *Queue) Dropped() uint64 {
+	return atomic.LoadUint64(&q.dropped)
+}
+
+// Close closes the queue. The items remaining in the queue are discarded.
+// Blocked Push and Pop calls return ErrQueueClosed.
+func (q *Queue) Close() {
+	q.closeOnce.Do(func() {
+		close(q.done)
+	})
+}
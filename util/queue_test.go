@@ -0,0 +1,89 @@
+package util
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueue_DropNewest(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	q := NewQueue(2, DropNewest)
+	assert.NoError(q.Push(ctx, 1))
+	assert.NoError(q.Push(ctx, 2))
+	assert.Equal(ErrQueueFull, q.Push(ctx, 3))
+	assert.Equal(2, q.Len())
+	assert.Equal(uint64(1), q.Dropped())
+
+	for _, expected := range []int{1, 2} {
+		item, err := q.Pop(ctx)
+		assert.NoError(err)
+		assert.Equal(expected, item)
+	}
+}
+
+func TestQueue_DropOldest(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	q := NewQueue(2, DropOldest)
+	for i := 1; i <= 4; i++ {
+		assert.NoError(q.Push(ctx, i))
+	}
+	assert.Equal(uint64(2), q.Dropped())
+
+	for _, expected := range []int{3, 4} {
+		item, err := q.Pop(ctx)
+		assert.NoError(err)
+		assert.Equal(expected, item)
+	}
+}
+
+func TestQueue_Block(t *testing.T) {
+	assert := assert.New(t)
+
+	q := NewQueue(1, Block)
+	assert.NoError(q.Push(context.Background(), 1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(context.DeadlineExceeded, q.Push(ctx, 2))
+
+	pushed := make(chan error)
+	go func() {
+		pushed <- q.Push(context.Background(), 3)
+	}()
+	item, err := q.Pop(context.Background())
+	assert.NoError(err)
+	assert.Equal(1, item)
+	assert.NoError(<-pushed)
+	assert.Equal(uint64(0), q.Dropped())
+}
+
+func TestQueue_Close(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	q := NewQueue(1, Block)
+	popped := make(chan error)
+	go func() {
+		_, err := q.Pop(ctx)
+		popped <- err
+	}()
+	q.Close()
+	assert.Equal(ErrQueueClosed, <-popped)
+	assert.Equal(ErrQueueClosed, q.Push(ctx, 1))
+}
+
+func TestQueue_TryPush(t *testing.T) {
+	assert := assert.New(t)
+
+	q := NewQueue(1, Block)
+	assert.NoError(q.TryPush(1))
+	assert.Equal(ErrQueueFull, q.TryPush(2))
+	assert.Equal(uint64(1), q.Dropped())
+}
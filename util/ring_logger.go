@@ -0,0 +1,110 @@
+package util
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// LogLine is a log message captured in a LogRing.
+type LogLine struct {
+	Time time.Time
+	// "DEBUG", "INFO" or "ERROR".
+	Level   string
+	Tags    string
+	Message string
+}
+
+func (l LogLine) String() string {
+	return fmt.Sprintf("%s [%-5s][%s] %s", l.Time.Format(time.RFC3339Nano), l.Level, l.Tags, l.Message)
+}
+
+// LogRing keeps a fixed number of the most recent log lines. It's safe for
+// concurrent use.
+type LogRing struct {
+	lock  sync.Mutex
+	lines []LogLine
+	next  int
+	full  bool
+}
+
+// NewLogRing creates a LogRing keeping up to size lines.
+func NewLogRing(size int) *LogRing {
+	return &LogRing{
+		lines: make([]LogLine, size),
+	}
+}
+
+func (r *LogRing) add(line LogLine) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.lines) == 0 {
+		return
+	}
+	r.lines[r.next] = line
+	r.next++
+	if r.next == len(r.lines) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// Lines returns the kept log lines, the oldest first.
+func (r *LogRing) Lines() []LogLine {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.full {
+		return append([]LogLine(nil), r.lines[:r.next]...)
+	}
+	lines := make([]LogLine, 0, len(r.lines))
+	lines = append(lines, r.lines[r.next:]...)
+	return append(lines, r.lines[:r.next]...)
+}
+
+// RingLogger is a Logger implementation which passes messages to another
+// Logger and captures all of them, including the debug severity ones, in
+// a LogRing.
+type RingLogger struct {
+	log  Logger
+	ring *LogRing
+	tags Tags
+}
+
+func NewRingLogger(log Logger, ring *LogRing) Logger {
+	return &RingLogger{
+		log:  log,
+		ring: ring,
+	}
+}
+
+func (l *RingLogger) capture(level string, format string, a ...interface{}) {
+	l.ring.add(LogLine{
+		Time:    time.Now(),
+		Level:   level,
+		Tags:    l.tags.String(),
+		Message: fmt.Sprintf(format, a...),
+	})
+}
+
+func (l *RingLogger) Debug(format string, a ...interface{}) {
+	l.capture("DEBUG", format, a...)
+	l.log.Debug(format, a...)
+}
+func (l *RingLogger) Info(format string, a ...interface{}) {
+	l.capture("INFO", format, a...)
+	l.log.Info(format, a...)
+}
+func (l *RingLogger) Error(format string, a ...interface{}) {
+	l.capture("ERROR", format, a...)
+	l.log.Error(format, a...)
+}
+func (l *RingLogger) WithTag(tag string) Logger {
+	return &RingLogger{
+		log:  l.log.WithTag(tag),
+		ring: l.ring,
+		tags: l.tags.With(tag),
+	}
+}
+func (l *RingLogger) Sync() {
+	l.log.Sync()
+}
@@ -0,0 +1,37 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRingLogger(t *testing.T) {
+	assert := assert.New(t)
+
+	ring := NewLogRing(3)
+	log := NewRingLogger(NoOpLogger{}, ring)
+	assert.Empty(ring.Lines())
+
+	log.Debug("line %d", 1)
+	log.Info("line %d", 2)
+	lines := ring.Lines()
+	if assert.Len(lines, 2) {
+		assert.Equal("DEBUG", lines[0].Level)
+		assert.Equal("line 1", lines[0].Message)
+		assert.Equal("INFO", lines[1].Level)
+	}
+
+	tagged := log.WithTag("tag")
+	tagged.Error("line %d", 3)
+	log.Info("line %d", 4)
+	lines = ring.Lines()
+	if assert.Len(lines, 3) {
+		assert.Equal("line 2", lines[0].Message)
+		assert.Equal("line 3", lines[1].Message)
+		assert.Equal("tag", lines[1].Tags)
+		assert.Equal("ERROR", lines[1].Level)
+		assert.Equal("line 4", lines[2].Message)
+		assert.Equal("", lines[2].Tags)
+	}
+}
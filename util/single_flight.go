@@ -0,0 +1,46 @@
+package util
+
+import (
+	"sync"
+)
+
+type flight struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// SingleFlight suppresses duplicate concurrent calls. The zero value is ready
+// to use.
+type SingleFlight struct {
+	lock    sync.Mutex
+	flights map[string]*flight
+}
+
+// Do calls fn and returns its results. If a call with the same key is already
+// in flight, Do waits for it instead and returns its results.
+func (g *SingleFlight) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.lock.Lock()
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	if f, ok := g.flights[key]; ok {
+		g.lock.Unlock()
+		<-f.done
+		return f.value, f.err
+	}
+	f := &flight{
+		done: make(chan struct{}),
+	}
+	g.flights[key] = f
+	g.lock.Unlock()
+
+	defer func() {
+		g.lock.Lock()
+		delete(g.flights, key)
+		g.lock.Unlock()
+		close(f.done)
+	}()
+	f.value, f.err = fn()
+	return f.value, f.err
+}
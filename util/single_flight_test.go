@@ -0,0 +1,43 @@
+package util
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSingleFlight(t *testing.T) {
+	assert := assert.New(t)
+
+	var g SingleFlight
+	var calls int32
+	fn := func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(100 * time.Millisecond)
+		return "value", nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := g.Do("key", fn)
+			assert.NoError(err)
+			assert.Equal("value", value)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(int32(1), atomic.LoadInt32(&calls))
+
+	// The results are not cached.
+	expected := errors.New("failed")
+	_, err := g.Do("key", func() (interface{}, error) {
+		return nil, expected
+	})
+	assert.Equal(expected, err)
+}
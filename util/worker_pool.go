@@ -0,0 +1,81 @@
+package util
+
+import (
+	"context"
+	"sync"
+)
+
+// WorkerPool runs tasks in a fixed number of goroutines. Submitted tasks wait
+// in a bounded Queue. The pool stops when its context is canceled or when
+// it's closed.
+type WorkerPool struct {
+	queue *Queue
+	wg    sync.WaitGroup
+}
+
+// NewWorkerPool starts a new pool of the given number of workers (at least 1).
+// At most queueSize tasks wait for a free worker, the policy decides what
+// happens with tasks exceeding the limit.
+func NewWorkerPool(ctx context.Context, workers, queueSize int, policy DropPolicy) *WorkerPool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &WorkerPool{
+		queue: NewQueue(queueSize, policy),
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.queue.Close()
+		case <-p.queue.done:
+		}
+	}()
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work(ctx)
+	}
+	return p
+}
+
+func (p *WorkerPool) work(ctx context.Context) {
+	defer p.wg.Done()
+	for {
+		task, err := p.queue.Pop(ctx)
+		if err != nil {
+			return
+		}
+		task.(func())()
+	}
+}
+
+// Submit queues the task. Returns ErrQueueFull if the task was dropped (see
+// DropPolicy) or ErrQueueClosed if the pool is stopped. With the Block
+// policy, Submit waits for a free space in the queue until the context is
+// canceled.
+func (p *WorkerPool) Submit(ctx context.Context, task func()) error {
+	return p.queue.Push(ctx, task)
+}
+
+// TrySubmit queues the task unless the queue is full, regardless of the
+// pool's DropPolicy. Returns ErrQueueFull if the task was dropped or
+// ErrQueueClosed if the pool is stopped.
+func (p *WorkerPool) TrySubmit(task func()) error {
+	return p.queue.TryPush(task)
+}
+
+// Dropped returns the number of tasks dropped because the queue was full.
+func (p *WorkerPool) Dropped() uint64 {
+	return p.queue.Dropped()
+}
+
+// Close stops the pool. Queued tasks which have not been started yet are
+// discarded. The running tasks are not interrupted, see Wait.
+func (p *WorkerPool) Close() {
+	p.queue.Close()
+}
+
+// Wait waits until all the workers terminate, i.e. until the pool is stopped
+// and the running tasks finish.
+func (p *WorkerPool) Wait() {
+	p.wg.Wait()
+}
@@ -0,0 +1,66 @@
+package util
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerPool(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const workers = 3
+	pool := NewWorkerPool(ctx, workers, 100, Block)
+
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	release := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		err := pool.Submit(ctx, func() {
+			defer wg.Done()
+			n := atomic.AddInt32(&running, 1)
+			for {
+				max := atomic.LoadInt32(&maxRunning)
+				if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+					break
+				}
+			}
+			<-release
+			atomic.AddInt32(&running, -1)
+		})
+		assert.NoError(err)
+	}
+	close(release)
+	wg.Wait()
+	assert.LessOrEqual(atomic.LoadInt32(&maxRunning), int32(workers))
+
+	cancel()
+	pool.Wait()
+	assert.Equal(ErrQueueClosed, pool.Submit(context.Background(), func() {}))
+}
+
+func TestWorkerPool_Drop(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	pool := NewWorkerPool(ctx, 1, 1, DropNewest)
+	defer pool.Close()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	assert.NoError(pool.Submit(ctx, func() {
+		close(started)
+		<-release
+	}))
+	<-started
+	assert.NoError(pool.Submit(ctx, func() {}))
+	assert.Equal(ErrQueueFull, pool.Submit(ctx, func() {}))
+	assert.Equal(uint64(1), pool.Dropped())
+	close(release)
+}